@@ -1,35 +1,49 @@
 package kvstores
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"net"
 	"net/url"
+	"path"
 	"strings"
 	"strconv"
 	"time"
 )
 
 const (
-	Unknown            = 1
-	Unimplemented      = 2
-	BackendUnreachable = 3
-	KeyNotFound        = 4
-	KeyExists          = 5
-	BadVersion         = 6
+	Unknown                 = 1
+	Unimplemented           = 2
+	BackendUnreachable      = 3
+	KeyNotFound             = 4
+	KeyExists               = 5
+	BadVersion              = 6
+	NotEmpty                = 7
+	AccessDenied            = 8
+	Timeout                 = 9
+	// ephemeral nodes can't be the parent of other nodes
+	NoChildrenForEphemerals = 10
 )
 
 var errCodeToErrMsg = map[int]string {
-	Unknown:            "unknown",
-	Unimplemented:      "unimplemented",
-	BackendUnreachable: "backend unreachable",
-	KeyNotFound:        "key not found",
-	KeyExists:          "key exists",
-	BadVersion:         "bad version",
+	Unknown:                 "unknown",
+	Unimplemented:           "unimplemented",
+	BackendUnreachable:      "backend unreachable",
+	KeyNotFound:             "key not found",
+	KeyExists:               "key exists",
+	BadVersion:              "bad version",
+	NotEmpty:                "not empty",
+	AccessDenied:            "access denied",
+	Timeout:                 "timeout",
+	NoChildrenForEphemerals: "no children for ephemerals",
 }
 
 type Error struct {
-	code int
-	msg  string
+	code   int
+	msg    string
+	// set on failures to connect, when the request was never sent
+	unsent bool
 }
 
 func (e *Error) Code() int {
@@ -50,11 +64,12 @@ func (e *Error) String() string {
 }
 
 type Node struct {
-	Path          string
-	Value         string
-	CreatedIndex  uint64
-	ModifiedIndex uint64
-	Nodes         Nodes
+	Path           string
+	Value          string
+	CreatedIndex   uint64
+	ModifiedIndex  uint64
+	EphemeralOwner int64
+	Nodes          Nodes
 }
 
 type Nodes []*Node
@@ -69,18 +84,224 @@ func NormalizeAddress(addr string, defaultPort uint16) string {
 	return addr
 }
 
+// rootPath returns the cleaned up path of a backend url, under which every
+// node is stored, or "" if they are stored at the root of the keyspace.
+func rootPath(p string) string {
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return ""
+	}
+	return p
+}
+
+// stripRoot returns the path of the node stored as key under root.
+func stripRoot(root string, key string) string {
+	p := strings.TrimPrefix(key, root)
+	if p == "" {
+		return "/"
+	}
+	return p
+}
+
+// Client is implemented by every backend. Requests fail with a Timeout error
+// once ctx is done, although the operation may still be applied afterwards.
 type Client interface {
-	Create(path string, data string) *Error
-	Delete(path string, version int32) *Error
-	Exists(path string) *Error
-	GetData(path string) (*Node, *Error)
-	SetData(path string, data string, version int32) *Error
-	GetChildren(path string) ([]string, *Error)
+	Create(ctx context.Context, path string, data string) *Error
+	Delete(ctx context.Context, path string, version int32) *Error
+	Exists(ctx context.Context, path string) *Error
+	GetData(ctx context.Context, path string) (*Node, *Error)
+	SetData(ctx context.Context, path string, data string, version int32) *Error
+	GetChildren(ctx context.Context, path string) ([]string, *Error)
+}
+
+// contextError returns a Timeout error if ctx is done.
+func contextError(ctx context.Context) *Error {
+	if err := ctx.Err(); err != nil {
+		return &Error { code: Timeout, msg: err.Error() }
+	}
+	return nil
+}
+
+const (
+	OpCreate  = 1
+	OpDelete  = 2
+	OpSetData = 3
+	OpCheck   = 4
+)
+
+// Op is a single operation of a transaction. Version is only taken into
+// account by delete, set data and check operations (-1 matches any version).
+// Session is only taken into account by create operations and, if non zero,
+// makes the node ephemeral (requires a SessionClient).
+type Op struct {
+	Type    int
+	Path    string
+	Data    string
+	Version int32
+	Session int64
+}
+
+// TxnClient is implemented by backends able to apply several operations
+// atomically. Multi returns the resulting node of every operation or, if the
+// transaction was aborted, the index of the operation which caused it (-1 if
+// the transaction as a whole failed) and the error.
+type TxnClient interface {
+	Client
+	Multi(ctx context.Context, ops []*Op) ([]*Node, int, *Error)
+}
+
+// SessionClient is implemented by backends supporting ephemeral nodes. Nodes
+// created with CreateEphemeral are removed when their session is closed or
+// expires, which happens if it is not kept alive within its ttl.
+type SessionClient interface {
+	Client
+	NewSession(ctx context.Context, ttl time.Duration) (int64, *Error)
+	KeepAlive(ctx context.Context, session int64) *Error
+	CloseSession(ctx context.Context, session int64) *Error
+	CreateEphemeral(ctx context.Context, path string, data string, session int64) *Error
+}
+
+const (
+	EventCreated         = 1
+	EventDeleted         = 2
+	EventDataChanged     = 3
+	EventChildrenChanged = 4
+)
+
+type Event struct {
+	Type  int
+	Path  string
+	Index uint64
+}
+
+// SyncClient is implemented by backends able to act as a read barrier. Sync
+// returns the index observed once every write committed before it was issued
+// is visible and Synced returns a client whose reads observe at least that
+// index (the client itself if reads are always up to date).
+type SyncClient interface {
+	Client
+	Sync(ctx context.Context, path string) (uint64, *Error)
+	Synced(index uint64) Client
+}
+
+// WatchClient is implemented by backends able to notify changes. Watch returns
+// once the watch is established, failing with a Timeout error if ctx is done
+// first, and from then on sends every change of path (and of its direct
+// children if children is set) through the returned channel, which is closed
+// when stop is closed or the watch is lost. The watch outlives ctx.
+type WatchClient interface {
+	Client
+	Watch(ctx context.Context, path string, children bool, stop <-chan struct{}) (<-chan *Event, *Error)
+}
+
+// BackendName returns the name of the backend c sends requests to, as used
+// in backend urls.
+func BackendName(c Client) string {
+	switch c.(type) {
+	case *EtcdClient, *etcdSyncedClient:
+		return "etcd"
+	case *Etcd3Client:
+		return "etcd3"
+	case *ConsulClient, *consulSyncedClient:
+		return "consul"
+	case *RedisClient:
+		return "redis"
+	case *FileClient:
+		return "file"
+	}
+	return "unknown"
+}
+
+// parseUrl parses backendUrl, which may specify a comma separated list of
+// hosts (e.g. etcd://h1:4001,h2:4001), and returns it along with the hosts.
+func parseUrl(backendUrl string) (*url.URL, []string, error) {
+	var hosts []string
+	if i := strings.Index(backendUrl, "://"); i >= 0 {
+		start := i + len("://")
+		end := len(backendUrl)
+		if j := strings.IndexAny(backendUrl[start:], "/?#"); j >= 0 {
+			end = start + j
+		}
+
+		userinfo, authority := "", backendUrl[start:end]
+		if k := strings.LastIndex(authority, "@"); k >= 0 {
+			userinfo, authority = authority[:k+1], authority[k+1:]
+		}
+
+		for _, host := range strings.Split(authority, ",") {
+			if host != "" {
+				hosts = append(hosts, host)
+			}
+		}
+
+		// url.Parse rejects multiple hosts, keep the first one only
+		first := ""
+		if len(hosts) > 0 {
+			first = hosts[0]
+		}
+		backendUrl = backendUrl[:start] + userinfo + first + backendUrl[end:]
+	}
+
+	u, err := url.Parse(backendUrl)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return u, hosts, nil
 }
 
+// normalizeAddresses returns hosts with the default port appended where
+// needed, or localhost if there are no hosts.
+func normalizeAddresses(hosts []string, defaultPort uint16) []string {
+	if len(hosts) == 0 {
+		hosts = []string{ "" }
+	}
+
+	addrs := make([]string, len(hosts))
+	for i, host := range hosts {
+		addrs[i] = NormalizeAddress(host, defaultPort)
+	}
+
+	return addrs
+}
+
+// parseRetryOptions overrides retry with the retries, retry-backoff,
+// breaker-failures and breaker-cooldown query params.
+func parseRetryOptions(query url.Values, retry *RetryOptions) error {
+	for name, dst := range map[string]*int {
+		"retries":          &retry.Retries,
+		"breaker-failures": &retry.BreakerFailures,
+	} {
+		if v := query.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return errors.New("invalid " + name + ": " + v)
+			}
+			*dst = n
+		}
+	}
+
+	for name, dst := range map[string]*time.Duration {
+		"retry-backoff":    &retry.Backoff,
+		"breaker-cooldown": &retry.BreakerCooldown,
+	} {
+		if v := query.Get(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return errors.New("invalid " + name + ": " + v)
+			}
+			*dst = d
+		}
+	}
+
+	return nil
+}
+
+// NewClient returns a client for the backend at backendUrl. Clients implement
+// io.Closer, which stops their background work once they are no longer needed.
 func NewClient(backendUrl string) (Client, error) {
 	// parse url
-	u, err := url.Parse(backendUrl)
+	u, hosts, err := parseUrl(backendUrl)
 	if err != nil {
 		return nil, err
 	}
@@ -88,13 +309,98 @@ func NewClient(backendUrl string) (Client, error) {
 	// create and return backend client
 	var addr string = u.Host
 	var dialTimeout time.Duration = time.Duration(3) * time.Second
-	switch strings.ToLower(u.Scheme) {
+	scheme := strings.ToLower(u.Scheme)
+	switch scheme {
+	case "file", "redis":
+		if len(hosts) > 1 {
+			return nil, errors.New("multiple endpoints are not supported by the " + scheme + " backend")
+		}
+	}
+
+	// tls is enabled by the secure variant of the scheme (etcds://) or by
+	// passing any of the cert, key and ca query params
+	query := u.Query()
+	var tlsConfig *tls.Config
+	secure := false
+	switch scheme {
+	case "etcds", "etcd3s", "consuls":
+		scheme, secure = strings.TrimSuffix(scheme, "s"), true
+	}
+	opts := &TLSOptions {
+		CertFile: query.Get("cert"),
+		KeyFile:  query.Get("key"),
+		CAFile:   query.Get("ca"),
+	}
+	if secure || opts.CertFile != "" || opts.KeyFile != "" || opts.CAFile != "" {
+		switch scheme {
+		case "file", "redis":
+			return nil, errors.New("tls is not supported by the " + scheme + " backend")
+		}
+		if tlsConfig, err = NewTLSConfig(opts); err != nil {
+			return nil, err
+		}
+	}
+
+	// credentials: user:password for etcd and an acl token for consul
+	var creds *Credentials
+	switch scheme {
+	case "etcd", "etcd3", "consul":
+		if creds, err = NewCredentials(u, scheme == "consul"); err != nil {
+			return nil, err
+		}
+	}
+
+	// retries and circuit breaker
+	retry := DefaultRetryOptions
+	if err := parseRetryOptions(query, &retry); err != nil {
+		return nil, err
+	}
+
+	// the url path, if any, is the root under which nodes are stored which
+	// allows several deployments to share a store
+	root := rootPath(u.Path)
+
+	switch scheme {
+	case "file":
+		return NewFileClient(u.Path)
 	case "etcd":
-		addr = NormalizeAddress(addr, uint16(4001))
-		return NewEtcdClient(addr, dialTimeout)
+		return NewEtcdClient(normalizeAddresses(hosts, uint16(4001)), root, creds, tlsConfig, &retry, dialTimeout)
+	case "etcd3":
+		return NewEtcd3Client(normalizeAddresses(hosts, uint16(2379)), root, creds, tlsConfig, &retry, dialTimeout)
 	case "consul":
-		addr = NormalizeAddress(addr, uint16(8500))
-		return NewConsulClient(addr, dialTimeout)
+		opts := &ConsulOptions {
+			Datacenter:    query.Get("dc"),
+			Consistency:   query.Get("consistency"),
+			OpConsistency: make(map[string]string),
+		}
+		for _, op := range []string{ "get", "exists", "children" } {
+			if mode := query.Get(op + "-consistency"); mode != "" {
+				opts.OpConsistency[op] = mode
+			}
+		}
+		if v := query.Get("chunk-size"); v != "" {
+			if opts.ChunkSize, err = strconv.Atoi(v); err != nil || opts.ChunkSize <= 0 {
+				return nil, errors.New("invalid chunk size: " + v)
+			}
+		}
+		if v := query.Get("txn-max-req-len"); v != "" {
+			if opts.TxnMaxReqLen, err = strconv.Atoi(v); err != nil || opts.TxnMaxReqLen <= 0 {
+				return nil, errors.New("invalid txn max request length: " + v)
+			}
+		}
+		return NewConsulClient(normalizeAddresses(hosts, uint16(8500)), root, creds, tlsConfig, opts, &retry, dialTimeout)
+	case "redis":
+		if root != "" {
+			return nil, errors.New("key prefixes are not supported by the redis backend, use db instead")
+		}
+		db := 0
+		if v := query.Get("db"); v != "" {
+			if db, err = strconv.Atoi(v); err != nil {
+				return nil, errors.New("invalid redis db: " + v)
+			}
+		}
+		addr = NormalizeAddress(addr, uint16(6379))
+		return NewRedisClient(addr, db, &retry, dialTimeout)
 	}
 
 	// return constructed client
@@ -1,75 +1,166 @@
 package kvstores
 
 import (
-	"net"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"math/rand"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	api "github.com/hashicorp/consul/api"
 )
 
+const (
+	ConsistencyDefault    = "default"
+	ConsistencyConsistent = "consistent"
+	ConsistencyStale      = "stale"
+)
+
+const (
+	// consul rejects values bigger than 512KB
+	DefaultConsulChunkSize = 512 * 1024
+	// default txn_max_req_len of consul servers, the biggest transaction body
+	// they accept
+	DefaultConsulTxnMaxReqLen = 512 * 1024
+	// chunks are stored as siblings of their key, named after it followed by
+	// a character zookeeper doesn't allow in paths so that they can't collide
+	// with nodes
+	consulChunkSeparator = "\x1f"
+	// chunks of values too big for a single transaction are staged under
+	// this other separator followed by the generation they belong to
+	consulStageSeparator = "\x1e"
+	// reads racing with writes of staged values retry up to this many times
+	consulStagedReadAttempts = 3
+	// consul transactions can't have more operations
+	consulMaxTxnOps = 64
+)
+
+// ConsulOptions configure the requests sent to consul. Consistency is the
+// consistency mode of every read unless overridden for a given operation
+// ("get", "exists" or "children") in OpConsistency. Values bigger than
+// ChunkSize bytes are split across several keys, written in a single
+// transaction unless its body (values are base64 encoded, taking 4/3 of their
+// size) would exceed TxnMaxReqLen bytes, which must match the txn_max_req_len
+// of the consul servers. Bigger values are staged in several transactions.
+type ConsulOptions struct {
+	Datacenter    string
+	Consistency   string
+	OpConsistency map[string]string
+	ChunkSize     int
+	TxnMaxReqLen  int
+}
+
 type ConsulClient struct {
-	addr   string
-	client *api.Client
-	kv     *api.KV
+	addrs      []string
+	root       string
+	clients    map[string]*api.Client
+	httpClient *http.Client
+	scheme     string
+	creds      *Credentials
+	opts       ConsulOptions
+	endpoints  *endpoints
 }
 
-func NewConsulClient(addr string, dialTimeout time.Duration) (*ConsulClient, error) {
-	var c *api.Client
+func NewConsulClient(addrs []string, root string, creds *Credentials, tlsConfig *tls.Config, opts *ConsulOptions, retry *RetryOptions, dialTimeout time.Duration) (*ConsulClient, error) {
+	c := &ConsulClient {
+		addrs:   addrs,
+		root:    root,
+		clients: make(map[string]*api.Client),
+		creds:   creds,
+	}
+	if (opts != nil) {
+		c.opts = *opts
+	}
 
-	// configure address (and scheme if necessary)
-	cfg := api.DefaultConfig()
-	cfg.Address = addr
-	cfg.HttpClient = &http.Client {
-		Transport: &http.Transport {
-			Dial: func(network, addr string) (net.Conn, error) {
-				return net.DialTimeout(network, addr, dialTimeout)
-			},
-		},
+	for op, mode := range c.opts.OpConsistency {
+		if (!validConsistency(mode)) {
+			return nil, errors.New("invalid " + op + " consistency mode: " + mode)
+		}
+	}
+	if (c.opts.Consistency == "") {
+		c.opts.Consistency = ConsistencyDefault
+	} else if (!validConsistency(c.opts.Consistency)) {
+		return nil, errors.New("invalid consistency mode: " + c.opts.Consistency)
+	}
+	if (c.opts.ChunkSize == 0) {
+		c.opts.ChunkSize = DefaultConsulChunkSize
+	} else if (c.opts.ChunkSize < 0) {
+		return nil, errors.New("invalid chunk size: " + strconv.Itoa(c.opts.ChunkSize))
+	}
+	if (c.opts.TxnMaxReqLen == 0) {
+		c.opts.TxnMaxReqLen = DefaultConsulTxnMaxReqLen
+	} else if (c.opts.TxnMaxReqLen < 0) {
+		return nil, errors.New("invalid txn max request length: " + strconv.Itoa(c.opts.TxnMaxReqLen))
 	}
 
-	// create custom client
-	c, err := api.NewClient(cfg)
-	if (err != nil) {
-		return nil, err
+	c.httpClient = &http.Client {
+		Transport: newTransport(tlsConfig, dialTimeout),
+	}
+
+	for _, addr := range addrs {
+		// configure address (and scheme if necessary)
+		cfg := api.DefaultConfig()
+		cfg.Address = addr
+		cfg.Datacenter = c.opts.Datacenter
+		cfg.HttpClient = c.httpClient
+		if tlsConfig != nil {
+			cfg.Scheme = "https"
+		}
+		c.scheme = cfg.Scheme
+
+		// create custom client
+		client, err := api.NewClient(cfg)
+		if (err != nil) {
+			return nil, err
+		}
+		c.clients[addr] = client
 	}
 
-	return &ConsulClient { addr: addr, client: c, kv: c.KV() }, nil
+	// any agent is able to serve requests, there is no need to prefer the leader
+	c.endpoints = newEndpoints("consul", addrs, c.probe, retry)
+
+	return c, nil
 }
 
-func (c *ConsulClient) Create(path string, data string) *Error {
-	return c.cas(path, data, uint64(0))
+// Close stops probing the agents.
+func (c *ConsulClient) Close() error {
+	c.endpoints.close()
+	return nil
 }
 
-func (c *ConsulClient) Delete(path string, version int32) *Error {
-	key := keyFromPath(path)
-	if (version == -1) {
-		_, err := c.kv.Delete(key, nil)
-		if (err != nil) {
-			return &Error { code: BackendUnreachable }
-		}
-	} else {
-		kv := &api.KVPair {
-			Key: key,
-			ModifyIndex: uint64(version),
-		}
+func (c *ConsulClient) Create(ctx context.Context, path string, data string) *Error {
+	return c.cas(ctx, path, data, uint64(0), 0)
+}
 
-		wasOk, _, err := c.kv.DeleteCAS(kv, nil)
-		if (err != nil) {
-			return &Error { code: BackendUnreachable }
-		}
+// Delete removes the key along with its chunks, if any, in a transaction.
+func (c *ConsulClient) Delete(ctx context.Context, path string, version int32) *Error {
+	key := c.key(path)
+	op := &consulTxnKVOp { Verb: "delete", Key: key }
+	if (version != -1) {
+		op = &consulTxnKVOp { Verb: "delete-cas", Key: key, Index: uint64(version) }
+	}
 
-		if (!wasOk) {
-			return &Error { code: BadVersion }
-		}
+	_, failed, err := c.txn(ctx, true, "", []*consulTxnKVOp {
+		op,
+		{ Verb: "delete-tree", Key: key + consulChunkSeparator },
+		{ Verb: "delete-tree", Key: key + consulStageSeparator },
+	})
+	if (err != nil && failed == 0) {
+		return &Error { code: BadVersion }
 	}
 
-	return nil
+	return err
 }
 
-func (c *ConsulClient) Exists(path string) *Error {
-	_, _, err := c.get(path, nil)
+func (c *ConsulClient) Exists(ctx context.Context, path string) *Error {
+	_, _, err := c.get(ctx, path, c.queryOptions(c.consistency("exists")))
 	if (err != nil) {
 		return err
 	}
@@ -77,17 +168,23 @@ func (c *ConsulClient) Exists(path string) *Error {
 	return nil
 }
 
-func (c *ConsulClient) GetData(path string) (*Node, *Error) {
-	kv, _, err := c.get(path, nil)
+func (c *ConsulClient) GetData(ctx context.Context, path string) (*Node, *Error) {
+	kv, err := c.getValue(ctx, path, c.consistency("get"))
 	if (err != nil) {
 		return nil, err
 	}
 
-	return mapFromKV(kv), nil
+	return c.mapFromKV(kv), nil
 }
 
-func (c *ConsulClient) SetData(path string, data string, version int32) *Error {
-	kv, _, err := c.get(keyFromPath(path), nil)
+func (c *ConsulClient) SetData(ctx context.Context, path string, data string, version int32) *Error {
+	// a stale modify index would make the cas fail spuriously
+	mode := c.opts.Consistency
+	if (mode == ConsistencyStale) {
+		mode = ConsistencyDefault
+	}
+
+	kv, _, err := c.get(ctx, path, c.queryOptions(mode))
 	if (err != nil) {
 		return err
 	}
@@ -97,14 +194,26 @@ func (c *ConsulClient) SetData(path string, data string, version int32) *Error {
 		modifyIndex = kv.ModifyIndex
 	}
 
-	return c.cas(path, data, modifyIndex)
+	return c.cas(ctx, path, data, modifyIndex, kv.Flags)
+}
+
+func (c *ConsulClient) GetChildren(ctx context.Context, path string) ([]string, *Error) {
+	return c.getChildren(ctx, path, c.consistency("children"))
 }
 
-func (c *ConsulClient) GetChildren(path string) ([]string, *Error) {
-	keyPath := keyFromPath(path) + "/"
-	kvs, _, err := c.kv.Keys(keyPath, "/", nil)
+func (c *ConsulClient) getChildren(ctx context.Context, path string, mode string) ([]string, *Error) {
+	keyPath := strings.TrimSuffix(c.key(path), "/") + "/"
+	var kvs []string
+	err := c.do(ctx, false, func(client *api.KV) *Error {
+		var kerr error
+		kvs, _, kerr = client.Keys(keyPath, "/", c.queryOptions(mode))
+		if (kerr != nil) {
+			return mapConsulError(kerr)
+		}
+		return nil
+	})
 	if (err != nil) {
-		return nil, &Error { code: BackendUnreachable }
+		return nil, err
 	}
 
 	// clean up keys
@@ -117,7 +226,7 @@ func (c *ConsulClient) GetChildren(path string) ([]string, *Error) {
 		childKey = kv
 		childKey = strings.TrimPrefix(childKey, keyPath)
 		childKey = strings.TrimSuffix(childKey, "/")
-		if (childKey != "") {
+		if (childKey != "" && !strings.ContainsAny(childKey, consulChunkSeparator + consulStageSeparator)) {
 			childrenMap[childKey] = true
 		}
 	}
@@ -130,10 +239,19 @@ func (c *ConsulClient) GetChildren(path string) ([]string, *Error) {
 	return children, nil
 }
 
-func (c *ConsulClient) get(path string, q *api.QueryOptions) (*api.KVPair, *api.QueryMeta, *Error) {
-	kv, qm, err := c.kv.Get(keyFromPath(path), nil)
+func (c *ConsulClient) get(ctx context.Context, path string, q *api.QueryOptions) (*api.KVPair, *api.QueryMeta, *Error) {
+	var kv *api.KVPair
+	var qm *api.QueryMeta
+	err := c.do(ctx, false, func(client *api.KV) *Error {
+		var gerr error
+		kv, qm, gerr = client.Get(c.key(path), q)
+		if (gerr != nil) {
+			return mapConsulError(gerr)
+		}
+		return nil
+	})
 	if (err != nil) {
-		return nil, qm, &Error { code: BackendUnreachable }
+		return nil, nil, err
 	}
 
 	if (kv == nil) {
@@ -143,37 +261,521 @@ func (c *ConsulClient) get(path string, q *api.QueryOptions) (*api.KVPair, *api.
 	return kv, qm, nil
 }
 
-func (c *ConsulClient) cas(path, data string, modifyIndex uint64) *Error {
+// getValue gets the key, reassembling its value if it was split into chunks.
+// Chunks are read in a transaction along with the key, they are consistent
+// with it as they are either written together or staged before it.
+func (c *ConsulClient) getValue(ctx context.Context, path string, mode string) (*api.KVPair, *Error) {
+	kv, _, err := c.get(ctx, path, c.queryOptions(mode))
+	if (err != nil || kv.Flags <= 1) {
+		return kv, err
+	}
+
+	key := c.key(path)
+	for attempt := 1; ; attempt++ {
+		gen := kv.Flags >> 32
+		tree := key + consulChunkSeparator
+		if (gen != 0) {
+			tree = stageKey(key, gen)
+		}
+
+		results, failed, err := c.txn(ctx, false, mode, []*consulTxnKVOp {
+			{ Verb: "get", Key: key },
+			{ Verb: "get-tree", Key: tree },
+		})
+		if (err != nil) {
+			if (failed == 0) {
+				return nil, &Error { code: KeyNotFound }
+			}
+			return nil, err
+		}
+
+		if (len(results) == 0) {
+			return nil, &Error { code: KeyNotFound }
+		}
+
+		kv = results[0]
+		if (kv.Flags <= 1) {
+			return kv, nil
+		}
+		// replaced since read by a value staged under another generation
+		if (kv.Flags >> 32 != gen) {
+			if (attempt == consulStagedReadAttempts) {
+				return nil, &Error { code: Unknown, msg: "chunks of " + key + " kept changing while read" }
+			}
+			continue
+		}
+
+		return assembleChunks(key, kv, results[1:])
+	}
+}
+
+// assembleChunks reassembles the value of kv, whose flags hold the number of
+// chunks in the lower 32 bits and their generation in the upper ones. Values
+// written in a single transaction (generation 0) hold the first chunk in the
+// key and the rest share its modify index, staged ones hold every chunk in
+// the generation staged.
+func assembleChunks(key string, kv *api.KVPair, chunks []*api.KVPair) (*api.KVPair, *Error) {
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunkIndex(chunks[i].Key) < chunkIndex(chunks[j].Key)
+	})
+
+	staged := kv.Flags >> 32 != 0
+	count := kv.Flags & 0xffffffff
+	if (!staged) {
+		count--
+	}
+	if (uint64(len(chunks)) != count) {
+		return nil, &Error { code: Unknown, msg: "missing chunks of " + key }
+	}
+
+	value := kv.Value
+	for i, chunk := range chunks {
+		if (chunkIndex(chunk.Key) != i + 1 || (!staged && chunk.ModifyIndex != kv.ModifyIndex)) {
+			return nil, &Error { code: Unknown, msg: "inconsistent chunks of " + key }
+		}
+		value = append(value, chunk.Value...)
+	}
+
+	assembled := *kv
+	assembled.Value = value
+	return &assembled, nil
+}
+
+func chunkIndex(key string) int {
+	i, err := strconv.Atoi(key[strings.LastIndex(key, consulChunkSeparator) + 1:])
+	if (err != nil) {
+		return -1
+	}
+	return i
+}
+
+// cas sets the key if its modify index matches, 0 meaning it doesn't exist.
+// Values bigger than the chunk size, or replacing chunked ones (as told by the
+// flags of the key replaced), are written in a transaction setting the key to
+// the first chunk and the number of chunks as its flags, and replacing the
+// rest of chunks.
+func (c *ConsulClient) cas(ctx context.Context, path, data string, modifyIndex uint64, prevFlags uint64) *Error {
+	if (len(data) > c.opts.ChunkSize || prevFlags > 1) {
+		return c.casChunks(ctx, path, data, modifyIndex, prevFlags)
+	}
+
 	kv := &api.KVPair {
-		Key: keyFromPath(path),
+		Key: c.key(path),
 		Value: []byte(data),
 		ModifyIndex: modifyIndex,
 	}
 
-	wasOk, _, err := c.kv.CAS(kv, nil)
+	var wasOk bool
+	err := c.do(ctx, true, func(client *api.KV) *Error {
+		var cerr error
+		wasOk, _, cerr = client.CAS(kv, c.writeOptions())
+		if (cerr != nil) {
+			return mapConsulError(cerr)
+		}
+		return nil
+	})
 	if (err != nil) {
-		//log.Debug(err.Error())
-		return &Error { code: BackendUnreachable }
+		return err
 	}
 
 	if (!wasOk) {
-		if (modifyIndex == 0) {
-			return &Error { code: BadVersion }
-		} else {
-			return &Error { code: KeyExists }
-		}
+		return casError(modifyIndex)
 	}
 
 	return nil
 }
 
-func keyFromPath(path string) string {
-	return strings.TrimPrefix(path, "/")
+func (c *ConsulClient) casChunks(ctx context.Context, path, data string, modifyIndex uint64, prevFlags uint64) *Error {
+	chunks := splitChunks(data, c.opts.ChunkSize)
+	key := c.key(path)
+	flags := uint64(len(chunks))
+	if (flags == 1) {
+		flags = 0
+	}
+
+	ops := []*consulTxnKVOp {
+		{ Verb: "cas", Key: key, Value: []byte(chunks[0]), Flags: flags, Index: modifyIndex },
+		{ Verb: "delete-tree", Key: key + consulChunkSeparator },
+	}
+	if prevGen := prevFlags >> 32; prevGen != 0 {
+		ops = append(ops, &consulTxnKVOp { Verb: "delete-tree", Key: stageKey(key, prevGen) })
+	}
+	for i := 1; i < len(chunks); i++ {
+		ops = append(ops, &consulTxnKVOp {
+			Verb: "set",
+			Key: key + consulChunkSeparator + strconv.Itoa(i),
+			Value: []byte(chunks[i]),
+		})
+	}
+
+	// too big for a single transaction
+	if (len(ops) > consulMaxTxnOps || txnSize(ops) > c.opts.TxnMaxReqLen) {
+		return c.casStaged(ctx, key, data, modifyIndex, prevFlags)
+	}
+
+	_, failed, err := c.txn(ctx, true, "", ops)
+	if (err != nil && failed == 0) {
+		return casError(modifyIndex)
+	}
+
+	return err
+}
+
+// casStaged writes values too big for a single transaction. Their chunks,
+// sized to fit in a transaction of their own, are staged first under a new
+// generation which a last transaction sets as the one of the key, along with
+// the number of chunks, deleting the chunks it replaces. Readers never see a
+// value partially written as its chunks are complete before the key points to
+// them. Chunks staged by writes that fail are deleted, or left behind until
+// the key is deleted if that fails too.
+func (c *ConsulClient) casStaged(ctx context.Context, key, data string, modifyIndex uint64, prevFlags uint64) *Error {
+	gen := uint64(rand.Int31()) + 1
+	stage := stageKey(key, gen)
+
+	// the biggest chunk fitting in a transaction, a multiple of 3 bytes so
+	// that it takes exactly 4/3 of its size once base64 encoded
+	overhead := txnSize([]*consulTxnKVOp { { Verb: "set", Key: stage + strconv.Itoa(len(data)), Value: []byte { 0 } } }) - 4
+	size := (c.opts.TxnMaxReqLen - overhead) / 4 * 3
+	if (size > c.opts.ChunkSize) {
+		size = c.opts.ChunkSize
+	}
+	if (size <= 0) {
+		return &Error {
+			code: Unknown,
+			msg: "txn_max_req_len of " + strconv.Itoa(c.opts.TxnMaxReqLen) + " bytes is too small to write chunks of " + key,
+		}
+	}
+
+	chunks := splitChunks(data, size)
+	for i, chunk := range chunks {
+		_, _, err := c.txn(ctx, true, "", []*consulTxnKVOp {
+			{ Verb: "set", Key: stage + strconv.Itoa(i + 1), Value: []byte(chunk) },
+		})
+		if (err != nil) {
+			c.unstage(ctx, stage)
+			return err
+		}
+	}
+
+	ops := []*consulTxnKVOp {
+		{ Verb: "cas", Key: key, Flags: gen << 32 | uint64(len(chunks)), Index: modifyIndex },
+		{ Verb: "delete-tree", Key: key + consulChunkSeparator },
+	}
+	if prevGen := prevFlags >> 32; prevGen != 0 && prevGen != gen {
+		ops = append(ops, &consulTxnKVOp { Verb: "delete-tree", Key: stageKey(key, prevGen) })
+	}
+
+	// the chunks are only deleted if the key surely wasn't set
+	_, failed, err := c.txn(ctx, true, "", ops)
+	if (err != nil && failed >= 0) {
+		c.unstage(ctx, stage)
+		if (failed == 0) {
+			return casError(modifyIndex)
+		}
+	}
+
+	return err
+}
+
+// unstage deletes the chunks staged under stage, best effort.
+func (c *ConsulClient) unstage(ctx context.Context, stage string) {
+	c.txn(ctx, true, "", []*consulTxnKVOp { { Verb: "delete-tree", Key: stage } })
+}
+
+// casError returns the error of a failed check and set of modifyIndex.
+func casError(modifyIndex uint64) *Error {
+	if (modifyIndex == 0) {
+		return &Error { code: KeyExists }
+	}
+	return &Error { code: BadVersion }
+}
+
+// stageKey returns the prefix of the chunks of key staged under gen.
+func stageKey(key string, gen uint64) string {
+	return key + consulStageSeparator + strconv.FormatUint(gen, 10) + consulChunkSeparator
+}
+
+func splitChunks(data string, size int) []string {
+	var chunks []string
+	for len(data) > size {
+		chunks, data = append(chunks, data[:size]), data[size:]
+	}
+	return append(chunks, data)
+}
+
+// txnSize returns the size of the body of a transaction made of ops.
+func txnSize(ops []*consulTxnKVOp) int {
+	txnOps := make([]*consulTxnOp, len(ops))
+	for i, op := range ops {
+		txnOps[i] = &consulTxnOp { KV: op }
+	}
+	body, _ := json.Marshal(txnOps)
+	return len(body)
+}
+
+type consulTxnKVOp struct {
+	Verb  string
+	Key   string
+	Value []byte `json:",omitempty"`
+	Flags uint64 `json:",omitempty"`
+	Index uint64 `json:",omitempty"`
+}
+
+type consulTxnOp struct {
+	KV *consulTxnKVOp
+}
+
+type consulTxnResult struct {
+	KV *api.KVPair
+}
+
+type consulTxnError struct {
+	OpIndex int
+	What    string
+}
+
+type consulTxnResponse struct {
+	Results []*consulTxnResult
+	Errors  []*consulTxnError
+}
+
+// txn applies ops atomically through the transaction endpoint, which isn't
+// supported by the api client, and returns the keys read. If the transaction
+// is rolled back, it also returns the index of the operation which caused it
+// (-1 otherwise). Reads are performed with the given consistency mode.
+func (c *ConsulClient) txn(ctx context.Context, write bool, mode string, ops []*consulTxnKVOp) ([]*api.KVPair, int, *Error) {
+	txnOps := make([]*consulTxnOp, len(ops))
+	for i, op := range ops {
+		txnOps[i] = &consulTxnOp { KV: op }
+	}
+	body, merr := json.Marshal(txnOps)
+	if (merr != nil) {
+		return nil, -1, &Error { code: Unknown, msg: merr.Error() }
+	}
+
+	// consul would reject it with a bare 413 after sending the whole body
+	if (len(body) > c.opts.TxnMaxReqLen) {
+		return nil, -1, &Error {
+			code: Unknown,
+			msg: "transaction of " + strconv.Itoa(len(body)) + " bytes exceeds the txn_max_req_len of " +
+				strconv.Itoa(c.opts.TxnMaxReqLen) + " bytes, raise it in the consul servers and in txn-max-req-len",
+		}
+	}
+
+	params := url.Values {}
+	if (c.opts.Datacenter != "") {
+		params.Set("dc", c.opts.Datacenter)
+	}
+	if _, token := c.creds.secrets(); token != "" {
+		params.Set("token", token)
+	}
+	switch mode {
+	case ConsistencyStale:
+		params.Set("stale", "")
+	case ConsistencyConsistent:
+		params.Set("consistent", "")
+	}
+
+	var results []*api.KVPair
+	failed := -1
+	err := c.endpoints.do(ctx, write, func(ctx context.Context, addr string) *Error {
+		rs, f, err := c.txnTo(ctx, addr, params, body)
+		if (err == nil || f >= 0) {
+			results, failed = rs, f
+		}
+		return err
+	})
+
+	return results, failed, err
+}
+
+func (c *ConsulClient) txnTo(ctx context.Context, addr string, params url.Values, body []byte) ([]*api.KVPair, int, *Error) {
+	u := &url.URL { Scheme: c.scheme, Host: addr, Path: "/v1/txn", RawQuery: params.Encode() }
+	req, err := http.NewRequest("PUT", u.String(), bytes.NewReader(body))
+	if (err != nil) {
+		return nil, -1, &Error { code: Unknown, msg: err.Error() }
+	}
+
+	injectTrace(ctx, req.Header)
+	resp, err := c.httpClient.Do(req.WithContext(ctx))
+	if (err != nil) {
+		if cerr := contextError(ctx); cerr != nil {
+			return nil, -1, cerr
+		}
+		return nil, -1, unreachableError(err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusConflict:
+	case http.StatusForbidden:
+		return nil, -1, &Error { code: AccessDenied, msg: resp.Status }
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		return nil, -1, &Error { code: Unknown, msg: resp.Status }
+	default:
+		return nil, -1, &Error { code: BackendUnreachable, msg: resp.Status }
+	}
+
+	txnResp := &consulTxnResponse {}
+	if err := json.NewDecoder(resp.Body).Decode(txnResp); err != nil {
+		if cerr := contextError(ctx); cerr != nil {
+			return nil, -1, cerr
+		}
+		return nil, -1, &Error { code: BackendUnreachable, msg: err.Error() }
+	}
+
+	if (len(txnResp.Errors) > 0) {
+		e := txnResp.Errors[0]
+		return nil, e.OpIndex, &Error { code: Unknown, msg: e.What }
+	}
+
+	results := make([]*api.KVPair, 0, len(txnResp.Results))
+	for _, result := range txnResp.Results {
+		if (result.KV != nil) {
+			results = append(results, result.KV)
+		}
+	}
+
+	return results, -1, nil
+}
+
+func (c *ConsulClient) Breaker() *Breaker {
+	return c.endpoints.breaker
+}
+
+// Reload re-reads the acl token from its file, if any.
+func (c *ConsulClient) Reload() error {
+	if (c.creds == nil) {
+		return nil
+	}
+	return c.creds.Reload()
+}
+
+// probe checks whether the agent at addr is healthy, which requires the
+// cluster to have a leader.
+func (c *ConsulClient) probe(addr string) (bool, *Error) {
+	leader, err := c.clients[addr].Status().Leader()
+	if (err != nil) {
+		return false, &Error { code: BackendUnreachable, msg: err.Error() }
+	}
+
+	if (leader == "") {
+		return false, &Error { code: BackendUnreachable, msg: "no cluster leader" }
+	}
+
+	return false, nil
+}
+
+// do runs f against the healthiest agent, failing over to the rest.
+func (c *ConsulClient) do(ctx context.Context, write bool, f func(*api.KV) *Error) *Error {
+	return c.endpoints.do(ctx, write, func(_ context.Context, addr string) *Error {
+		return f(c.clients[addr].KV())
+	})
+}
+
+// Sync performs a consistent read of path, which acts as a read barrier, and
+// returns the index it observed.
+func (c *ConsulClient) Sync(ctx context.Context, path string) (uint64, *Error) {
+	_, qm, err := c.get(ctx, path, c.queryOptions(ConsistencyConsistent))
+	if (err != nil && err.code != KeyNotFound) {
+		return 0, err
+	}
+
+	if (qm == nil) {
+		return 0, nil
+	}
+
+	return qm.LastIndex, nil
+}
+
+// Synced returns a client whose reads are consistent, as indexes returned by
+// consul are those of the keys read and can't be used to tell whether the
+// agent is up to date.
+func (c *ConsulClient) Synced(index uint64) Client {
+	if (c.opts.Consistency == ConsistencyConsistent && len(c.opts.OpConsistency) == 0) {
+		return c
+	}
+
+	return &consulSyncedClient { ConsulClient: c }
+}
+
+type consulSyncedClient struct {
+	*ConsulClient
+}
+
+func (c *consulSyncedClient) Exists(ctx context.Context, path string) *Error {
+	_, _, err := c.get(ctx, path, c.queryOptions(ConsistencyConsistent))
+	return err
+}
+
+func (c *consulSyncedClient) GetData(ctx context.Context, path string) (*Node, *Error) {
+	kv, err := c.getValue(ctx, path, ConsistencyConsistent)
+	if (err != nil) {
+		return nil, err
+	}
+
+	return c.mapFromKV(kv), nil
+}
+
+func (c *consulSyncedClient) GetChildren(ctx context.Context, path string) ([]string, *Error) {
+	return c.getChildren(ctx, path, ConsistencyConsistent)
+}
+
+// consistency returns the consistency mode of reads issued by op.
+func (c *ConsulClient) consistency(op string) string {
+	if mode, found := c.opts.OpConsistency[op]; found {
+		return mode
+	}
+	return c.opts.Consistency
+}
+
+// queryOptions and writeOptions carry the acl token, which may change on
+// reload, on every request.
+func (c *ConsulClient) queryOptions(mode string) *api.QueryOptions {
+	_, token := c.creds.secrets()
+	return &api.QueryOptions {
+		Token:             token,
+		AllowStale:        mode == ConsistencyStale,
+		RequireConsistent: mode == ConsistencyConsistent,
+	}
+}
+
+func (c *ConsulClient) writeOptions() *api.WriteOptions {
+	_, token := c.creds.secrets()
+	return &api.WriteOptions { Token: token }
+}
+
+// mapConsulError maps errors returned by the consul api, which only exposes
+// the status code through the error message.
+func mapConsulError(err error) *Error {
+	if (strings.HasPrefix(err.Error(), "Unexpected response code: 403")) {
+		return &Error { code: AccessDenied, msg: err.Error() }
+	}
+
+	// too large requests won't go through no matter the agent
+	if (strings.HasPrefix(err.Error(), "Unexpected response code: 413")) {
+		return &Error { code: Unknown, msg: err.Error() }
+	}
+
+	return unreachableError(err)
+}
+
+func validConsistency(mode string) bool {
+	switch mode {
+	case ConsistencyDefault, ConsistencyConsistent, ConsistencyStale:
+		return true
+	}
+	return false
+}
+
+// key returns the consul key of the node at path.
+func (c *ConsulClient) key(path string) string {
+	return strings.TrimPrefix(c.root + path, "/")
 }
 
-func mapFromKV(kv *api.KVPair) *Node {
+func (c *ConsulClient) mapFromKV(kv *api.KVPair) *Node {
 	return &Node {
-		Path:          kv.Key,
+		Path:          stripRoot(c.root, "/" + kv.Key),
 		Value:         string(kv.Value),
 		CreatedIndex:  kv.CreateIndex,
 		ModifiedIndex: kv.ModifyIndex,
@@ -0,0 +1,521 @@
+package kvstores
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/hashicorp/consul/api"
+)
+
+// fakeConsul is an in-process stand-in for a consul agent, holding a single
+// indexed keyspace. It implements the subset of the kv and txn endpoints used
+// by ConsulClient with the same semantics as consul, rejecting transaction
+// bodies bigger than its txn_max_req_len.
+type fakeConsul struct {
+	server       *httptest.Server
+	txnMaxReqLen int
+
+	mutex        sync.Mutex
+	index        uint64
+	kvs          map[string]*api.KVPair
+	// transactions received
+	txns         int
+}
+
+func newFakeConsul(txnMaxReqLen int) *fakeConsul {
+	f := &fakeConsul {
+		txnMaxReqLen: txnMaxReqLen,
+		kvs:          make(map[string]*api.KVPair),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/status/leader", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode("127.0.0.1:8300")
+	})
+	mux.HandleFunc("/v1/kv/", f.kv)
+	mux.HandleFunc("/v1/txn", f.txn)
+	f.server = httptest.NewServer(mux)
+
+	return f
+}
+
+func (f *fakeConsul) addr() string {
+	return strings.TrimPrefix(f.server.URL, "http://")
+}
+
+func (f *fakeConsul) close() {
+	f.server.CloseClientConnections()
+	f.server.Close()
+}
+
+func (f *fakeConsul) kv(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	query := r.URL.Query()
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+	w.Header().Set("X-Consul-LastContact", "0")
+	w.Header().Set("X-Consul-KnownLeader", "true")
+
+	switch r.Method {
+	case "GET":
+		if _, found := query["keys"]; found {
+			keys := f.keys(key, query.Get("separator"))
+			if len(keys) == 0 {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(keys)
+			return
+		}
+
+		kv, found := f.kvs[key]
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode([]*api.KVPair { kv })
+	case "PUT":
+		value, _ := ioutil.ReadAll(r.Body)
+		flags, _ := strconv.ParseUint(query.Get("flags"), 10, 64)
+		cas, _ := strconv.ParseUint(query.Get("cas"), 10, 64)
+		if _, found := query["cas"]; found && !f.casMatches(key, cas) {
+			json.NewEncoder(w).Encode(false)
+			return
+		}
+
+		f.index++
+		f.set(f.kvs, key, value, flags)
+		json.NewEncoder(w).Encode(true)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// keys returns the keys under prefix, up to the first separator after it.
+func (f *fakeConsul) keys(prefix string, separator string) []string {
+	found := make(map[string]bool)
+	for key := range f.kvs {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		rest := key[len(prefix):]
+		if i := strings.Index(rest, separator); separator != "" && i >= 0 {
+			key = prefix + rest[:i + 1]
+		}
+		found[key] = true
+	}
+
+	keys := make([]string, 0, len(found))
+	for key := range found {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// casMatches tells whether a check and set of key with index would succeed, 0
+// meaning it doesn't exist.
+func (f *fakeConsul) casMatches(key string, index uint64) bool {
+	kv, found := f.kvs[key]
+	if index == 0 {
+		return !found
+	}
+	return found && kv.ModifyIndex == index
+}
+
+func (f *fakeConsul) set(kvs map[string]*api.KVPair, key string, value []byte, flags uint64) {
+	kv := &api.KVPair { Key: key, Value: value, Flags: flags, CreateIndex: f.index, ModifyIndex: f.index }
+	if prev, found := kvs[key]; found {
+		kv.CreateIndex = prev.CreateIndex
+	}
+	kvs[key] = kv
+}
+
+func (f *fakeConsul) txn(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.txns++
+
+	if len(body) > f.txnMaxReqLen {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var ops []*consulTxnOp
+	if err := json.Unmarshal(body, &ops); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// operations are applied to a copy, kept only if all of them succeed,
+	// and share the index of the transaction
+	kvs := make(map[string]*api.KVPair, len(f.kvs))
+	for key, kv := range f.kvs {
+		kvs[key] = kv
+	}
+	index := f.index
+	f.index++
+
+	resp := &consulTxnResponse {}
+	for i, op := range ops {
+		kv, found := kvs[op.KV.Key]
+		var what string
+		switch op.KV.Verb {
+		case "set":
+			f.set(kvs, op.KV.Key, op.KV.Value, op.KV.Flags)
+		case "cas":
+			if (op.KV.Index == 0 && found) || (op.KV.Index != 0 && (!found || kv.ModifyIndex != op.KV.Index)) {
+				what = "failed to set key " + op.KV.Key + ", index is stale"
+				break
+			}
+			f.set(kvs, op.KV.Key, op.KV.Value, op.KV.Flags)
+		case "get":
+			if !found {
+				what = "key " + op.KV.Key + " doesn't exist"
+				break
+			}
+			resp.Results = append(resp.Results, &consulTxnResult { KV: kv })
+		case "get-tree":
+			for key, kv := range kvs {
+				if strings.HasPrefix(key, op.KV.Key) {
+					resp.Results = append(resp.Results, &consulTxnResult { KV: kv })
+				}
+			}
+		case "delete":
+			delete(kvs, op.KV.Key)
+		case "delete-cas":
+			if !found || kv.ModifyIndex != op.KV.Index {
+				what = "failed to delete key " + op.KV.Key + ", index is stale"
+				break
+			}
+			delete(kvs, op.KV.Key)
+		case "delete-tree":
+			for key := range kvs {
+				if strings.HasPrefix(key, op.KV.Key) {
+					delete(kvs, key)
+				}
+			}
+		default:
+			what = "unknown verb " + op.KV.Verb
+		}
+
+		if what != "" {
+			f.index = index
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(&consulTxnResponse { Errors: []*consulTxnError { { OpIndex: i, What: what } } })
+			return
+		}
+	}
+
+	f.kvs = kvs
+	json.NewEncoder(w).Encode(resp)
+}
+
+func newTestConsulClient(t *testing.T, f *fakeConsul, opts *ConsulOptions) *ConsulClient {
+	c, err := NewConsulClient([]string{ f.addr() }, "", nil, nil, opts, nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func randomValue(size int) string {
+	b := make([]byte, size)
+	rand.Read(b)
+	return string(b)
+}
+
+func TestConsulClientChunkedValues(t *testing.T) {
+	// enough for a megabyte, base64 encoded, and the rest of the transaction
+	f := newFakeConsul(1536 * 1024)
+	defer f.close()
+	c := newTestConsulClient(t, f, &ConsulOptions { TxnMaxReqLen: 1536 * 1024 })
+	defer c.Close()
+	ctx := context.Background()
+
+	expectValue := func(path string, value string) {
+		node, err := c.GetData(ctx, path)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.String())
+		}
+		if node.Value != value {
+			t.Fatalf("expected a %d bytes value, got %d bytes", len(value), len(node.Value))
+		}
+	}
+
+	// a megabyte takes two chunks
+	value := randomValue(1024 * 1024)
+	if err := c.Create(ctx, "/big", value); err != nil {
+		t.Fatal(err.String())
+	}
+	expectValue("/big", value)
+	f.mutex.Lock()
+	keys := len(f.kvs)
+	f.mutex.Unlock()
+	if keys != 2 {
+		t.Fatalf("expected the value to take 2 keys, got %d", keys)
+	}
+
+	// chunks aren't children
+	children, err := c.GetChildren(ctx, "/")
+	if err != nil {
+		t.Fatal(err.String())
+	}
+	if len(children) != 1 || children[0] != "big" {
+		t.Fatalf("expected big to be the only child, got %v", children)
+	}
+
+	// replacing it with a smaller value removes its chunks
+	value = randomValue(1024 * 1024 - 1)
+	if err := c.SetData(ctx, "/big", value, -1); err != nil {
+		t.Fatal(err.String())
+	}
+	expectValue("/big", value)
+	value = "small"
+	if err := c.SetData(ctx, "/big", value, -1); err != nil {
+		t.Fatal(err.String())
+	}
+	expectValue("/big", value)
+	f.mutex.Lock()
+	keys = len(f.kvs)
+	f.mutex.Unlock()
+	if keys != 1 {
+		t.Fatalf("expected the value to take a single key, got %d", keys)
+	}
+
+	// and deleting it removes them too
+	if err := c.SetData(ctx, "/big", randomValue(1024 * 1024), -1); err != nil {
+		t.Fatal(err.String())
+	}
+	if err := c.Delete(ctx, "/big", -1); err != nil {
+		t.Fatal(err.String())
+	}
+	if err := c.Exists(ctx, "/big"); err == nil || err.Code() != KeyNotFound {
+		t.Fatalf("expected the node to be deleted, got %v", err)
+	}
+	f.mutex.Lock()
+	keys = len(f.kvs)
+	f.mutex.Unlock()
+	if keys != 0 {
+		t.Fatalf("expected every chunk to be deleted, %d keys left", keys)
+	}
+}
+
+func TestConsulClientTxnMaxReqLen(t *testing.T) {
+	f := newFakeConsul(DefaultConsulTxnMaxReqLen)
+	defer f.close()
+	ctx := context.Background()
+	c := newTestConsulClient(t, f, nil)
+	defer c.Close()
+
+	keys := func() []string {
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		keys := make([]string, 0, len(f.kvs))
+		for key := range f.kvs {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	expectValue := func(path string, value string) {
+		node, err := c.GetData(ctx, path)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.String())
+		}
+		if node.Value != value {
+			t.Fatalf("expected a %d bytes value, got %d bytes", len(value), len(node.Value))
+		}
+	}
+
+	// values not chunked aren't written through transactions
+	if err := c.Create(ctx, "/a", randomValue(DefaultConsulChunkSize)); err != nil {
+		t.Fatal(err.String())
+	}
+	f.mutex.Lock()
+	txns := f.txns
+	f.mutex.Unlock()
+	if txns != 0 {
+		t.Fatalf("expected no transaction to be sent, got %d", txns)
+	}
+
+	// chunked values whose transaction would exceed txn_max_req_len are
+	// staged in transactions that fit instead
+	value := randomValue(1024 * 1024)
+	if err := c.Create(ctx, "/b", value); err != nil {
+		t.Fatal(err.String())
+	}
+	expectValue("/b", value)
+	staged := keys()
+	if len(staged) != 5 {
+		t.Fatalf("expected a key and 3 staged chunks besides /a, got %q", staged)
+	}
+	children, err := c.GetChildren(ctx, "/")
+	if err != nil {
+		t.Fatal(err.String())
+	}
+	if sort.Strings(children); len(children) != 2 || children[0] != "a" || children[1] != "b" {
+		t.Fatalf("expected staged chunks not to be children, got %q", children)
+	}
+
+	// replacing a staged value deletes its chunks, whatever it's replaced by
+	for _, size := range []int{ 1024 * 1024, 768 * 1024, 16 } {
+		value = randomValue(size)
+		if err := c.SetData(ctx, "/b", value, -1); err != nil {
+			t.Fatal(err.String())
+		}
+		expectValue("/b", value)
+		for _, key := range keys() {
+			for _, prev := range staged {
+				if key == prev && strings.Contains(key, consulStageSeparator) {
+					t.Fatalf("expected %q to be deleted", key)
+				}
+			}
+		}
+		staged = keys()
+	}
+	if len(staged) != 2 {
+		t.Fatalf("expected only /a and /b to be left, got %q", staged)
+	}
+
+	// failed writes delete the chunks they staged
+	node, gerr := c.GetData(ctx, "/b")
+	if gerr != nil {
+		t.Fatal(gerr.String())
+	}
+	if err := c.SetData(ctx, "/b", randomValue(1024 * 1024), int32(node.ModifiedIndex) + 1); err == nil || err.Code() != BadVersion {
+		t.Fatalf("expected a stale version to fail with BadVersion, got %v", err)
+	}
+	if err := c.Create(ctx, "/b", randomValue(1024 * 1024)); err == nil || err.Code() != KeyExists {
+		t.Fatalf("expected an existing node to fail with KeyExists, got %v", err)
+	}
+	if got := keys(); len(got) != 2 {
+		t.Fatalf("expected staged chunks to be deleted, got %q", got)
+	}
+
+	// and deleting a staged value deletes its chunks too
+	if err := c.SetData(ctx, "/b", randomValue(1024 * 1024), -1); err != nil {
+		t.Fatal(err.String())
+	}
+	if err := c.Delete(ctx, "/b", -1); err != nil {
+		t.Fatal(err.String())
+	}
+	if got := keys(); len(got) != 1 {
+		t.Fatalf("expected only /a to be left, got %q", got)
+	}
+
+	// a limit too small for any chunk is reported as such
+	small := newTestConsulClient(t, f, &ConsulOptions { TxnMaxReqLen: 64 })
+	defer small.Close()
+	if err := small.Create(ctx, "/c", randomValue(1024 * 1024)); err == nil || !strings.Contains(err.String(), "txn_max_req_len") {
+		t.Fatalf("expected a txn_max_req_len error, got %v", err)
+	}
+
+	if _, err := NewConsulClient([]string{ f.addr() }, "", nil, nil, &ConsulOptions { TxnMaxReqLen: -1 }, nil, time.Second); err == nil {
+		t.Fatal("expected a negative txn max request length to be refused")
+	}
+}
+
+// TestConsulClientStagedReadRace reads a staged value while it's replaced by
+// another one, which must be read whole.
+func TestConsulClientStagedReadRace(t *testing.T) {
+	f := newFakeConsul(DefaultConsulTxnMaxReqLen)
+	defer f.close()
+	ctx := context.Background()
+	c := newTestConsulClient(t, f, nil)
+	defer c.Close()
+
+	values := map[string]bool {}
+	value := randomValue(1024 * 1024)
+	values[value] = true
+	if err := c.Create(ctx, "/a", value); err != nil {
+		t.Fatal(err.String())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			value := randomValue(1024 * 1024)
+			f.mutex.Lock()
+			values[value] = true
+			f.mutex.Unlock()
+			if err := c.SetData(ctx, "/a", value, -1); err != nil {
+				t.Error(err.String())
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		node, err := c.GetData(ctx, "/a")
+		if err != nil {
+			// readers outpaced by writers give up instead of looping
+			if strings.Contains(err.String(), "kept changing") {
+				continue
+			}
+			t.Fatal(err.String())
+		}
+		f.mutex.Lock()
+		found := values[node.Value]
+		f.mutex.Unlock()
+		if !found {
+			t.Fatalf("read a %d bytes value never written", len(node.Value))
+		}
+	}
+}
+
+func TestConsulClientCasErrors(t *testing.T) {
+	f := newFakeConsul(1536 * 1024)
+	defer f.close()
+	c := newTestConsulClient(t, f, &ConsulOptions { TxnMaxReqLen: 1536 * 1024 })
+	defer c.Close()
+	ctx := context.Background()
+
+	// both plain and chunked values
+	for _, size := range []int{ 16, 1024 * 1024 } {
+		path := "/n" + strconv.Itoa(size)
+		if err := c.Create(ctx, path, randomValue(size)); err != nil {
+			t.Fatal(err.String())
+		}
+		node, err := c.GetData(ctx, path)
+		if err != nil {
+			t.Fatal(err.String())
+		}
+
+		if err := c.Create(ctx, path, randomValue(size)); err == nil || err.Code() != KeyExists {
+			t.Fatalf("%d bytes: expected creating an existing node to fail with KeyExists, got %v", size, err)
+		}
+		stale := int32(node.ModifiedIndex) + 1
+		if err := c.SetData(ctx, path, randomValue(size), stale); err == nil || err.Code() != BadVersion {
+			t.Fatalf("%d bytes: expected setting a stale version to fail with BadVersion, got %v", size, err)
+		}
+		if err := c.SetData(ctx, path, randomValue(size), int32(node.ModifiedIndex)); err != nil {
+			t.Fatalf("%d bytes: unexpected error: %s", size, err.String())
+		}
+		// the version read is stale once set
+		if err := c.Delete(ctx, path, int32(node.ModifiedIndex)); err == nil || err.Code() != BadVersion {
+			t.Fatalf("%d bytes: expected deleting a stale version to fail with BadVersion, got %v", size, err)
+		}
+	}
+}
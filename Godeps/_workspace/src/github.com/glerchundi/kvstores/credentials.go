@@ -0,0 +1,100 @@
+package kvstores
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Reloader is implemented by clients holding secrets read from files, Reload
+// re-reads them (parkeeper does it on SIGHUP).
+type Reloader interface {
+	Reload() error
+}
+
+// Credentials authenticate the requests sent to a backend. The password and
+// the token can be read from files instead, which keeps them out of the
+// process args.
+type Credentials struct {
+	username     string
+	passwordFile string
+	tokenFile    string
+
+	mutex        sync.RWMutex
+	password     string
+	token        string
+}
+
+// NewCredentials returns the credentials specified in u, either as user info
+// (user:password@host or token@host) or query params (token, token-file and
+// password-file), or nil if there are none.
+func NewCredentials(u *url.URL, userIsToken bool) (*Credentials, error) {
+	query := u.Query()
+	c := &Credentials {
+		passwordFile: query.Get("password-file"),
+		tokenFile:    query.Get("token-file"),
+		token:        query.Get("token"),
+	}
+
+	if u.User != nil {
+		if userIsToken {
+			c.token = u.User.Username()
+		} else {
+			c.username = u.User.Username()
+			c.password, _ = u.User.Password()
+		}
+	}
+
+	if c.passwordFile != "" && c.username == "" {
+		return nil, errors.New("password-file requires a user")
+	}
+
+	if c.username == "" && c.token == "" && c.tokenFile == "" {
+		return nil, nil
+	}
+
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *Credentials) Reload() error {
+	password, token := c.secrets()
+
+	if c.passwordFile != "" {
+		b, err := ioutil.ReadFile(c.passwordFile)
+		if err != nil {
+			return err
+		}
+		password = strings.TrimSpace(string(b))
+	}
+
+	if c.tokenFile != "" {
+		b, err := ioutil.ReadFile(c.tokenFile)
+		if err != nil {
+			return err
+		}
+		token = strings.TrimSpace(string(b))
+	}
+
+	c.mutex.Lock()
+	c.password, c.token = password, token
+	c.mutex.Unlock()
+
+	return nil
+}
+
+// secrets returns the current password and token, if any (c may be nil).
+func (c *Credentials) secrets() (string, string) {
+	if c == nil {
+		return "", ""
+	}
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.password, c.token
+}
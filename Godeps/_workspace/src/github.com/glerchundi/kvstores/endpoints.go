@@ -0,0 +1,415 @@
+package kvstores
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// time an endpoint has to answer a health probe
+const probeTimeout = 2 * time.Second
+
+// interval between background health probes
+var probeInterval = 5 * time.Second
+
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = 0
+	BreakerOpen     BreakerState = 1
+	BreakerHalfOpen BreakerState = 2
+)
+
+var breakerStateNames = map[BreakerState]string {
+	BreakerClosed:   "closed",
+	BreakerOpen:     "open",
+	BreakerHalfOpen: "half-open",
+}
+
+func (s BreakerState) String() string {
+	return breakerStateNames[s]
+}
+
+// RetryOptions configure how failed requests are retried and when the circuit
+// breaker around a backend opens. Only reads are retried, with a jittered
+// exponential backoff, since writes may have been applied before failing. For
+// the same reason writes only fail over to the next endpoint if they couldn't
+// connect to the previous one.
+type RetryOptions struct {
+	Retries         int
+	Backoff         time.Duration
+	BreakerFailures int
+	BreakerCooldown time.Duration
+}
+
+var DefaultRetryOptions = RetryOptions {
+	Retries:         2,
+	Backoff:         100 * time.Millisecond,
+	BreakerFailures: 5,
+	BreakerCooldown: 10 * time.Second,
+}
+
+// BreakerClient is implemented by backends guarded by a circuit breaker.
+type BreakerClient interface {
+	Client
+	Breaker() *Breaker
+}
+
+// Breaker stops sending requests to a backend once a number of them in a row
+// found it unreachable, failing them right away instead. After a cooldown a
+// single request is let through (half open) and the breaker closes again if it
+// succeeds. A non positive number of failures disables it.
+type Breaker struct {
+	failures    int
+	cooldown    time.Duration
+
+	mutex       sync.Mutex
+	state       BreakerState
+	consecutive int
+	openedAt    time.Time
+	probing     bool
+	transitions uint64
+	// notified of every state change
+	subscribers map[chan<- BreakerState]bool
+}
+
+func newBreaker(failures int, cooldown time.Duration) *Breaker {
+	return &Breaker {
+		failures:    failures,
+		cooldown:    cooldown,
+		subscribers: make(map[chan<- BreakerState]bool),
+	}
+}
+
+// State returns the state of the breaker, which is reported as half open as
+// soon as the cooldown elapses so that callers let the next request through.
+func (b *Breaker) State() BreakerState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.cooldown {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// Transitions returns the number of state changes so far.
+func (b *Breaker) Transitions() uint64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.transitions
+}
+
+// Notify relays the state changes of the breaker to ch. Like signal.Notify,
+// sends don't block and ch must be buffered to not miss any of them.
+func (b *Breaker) Notify(ch chan<- BreakerState) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.subscribers[ch] = true
+}
+
+// Stop stops relaying state changes to ch.
+func (b *Breaker) Stop(ch chan<- BreakerState) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.subscribers, ch)
+}
+
+func (b *Breaker) allow() bool {
+	if b.failures <= 0 {
+		return true
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(BreakerHalfOpen)
+		fallthrough
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+
+	return true
+}
+
+func (b *Breaker) record(reachable bool) {
+	if b.failures <= 0 {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.probing = false
+	if reachable {
+		b.consecutive = 0
+		if b.state != BreakerClosed {
+			b.setState(BreakerClosed)
+		}
+		return
+	}
+
+	b.consecutive++
+	if b.state == BreakerHalfOpen || (b.state == BreakerClosed && b.consecutive >= b.failures) {
+		b.openedAt = time.Now()
+		b.setState(BreakerOpen)
+	}
+}
+
+func (b *Breaker) setState(state BreakerState) {
+	log.Printf("backend circuit breaker %s (was %s)", state, b.state)
+	b.state = state
+	b.transitions++
+	for ch := range b.subscribers {
+		select {
+		case ch <- state:
+		default:
+		}
+	}
+}
+
+// endpoints keeps track of the health of the endpoints of a backend, which are
+// probed in the background, and of which one of them is the leader. Requests
+// are sent to the endpoint that worked last (the leader, if known, for writes)
+// and fail over to the rest of them in case it is unreachable.
+type endpoints struct {
+	// backend name, reported by traces
+	name    string
+	addrs   []string
+	// probe returns whether addr is the leader or an error if unhealthy
+	probe   func(addr string) (bool, *Error)
+	retry   RetryOptions
+	breaker *Breaker
+
+	mutex   sync.RWMutex
+	down    map[string]bool
+	leader  string
+	current string
+
+	// closed to stop probing
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+func newEndpoints(name string, addrs []string, probe func(addr string) (bool, *Error), retry *RetryOptions) *endpoints {
+	if retry == nil {
+		retry = &DefaultRetryOptions
+	}
+
+	e := &endpoints {
+		name:    name,
+		addrs:   addrs,
+		probe:   probe,
+		retry:   *retry,
+		breaker: newBreaker(retry.BreakerFailures, retry.BreakerCooldown),
+		down:    make(map[string]bool),
+		current: addrs[0],
+		stop:    make(chan struct{}),
+	}
+
+	e.probeAll()
+	if len(addrs) > 1 {
+		go e.probeLoop(probeInterval)
+	}
+
+	return e
+}
+
+// close stops probing the endpoints in the background.
+func (e *endpoints) close() {
+	e.closeOnce.Do(func() { close(e.stop) })
+}
+
+// healthy returns whether at least one endpoint is up.
+func (e *endpoints) healthy() bool {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return len(e.down) < len(e.addrs)
+}
+
+// do runs f against the endpoints, in order of preference, until one of them
+// is reachable, or for writes until one of them fails after connecting. Reads
+// are retried if none of them was.
+//
+// If ctx is done first a Timeout error is returned right away, leaving f to
+// finish in the background, so callers must not read anything written by f
+// unless it was f's error that got returned.
+func (e *endpoints) do(ctx context.Context, write bool, f func(ctx context.Context, addr string) *Error) *Error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+
+	if !e.breaker.allow() {
+		return &Error { code: BackendUnreachable, msg: "circuit breaker open" }
+	}
+
+	done := make(chan *Error, 1)
+	go func() {
+		var err *Error
+		for attempt := 0; ; attempt++ {
+			err = e.try(ctx, write, f)
+			if err == nil || err.code != BackendUnreachable || write || attempt >= e.retry.Retries {
+				break
+			}
+
+			select {
+			case <-time.After(backoff(e.retry.Backoff, attempt)):
+			case <-ctx.Done():
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+
+		// a backend letting requests time out may be hung or dropping them,
+		// which is as bad as being unreachable
+		e.breaker.record(err == nil || (err.code != BackendUnreachable && err.code != Timeout))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return contextError(ctx)
+	}
+}
+
+// try runs f against every candidate until one is reachable, each call in a
+// span of its own.
+func (e *endpoints) try(ctx context.Context, write bool, f func(ctx context.Context, addr string) *Error) *Error {
+	var err *Error
+	for _, addr := range e.candidates(write) {
+		spanCtx, end := e.startSpan(ctx, addr, write)
+		err = f(spanCtx, addr)
+		end(err)
+		if err == nil || err.code != BackendUnreachable {
+			e.markUp(addr, false)
+			return err
+		}
+		e.markDown(addr, err)
+		if write && !err.unsent {
+			return err
+		}
+	}
+
+	return err
+}
+
+// unreachableError maps a failure to reach a backend, telling whether it
+// happened while connecting and therefore the request was never sent.
+func unreachableError(err error) *Error {
+	var opErr *net.OpError
+	unsent := errors.As(err, &opErr) && opErr.Op == "dial"
+	return &Error { code: BackendUnreachable, msg: err.Error(), unsent: unsent }
+}
+
+// backoff returns the delay before retrying for the attempt-th time, which
+// doubles every attempt and is randomized between its half and itself.
+func backoff(base time.Duration, attempt int) time.Duration {
+	d := base << uint(attempt)
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2) + 1))
+}
+
+func (e *endpoints) candidates(write bool) []string {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	candidates := make([]string, 0, len(e.addrs))
+	seen := make(map[string]bool)
+	add := func(addr string) {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			candidates = append(candidates, addr)
+		}
+	}
+
+	if write && !e.down[e.leader] {
+		add(e.leader)
+	}
+	if !e.down[e.current] {
+		add(e.current)
+	}
+	for _, addr := range e.addrs {
+		if !e.down[addr] {
+			add(addr)
+		}
+	}
+	// unhealthy endpoints are tried as a last resort
+	for _, addr := range e.addrs {
+		add(addr)
+	}
+
+	return candidates
+}
+
+func (e *endpoints) probeLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.probeAll()
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+func (e *endpoints) probeAll() {
+	for _, addr := range e.addrs {
+		leader, err := e.probe(addr)
+		if err != nil {
+			e.markDown(addr, err)
+			continue
+		}
+		e.markUp(addr, true)
+
+		e.mutex.Lock()
+		if leader {
+			e.leader = addr
+		} else if e.leader == addr {
+			e.leader = ""
+		}
+		e.mutex.Unlock()
+	}
+}
+
+func (e *endpoints) markUp(addr string, probed bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.down[addr] {
+		log.Printf("backend endpoint %s is up", addr)
+		delete(e.down, addr)
+	}
+
+	// probes don't change the preferred endpoint unless it is down
+	if !probed || e.down[e.current] {
+		e.current = addr
+	}
+}
+
+func (e *endpoints) markDown(addr string, err *Error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if !e.down[addr] {
+		log.Printf("backend endpoint %s is down: %s", addr, err.String())
+		e.down[addr] = true
+	}
+}
@@ -0,0 +1,274 @@
+package kvstores
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEndpointsFailover(t *testing.T) {
+	defer func(interval time.Duration) { probeInterval = interval }(probeInterval)
+	probeInterval = 10 * time.Millisecond
+
+	// two members sharing the same keyspace, the first of them the leader
+	f := newFakeEtcd3()
+	defer f.close()
+	replica := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v3/maintenance/status" {
+			f.reply(w, &etcd3StatusResponse { Header: etcd3Header { MemberID: 2 }, Leader: 1 })
+			return
+		}
+		f.server.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer replica.Close()
+	primary, secondary := f.addr(), strings.TrimPrefix(replica.URL, "http://")
+
+	c, err := NewEtcd3Client([]string{ primary, secondary }, "", nil, nil, nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+	if err := c.Create(ctx, "/a", "a"); err != nil {
+		t.Fatal(err.String())
+	}
+	c.endpoints.mutex.RLock()
+	current, leader := c.endpoints.current, c.endpoints.leader
+	c.endpoints.mutex.RUnlock()
+	if current != primary || leader != primary {
+		t.Fatalf("expected requests to go to %s, got %s (leader %s)", primary, current, leader)
+	}
+
+	// the probe loop notices the member going away before any request does
+	f.server.CloseClientConnections()
+	f.server.Listener.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.endpoints.mutex.RLock()
+		down := c.endpoints.down[primary]
+		c.endpoints.mutex.RUnlock()
+		if down {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %s to be marked down", primary)
+		}
+		time.Sleep(probeInterval)
+	}
+
+	expectEtcd3Data(t, c, "/a", "a")
+	if err := c.Create(ctx, "/b", "b"); err != nil {
+		t.Fatal(err.String())
+	}
+	expectEtcd3Data(t, c, "/b", "b")
+
+	c.endpoints.mutex.RLock()
+	current = c.endpoints.current
+	c.endpoints.mutex.RUnlock()
+	if current != secondary {
+		t.Fatalf("expected requests to fail over to %s, got %s", secondary, current)
+	}
+	if !c.endpoints.healthy() {
+		t.Fatal("expected the backend to be healthy with one member up")
+	}
+	if state := c.endpoints.breaker.State(); state != BreakerClosed {
+		t.Fatalf("expected breaker to stay closed, got %s", state)
+	}
+}
+
+func TestEndpointsCloseStopsProbing(t *testing.T) {
+	defer func(interval time.Duration) { probeInterval = interval }(probeInterval)
+	probeInterval = time.Millisecond
+
+	var probes int64
+	e := newEndpoints("test", []string{ "a", "b" }, func(addr string) (bool, *Error) {
+		atomic.AddInt64(&probes, 1)
+		return false, nil
+	}, nil)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&probes) < 10 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected endpoints to be probed in the background")
+		}
+		time.Sleep(probeInterval)
+	}
+
+	e.close()
+	e.close()
+
+	// a probe round may be in flight when closing
+	time.Sleep(20 * probeInterval)
+	stopped := atomic.LoadInt64(&probes)
+	time.Sleep(50 * probeInterval)
+	if got := atomic.LoadInt64(&probes); got != stopped {
+		t.Fatalf("expected probing to stop once closed, got %d more probes", got - stopped)
+	}
+}
+
+func TestBreakerNotify(t *testing.T) {
+	b := newBreaker(2, time.Hour)
+	ch := make(chan BreakerState, 4)
+	b.Notify(ch)
+
+	b.record(false)
+	select {
+	case state := <-ch:
+		t.Fatalf("expected no transition before reaching the failures, got %s", state)
+	default:
+	}
+
+	b.record(false)
+	if state := <-ch; state != BreakerOpen {
+		t.Fatalf("expected the breaker to open, got %s", state)
+	}
+	if b.allow() {
+		t.Fatal("expected requests to be failed while open")
+	}
+
+	// once the cooldown elapses a request is let through and closes it
+	b.mutex.Lock()
+	b.openedAt = time.Now().Add(-2 * time.Hour)
+	b.mutex.Unlock()
+	if !b.allow() {
+		t.Fatal("expected a request to be let through after the cooldown")
+	}
+	b.record(true)
+	for _, expected := range []BreakerState{ BreakerHalfOpen, BreakerClosed } {
+		if state := <-ch; state != expected {
+			t.Fatalf("expected the breaker to be %s, got %s", expected, state)
+		}
+	}
+
+	b.Stop(ch)
+	b.record(false)
+	b.record(false)
+	select {
+	case state := <-ch:
+		t.Fatalf("expected no notification once stopped, got %s", state)
+	default:
+	}
+	if state := b.State(); state != BreakerOpen {
+		t.Fatalf("expected the breaker to open, got %s", state)
+	}
+}
+
+func TestBreakerOpensOnHungBackend(t *testing.T) {
+	// connections are accepted by the kernel but never answered
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	e := newEndpoints("test", []string{ l.Addr().String() }, func(string) (bool, *Error) { return false, nil },
+		&RetryOptions { BreakerFailures: 2, BreakerCooldown: 100 * time.Millisecond })
+	defer e.close()
+	ch := make(chan BreakerState, 4)
+	e.breaker.Notify(ch)
+
+	get := func() *Error {
+		ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+		defer cancel()
+		return e.do(ctx, false, func(ctx context.Context, addr string) *Error {
+			req, _ := http.NewRequest("GET", "http://" + addr + "/", nil)
+			resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+			if err != nil {
+				if cerr := contextError(ctx); cerr != nil {
+					return cerr
+				}
+				return &Error { code: BackendUnreachable, msg: err.Error() }
+			}
+			resp.Body.Close()
+			return nil
+		})
+	}
+	expectState := func(expected BreakerState) {
+		select {
+		case state := <-ch:
+			if state != expected {
+				t.Fatalf("expected the breaker to be %s, got %s", expected, state)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the breaker to be %s", expected)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := get(); err == nil || err.Code() != Timeout {
+			t.Fatalf("expected the request to time out, got %v", err)
+		}
+	}
+	expectState(BreakerOpen)
+	if err := get(); err == nil || err.Code() != BackendUnreachable {
+		t.Fatalf("expected the request to be failed by the breaker, got %v", err)
+	}
+
+	// a request let through after the cooldown which times out opens it again
+	time.Sleep(100 * time.Millisecond)
+	if err := get(); err == nil || err.Code() != Timeout {
+		t.Fatalf("expected the request to time out, got %v", err)
+	}
+	expectState(BreakerHalfOpen)
+	expectState(BreakerOpen)
+}
+
+func TestEndpointsWriteFailover(t *testing.T) {
+	// a real connection refused error, as returned when dialing a member down
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	_, dialErr := net.Dial("tcp", l.Addr().String())
+	if dialErr == nil {
+		t.Fatal("expected dialing a closed listener to fail")
+	}
+	_, httpErr := http.Get("http://" + l.Addr().String())
+	if httpErr == nil {
+		t.Fatal("expected requests to a closed listener to fail")
+	}
+
+	tests := []struct {
+		write    bool
+		err      *Error
+		expected []string
+	}{
+		// writes which never reached the first member are safe to send again
+		{ true, unreachableError(dialErr), []string{ "a", "b" } },
+		{ true, unreachableError(httpErr), []string{ "a", "b" } },
+		// but not the ones that may have been applied before failing
+		{ true, unreachableError(io.ErrUnexpectedEOF), []string{ "a" } },
+		{ false, unreachableError(io.ErrUnexpectedEOF), []string{ "a", "b" } },
+	}
+	for i, test := range tests {
+		e := newEndpoints("test", []string{ "a", "b" }, func(string) (bool, *Error) { return false, nil }, nil)
+		var tried []string
+		err := e.do(context.Background(), test.write, func(_ context.Context, addr string) *Error {
+			tried = append(tried, addr)
+			if addr == "a" {
+				return test.err
+			}
+			return nil
+		})
+		e.close()
+
+		if !reflect.DeepEqual(tried, test.expected) {
+			t.Fatalf("%d: expected %v to be tried, got %v", i, test.expected, tried)
+		}
+		if len(tried) == 1 && (err == nil || err.Code() != BackendUnreachable) {
+			t.Fatalf("%d: expected the write to fail, got %v", i, err)
+		}
+		if len(tried) == 2 && err != nil {
+			t.Fatalf("%d: unexpected error: %s", i, err.String())
+		}
+	}
+}
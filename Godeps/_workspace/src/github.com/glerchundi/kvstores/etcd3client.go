@@ -0,0 +1,909 @@
+package kvstores
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// number of times an optimistic transaction is retried when it conflicts
+	// with a concurrent write
+	etcd3TxnRetries = 8
+)
+
+// Etcd3Client talks to etcd through the v3 API json gateway. Nodes are stored
+// as keys named after their path, transactions are used to honour ZooKeeper
+// semantics (parent must exist, non-empty nodes can't be deleted...), leases
+// back sessions and revisions are used as created/modified indexes.
+type Etcd3Client struct {
+	addrs     []string
+	root      string
+	scheme    string
+	creds     *Credentials
+	client    *http.Client
+	endpoints *endpoints
+
+	// auth tokens by member
+	mutex     sync.Mutex
+	tokens    map[string]string
+}
+
+type etcd3Header struct {
+	MemberID uint64 `json:"member_id,string"`
+	Revision int64  `json:"revision,string"`
+}
+
+type etcd3AuthRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+type etcd3AuthResponse struct {
+	Token string `json:"token"`
+}
+
+type etcd3StatusResponse struct {
+	Header etcd3Header `json:"header"`
+	Leader uint64      `json:"leader,string"`
+}
+
+// methods sent to the leader, if known, as they would be forwarded otherwise
+var etcd3Writes = map[string]bool {
+	"kv/txn":          true,
+	"lease/grant":     true,
+	"lease/keepalive": true,
+	"lease/revoke":    true,
+}
+
+type etcd3KeyValue struct {
+	Key            []byte `json:"key"`
+	Value          []byte `json:"value"`
+	CreateRevision int64  `json:"create_revision,string"`
+	ModRevision    int64  `json:"mod_revision,string"`
+	Lease          int64  `json:"lease,string"`
+}
+
+type etcd3RangeRequest struct {
+	Key       []byte `json:"key"`
+	RangeEnd  []byte `json:"range_end,omitempty"`
+	KeysOnly  bool   `json:"keys_only,omitempty"`
+	CountOnly bool   `json:"count_only,omitempty"`
+}
+
+type etcd3RangeResponse struct {
+	Header etcd3Header      `json:"header"`
+	Kvs    []*etcd3KeyValue `json:"kvs"`
+	Count  int64            `json:"count,string"`
+}
+
+type etcd3PutRequest struct {
+	Key         []byte `json:"key"`
+	Value       []byte `json:"value"`
+	Lease       int64  `json:"lease,string,omitempty"`
+	IgnoreLease bool   `json:"ignore_lease,omitempty"`
+}
+
+type etcd3DeleteRangeRequest struct {
+	Key []byte `json:"key"`
+}
+
+type etcd3Compare struct {
+	Result      string `json:"result"`
+	Target      string `json:"target"`
+	Key         []byte `json:"key"`
+	RangeEnd    []byte `json:"range_end,omitempty"`
+	ModRevision int64  `json:"mod_revision,string"`
+}
+
+type etcd3RequestOp struct {
+	RequestRange       *etcd3RangeRequest       `json:"request_range,omitempty"`
+	RequestPut         *etcd3PutRequest         `json:"request_put,omitempty"`
+	RequestDeleteRange *etcd3DeleteRangeRequest `json:"request_delete_range,omitempty"`
+}
+
+type etcd3ResponseOp struct {
+	ResponseRange *etcd3RangeResponse `json:"response_range"`
+}
+
+type etcd3TxnRequest struct {
+	Compare []*etcd3Compare   `json:"compare,omitempty"`
+	Success []*etcd3RequestOp `json:"success,omitempty"`
+	Failure []*etcd3RequestOp `json:"failure,omitempty"`
+}
+
+type etcd3TxnResponse struct {
+	Header    etcd3Header        `json:"header"`
+	Succeeded bool               `json:"succeeded"`
+	Responses []*etcd3ResponseOp `json:"responses"`
+}
+
+type etcd3LeaseRequest struct {
+	ID  int64 `json:"ID,string,omitempty"`
+	TTL int64 `json:"TTL,string,omitempty"`
+}
+
+type etcd3LeaseResponse struct {
+	ID  int64 `json:"ID,string"`
+	TTL int64 `json:"TTL,string"`
+}
+
+type etcd3WatchCreateRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+}
+
+type etcd3WatchRequest struct {
+	CreateRequest *etcd3WatchCreateRequest `json:"create_request"`
+}
+
+type etcd3Event struct {
+	Type string         `json:"type"`
+	Kv   *etcd3KeyValue `json:"kv"`
+}
+
+type etcd3WatchResponse struct {
+	Header   etcd3Header   `json:"header"`
+	Created  bool          `json:"created"`
+	Canceled bool          `json:"canceled"`
+	Events   []*etcd3Event `json:"events"`
+}
+
+type etcd3StreamMessage struct {
+	Result json.RawMessage `json:"result"`
+	Error  *etcd3Status    `json:"error"`
+}
+
+type etcd3Status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// etcd3Key keeps track of a key while an optimistic transaction is evaluated.
+type etcd3Key struct {
+	// state read from etcd
+	kv *etcd3KeyValue
+	// state after applying the operations evaluated so far
+	exists  bool
+	touched bool
+	node    *Node
+	lease   int64
+}
+
+func NewEtcd3Client(addrs []string, root string, creds *Credentials, tlsConfig *tls.Config, retry *RetryOptions, dialTimeout time.Duration) (*Etcd3Client, error) {
+	c := &Etcd3Client {
+		addrs:  addrs,
+		root:   root,
+		scheme: "http",
+		creds:  creds,
+		tokens: make(map[string]string),
+		client: &http.Client {
+			Transport: newTransport(tlsConfig, dialTimeout),
+		},
+	}
+	if tlsConfig != nil {
+		c.scheme = "https"
+	}
+
+	c.endpoints = newEndpoints("etcd3", addrs, c.probe, retry)
+	if !c.endpoints.healthy() {
+		c.endpoints.close()
+		return nil, errors.New("cannot connect to etcd cluster: " + strings.Join(addrs, ","))
+	}
+
+	return c, nil
+}
+
+// Close stops probing the cluster members and closes idle connections.
+func (c *Etcd3Client) Close() error {
+	c.endpoints.close()
+	c.client.Transport.(*http.Transport).CloseIdleConnections()
+	return nil
+}
+
+func (c *Etcd3Client) Create(ctx context.Context, path string, data string) *Error {
+	_, _, err := c.Multi(ctx, []*Op{ { Type: OpCreate, Path: path, Data: data } })
+	return err
+}
+
+func (c *Etcd3Client) Delete(ctx context.Context, path string, version int32) *Error {
+	_, _, err := c.Multi(ctx, []*Op{ { Type: OpDelete, Path: path, Version: version } })
+	return err
+}
+
+func (c *Etcd3Client) Exists(ctx context.Context, path string) *Error {
+	_, err := c.GetData(ctx, path)
+	return err
+}
+
+func (c *Etcd3Client) GetData(ctx context.Context, path string) (*Node, *Error) {
+	resp := &etcd3RangeResponse {}
+	if err := c.call(ctx, "kv/range", &etcd3RangeRequest { Key: c.key(path) }, resp); err != nil {
+		return nil, err
+	}
+
+	if len(resp.Kvs) == 0 {
+		// root always exists
+		if path == "/" {
+			return &Node { Path: path }, nil
+		}
+		return nil, &Error { code: KeyNotFound }
+	}
+
+	return c.mapKeyValue(resp.Kvs[0]), nil
+}
+
+func (c *Etcd3Client) SetData(ctx context.Context, path string, data string, version int32) *Error {
+	_, _, err := c.Multi(ctx, []*Op{ { Type: OpSetData, Path: path, Data: data, Version: version } })
+	return err
+}
+
+func (c *Etcd3Client) GetChildren(ctx context.Context, path string) ([]string, *Error) {
+	prefix, rangeEnd := etcd3ChildrenRange(c.root + path)
+	req := &etcd3TxnRequest {
+		Success: []*etcd3RequestOp {
+			{ RequestRange: &etcd3RangeRequest { Key: c.key(path), CountOnly: true } },
+			{ RequestRange: &etcd3RangeRequest { Key: prefix, RangeEnd: rangeEnd, KeysOnly: true } },
+		},
+	}
+
+	resp := &etcd3TxnResponse {}
+	if err := c.call(ctx, "kv/txn", req, resp); err != nil {
+		return nil, err
+	}
+
+	if len(resp.Responses) != 2 {
+		return nil, &Error { code: Unknown, msg: "unexpected txn response" }
+	}
+
+	if path != "/" && resp.Responses[0].ResponseRange.Count == 0 {
+		return nil, &Error { code: KeyNotFound }
+	}
+
+	children := make([]string, 0)
+	for _, kv := range resp.Responses[1].ResponseRange.Kvs {
+		if name, ok := etcd3ChildName(prefix, kv.Key); ok {
+			children = append(children, name)
+		}
+	}
+
+	return children, nil
+}
+
+// Sync performs a linearizable read of path, which observes every write
+// committed before, and returns the revision.
+func (c *Etcd3Client) Sync(ctx context.Context, path string) (uint64, *Error) {
+	resp := &etcd3RangeResponse {}
+	if err := c.call(ctx, "kv/range", &etcd3RangeRequest { Key: c.key(path), CountOnly: true }, resp); err != nil {
+		return 0, err
+	}
+
+	return uint64(resp.Header.Revision), nil
+}
+
+// Synced returns the client itself, as ranges are linearizable already.
+func (c *Etcd3Client) Synced(index uint64) Client {
+	return c
+}
+
+// Multi evaluates the operations against a consistent snapshot of every key
+// involved and commits the result only if none of them changed meanwhile,
+// retrying otherwise.
+func (c *Etcd3Client) Multi(ctx context.Context, ops []*Op) ([]*Node, int, *Error) {
+	for attempt := 0; attempt < etcd3TxnRetries; attempt++ {
+		nodes, failed, err, conflict := c.tryMulti(ctx, ops)
+		if !conflict {
+			return nodes, failed, err
+		}
+	}
+
+	return nil, -1, &Error { code: Unknown, msg: "transaction aborted due to contention" }
+}
+
+func (c *Etcd3Client) NewSession(ctx context.Context, ttl time.Duration) (int64, *Error) {
+	req := &etcd3LeaseRequest { TTL: int64(math.Max(1, math.Ceil(ttl.Seconds()))) }
+	resp := &etcd3LeaseResponse {}
+	if err := c.call(ctx, "lease/grant", req, resp); err != nil {
+		return 0, err
+	}
+
+	return resp.ID, nil
+}
+
+func (c *Etcd3Client) KeepAlive(ctx context.Context, session int64) *Error {
+	resp := &etcd3LeaseResponse {}
+	if err := c.stream(ctx, "lease/keepalive", &etcd3LeaseRequest { ID: session }, resp); err != nil {
+		return err
+	}
+
+	// an expired lease is reported with a non-positive ttl
+	if resp.TTL <= 0 {
+		return &Error { code: KeyNotFound }
+	}
+
+	return nil
+}
+
+func (c *Etcd3Client) CloseSession(ctx context.Context, session int64) *Error {
+	return c.call(ctx, "lease/revoke", &etcd3LeaseRequest { ID: session }, nil)
+}
+
+func (c *Etcd3Client) CreateEphemeral(ctx context.Context, path string, data string, session int64) *Error {
+	_, _, err := c.Multi(ctx, []*Op{ { Type: OpCreate, Path: path, Data: data, Session: session } })
+	return err
+}
+
+func (c *Etcd3Client) Watch(ctx context.Context, path string, children bool, stop <-chan struct{}) (<-chan *Event, *Error) {
+	prefix, rangeEnd := etcd3ChildrenRange(c.root + path)
+	create := &etcd3WatchCreateRequest { Key: c.key(path) }
+	if children {
+		// [path, prefixEnd(path + "/")) covers the node and its descendants
+		// (but also some siblings, filtered below)
+		create.RangeEnd = rangeEnd
+		if path == "/" {
+			create.Key = prefix
+		}
+	}
+
+	body, err := json.Marshal(&etcd3WatchRequest { CreateRequest: create })
+	if err != nil {
+		return nil, &Error { code: Unknown, msg: err.Error() }
+	}
+
+	// the stream lives until stopped, only establishing it is bound to ctx
+	streamCtx, cancel := context.WithCancel(context.Background())
+	var resp *http.Response
+	perr := c.endpoints.do(ctx, false, func(_ context.Context, addr string) (err *Error) {
+		resp, err = c.postTo(streamCtx, addr, "watch", body)
+		return
+	})
+	if perr != nil {
+		cancel()
+		return nil, perr
+	}
+
+	// wait until the watch is created
+	decoder := json.NewDecoder(resp.Body)
+	created := make(chan *Error, 1)
+	go func() {
+		wresp := &etcd3WatchResponse {}
+		err := decodeEtcd3Stream(decoder, wresp)
+		if err == nil && !wresp.Created {
+			err = &Error { code: Unknown, msg: "watch wasn't created" }
+		}
+		created <- err
+	}()
+
+	var werr *Error
+	select {
+	case werr = <-created:
+	case <-ctx.Done():
+		werr = contextError(ctx)
+	}
+	if werr != nil {
+		cancel()
+		resp.Body.Close()
+		return nil, werr
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-stop:
+		case <-done:
+		}
+		cancel()
+		resp.Body.Close()
+	}()
+
+	events := make(chan *Event)
+	go func() {
+		defer close(events)
+		defer close(done)
+		for {
+			wresp := &etcd3WatchResponse {}
+			if err := decodeEtcd3Stream(decoder, wresp); err != nil || wresp.Canceled {
+				return
+			}
+
+			for _, e := range wresp.Events {
+				event := mapEtcd3Event(path, c.root + path, prefix, children, e)
+				if event == nil {
+					continue
+				}
+
+				select {
+				case events <- event:
+				case <-stop:
+					return
+				}
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+//
+// PRIVATE
+//
+
+// tryMulti returns conflict=true if any key involved was modified between the
+// snapshot read and the commit.
+func (c *Etcd3Client) tryMulti(ctx context.Context, ops []*Op) (nodes []*Node, failed int, err *Error, conflict bool) {
+	// gather every key (and children range) the operations depend on
+	var paths, parents []string
+	seenPaths, seenParents := make(map[string]bool), make(map[string]bool)
+	addPath := func(path string) {
+		if !seenPaths[path] {
+			seenPaths[path] = true
+			paths = append(paths, path)
+		}
+	}
+	for _, op := range ops {
+		addPath(op.Path)
+		switch op.Type {
+		case OpCreate:
+			if parentPath, _ := splitPath(op.Path); parentPath != "/" {
+				addPath(parentPath)
+			}
+		case OpDelete:
+			if !seenParents[op.Path] {
+				seenParents[op.Path] = true
+				parents = append(parents, op.Path)
+			}
+		}
+	}
+
+	// read a consistent snapshot
+	read := &etcd3TxnRequest {}
+	for _, path := range paths {
+		read.Success = append(read.Success, &etcd3RequestOp {
+			RequestRange: &etcd3RangeRequest { Key: c.key(path) },
+		})
+	}
+	for _, path := range parents {
+		prefix, rangeEnd := etcd3ChildrenRange(c.root + path)
+		read.Success = append(read.Success, &etcd3RequestOp {
+			RequestRange: &etcd3RangeRequest { Key: prefix, RangeEnd: rangeEnd, CountOnly: true },
+		})
+	}
+
+	snapshot := &etcd3TxnResponse {}
+	if err := c.call(ctx, "kv/txn", read, snapshot); err != nil {
+		return nil, -1, err, false
+	}
+	if len(snapshot.Responses) != len(read.Success) {
+		return nil, -1, &Error { code: Unknown, msg: "unexpected txn response" }, false
+	}
+
+	keys := make(map[string]*etcd3Key)
+	for i, path := range paths {
+		k := &etcd3Key {}
+		if kvs := snapshot.Responses[i].ResponseRange.Kvs; len(kvs) > 0 {
+			k.kv, k.exists, k.lease = kvs[0], true, kvs[0].Lease
+			k.node = c.mapKeyValue(kvs[0])
+		}
+		keys[path] = k
+	}
+	// number of descendants of the nodes being deleted, which change along
+	// with every node created or deleted under them
+	numChildren := make(map[string]int64)
+	for i, path := range parents {
+		numChildren[path] = snapshot.Responses[len(paths)+i].ResponseRange.Count
+	}
+	adjustAncestors := func(path string, delta int64) {
+		for path != "/" {
+			path, _ = splitPath(path)
+			if _, found := numChildren[path]; found {
+				numChildren[path] += delta
+			}
+		}
+	}
+
+	// evaluate operations in order
+	nodes = make([]*Node, len(ops))
+	for i, op := range ops {
+		k := keys[op.Path]
+		parentPath, _ := splitPath(op.Path)
+		switch op.Type {
+		case OpCreate:
+			if k.exists || op.Path == "/" {
+				return nil, i, &Error { code: KeyExists }, false
+			}
+			if parent, found := keys[parentPath]; found && !parent.exists {
+				return nil, i, &Error { code: KeyNotFound }, false
+			}
+			k.exists, k.touched, k.lease = true, true, op.Session
+			k.node = &Node { Path: op.Path, Value: op.Data, EphemeralOwner: op.Session }
+			adjustAncestors(op.Path, 1)
+		case OpDelete, OpSetData, OpCheck:
+			if op.Path == "/" && op.Type == OpDelete {
+				return nil, i, &Error { code: Unknown, msg: "root node cannot be deleted" }, false
+			}
+			if !k.exists {
+				return nil, i, &Error { code: KeyNotFound }, false
+			}
+			// the revision of a node modified by this transaction is unknown
+			// until it is committed
+			if op.Version != -1 && (k.touched || uint64(op.Version) != k.node.ModifiedIndex) {
+				return nil, i, &Error { code: BadVersion }, false
+			}
+			switch op.Type {
+			case OpDelete:
+				if numChildren[op.Path] > 0 {
+					return nil, i, &Error { code: NotEmpty }, false
+				}
+				k.exists, k.touched = false, true
+				k.node = &Node { Path: op.Path }
+				adjustAncestors(op.Path, -1)
+			case OpSetData:
+				node := *k.node
+				node.Value, node.ModifiedIndex = op.Data, 0
+				k.touched, k.node = true, &node
+			}
+		default:
+			return nil, i, &Error { code: Unimplemented }, false
+		}
+		nodes[i] = k.node
+	}
+
+	// build the commit guarded by the snapshot
+	commit := &etcd3TxnRequest {}
+	for _, path := range paths {
+		var modRevision int64 = 0
+		if kv := keys[path].kv; kv != nil {
+			modRevision = kv.ModRevision
+		}
+		commit.Compare = append(commit.Compare, &etcd3Compare {
+			Result: "EQUAL", Target: "MOD", Key: c.key(path), ModRevision: modRevision,
+		})
+	}
+	for _, path := range parents {
+		prefix, rangeEnd := etcd3ChildrenRange(c.root + path)
+		commit.Compare = append(commit.Compare, &etcd3Compare {
+			Result: "LESS", Target: "MOD", Key: prefix, RangeEnd: rangeEnd,
+			ModRevision: snapshot.Header.Revision + 1,
+		})
+	}
+	for _, path := range paths {
+		k := keys[path]
+		switch {
+		case !k.touched:
+		case k.exists:
+			put := &etcd3PutRequest { Key: c.key(path), Value: []byte(k.node.Value) }
+			if k.kv != nil && k.lease == k.kv.Lease {
+				put.IgnoreLease = k.lease != 0
+			} else {
+				put.Lease = k.lease
+			}
+			commit.Success = append(commit.Success, &etcd3RequestOp { RequestPut: put })
+		case k.kv != nil:
+			commit.Success = append(commit.Success, &etcd3RequestOp {
+				RequestDeleteRange: &etcd3DeleteRangeRequest { Key: c.key(path) },
+			})
+		}
+	}
+
+	// read only transaction
+	if len(commit.Success) == 0 {
+		return nodes, -1, nil, false
+	}
+
+	resp := &etcd3TxnResponse {}
+	if err := c.call(ctx, "kv/txn", commit, resp); err != nil {
+		return nil, -1, err, false
+	}
+	if !resp.Succeeded {
+		return nil, -1, nil, true
+	}
+
+	// nodes modified by this transaction get its revision
+	revision := uint64(resp.Header.Revision)
+	for _, node := range nodes {
+		if node.CreatedIndex == 0 {
+			node.CreatedIndex = revision
+		}
+		if node.ModifiedIndex == 0 {
+			node.ModifiedIndex = revision
+		}
+	}
+
+	return nodes, -1, nil, false
+}
+
+func (c *Etcd3Client) Breaker() *Breaker {
+	return c.endpoints.breaker
+}
+
+// Reload re-reads the password from its file, if any, and discards the auth
+// tokens obtained with the previous one.
+func (c *Etcd3Client) Reload() error {
+	if c.creds == nil {
+		return nil
+	}
+
+	if err := c.creds.Reload(); err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	c.tokens = make(map[string]string)
+	c.mutex.Unlock()
+
+	return nil
+}
+
+// probe returns whether the member at addr is the leader of the cluster.
+func (c *Etcd3Client) probe(addr string) (bool, *Error) {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+
+	resp, err := c.send(ctx, addr, "maintenance/status", []byte("{}"), "")
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	status := &etcd3StatusResponse {}
+	if err := json.NewDecoder(resp.Body).Decode(status); err != nil {
+		return false, &Error { code: BackendUnreachable, msg: err.Error() }
+	}
+
+	return status.Leader != 0 && status.Leader == status.Header.MemberID, nil
+}
+
+// post sends req to method and lets read consume the response, which is done
+// before returning as the request may be abandoned once ctx is done.
+func (c *Etcd3Client) post(ctx context.Context, method string, req interface{}, read func(*http.Response) *Error) *Error {
+	body, merr := json.Marshal(req)
+	if merr != nil {
+		return &Error { code: Unknown, msg: merr.Error() }
+	}
+
+	return c.endpoints.do(ctx, etcd3Writes[method], func(ctx context.Context, addr string) *Error {
+		resp, err := c.postTo(ctx, addr, method, body)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if err := read(resp); err != nil {
+			if cerr := contextError(ctx); cerr != nil {
+				return cerr
+			}
+			return err
+		}
+		return nil
+	})
+}
+
+// postTo posts to the member at addr, authenticating first if required. Auth
+// tokens are cached by member, since simple tokens are only valid in the one
+// which issued them, and refreshed once if rejected.
+func (c *Etcd3Client) postTo(ctx context.Context, addr string, method string, body []byte) (*http.Response, *Error) {
+	if c.creds == nil {
+		return c.send(ctx, addr, method, body, "")
+	}
+
+	for refresh := false; ; refresh = true {
+		token, err := c.token(ctx, addr, refresh)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := c.send(ctx, addr, method, body, token)
+		if err == nil || err.code != AccessDenied || refresh {
+			return resp, err
+		}
+	}
+}
+
+func (c *Etcd3Client) token(ctx context.Context, addr string, refresh bool) (string, *Error) {
+	c.mutex.Lock()
+	token, found := c.tokens[addr]
+	c.mutex.Unlock()
+	if found && !refresh {
+		return token, nil
+	}
+
+	password, _ := c.creds.secrets()
+	body, merr := json.Marshal(&etcd3AuthRequest { Name: c.creds.username, Password: password })
+	if merr != nil {
+		return "", &Error { code: Unknown, msg: merr.Error() }
+	}
+
+	resp, err := c.send(ctx, addr, "auth/authenticate", body, "")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	auth := &etcd3AuthResponse {}
+	if err := json.NewDecoder(resp.Body).Decode(auth); err != nil {
+		return "", &Error { code: Unknown, msg: err.Error() }
+	}
+
+	c.mutex.Lock()
+	c.tokens[addr] = auth.Token
+	c.mutex.Unlock()
+
+	return auth.Token, nil
+}
+
+func (c *Etcd3Client) send(ctx context.Context, addr string, method string, body []byte, token string) (*http.Response, *Error) {
+	req, err := http.NewRequest("POST", c.scheme+"://"+addr+"/v3/"+method, bytes.NewReader(body))
+	if err != nil {
+		return nil, &Error { code: Unknown, msg: err.Error() }
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	injectTrace(ctx, req.Header)
+
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		if cerr := contextError(ctx); cerr != nil {
+			return nil, cerr
+		}
+		return nil, unreachableError(err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, etcd3Error(resp)
+	}
+
+	return resp, nil
+}
+
+func (c *Etcd3Client) call(ctx context.Context, method string, req interface{}, v interface{}) *Error {
+	return c.post(ctx, method, req, func(resp *http.Response) *Error {
+		if v == nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			return nil
+		}
+
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			return &Error { code: Unknown, msg: err.Error() }
+		}
+
+		return nil
+	})
+}
+
+// stream sends a single message to a streaming method and waits for the first
+// reply.
+func (c *Etcd3Client) stream(ctx context.Context, method string, req interface{}, v interface{}) *Error {
+	return c.post(ctx, method, req, func(resp *http.Response) *Error {
+		return decodeEtcd3Stream(json.NewDecoder(resp.Body), v)
+	})
+}
+
+func decodeEtcd3Stream(decoder *json.Decoder, v interface{}) *Error {
+	msg := &etcd3StreamMessage {}
+	if err := decoder.Decode(msg); err != nil {
+		return &Error { code: BackendUnreachable, msg: err.Error() }
+	}
+
+	if msg.Error != nil {
+		return mapEtcd3Status(msg.Error)
+	}
+
+	if err := json.Unmarshal(msg.Result, v); err != nil {
+		return &Error { code: Unknown, msg: err.Error() }
+	}
+
+	return nil
+}
+
+func etcd3Error(resp *http.Response) *Error {
+	status := &etcd3Status {}
+	if err := json.NewDecoder(resp.Body).Decode(status); err != nil {
+		return &Error { code: Unknown, msg: resp.Status }
+	}
+
+	return mapEtcd3Status(status)
+}
+
+func mapEtcd3Status(status *etcd3Status) *Error {
+	// grpc status codes
+	switch status.Code {
+	case 5: // NotFound
+		return &Error { code: KeyNotFound, msg: status.Message }
+	case 7, 16: // PermissionDenied, Unauthenticated
+		return &Error { code: AccessDenied, msg: status.Message }
+	case 14: // Unavailable
+		return &Error { code: BackendUnreachable, msg: status.Message }
+	}
+
+	return &Error { code: Unknown, msg: status.Message }
+}
+
+// key returns the etcd key of the node at path.
+func (c *Etcd3Client) key(path string) []byte {
+	return []byte(c.root + path)
+}
+
+func (c *Etcd3Client) mapKeyValue(kv *etcd3KeyValue) *Node {
+	node := mapEtcd3KeyValue(kv)
+	node.Path = stripRoot(c.root, node.Path)
+	return node
+}
+
+// etcd3ChildrenRange returns the range holding every descendant of key.
+func etcd3ChildrenRange(key string) ([]byte, []byte) {
+	prefix := key
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	rangeEnd := []byte(prefix)
+	rangeEnd[len(rangeEnd)-1]++
+	return []byte(prefix), rangeEnd
+}
+
+func etcd3ChildName(prefix []byte, key []byte) (string, bool) {
+	if !bytes.HasPrefix(key, prefix) {
+		return "", false
+	}
+
+	name := string(key[len(prefix):])
+	if name == "" || strings.Contains(name, "/") {
+		return "", false
+	}
+
+	return name, true
+}
+
+func mapEtcd3Event(path string, key string, prefix []byte, children bool, e *etcd3Event) *Event {
+	if e.Kv == nil {
+		return nil
+	}
+
+	event := &Event { Path: path, Index: uint64(e.Kv.ModRevision) }
+	switch {
+	case string(e.Kv.Key) == key:
+		switch {
+		case e.Type == "DELETE":
+			event.Type = EventDeleted
+		case e.Kv.CreateRevision == e.Kv.ModRevision:
+			event.Type = EventCreated
+		default:
+			event.Type = EventDataChanged
+		}
+	case children:
+		// only creation and deletion of direct children are relevant
+		if _, ok := etcd3ChildName(prefix, e.Kv.Key); !ok {
+			return nil
+		}
+		if e.Type != "DELETE" && e.Kv.CreateRevision != e.Kv.ModRevision {
+			return nil
+		}
+		event.Type = EventChildrenChanged
+	default:
+		return nil
+	}
+
+	return event
+}
+
+func mapEtcd3KeyValue(kv *etcd3KeyValue) *Node {
+	return &Node {
+		Path:           string(kv.Key),
+		Value:          string(kv.Value),
+		CreatedIndex:   uint64(kv.CreateRevision),
+		ModifiedIndex:  uint64(kv.ModRevision),
+		EphemeralOwner: kv.Lease,
+	}
+}
@@ -0,0 +1,940 @@
+package kvstores
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEtcd3 is an in-process stand-in for the etcd v3 json gateway, holding a
+// single revisioned keyspace with leases and watches. It implements the
+// subset of the API used by Etcd3Client with the same semantics as etcd.
+type fakeEtcd3 struct {
+	server *httptest.Server
+
+	mutex     sync.Mutex
+	revision  int64
+	kvs       map[string]*etcd3KeyValue
+	leases    map[int64]int64
+	nextLease int64
+	watchers  map[*fakeEtcd3Watcher]bool
+	// called before evaluating every guarded txn, used to inject conflicts
+	beforeTxn func(f *fakeEtcd3)
+}
+
+type fakeEtcd3Watcher struct {
+	key      []byte
+	rangeEnd []byte
+	events   chan []*etcd3Event
+}
+
+func newFakeEtcd3() *fakeEtcd3 {
+	f := &fakeEtcd3 {
+		kvs:       make(map[string]*etcd3KeyValue),
+		leases:    make(map[int64]int64),
+		nextLease: 0x1000,
+		watchers:  make(map[*fakeEtcd3Watcher]bool),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v3/maintenance/status", f.status)
+	mux.HandleFunc("/v3/kv/range", f.rangeHandler)
+	mux.HandleFunc("/v3/kv/txn", f.txnHandler)
+	mux.HandleFunc("/v3/lease/grant", f.grant)
+	mux.HandleFunc("/v3/lease/keepalive", f.keepAlive)
+	mux.HandleFunc("/v3/lease/revoke", f.revoke)
+	mux.HandleFunc("/v3/watch", f.watch)
+	f.server = httptest.NewServer(mux)
+
+	return f
+}
+
+func (f *fakeEtcd3) addr() string {
+	return strings.TrimPrefix(f.server.URL, "http://")
+}
+
+func (f *fakeEtcd3) close() {
+	f.server.CloseClientConnections()
+	f.server.Close()
+}
+
+func (f *fakeEtcd3) header() etcd3Header {
+	return etcd3Header { MemberID: 1, Revision: f.revision }
+}
+
+func (f *fakeEtcd3) reply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (f *fakeEtcd3) fail(w http.ResponseWriter, status int, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&etcd3Status { Code: code, Message: msg })
+}
+
+func (f *fakeEtcd3) stream(w http.ResponseWriter, v interface{}) {
+	result, _ := json.Marshal(v)
+	json.NewEncoder(w).Encode(&etcd3StreamMessage { Result: result })
+	w.(http.Flusher).Flush()
+}
+
+func (f *fakeEtcd3) status(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.reply(w, &etcd3StatusResponse { Header: f.header(), Leader: 1 })
+}
+
+func (f *fakeEtcd3) rangeHandler(w http.ResponseWriter, r *http.Request) {
+	req := &etcd3RangeRequest {}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		f.fail(w, http.StatusBadRequest, 3, err.Error())
+		return
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.reply(w, f.rangeKeys(req))
+}
+
+func (f *fakeEtcd3) txnHandler(w http.ResponseWriter, r *http.Request) {
+	req := &etcd3TxnRequest {}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		f.fail(w, http.StatusBadRequest, 3, err.Error())
+		return
+	}
+
+	f.mutex.Lock()
+	if len(req.Compare) > 0 && f.beforeTxn != nil {
+		f.beforeTxn(f)
+	}
+
+	succeeded := true
+	for _, cmp := range req.Compare {
+		if !f.compare(cmp) {
+			succeeded = false
+			break
+		}
+	}
+	ops := req.Success
+	if !succeeded {
+		ops = req.Failure
+	}
+
+	// puts must refer to live leases, checked before applying anything
+	for _, op := range ops {
+		if put := op.RequestPut; put != nil && put.Lease != 0 && f.leases[put.Lease] == 0 {
+			f.mutex.Unlock()
+			f.fail(w, http.StatusNotFound, 5, "etcdserver: requested lease not found")
+			return
+		}
+	}
+
+	var events []*etcd3Event
+	resp := &etcd3TxnResponse { Succeeded: succeeded }
+	revision := f.revision + 1
+	for _, op := range ops {
+		switch {
+		case op.RequestRange != nil:
+			resp.Responses = append(resp.Responses, &etcd3ResponseOp { ResponseRange: f.rangeKeys(op.RequestRange) })
+		case op.RequestPut != nil:
+			events = append(events, f.put(op.RequestPut, revision))
+			resp.Responses = append(resp.Responses, &etcd3ResponseOp {})
+		case op.RequestDeleteRange != nil:
+			if e := f.delete(string(op.RequestDeleteRange.Key), revision); e != nil {
+				events = append(events, e)
+			}
+			resp.Responses = append(resp.Responses, &etcd3ResponseOp {})
+		}
+	}
+	f.commit(revision, events)
+	resp.Header = f.header()
+	f.mutex.Unlock()
+
+	f.reply(w, resp)
+}
+
+func (f *fakeEtcd3) grant(w http.ResponseWriter, r *http.Request) {
+	req := &etcd3LeaseRequest {}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		f.fail(w, http.StatusBadRequest, 3, err.Error())
+		return
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.nextLease++
+	f.leases[f.nextLease] = req.TTL
+	f.reply(w, &etcd3LeaseResponse { ID: f.nextLease, TTL: req.TTL })
+}
+
+func (f *fakeEtcd3) keepAlive(w http.ResponseWriter, r *http.Request) {
+	req := &etcd3LeaseRequest {}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		f.fail(w, http.StatusBadRequest, 3, err.Error())
+		return
+	}
+
+	f.mutex.Lock()
+	ttl := f.leases[req.ID]
+	f.mutex.Unlock()
+	f.stream(w, &etcd3LeaseResponse { ID: req.ID, TTL: ttl })
+}
+
+func (f *fakeEtcd3) revoke(w http.ResponseWriter, r *http.Request) {
+	req := &etcd3LeaseRequest {}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		f.fail(w, http.StatusBadRequest, 3, err.Error())
+		return
+	}
+
+	if !f.expire(req.ID) {
+		f.fail(w, http.StatusNotFound, 5, "etcdserver: requested lease not found")
+		return
+	}
+	f.reply(w, struct{}{})
+}
+
+// expire drops the lease id along with the keys attached to it, as etcd does
+// once a lease is neither kept alive nor revoked within its ttl.
+func (f *fakeEtcd3) expire(id int64) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if _, found := f.leases[id]; !found {
+		return false
+	}
+	delete(f.leases, id)
+
+	var events []*etcd3Event
+	revision := f.revision + 1
+	for _, key := range f.sortedKeys() {
+		if f.kvs[key].Lease == id {
+			events = append(events, f.delete(key, revision))
+		}
+	}
+	f.commit(revision, events)
+	return true
+}
+
+func (f *fakeEtcd3) watch(w http.ResponseWriter, r *http.Request) {
+	req := &etcd3WatchRequest {}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil || req.CreateRequest == nil {
+		f.fail(w, http.StatusBadRequest, 3, "invalid watch request")
+		return
+	}
+
+	watcher := &fakeEtcd3Watcher {
+		key:      req.CreateRequest.Key,
+		rangeEnd: req.CreateRequest.RangeEnd,
+		events:   make(chan []*etcd3Event, 64),
+	}
+	f.mutex.Lock()
+	f.watchers[watcher] = true
+	header := f.header()
+	f.mutex.Unlock()
+	defer func() {
+		f.mutex.Lock()
+		delete(f.watchers, watcher)
+		f.mutex.Unlock()
+	}()
+
+	f.stream(w, &etcd3WatchResponse { Header: header, Created: true })
+	for {
+		select {
+		case events := <-watcher.events:
+			f.stream(w, &etcd3WatchResponse { Header: header, Events: events })
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (f *fakeEtcd3) sortedKeys() []string {
+	keys := make([]string, 0, len(f.kvs))
+	for key := range f.kvs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func inEtcd3Range(key []byte, rangeEnd []byte, k []byte) bool {
+	if len(rangeEnd) == 0 {
+		return bytes.Equal(key, k)
+	}
+	return bytes.Compare(k, key) >= 0 && bytes.Compare(k, rangeEnd) < 0
+}
+
+func (f *fakeEtcd3) rangeKeys(req *etcd3RangeRequest) *etcd3RangeResponse {
+	resp := &etcd3RangeResponse { Header: f.header() }
+	for _, key := range f.sortedKeys() {
+		if !inEtcd3Range(req.Key, req.RangeEnd, []byte(key)) {
+			continue
+		}
+		resp.Count++
+		if req.CountOnly {
+			continue
+		}
+		kv := *f.kvs[key]
+		if req.KeysOnly {
+			kv.Value = nil
+		}
+		resp.Kvs = append(resp.Kvs, &kv)
+	}
+	return resp
+}
+
+// compare evaluates cmp against every key in its range, or against an empty
+// key if there is none, like etcd does.
+func (f *fakeEtcd3) compare(cmp *etcd3Compare) bool {
+	var revisions []int64
+	for _, key := range f.sortedKeys() {
+		if inEtcd3Range(cmp.Key, cmp.RangeEnd, []byte(key)) {
+			revisions = append(revisions, f.kvs[key].ModRevision)
+		}
+	}
+	if len(revisions) == 0 {
+		revisions = []int64{ 0 }
+	}
+
+	for _, revision := range revisions {
+		switch cmp.Result {
+		case "EQUAL":
+			if revision != cmp.ModRevision {
+				return false
+			}
+		case "LESS":
+			if revision >= cmp.ModRevision {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func (f *fakeEtcd3) put(req *etcd3PutRequest, revision int64) *etcd3Event {
+	key := string(req.Key)
+	kv := &etcd3KeyValue { Key: req.Key, Value: req.Value, CreateRevision: revision, ModRevision: revision, Lease: req.Lease }
+	if prev, found := f.kvs[key]; found {
+		kv.CreateRevision = prev.CreateRevision
+		if req.IgnoreLease {
+			kv.Lease = prev.Lease
+		}
+	}
+	f.kvs[key] = kv
+
+	copied := *kv
+	return &etcd3Event { Kv: &copied }
+}
+
+func (f *fakeEtcd3) delete(key string, revision int64) *etcd3Event {
+	if _, found := f.kvs[key]; !found {
+		return nil
+	}
+	delete(f.kvs, key)
+	return &etcd3Event { Type: "DELETE", Kv: &etcd3KeyValue { Key: []byte(key), ModRevision: revision } }
+}
+
+// commit bumps the revision if anything changed and sends the events to the
+// watchers whose range they fall in.
+func (f *fakeEtcd3) commit(revision int64, events []*etcd3Event) {
+	if len(events) == 0 {
+		return
+	}
+	f.revision = revision
+
+	for watcher := range f.watchers {
+		var matching []*etcd3Event
+		for _, e := range events {
+			if inEtcd3Range(watcher.key, watcher.rangeEnd, e.Kv.Key) {
+				matching = append(matching, e)
+			}
+		}
+		if len(matching) > 0 {
+			watcher.events <- matching
+		}
+	}
+}
+
+func newTestEtcd3Client(t *testing.T) (*Etcd3Client, *fakeEtcd3) {
+	f := newFakeEtcd3()
+	c, err := NewEtcd3Client([]string{ f.addr() }, "", nil, nil, nil, time.Second)
+	if err != nil {
+		f.close()
+		t.Fatal(err)
+	}
+	return c, f
+}
+
+func expectEtcd3Data(t *testing.T, c *Etcd3Client, path string, value string) *Node {
+	n, err := c.GetData(context.Background(), path)
+	if err != nil {
+		t.Fatalf("%s: unexpected error: %s", path, err.String())
+	}
+	if n.Value != value {
+		t.Fatalf("%s: expected %q, got %q", path, value, n.Value)
+	}
+	return n
+}
+
+func expectEtcd3NoNode(t *testing.T, c *Etcd3Client, path string) {
+	if err := c.Exists(context.Background(), path); err == nil || err.Code() != KeyNotFound {
+		t.Fatalf("%s: expected key not found, got %v", path, err)
+	}
+}
+
+func TestEtcd3ClientMulti(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestEtcd3Client(t)
+	defer f.close()
+
+	if err := c.Create(ctx, "/a", "a"); err != nil {
+		t.Fatal(err.String())
+	}
+
+	nodes, failed, err := c.Multi(ctx, []*Op{
+		{ Type: OpCreate, Path: "/a/b", Data: "b" },
+		{ Type: OpCreate, Path: "/a/b/c", Data: "c" },
+		{ Type: OpSetData, Path: "/a", Data: "x", Version: 1 },
+		{ Type: OpCheck, Path: "/a", Version: -1 },
+	})
+	if err != nil {
+		t.Fatalf("unexpected error at op %d: %s", failed, err.String())
+	}
+	if len(nodes) != 4 || nodes[0].CreatedIndex != 2 || nodes[2].ModifiedIndex != 2 || nodes[2].CreatedIndex != 1 {
+		t.Fatalf("expected nodes to carry the txn revision, got %+v", nodes)
+	}
+	expectEtcd3Data(t, c, "/a", "x")
+	expectEtcd3Data(t, c, "/a/b/c", "c")
+	if children, _ := c.GetChildren(ctx, "/a"); len(children) != 1 || children[0] != "b" {
+		t.Fatalf("unexpected children of /a: %v", children)
+	}
+
+	tests := []struct {
+		ops    []*Op
+		failed int
+		code   int
+	}{
+		{
+			ops: []*Op{
+				{ Type: OpCreate, Path: "/d" },
+				{ Type: OpDelete, Path: "/a", Version: -1 },
+			},
+			failed: 1,
+			code:   NotEmpty,
+		},
+		{
+			ops: []*Op{
+				{ Type: OpCreate, Path: "/d" },
+				{ Type: OpCreate, Path: "/d" },
+			},
+			failed: 1,
+			code:   KeyExists,
+		},
+		{
+			ops: []*Op{
+				{ Type: OpCreate, Path: "/d" },
+				{ Type: OpCreate, Path: "/e/f" },
+			},
+			failed: 1,
+			code:   KeyNotFound,
+		},
+		{
+			ops: []*Op{
+				{ Type: OpSetData, Path: "/a/b", Data: "y", Version: -1 },
+				{ Type: OpCheck, Path: "/a/b", Version: 2 },
+			},
+			failed: 1,
+			code:   BadVersion,
+		},
+	}
+	for i, test := range tests {
+		_, failed, err := c.Multi(ctx, test.ops)
+		if err == nil || failed != test.failed || err.Code() != test.code {
+			t.Fatalf("%d: expected op %d to fail with %d, got op %d with %v", i, test.failed, test.code, failed, err)
+		}
+	}
+	expectEtcd3NoNode(t, c, "/d")
+	expectEtcd3Data(t, c, "/a/b", "b")
+
+	// deleting the children first lets the parent be deleted in the same txn
+	if _, failed, err := c.Multi(ctx, []*Op{
+		{ Type: OpDelete, Path: "/a/b/c", Version: -1 },
+		{ Type: OpDelete, Path: "/a/b", Version: -1 },
+		{ Type: OpDelete, Path: "/a", Version: -1 },
+	}); err != nil {
+		t.Fatalf("unexpected error at op %d: %s", failed, err.String())
+	}
+	expectEtcd3NoNode(t, c, "/a")
+}
+
+func TestEtcd3ClientMultiConflict(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestEtcd3Client(t)
+	defer f.close()
+
+	if err := c.Create(ctx, "/a", "a"); err != nil {
+		t.Fatal(err.String())
+	}
+
+	// a concurrent writer creates a child of /a between the snapshot read
+	// and the first commit, which must fail and be evaluated again
+	conflicts := 0
+	f.beforeTxn = func(f *fakeEtcd3) {
+		if conflicts == 0 {
+			conflicts++
+			f.put(&etcd3PutRequest { Key: []byte("/a/b") }, f.revision + 1)
+			f.revision++
+		}
+	}
+
+	_, failed, err := c.Multi(ctx, []*Op{ { Type: OpDelete, Path: "/a", Version: -1 } })
+	if err == nil || failed != 0 || err.Code() != NotEmpty {
+		t.Fatalf("expected the retried delete to fail as not empty, got op %d with %v", failed, err)
+	}
+	expectEtcd3Data(t, c, "/a", "a")
+}
+
+func TestEtcd3ClientEphemerals(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestEtcd3Client(t)
+	defer f.close()
+
+	session, err := c.NewSession(ctx, 10 * time.Second)
+	if err != nil {
+		t.Fatal(err.String())
+	}
+	f.mutex.Lock()
+	ttl := f.leases[session]
+	f.mutex.Unlock()
+	if ttl != 10 {
+		t.Fatalf("expected a lease of 10s, got %d", ttl)
+	}
+
+	if err := c.CreateEphemeral(ctx, "/e", "e", session); err != nil {
+		t.Fatal(err.String())
+	}
+	if err := c.Create(ctx, "/p", "p"); err != nil {
+		t.Fatal(err.String())
+	}
+	if n := expectEtcd3Data(t, c, "/e", "e"); n.EphemeralOwner != session {
+		t.Fatalf("expected /e to be owned by %d, got %d", session, n.EphemeralOwner)
+	}
+
+	// updating an ephemeral keeps it bound to its lease
+	if err := c.SetData(ctx, "/e", "f", -1); err != nil {
+		t.Fatal(err.String())
+	}
+	if n := expectEtcd3Data(t, c, "/e", "f"); n.EphemeralOwner != session {
+		t.Fatalf("expected /e to be owned by %d after set data, got %d", session, n.EphemeralOwner)
+	}
+	if err := c.KeepAlive(ctx, session); err != nil {
+		t.Fatal(err.String())
+	}
+
+	if err := c.CloseSession(ctx, session); err != nil {
+		t.Fatal(err.String())
+	}
+	expectEtcd3NoNode(t, c, "/e")
+	expectEtcd3Data(t, c, "/p", "p")
+	if err := c.KeepAlive(ctx, session); err == nil || err.Code() != KeyNotFound {
+		t.Fatalf("expected closed session to be reported as not found, got %v", err)
+	}
+
+	// ephemerals of an expired lease are gone too
+	session, _ = c.NewSession(ctx, 10 * time.Second)
+	if err := c.CreateEphemeral(ctx, "/p/e", "e", session); err != nil {
+		t.Fatal(err.String())
+	}
+	f.expire(session)
+	expectEtcd3NoNode(t, c, "/p/e")
+	if err := c.KeepAlive(ctx, session); err == nil || err.Code() != KeyNotFound {
+		t.Fatalf("expected expired session to be reported as not found, got %v", err)
+	}
+	if err := c.CreateEphemeral(ctx, "/p/e", "e", session); err == nil || err.Code() != KeyNotFound {
+		t.Fatalf("expected create with an expired session to fail, got %v", err)
+	}
+}
+
+func expectEtcd3Event(t *testing.T, events <-chan *Event, eventType int, path string) {
+	select {
+	case e, ok := <-events:
+		if !ok {
+			t.Fatalf("expected event %d on %s, watch was lost", eventType, path)
+		}
+		if e.Type != eventType || e.Path != path {
+			t.Fatalf("expected event %d on %s, got %d on %s", eventType, path, e.Type, e.Path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected event %d on %s, got none", eventType, path)
+	}
+}
+
+func TestEtcd3ClientWatch(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestEtcd3Client(t)
+	defer f.close()
+
+	stop := make(chan struct{})
+	events, err := c.Watch(ctx, "/w", false, stop)
+	if err != nil {
+		t.Fatal(err.String())
+	}
+
+	c.Create(ctx, "/w", "a")
+	expectEtcd3Event(t, events, EventCreated, "/w")
+	c.SetData(ctx, "/w", "b", -1)
+	expectEtcd3Event(t, events, EventDataChanged, "/w")
+	c.Create(ctx, "/w/c", "c")
+	c.Delete(ctx, "/w/c", -1)
+	c.Delete(ctx, "/w", -1)
+	expectEtcd3Event(t, events, EventDeleted, "/w")
+
+	close(stop)
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Fatal("expected no more events once stopped")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected events to be closed once stopped")
+	}
+}
+
+func TestEtcd3ClientWatchChildren(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestEtcd3Client(t)
+	defer f.close()
+
+	c.Create(ctx, "/p", "p")
+	stop := make(chan struct{})
+	defer close(stop)
+	events, err := c.Watch(ctx, "/p", true, stop)
+	if err != nil {
+		t.Fatal(err.String())
+	}
+
+	c.Create(ctx, "/p/c", "c")
+	expectEtcd3Event(t, events, EventChildrenChanged, "/p")
+
+	// data changes of children, grandchildren and siblings sharing the
+	// prefix are filtered out
+	c.SetData(ctx, "/p/c", "d", -1)
+	c.Create(ctx, "/p/c/g", "g")
+	c.Create(ctx, "/p-sibling", "s")
+	c.SetData(ctx, "/p", "q", -1)
+	expectEtcd3Event(t, events, EventDataChanged, "/p")
+
+	c.Delete(ctx, "/p/c/g", -1)
+	c.Delete(ctx, "/p/c", -1)
+	expectEtcd3Event(t, events, EventChildrenChanged, "/p")
+	c.Delete(ctx, "/p", -1)
+	expectEtcd3Event(t, events, EventDeleted, "/p")
+}
+
+func TestEtcd3ClientWatchDeadline(t *testing.T) {
+	f := newFakeEtcd3()
+	defer f.close()
+
+	// a member accepting watches but never creating them
+	hung := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v3/watch" {
+			w.(http.Flusher).Flush()
+			<-hung
+			return
+		}
+		f.server.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+	defer close(hung)
+
+	c, err := NewEtcd3Client([]string{ strings.TrimPrefix(s.URL, "http://") }, "", nil, nil, nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100 * time.Millisecond)
+	defer cancel()
+	stop := make(chan struct{})
+	defer close(stop)
+
+	start := time.Now()
+	if _, err := c.Watch(ctx, "/w", false, stop); err == nil || err.Code() != Timeout {
+		t.Fatalf("expected the watch to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the watch to give up at the deadline, took %s", elapsed)
+	}
+
+	// established watches outlive the ctx they were set with
+	c2, err := NewEtcd3Client([]string{ f.addr() }, "", nil, nil, nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	events, werr := c2.Watch(ctx, "/w", false, stop)
+	cancel()
+	if werr != nil {
+		t.Fatal(werr.String())
+	}
+	c2.Create(context.Background(), "/w", "a")
+	expectEtcd3Event(t, events, EventCreated, "/w")
+}
+
+// etcd3Exchange is a request to the json gateway and its reply, written in the
+// format etcd 3.4 uses on the wire rather than through the client types: int64
+// and uint64 fields as strings, bytes base64 encoded, enums by name and fields
+// holding zero values left out (PUT events have no type, empty ranges no kvs
+// nor count, failed txns no succeeded). Streams reply several messages, one per
+// line, and are then kept open.
+type etcd3Exchange struct {
+	path     string
+	request  string
+	status   int
+	response string
+	stream   bool
+}
+
+const (
+	etcd3GatewayHeader  = `"header":{"cluster_id":"14841639068965178418","member_id":"10276657743932975437","revision":"5","raft_term":"2"}`
+	etcd3GatewayHeader6 = `"header":{"cluster_id":"14841639068965178418","member_id":"10276657743932975437","revision":"6","raft_term":"2"}`
+	etcd3GatewayHeader7 = `"header":{"cluster_id":"14841639068965178418","member_id":"10276657743932975437","revision":"7","raft_term":"2"}`
+	// bigger than 2^53, so that it doesn't survive being decoded as a float
+	etcd3GatewayLease   = "7587869283487446276"
+)
+
+// serveEtcd3Exchanges replies exchanges in order, failing on requests that
+// differ from the expected ones. The returned function tells how many of them
+// were served.
+func serveEtcd3Exchanges(t *testing.T, exchanges []etcd3Exchange) (*httptest.Server, func() int) {
+	var mutex sync.Mutex
+	served := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		mutex.Lock()
+		if served == len(exchanges) {
+			mutex.Unlock()
+			t.Errorf("unexpected request to %s: %s", r.URL.Path, body)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		x := exchanges[served]
+		served++
+		mutex.Unlock()
+
+		var got, expected interface{}
+		json.Unmarshal(body, &got)
+		json.Unmarshal([]byte(x.request), &expected)
+		if r.URL.Path != x.path || !reflect.DeepEqual(got, expected) {
+			t.Errorf("expected %s %s, got %s %s", x.path, x.request, r.URL.Path, body)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if x.status != 0 {
+			w.WriteHeader(x.status)
+		}
+		io.WriteString(w, x.response + "\n")
+		if x.stream {
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		}
+	}))
+
+	return s, func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return served
+	}
+}
+
+func TestEtcd3ClientGatewayPayloads(t *testing.T) {
+	exchanges := []etcd3Exchange {
+		// the member is the leader
+		{
+			path:     "/v3/maintenance/status",
+			request:  `{}`,
+			response: `{` + etcd3GatewayHeader + `,"version":"3.4.27","db_size":"20480","leader":"10276657743932975437","raft_index":"9","raft_term":"2","raft_applied_index":"9","db_size_in_use":"20480"}`,
+		},
+		// create /a: snapshot of the key, then a guarded put
+		{
+			path:     "/v3/kv/txn",
+			request:  `{"success":[{"request_range":{"key":"L2E="}}]}`,
+			response: `{` + etcd3GatewayHeader + `,"succeeded":true,"responses":[{"response_range":{"header":{"revision":"5"}}}]}`,
+		},
+		{
+			path:     "/v3/kv/txn",
+			request:  `{"compare":[{"result":"EQUAL","target":"MOD","key":"L2E=","mod_revision":"0"}],"success":[{"request_put":{"key":"L2E=","value":"MQ=="}}]}`,
+			response: `{` + etcd3GatewayHeader6 + `,"succeeded":true,"responses":[{"response_put":{"header":{"revision":"6"}}}]}`,
+		},
+		// get /a
+		{
+			path:     "/v3/kv/range",
+			request:  `{"key":"L2E="}`,
+			response: `{` + etcd3GatewayHeader6 + `,"kvs":[{"key":"L2E=","create_revision":"6","mod_revision":"6","version":"1","value":"MQ=="}],"count":"1"}`,
+		},
+		// children of /, which isn't a key itself
+		{
+			path:     "/v3/kv/txn",
+			request:  `{"success":[{"request_range":{"key":"Lw==","count_only":true}},{"request_range":{"key":"Lw==","range_end":"MA==","keys_only":true}}]}`,
+			response: `{` + etcd3GatewayHeader6 + `,"succeeded":true,"responses":[{"response_range":{"header":{"revision":"6"}}},{"response_range":{"header":{"revision":"6"},"kvs":[{"key":"L2E=","create_revision":"6","mod_revision":"6","version":"1"}],"count":"1"}}]}`,
+		},
+		// set /a, whose guarded put loses a race first and is retried
+		{
+			path:     "/v3/kv/txn",
+			request:  `{"success":[{"request_range":{"key":"L2E="}}]}`,
+			response: `{` + etcd3GatewayHeader6 + `,"succeeded":true,"responses":[{"response_range":{"header":{"revision":"6"},"kvs":[{"key":"L2E=","create_revision":"6","mod_revision":"6","version":"1","value":"MQ=="}],"count":"1"}}]}`,
+		},
+		{
+			path:     "/v3/kv/txn",
+			request:  `{"compare":[{"result":"EQUAL","target":"MOD","key":"L2E=","mod_revision":"6"}],"success":[{"request_put":{"key":"L2E=","value":"Mg=="}}]}`,
+			response: `{` + etcd3GatewayHeader7 + `}`,
+		},
+		{
+			path:     "/v3/kv/txn",
+			request:  `{"success":[{"request_range":{"key":"L2E="}}]}`,
+			response: `{` + etcd3GatewayHeader7 + `,"succeeded":true,"responses":[{"response_range":{"header":{"revision":"7"},"kvs":[{"key":"L2E=","create_revision":"6","mod_revision":"6","version":"1","value":"MQ=="}],"count":"1"}}]}`,
+		},
+		{
+			path:     "/v3/kv/txn",
+			request:  `{"compare":[{"result":"EQUAL","target":"MOD","key":"L2E=","mod_revision":"6"}],"success":[{"request_put":{"key":"L2E=","value":"Mg=="}}]}`,
+			response: `{` + etcd3GatewayHeader7 + `,"succeeded":true,"responses":[{"response_put":{"header":{"revision":"8"}}}]}`,
+		},
+		// sessions are leases
+		{
+			path:     "/v3/lease/grant",
+			request:  `{"TTL":"10"}`,
+			response: `{` + etcd3GatewayHeader7 + `,"ID":"` + etcd3GatewayLease + `","TTL":"10"}`,
+		},
+		{
+			path:     "/v3/kv/txn",
+			request:  `{"success":[{"request_range":{"key":"L2EvZQ=="}},{"request_range":{"key":"L2E="}}]}`,
+			response: `{` + etcd3GatewayHeader7 + `,"succeeded":true,"responses":[{"response_range":{"header":{"revision":"8"}}},{"response_range":{"header":{"revision":"8"},"kvs":[{"key":"L2E=","create_revision":"6","mod_revision":"8","version":"2","value":"Mg=="}],"count":"1"}}]}`,
+		},
+		{
+			path:     "/v3/kv/txn",
+			request:  `{"compare":[{"result":"EQUAL","target":"MOD","key":"L2EvZQ==","mod_revision":"0"},{"result":"EQUAL","target":"MOD","key":"L2E=","mod_revision":"8"}],"success":[{"request_put":{"key":"L2EvZQ==","value":"ZQ==","lease":"` + etcd3GatewayLease + `"}}]}`,
+			response: `{` + etcd3GatewayHeader7 + `,"succeeded":true,"responses":[{"response_put":{"header":{"revision":"9"}}}]}`,
+		},
+		{
+			path:     "/v3/kv/range",
+			request:  `{"key":"L2EvZQ=="}`,
+			response: `{` + etcd3GatewayHeader7 + `,"kvs":[{"key":"L2EvZQ==","create_revision":"9","mod_revision":"9","version":"1","value":"ZQ==","lease":"` + etcd3GatewayLease + `"}],"count":"1"}`,
+		},
+		// keep alives are streams, answered with no ttl once expired
+		{
+			path:     "/v3/lease/keepalive",
+			request:  `{"ID":"` + etcd3GatewayLease + `"}`,
+			response: `{"result":{` + etcd3GatewayHeader7 + `,"ID":"` + etcd3GatewayLease + `","TTL":"10"}}`,
+			stream:   true,
+		},
+		{
+			path:     "/v3/lease/keepalive",
+			request:  `{"ID":"` + etcd3GatewayLease + `"}`,
+			response: `{"result":{` + etcd3GatewayHeader7 + `,"ID":"` + etcd3GatewayLease + `"}}`,
+			stream:   true,
+		},
+		// grpc errors are mapped by their status code
+		{
+			path:     "/v3/lease/revoke",
+			request:  `{"ID":"` + etcd3GatewayLease + `"}`,
+			status:   http.StatusNotFound,
+			response: `{"error":"etcdserver: requested lease not found","code":5,"message":"etcdserver: requested lease not found"}`,
+		},
+		// watches are created first, then they stream events
+		{
+			path:     "/v3/watch",
+			request:  `{"create_request":{"key":"L2E="}}`,
+			response: `{"result":{` + etcd3GatewayHeader7 + `,"created":true}}` + "\n" +
+				`{"result":{` + etcd3GatewayHeader7 + `,"events":[{"kv":{"key":"L2E=","create_revision":"6","mod_revision":"10","version":"3","value":"Mw=="}}]}}` + "\n" +
+				`{"result":{` + etcd3GatewayHeader7 + `,"events":[{"type":"DELETE","kv":{"key":"L2E=","mod_revision":"11"}}]}}`,
+			stream:   true,
+		},
+	}
+
+	s, served := serveEtcd3Exchanges(t, exchanges)
+	defer s.Close()
+	c, err := NewEtcd3Client([]string{ strings.TrimPrefix(s.URL, "http://") }, "", nil, nil, nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx := context.Background()
+
+	if err := c.Create(ctx, "/a", "1"); err != nil {
+		t.Fatal(err.String())
+	}
+	node, gerr := c.GetData(ctx, "/a")
+	if gerr != nil {
+		t.Fatal(gerr.String())
+	}
+	if node.Value != "1" || node.CreatedIndex != 6 || node.ModifiedIndex != 6 || node.EphemeralOwner != 0 {
+		t.Fatalf("unexpected node: %+v", node)
+	}
+	children, gerr := c.GetChildren(ctx, "/")
+	if gerr != nil {
+		t.Fatal(gerr.String())
+	}
+	if len(children) != 1 || children[0] != "a" {
+		t.Fatalf("unexpected children: %v", children)
+	}
+	if err := c.SetData(ctx, "/a", "2", 6); err != nil {
+		t.Fatal(err.String())
+	}
+
+	session, serr := c.NewSession(ctx, 10 * time.Second)
+	if serr != nil {
+		t.Fatal(serr.String())
+	}
+	if strconv.FormatInt(session, 10) != etcd3GatewayLease {
+		t.Fatalf("expected session %s, got %d", etcd3GatewayLease, session)
+	}
+	if err := c.CreateEphemeral(ctx, "/a/e", "e", session); err != nil {
+		t.Fatal(err.String())
+	}
+	if node, gerr = c.GetData(ctx, "/a/e"); gerr != nil {
+		t.Fatal(gerr.String())
+	}
+	if node.EphemeralOwner != session {
+		t.Fatalf("expected /a/e to be owned by %d, got %d", session, node.EphemeralOwner)
+	}
+	if err := c.KeepAlive(ctx, session); err != nil {
+		t.Fatal(err.String())
+	}
+	if err := c.KeepAlive(ctx, session); err == nil || err.Code() != KeyNotFound {
+		t.Fatalf("expected the expired session to be reported as not found, got %v", err)
+	}
+	if err := c.CloseSession(ctx, session); err == nil || err.Code() != KeyNotFound {
+		t.Fatalf("expected the expired session to be reported as not found, got %v", err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	events, werr := c.Watch(ctx, "/a", false, stop)
+	if werr != nil {
+		t.Fatal(werr.String())
+	}
+	expectEtcd3Event(t, events, EventDataChanged, "/a")
+	expectEtcd3Event(t, events, EventDeleted, "/a")
+
+	if n := served(); n != len(exchanges) {
+		t.Fatalf("expected %d requests, got %d", len(exchanges), n)
+	}
+}
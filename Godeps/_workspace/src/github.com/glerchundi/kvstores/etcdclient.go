@@ -1,79 +1,163 @@
 package kvstores
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	api "github.com/coreos/go-etcd/etcd"
 )
 
 type EtcdClient struct {
-	addr   string
-	client *api.Client
-}
-
-func NewEtcdClient(addr string, dialTimeout time.Duration) (*EtcdClient, error) {
-	var c *api.Client
-	/*
-		var err error
-		if cert != "" && key != "" {
-			c, err = etcd.NewTLSClient(machines, cert, key, caCert)
-			if err != nil {
-				return &Client{c}, err
-			}
-		} else {
-			c = etcd.NewClient(machines)
-		}
-	*/
+	addrs     []string
+	root      string
+	scheme    string
+	creds     *Credentials
+	transport *http.Transport
+	prober    *http.Client
+	endpoints *endpoints
+
+	mutex     sync.RWMutex
+	clients   map[string]*api.Client
+}
+
+func NewEtcdClient(addrs []string, root string, creds *Credentials, tlsConfig *tls.Config, retry *RetryOptions, dialTimeout time.Duration) (*EtcdClient, error) {
+	transport := newTransport(tlsConfig, dialTimeout)
 
-	// machine addresses
-	machines := []string{addr}
+	c := &EtcdClient {
+		addrs:     addrs,
+		root:      root,
+		scheme:    "http",
+		creds:     creds,
+		transport: transport,
+		prober:    &http.Client { Timeout: probeTimeout, Transport: transport },
+	}
+	if tlsConfig != nil {
+		c.scheme = "https"
+	}
+	c.clients = c.newClients()
 
-	// create custom client
-	c = api.NewClient(machines)
-	if !c.SetCluster(machines) {
-		return nil, errors.New("cannot connect to etcd cluster: " + addr)
+	c.endpoints = newEndpoints("etcd", addrs, c.probe, retry)
+	if !c.endpoints.healthy() {
+		c.endpoints.close()
+		return nil, errors.New("cannot connect to etcd cluster: " + strings.Join(addrs, ","))
 	}
 
-	// configure dial timeout
-	c.SetDialTimeout(dialTimeout)
+	return c, nil
+}
 
-	return &EtcdClient { addr: addr, client: c }, nil
+// Close stops probing the cluster members and closes idle connections.
+func (c *EtcdClient) Close() error {
+	c.endpoints.close()
+	c.transport.CloseIdleConnections()
+	return nil
 }
 
-func (c *EtcdClient) Create(path string, data string) (err *Error) {
-	_, err = rawCall(func() (*api.RawResponse, error) {
-		return c.client.RawCreate(path, data, 0)
+func (c *EtcdClient) Create(ctx context.Context, path string, data string) (err *Error) {
+	_, err = c.call(ctx, true, func(client *api.Client) (*api.RawResponse, error) {
+		return client.RawCreate(c.root + path, data, 0)
 	}, nil)
 	return
 }
 
-func (c *EtcdClient) Delete(path string, version int32) (err *Error) {
-	_, err = rawCall(func() (*api.RawResponse, error) {
+func (c *EtcdClient) Delete(ctx context.Context, path string, version int32) (err *Error) {
+	_, err = c.call(ctx, true, func(client *api.Client) (*api.RawResponse, error) {
 		if (version == -1) {
-			return c.client.RawDelete(path, false, false)
+			return client.RawDelete(c.root + path, false, false)
 		} else {
-			return c.client.RawCompareAndDelete(path, "", uint64(version))
+			return client.RawCompareAndDelete(c.root + path, "", uint64(version))
 		}
 	}, nil)
 	return
 }
 
-func (c *EtcdClient) Exists(path string) (err *Error) {
-	_, err = rawCall(func() (*api.RawResponse, error) {
-		return c.client.RawGet(path, true, false)
+func (c *EtcdClient) Exists(ctx context.Context, path string) *Error {
+	return c.exists(ctx, path, 0)
+}
+
+func (c *EtcdClient) GetData(ctx context.Context, path string) (*Node, *Error) {
+	return c.getData(ctx, path, 0)
+}
+
+func (c *EtcdClient) SetData(ctx context.Context, path string, data string, version int32) (err *Error) {
+	_, err = c.call(ctx, true, func(client *api.Client) (*api.RawResponse, error) {
+		if (version == -1) {
+			return client.RawUpdate(c.root + path, data, 0)
+		} else {
+			return client.RawCompareAndSwap(c.root + path, data, 0, "", uint64(version))
+		}
 	}, nil)
 	return
 }
 
-func (c *EtcdClient) GetData(path string) (*Node, *Error) {
-	return rawCall(
-		func() (*api.RawResponse, error) {
-			return c.client.RawGet(path, true, false)
-		},
+func (c *EtcdClient) GetChildren(ctx context.Context, path string) ([]string, *Error) {
+	return c.getChildren(ctx, path, 0)
+}
+
+// Sync performs a quorum read of path, which goes through raft and therefore
+// observes every write committed before, and returns the etcd index.
+func (c *EtcdClient) Sync(ctx context.Context, path string) (uint64, *Error) {
+	var index uint64
+	err := c.endpoints.do(ctx, false, func(_ context.Context, addr string) *Error {
+		c.mutex.RLock()
+		client := c.clients[addr]
+		c.mutex.RUnlock()
+
+		rawResp, cerr := quorumGet(client, c.root + path)
+		if cerr != nil {
+			return unreachableError(cerr)
+		}
+
+		index = etcdIndex(rawResp)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return index, nil
+}
+
+// Synced returns a client whose reads observe at least index. Reads are
+// served by any machine as usual and only repeated as quorum reads if the
+// machine was lagging behind.
+func (c *EtcdClient) Synced(index uint64) Client {
+	return &etcdSyncedClient { EtcdClient: c, minIndex: index }
+}
+
+type etcdSyncedClient struct {
+	*EtcdClient
+	minIndex uint64
+}
+
+func (c *etcdSyncedClient) Exists(ctx context.Context, path string) *Error {
+	return c.exists(ctx, path, c.minIndex)
+}
+
+func (c *etcdSyncedClient) GetData(ctx context.Context, path string) (*Node, *Error) {
+	return c.getData(ctx, path, c.minIndex)
+}
+
+func (c *etcdSyncedClient) GetChildren(ctx context.Context, path string) ([]string, *Error) {
+	return c.getChildren(ctx, path, c.minIndex)
+}
+
+func (c *EtcdClient) exists(ctx context.Context, path string, minIndex uint64) (err *Error) {
+	_, err = c.call(ctx, false, c.get(path, minIndex), nil)
+	return
+}
+
+func (c *EtcdClient) getData(ctx context.Context, path string, minIndex uint64) (*Node, *Error) {
+	return c.call(ctx, false,
+		c.get(path, minIndex),
 		func(resp *api.Response) *Error {
 			if (resp.Node.Dir) {
 				return &Error { code: KeyNotFound }
@@ -83,21 +167,8 @@ func (c *EtcdClient) GetData(path string) (*Node, *Error) {
 	)
 }
 
-func (c *EtcdClient) SetData(path string, data string, version int32) (err *Error) {
-	_, err = rawCall(func() (*api.RawResponse, error) {
-		if (version == -1) {
-			return c.client.RawUpdate(path, data, 0)
-		} else {
-			return c.client.RawCompareAndSwap(path, data, 0, "", uint64(version))
-		}
-	}, nil)
-	return
-}
-
-func (c *EtcdClient) GetChildren(path string) ([]string, *Error) {
-	node, err := rawCall(func() (*api.RawResponse, error) {
-		return c.client.RawGet(path, true, false)
-	}, nil)
+func (c *EtcdClient) getChildren(ctx context.Context, path string, minIndex uint64) ([]string, *Error) {
+	node, err := c.call(ctx, false, c.get(path, minIndex), nil)
 	if (err != nil) {
 		return nil, err
 	}
@@ -111,6 +182,106 @@ func (c *EtcdClient) GetChildren(path string) ([]string, *Error) {
 	return children, nil
 }
 
+// get returns a function reading path which, if minIndex is set, falls back to
+// a quorum read when the machine answering hasn't reached it yet.
+func (c *EtcdClient) get(path string, minIndex uint64) func(*api.Client) (*api.RawResponse, error) {
+	return func(client *api.Client) (*api.RawResponse, error) {
+		rawResp, err := client.RawGet(c.root + path, true, false)
+		if minIndex == 0 || err != nil || etcdIndex(rawResp) >= minIndex {
+			return rawResp, err
+		}
+
+		return quorumGet(client, c.root + path)
+	}
+}
+
+func (c *EtcdClient) Breaker() *Breaker {
+	return c.endpoints.breaker
+}
+
+// Reload re-reads the password from its file, if any.
+func (c *EtcdClient) Reload() error {
+	if c.creds == nil {
+		return nil
+	}
+
+	if err := c.creds.Reload(); err != nil {
+		return err
+	}
+
+	clients := c.newClients()
+	c.mutex.Lock()
+	c.clients = clients
+	c.mutex.Unlock()
+
+	return nil
+}
+
+// newClients creates a custom client per machine, failover is handled by
+// endpoints.
+func (c *EtcdClient) newClients() map[string]*api.Client {
+	clients := make(map[string]*api.Client)
+	for _, addr := range c.addrs {
+		client := api.NewClient([]string{ c.machine(addr) })
+		client.SetTransport(c.transport)
+		client.CheckRetry = checkRetry
+		clients[addr] = client
+	}
+
+	return clients
+}
+
+// machine returns the url of the machine at addr, basic auth credentials are
+// sent by the http client as they are part of it.
+func (c *EtcdClient) machine(addr string) string {
+	u := &url.URL { Scheme: c.scheme, Host: addr }
+	if c.creds != nil {
+		password, _ := c.creds.secrets()
+		u.User = url.UserPassword(c.creds.username, password)
+	}
+
+	return u.String()
+}
+
+// probe returns whether the member at addr is the leader of the cluster.
+func (c *EtcdClient) probe(addr string) (bool, *Error) {
+	resp, err := c.prober.Get(c.machine(addr) + "/v2/stats/self")
+	if err != nil {
+		return false, &Error { code: BackendUnreachable, msg: err.Error() }
+	}
+	defer resp.Body.Close()
+
+	stats := &struct { State string `json:"state"` } {}
+	if err := json.NewDecoder(resp.Body).Decode(stats); err != nil {
+		return false, &Error { code: BackendUnreachable, msg: err.Error() }
+	}
+
+	return stats.State == "StateLeader", nil
+}
+
+// call runs f against the healthiest machine, failing over to the rest.
+func (c *EtcdClient) call(ctx context.Context, write bool, f func(*api.Client) (*api.RawResponse, error), v func(*api.Response) *Error) (*Node, *Error) {
+	var node *Node
+	err := c.endpoints.do(ctx, write, func(_ context.Context, addr string) (err *Error) {
+		c.mutex.RLock()
+		client := c.clients[addr]
+		c.mutex.RUnlock()
+
+		node, err = rawCall(func() (*api.RawResponse, error) {
+			return f(client)
+		}, v)
+		if node != nil {
+			stripNode(c.root, node)
+		}
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return node, nil
+}
+
 func mapNode(etcdNode *api.Node) *Node {
 	node := &Node{
 		Path:          etcdNode.Key,
@@ -127,10 +298,44 @@ func mapNode(etcdNode *api.Node) *Node {
 	return node
 }
 
+// quorumGet reads key through raft, which go-etcd doesn't support.
+func quorumGet(client *api.Client, key string) (*api.RawResponse, error) {
+	p := (&url.URL { Path: "keys/" + strings.TrimPrefix(key, "/") }).String()
+	req := api.NewRawRequest("GET", p + "?quorum=true&sorted=true", nil, nil)
+	return client.SendRequest(req)
+}
+
+func etcdIndex(rawResp *api.RawResponse) uint64 {
+	index, _ := strconv.ParseUint(rawResp.Header.Get("X-Etcd-Index"), 10, 64)
+	return index
+}
+
+// checkRetry stops retrying requests rejected due to the credentials, which
+// would be reported as unreachable machines otherwise.
+func checkRetry(cluster *api.Cluster, numReqs int, lastResp http.Response, err error) error {
+	switch lastResp.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return &api.EtcdError { ErrorCode: 110, Message: lastResp.Status }
+	}
+
+	return api.DefaultCheckRetry(cluster, numReqs, lastResp, err)
+}
+
+// stripNode removes root from the paths of node and its children.
+func stripNode(root string, node *Node) {
+	node.Path = stripRoot(root, node.Path)
+	for _, child := range node.Nodes {
+		stripNode(root, child)
+	}
+}
+
 func rawCall(f func() (*api.RawResponse, error), v func(*api.Response) *Error) (*Node, *Error) {
 	rawResp, cerr := f()
 	if cerr != nil {
-		return nil, &Error { code: BackendUnreachable, msg: cerr.Error() }
+		if etcdError, ok := cerr.(*api.EtcdError); ok && etcdError.ErrorCode == 110 {
+			return nil, &Error { code: AccessDenied, msg: etcdError.Message }
+		}
+		return nil, unreachableError(cerr)
 	}
 
 	if rawResp.StatusCode != http.StatusOK && rawResp.StatusCode != http.StatusCreated {
@@ -147,6 +352,8 @@ func rawCall(f func() (*api.RawResponse, error), v func(*api.Response) *Error) (
 			code = KeyNotFound
 		case 105: // EcodeNodeExist
 			code = KeyExists
+		case 110: // EcodeUnauthorized
+			code = AccessDenied
 		case 107: // EcodeRootROnly
 			// TODO: Decide which error should be triggered
 			code = KeyNotFound
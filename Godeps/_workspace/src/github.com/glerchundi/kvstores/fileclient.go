@@ -0,0 +1,830 @@
+package kvstores
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// number of records appended to the log before it gets compacted into a
+	// single snapshot record
+	fileCompactThreshold = 4096
+	// size of the record header: payload length + payload crc32
+	fileRecordHeaderSize = 8
+	// upper bound of a single record, anything bigger is considered garbage
+	fileMaxRecordSize = 1 << 30
+	// how often sessions are checked for expiration
+	fileSessionCheckInterval = 100 * time.Millisecond
+	// events a watcher can fall behind before losing its watch
+	fileWatchBuffer = 64
+)
+
+// mutations of sessions, following the ones of nodes which share the op types
+const (
+	fileOpenSession  = 101
+	fileCloseSession = 102
+)
+
+var errFileCorrupted = errors.New("corrupted record")
+
+// FileClient is an embedded, single node store persisted in a local file.
+//
+// The whole tree is kept in memory and every committed transaction is
+// appended (and fsync'ed) to the file as a checksummed record before being
+// acknowledged. On startup records are replayed in order and a torn or
+// corrupted tail, which can only be the result of a crash while appending, is
+// truncated. The log is periodically compacted into a single snapshot record.
+//
+// Every transaction is assigned a monotonically increasing index which is
+// used as both the created and modified index of the nodes it touches.
+//
+// Sessions are logged too, identified by the index of the transaction opening
+// them, but their deadlines aren't: after a restart every session is given a
+// whole ttl to be kept alive before it expires and its ephemeral nodes are
+// deleted. Watchers are notified of every committed transaction.
+type FileClient struct {
+	path     string
+	mutex    sync.RWMutex
+	file     *os.File
+	size     int64
+	records  int
+	index    uint64
+	nodes    map[string]*fileNode
+	sessions map[int64]*fileSession
+	watchers map[*fileWatcher]bool
+	done     chan struct{}
+}
+
+type fileNode struct {
+	value          string
+	createdIndex   uint64
+	modifiedIndex  uint64
+	ephemeralOwner int64
+	children       map[string]bool
+}
+
+type fileSession struct {
+	ttl     time.Duration
+	expires time.Time
+}
+
+type fileWatcher struct {
+	path     string
+	children bool
+	events   chan *Event
+}
+
+// fileUndo holds the state of every node touched by a transaction as it was
+// before the transaction started, nil for nodes which didn't exist.
+type fileUndo map[string]*fileNode
+
+type fileRecord struct {
+	Index     uint64          `json:"index"`
+	Snapshot  bool            `json:"snapshot,omitempty"`
+	Mutations []*fileMutation `json:"mutations"`
+}
+
+type fileMutation struct {
+	Type          int    `json:"type"`
+	Path          string `json:"path"`
+	Value         string `json:"value,omitempty"`
+	CreatedIndex  uint64 `json:"createdIndex,omitempty"`
+	ModifiedIndex uint64 `json:"modifiedIndex,omitempty"`
+	// owner of ephemeral nodes, or the session opened or closed
+	Session       int64  `json:"session,omitempty"`
+	// ttl of the session opened, in milliseconds
+	TTL           int64  `json:"ttl,omitempty"`
+}
+
+func NewFileClient(path string) (*FileClient, error) {
+	if path == "" {
+		return nil, errors.New("file backend requires a path")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &FileClient {
+		path:     path,
+		file:     f,
+		watchers: make(map[*fileWatcher]bool),
+		done:     make(chan struct{}),
+	}
+	c.reset()
+	if err := c.recover(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	go c.expireSessions()
+
+	return c, nil
+}
+
+// Close stops expiring sessions and closes every watch.
+func (c *FileClient) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	select {
+	case <-c.done:
+		return nil
+	default:
+		close(c.done)
+	}
+	for w := range c.watchers {
+		c.unwatch(w)
+	}
+
+	return c.file.Close()
+}
+
+func (c *FileClient) Create(ctx context.Context, path string, data string) *Error {
+	_, _, err := c.Multi(ctx, []*Op{ { Type: OpCreate, Path: path, Data: data } })
+	return err
+}
+
+func (c *FileClient) Delete(ctx context.Context, path string, version int32) *Error {
+	_, _, err := c.Multi(ctx, []*Op{ { Type: OpDelete, Path: path, Version: version } })
+	return err
+}
+
+func (c *FileClient) Exists(ctx context.Context, path string) *Error {
+	_, err := c.GetData(ctx, path)
+	return err
+}
+
+func (c *FileClient) GetData(ctx context.Context, path string) (*Node, *Error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	n, found := c.nodes[path]
+	if !found {
+		return nil, &Error { code: KeyNotFound }
+	}
+
+	return mapFileNode(path, n), nil
+}
+
+// Sync returns the current index, reads are always up to date since there is
+// a single process.
+func (c *FileClient) Sync(ctx context.Context, path string) (uint64, *Error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.index, nil
+}
+
+func (c *FileClient) Synced(index uint64) Client {
+	return c
+}
+
+func (c *FileClient) SetData(ctx context.Context, path string, data string, version int32) *Error {
+	_, _, err := c.Multi(ctx, []*Op{ { Type: OpSetData, Path: path, Data: data, Version: version } })
+	return err
+}
+
+func (c *FileClient) GetChildren(ctx context.Context, path string) ([]string, *Error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	n, found := c.nodes[path]
+	if !found {
+		return nil, &Error { code: KeyNotFound }
+	}
+
+	children := make([]string, 0, len(n.children))
+	for name := range n.children {
+		children = append(children, name)
+	}
+	sort.Strings(children)
+
+	return children, nil
+}
+
+// Multi applies ops unless ctx is done by the time the lock is acquired, once
+// started a transaction is always completed.
+func (c *FileClient) Multi(ctx context.Context, ops []*Op) ([]*Node, int, *Error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := contextError(ctx); err != nil {
+		return nil, -1, err
+	}
+
+	index := c.index + 1
+	record := &fileRecord { Index: index }
+	nodes := make([]*Node, len(ops))
+
+	// apply operations in memory keeping track of how to revert them
+	undo := make(fileUndo)
+	for i, op := range ops {
+		node, m, err := c.apply(op, index, undo)
+		if err != nil {
+			c.rollback(undo)
+			return nil, i, err
+		}
+		nodes[i] = node
+		if m != nil {
+			record.Mutations = append(record.Mutations, m)
+		}
+	}
+
+	// read only transaction, nothing to persist
+	if len(record.Mutations) == 0 {
+		return nodes, -1, nil
+	}
+
+	if err := c.append(record); err != nil {
+		c.rollback(undo)
+		return nil, -1, &Error { code: BackendUnreachable, msg: err.Error() }
+	}
+	c.committed(record)
+
+	return nodes, -1, nil
+}
+
+func (c *FileClient) NewSession(ctx context.Context, ttl time.Duration) (int64, *Error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := contextError(ctx); err != nil {
+		return 0, err
+	}
+
+	index := c.index + 1
+	record := &fileRecord {
+		Index:     index,
+		Mutations: []*fileMutation{ { Type: fileOpenSession, Session: int64(index), TTL: int64(ttl / time.Millisecond) } },
+	}
+	if err := c.commit(record); err != nil {
+		return 0, &Error { code: BackendUnreachable, msg: err.Error() }
+	}
+
+	return int64(index), nil
+}
+
+// KeepAlive extends the deadline of session by its ttl, failing with
+// KeyNotFound once it has expired.
+func (c *FileClient) KeepAlive(ctx context.Context, session int64) *Error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+
+	s, found := c.sessions[session]
+	if !found {
+		return &Error { code: KeyNotFound }
+	}
+	s.expires = time.Now().Add(s.ttl)
+
+	return nil
+}
+
+func (c *FileClient) CloseSession(ctx context.Context, session int64) *Error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+
+	if _, found := c.sessions[session]; !found {
+		return &Error { code: KeyNotFound }
+	}
+	if err := c.closeSession(session); err != nil {
+		return &Error { code: BackendUnreachable, msg: err.Error() }
+	}
+
+	return nil
+}
+
+func (c *FileClient) CreateEphemeral(ctx context.Context, path string, data string, session int64) *Error {
+	_, _, err := c.Multi(ctx, []*Op{ { Type: OpCreate, Path: path, Data: data, Session: session } })
+	return err
+}
+
+// Watch sends the changes of path committed from now on. Watchers falling
+// behind by more than fileWatchBuffer events lose their watch instead of
+// blocking transactions.
+func (c *FileClient) Watch(ctx context.Context, path string, children bool, stop <-chan struct{}) (<-chan *Event, *Error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+	select {
+	case <-c.done:
+		return nil, &Error { code: BackendUnreachable, msg: "file backend closed" }
+	default:
+	}
+
+	w := &fileWatcher { path: path, children: children, events: make(chan *Event, fileWatchBuffer) }
+	c.watchers[w] = true
+	go func() {
+		select {
+		case <-stop:
+		case <-c.done:
+		}
+		c.mutex.Lock()
+		c.unwatch(w)
+		c.mutex.Unlock()
+	}()
+
+	return w.events, nil
+}
+
+//
+// PRIVATE
+//
+
+func (c *FileClient) reset() {
+	c.index = 0
+	c.nodes = map[string]*fileNode {
+		"/": &fileNode { children: make(map[string]bool) },
+	}
+	c.sessions = make(map[int64]*fileSession)
+}
+
+// apply validates and applies op to the in-memory tree, returning the
+// resulting node and the mutation to be persisted (nil for read only ops).
+func (c *FileClient) apply(op *Op, index uint64, undo fileUndo) (*Node, *fileMutation, *Error) {
+	n, found := c.nodes[op.Path]
+	switch op.Type {
+	case OpCreate:
+		if found {
+			return nil, nil, &Error { code: KeyExists }
+		}
+		parentPath, _ := splitPath(op.Path)
+		parent, found := c.nodes[parentPath]
+		if !found {
+			return nil, nil, &Error { code: KeyNotFound }
+		}
+		if parent.ephemeralOwner != 0 {
+			return nil, nil, &Error { code: NoChildrenForEphemerals }
+		}
+		if _, found := c.sessions[op.Session]; op.Session != 0 && !found {
+			return nil, nil, &Error { code: KeyNotFound, msg: fmt.Sprintf("session %d expired", op.Session) }
+		}
+	case OpDelete, OpSetData, OpCheck:
+		if !found {
+			return nil, nil, &Error { code: KeyNotFound }
+		}
+		if op.Version != -1 && uint64(op.Version) != n.modifiedIndex {
+			return nil, nil, &Error { code: BadVersion }
+		}
+	default:
+		return nil, nil, &Error { code: Unimplemented }
+	}
+
+	var m *fileMutation
+	switch op.Type {
+	case OpCreate:
+		m = &fileMutation {
+			Type: OpCreate, Path: op.Path, Value: op.Data,
+			CreatedIndex: index, ModifiedIndex: index, Session: op.Session,
+		}
+	case OpDelete:
+		if op.Path == "/" {
+			return nil, nil, &Error { code: Unknown, msg: "root node cannot be deleted" }
+		}
+		if len(n.children) > 0 {
+			return nil, nil, &Error { code: NotEmpty }
+		}
+		m = &fileMutation { Type: OpDelete, Path: op.Path }
+	case OpSetData:
+		m = &fileMutation {
+			Type: OpSetData, Path: op.Path, Value: op.Data,
+			CreatedIndex: n.createdIndex, ModifiedIndex: index,
+		}
+	case OpCheck:
+		return mapFileNode(op.Path, n), nil, nil
+	}
+
+	c.save(undo, op.Path)
+	c.load(m)
+	if n, found := c.nodes[op.Path]; found {
+		return mapFileNode(op.Path, n), m, nil
+	}
+	return &Node { Path: op.Path }, m, nil
+}
+
+// load applies an already validated mutation to the in-memory tree.
+func (c *FileClient) load(m *fileMutation) {
+	switch m.Type {
+	case OpCreate:
+		c.nodes[m.Path] = &fileNode {
+			value:          m.Value,
+			createdIndex:   m.CreatedIndex,
+			modifiedIndex:  m.ModifiedIndex,
+			ephemeralOwner: m.Session,
+			children:       make(map[string]bool),
+		}
+		// the root is only created by snapshots, before any other node
+		if m.Path == "/" {
+			break
+		}
+		parentPath, name := splitPath(m.Path)
+		if parent, found := c.nodes[parentPath]; found {
+			parent.children[name] = true
+		}
+	case OpDelete:
+		c.remove(m.Path)
+	case OpSetData:
+		if n, found := c.nodes[m.Path]; found {
+			n.value = m.Value
+			n.modifiedIndex = m.ModifiedIndex
+		}
+	case fileOpenSession:
+		ttl := time.Duration(m.TTL) * time.Millisecond
+		c.sessions[m.Session] = &fileSession { ttl: ttl, expires: time.Now().Add(ttl) }
+	case fileCloseSession:
+		delete(c.sessions, m.Session)
+	}
+}
+
+// commit durably appends record and then applies its mutations.
+func (c *FileClient) commit(record *fileRecord) error {
+	if err := c.append(record); err != nil {
+		return err
+	}
+	for _, m := range record.Mutations {
+		c.load(m)
+	}
+	c.committed(record)
+	return nil
+}
+
+// committed makes record, already appended and applied, the last transaction.
+func (c *FileClient) committed(record *fileRecord) {
+	c.index = record.Index
+	c.notify(record)
+
+	if c.records >= fileCompactThreshold {
+		if err := c.compact(); err != nil {
+			log.Printf("unable to compact %s: %s", c.path, err)
+		}
+	}
+}
+
+// closeSession deletes session and its ephemeral nodes in a single
+// transaction.
+func (c *FileClient) closeSession(session int64) error {
+	record := &fileRecord { Index: c.index + 1 }
+	var paths []string
+	for path, n := range c.nodes {
+		if n.ephemeralOwner == session {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		record.Mutations = append(record.Mutations, &fileMutation { Type: OpDelete, Path: path })
+	}
+	record.Mutations = append(record.Mutations, &fileMutation { Type: fileCloseSession, Session: session })
+
+	return c.commit(record)
+}
+
+// expireSessions closes the sessions not kept alive within their ttl until
+// the client is closed.
+func (c *FileClient) expireSessions() {
+	ticker := time.NewTicker(fileSessionCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		c.mutex.Lock()
+		now := time.Now()
+		for session, s := range c.sessions {
+			if now.After(s.expires) {
+				if err := c.closeSession(session); err != nil {
+					log.Printf("unable to expire session %d: %s", session, err)
+				}
+			}
+		}
+		c.mutex.Unlock()
+	}
+}
+
+// notify sends the events of record to the watchers of the paths changed.
+func (c *FileClient) notify(record *fileRecord) {
+	if len(c.watchers) == 0 {
+		return
+	}
+
+	var events []*Event
+	for _, m := range record.Mutations {
+		parentPath, _ := splitPath(m.Path)
+		switch m.Type {
+		case OpCreate:
+			events = append(events,
+				&Event { Type: EventCreated, Path: m.Path, Index: record.Index },
+				&Event { Type: EventChildrenChanged, Path: parentPath, Index: record.Index })
+		case OpDelete:
+			events = append(events,
+				&Event { Type: EventDeleted, Path: m.Path, Index: record.Index },
+				&Event { Type: EventChildrenChanged, Path: parentPath, Index: record.Index })
+		case OpSetData:
+			events = append(events, &Event { Type: EventDataChanged, Path: m.Path, Index: record.Index })
+		}
+	}
+
+	for _, e := range events {
+		for w := range c.watchers {
+			if e.Path != w.path || (e.Type == EventChildrenChanged && !w.children) {
+				continue
+			}
+			select {
+			case w.events <- e:
+			default:
+				c.unwatch(w)
+			}
+		}
+	}
+}
+
+// unwatch closes the events of w unless already closed.
+func (c *FileClient) unwatch(w *fileWatcher) {
+	if c.watchers[w] {
+		delete(c.watchers, w)
+		close(w.events)
+	}
+}
+
+// save keeps the state of path in undo unless already kept, so that it's the
+// one before the transaction whatever the ops applied since.
+func (c *FileClient) save(undo fileUndo, path string) {
+	if _, saved := undo[path]; saved {
+		return
+	}
+	if n, found := c.nodes[path]; found {
+		prev := *n
+		undo[path] = &prev
+	} else {
+		undo[path] = nil
+	}
+}
+
+// rollback restores the nodes kept in undo. Nodes which didn't exist are
+// removed children first, then the rest are restored parents first, which
+// reattaches the deleted ones to their parents.
+func (c *FileClient) rollback(undo fileUndo) {
+	paths := make([]string, 0, len(undo))
+	for path := range undo {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for i := len(paths) - 1; i >= 0; i-- {
+		if undo[paths[i]] == nil {
+			c.remove(paths[i])
+		}
+	}
+	for _, path := range paths {
+		prev := undo[path]
+		if prev == nil {
+			continue
+		}
+		if n, found := c.nodes[path]; found {
+			n.value, n.createdIndex, n.modifiedIndex = prev.value, prev.createdIndex, prev.modifiedIndex
+			n.ephemeralOwner = prev.ephemeralOwner
+		} else {
+			c.load(&fileMutation {
+				Type: OpCreate, Path: path, Value: prev.value,
+				CreatedIndex: prev.createdIndex, ModifiedIndex: prev.modifiedIndex,
+				Session: prev.ephemeralOwner,
+			})
+		}
+	}
+}
+
+func (c *FileClient) remove(path string) {
+	delete(c.nodes, path)
+	parentPath, name := splitPath(path)
+	if parent, found := c.nodes[parentPath]; found {
+		delete(parent.children, name)
+	}
+}
+
+// recover replays every record of the log, truncating it at the first torn or
+// corrupted one.
+func (c *FileClient) recover() error {
+	if _, err := c.file.Seek(0, 0); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(c.file)
+	var offset int64 = 0
+	for {
+		record, n, err := readFileRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("truncating %s at offset %d: %s", c.path, offset, err)
+			if err := c.file.Truncate(offset); err != nil {
+				return err
+			}
+			if err := c.file.Sync(); err != nil {
+				return err
+			}
+			break
+		}
+
+		if record.Snapshot {
+			c.reset()
+		}
+		for _, m := range record.Mutations {
+			c.load(m)
+		}
+		if record.Index > c.index {
+			c.index = record.Index
+		}
+
+		offset += n
+		c.records++
+	}
+
+	c.size = offset
+	_, err := c.file.Seek(offset, 0)
+	return err
+}
+
+// append durably writes record at the end of the log. On failure the log is
+// truncated to its previous size so that no partial record is left behind.
+func (c *FileClient) append(record *fileRecord) error {
+	buf, err := encodeFileRecord(record)
+	if err != nil {
+		return err
+	}
+
+	if _, err = c.file.Write(buf); err == nil {
+		err = c.file.Sync()
+	}
+	if err != nil {
+		c.file.Truncate(c.size)
+		c.file.Seek(c.size, 0)
+		return err
+	}
+
+	c.size += int64(len(buf))
+	c.records++
+	return nil
+}
+
+// compact replaces the log with a single snapshot record of the current tree.
+func (c *FileClient) compact() error {
+	paths := make([]string, 0, len(c.nodes))
+	for path := range c.nodes {
+		paths = append(paths, path)
+	}
+	// parents always sort before their children, the root first
+	sort.Strings(paths)
+
+	sessions := make([]int64, 0, len(c.sessions))
+	for session := range c.sessions {
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i] < sessions[j] })
+
+	record := &fileRecord {
+		Index:     c.index,
+		Snapshot:  true,
+		Mutations: make([]*fileMutation, 0, len(sessions) + len(paths)),
+	}
+	for _, session := range sessions {
+		record.Mutations = append(record.Mutations, &fileMutation {
+			Type: fileOpenSession, Session: session, TTL: int64(c.sessions[session].ttl / time.Millisecond),
+		})
+	}
+	for _, path := range paths {
+		n := c.nodes[path]
+		record.Mutations = append(record.Mutations, &fileMutation {
+			Type: OpCreate, Path: path, Value: n.value,
+			CreatedIndex: n.createdIndex, ModifiedIndex: n.modifiedIndex, Session: n.ephemeralOwner,
+		})
+	}
+
+	buf, err := encodeFileRecord(record)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := c.path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(buf); err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, c.path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	syncDir(filepath.Dir(c.path))
+
+	c.file.Close()
+	c.file = f
+	c.size = int64(len(buf))
+	c.records = 1
+	return nil
+}
+
+func encodeFileRecord(record *fileRecord) ([]byte, error) {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, fileRecordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	copy(buf[fileRecordHeaderSize:], payload)
+	return buf, nil
+}
+
+func readFileRecord(r io.Reader) (*fileRecord, int64, error) {
+	var hdr [fileRecordHeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, 0, errFileCorrupted
+		}
+		return nil, 0, err
+	}
+
+	size := binary.BigEndian.Uint32(hdr[0:4])
+	if size > fileMaxRecordSize {
+		return nil, 0, errFileCorrupted
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, 0, errFileCorrupted
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(hdr[4:8]) {
+		return nil, 0, errFileCorrupted
+	}
+
+	record := &fileRecord {}
+	if err := json.Unmarshal(payload, record); err != nil {
+		return nil, 0, errFileCorrupted
+	}
+
+	return record, int64(fileRecordHeaderSize + len(payload)), nil
+}
+
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+func splitPath(path string) (string, string) {
+	i := strings.LastIndex(path, "/")
+	if i <= 0 {
+		return "/", path[i+1:]
+	}
+	return path[:i], path[i+1:]
+}
+
+func mapFileNode(path string, n *fileNode) *Node {
+	return &Node {
+		Path:          path,
+		Value:         n.value,
+		CreatedIndex:   n.createdIndex,
+		ModifiedIndex:  n.modifiedIndex,
+		EphemeralOwner: n.ephemeralOwner,
+	}
+}
@@ -0,0 +1,605 @@
+package kvstores
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestFileClient(t *testing.T) (*FileClient, string) {
+	dir, err := ioutil.TempDir("", "kvstores-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "data.db")
+
+	c, err := NewFileClient(path)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return c, path
+}
+
+func reopenFileClient(t *testing.T, c *FileClient, path string) *FileClient {
+	c.Close()
+	c, err := NewFileClient(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Size()
+}
+
+func expectFileData(t *testing.T, c *FileClient, path string, value string) {
+	n, err := c.GetData(context.Background(), path)
+	if err != nil {
+		t.Fatalf("%s: unexpected error: %s", path, err.String())
+	}
+	if n.Value != value {
+		t.Fatalf("%s: expected %q, got %q", path, value, n.Value)
+	}
+}
+
+func expectFileNoNode(t *testing.T, c *FileClient, path string) {
+	if err := c.Exists(context.Background(), path); err == nil || err.Code() != KeyNotFound {
+		t.Fatalf("%s: expected key not found, got %v", path, err)
+	}
+}
+
+func TestFileClientRecoverTruncatedTail(t *testing.T) {
+	ctx := context.Background()
+	c, path := newTestFileClient(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	for _, p := range []string{ "/a", "/a/b" } {
+		if err := c.Create(ctx, p, p); err != nil {
+			t.Fatal(err.String())
+		}
+	}
+	size := fileSize(t, path)
+
+	// a record whose header announces more bytes than there are, as left by
+	// a crash while appending
+	tail, err := encodeFileRecord(&fileRecord {
+		Index:     3,
+		Mutations: []*fileMutation{ { Type: OpCreate, Path: "/c", CreatedIndex: 3, ModifiedIndex: 3 } },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(tail[:len(tail)-3])
+	f.Close()
+
+	c = reopenFileClient(t, c, path)
+	defer c.Close()
+
+	if got := fileSize(t, path); got != size {
+		t.Fatalf("expected log to be truncated to %d bytes, got %d", size, got)
+	}
+	expectFileData(t, c, "/a", "/a")
+	expectFileData(t, c, "/a/b", "/a/b")
+	expectFileNoNode(t, c, "/c")
+
+	// appends resume where the valid records end
+	if err := c.Create(ctx, "/c", "c"); err != nil {
+		t.Fatal(err.String())
+	}
+	c = reopenFileClient(t, c, path)
+	expectFileData(t, c, "/c", "c")
+	if n, _ := c.GetData(ctx, "/c"); n.CreatedIndex != 3 {
+		t.Fatalf("expected created index 3, got %d", n.CreatedIndex)
+	}
+}
+
+func TestFileClientRecoverCorruptedTail(t *testing.T) {
+	ctx := context.Background()
+	c, path := newTestFileClient(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	if err := c.Create(ctx, "/a", "a"); err != nil {
+		t.Fatal(err.String())
+	}
+	size := fileSize(t, path)
+	if err := c.SetData(ctx, "/a", "b", -1); err != nil {
+		t.Fatal(err.String())
+	}
+
+	// flip the last byte of the second record so that its checksum fails
+	c.Close()
+	f, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := make([]byte, 1)
+	f.ReadAt(last, fileSize(t, path)-1)
+	last[0] ^= 0xff
+	f.WriteAt(last, fileSize(t, path)-1)
+	f.Close()
+
+	c, err = NewFileClient(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if got := fileSize(t, path); got != size {
+		t.Fatalf("expected log to be truncated to %d bytes, got %d", size, got)
+	}
+	expectFileData(t, c, "/a", "a")
+}
+
+func TestFileClientCompact(t *testing.T) {
+	ctx := context.Background()
+	c, path := newTestFileClient(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	for _, p := range []string{ "/a", "/a/b", "/a/b/c", "/d" } {
+		if err := c.Create(ctx, p, p); err != nil {
+			t.Fatal(err.String())
+		}
+	}
+	if err := c.SetData(ctx, "/a/b", "updated", -1); err != nil {
+		t.Fatal(err.String())
+	}
+	if err := c.Delete(ctx, "/d", -1); err != nil {
+		t.Fatal(err.String())
+	}
+	before := fileSize(t, path)
+
+	c.mutex.Lock()
+	err := c.compact()
+	records := c.records
+	c.mutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records != 1 {
+		t.Fatalf("expected a single snapshot record, got %d", records)
+	}
+	if after := fileSize(t, path); after >= before {
+		t.Fatalf("expected compaction to shrink the log (%d bytes), got %d", before, after)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("expected temporary snapshot to be renamed, got %v", err)
+	}
+
+	// records appended after the snapshot are replayed on top of it
+	if err := c.Create(ctx, "/e", "e"); err != nil {
+		t.Fatal(err.String())
+	}
+
+	c = reopenFileClient(t, c, path)
+	defer c.Close()
+
+	expectFileData(t, c, "/a", "/a")
+	expectFileData(t, c, "/a/b", "updated")
+	expectFileData(t, c, "/a/b/c", "/a/b/c")
+	expectFileData(t, c, "/e", "e")
+	expectFileNoNode(t, c, "/d")
+
+	n, _ := c.GetData(ctx, "/a/b")
+	if n.CreatedIndex != 2 || n.ModifiedIndex != 5 {
+		t.Fatalf("expected indexes 2/5, got %d/%d", n.CreatedIndex, n.ModifiedIndex)
+	}
+	if index, _ := c.Sync(ctx, "/"); index != 7 {
+		t.Fatalf("expected index 7, got %d", index)
+	}
+	children, _ := c.GetChildren(ctx, "/")
+	if len(children) != 2 || children[0] != "a" || children[1] != "e" {
+		t.Fatalf("unexpected children of /: %v", children)
+	}
+}
+
+func TestFileClientCompactRoot(t *testing.T) {
+	ctx := context.Background()
+	c, path := newTestFileClient(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	if err := c.Create(ctx, "/a", "a"); err != nil {
+		t.Fatal(err.String())
+	}
+	if err := c.SetData(ctx, "/", "root", -1); err != nil {
+		t.Fatal(err.String())
+	}
+
+	c.mutex.Lock()
+	err := c.compact()
+	c.mutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c = reopenFileClient(t, c, path)
+	defer c.Close()
+
+	expectFileData(t, c, "/", "root")
+	expectFileData(t, c, "/a", "a")
+	if n, _ := c.GetData(ctx, "/"); n.ModifiedIndex != 2 {
+		t.Fatalf("expected root modified index 2, got %d", n.ModifiedIndex)
+	}
+	children, _ := c.GetChildren(ctx, "/")
+	if len(children) != 1 || children[0] != "a" {
+		t.Fatalf("unexpected children of /: %v", children)
+	}
+
+	// the root is still versioned by its modified index
+	if err := c.SetData(ctx, "/", "updated", 2); err != nil {
+		t.Fatal(err.String())
+	}
+}
+
+func TestFileClientMultiRollback(t *testing.T) {
+	ctx := context.Background()
+	c, path := newTestFileClient(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	if err := c.Create(ctx, "/a", "a"); err != nil {
+		t.Fatal(err.String())
+	}
+	if err := c.Create(ctx, "/a/b", "b"); err != nil {
+		t.Fatal(err.String())
+	}
+	size := fileSize(t, path)
+
+	tests := []struct {
+		ops    []*Op
+		failed int
+		code   int
+	}{
+		{
+			ops: []*Op{
+				{ Type: OpCreate, Path: "/c", Data: "c" },
+				{ Type: OpSetData, Path: "/a", Data: "x", Version: -1 },
+				{ Type: OpDelete, Path: "/a/b", Version: -1 },
+				{ Type: OpCheck, Path: "/missing", Version: -1 },
+			},
+			failed: 3,
+			code:   KeyNotFound,
+		},
+		{
+			ops: []*Op{
+				{ Type: OpDelete, Path: "/a/b", Version: -1 },
+				{ Type: OpCreate, Path: "/a/b/c" },
+			},
+			failed: 1,
+			code:   KeyNotFound,
+		},
+		{
+			ops: []*Op{
+				{ Type: OpSetData, Path: "/a/b", Data: "x", Version: -1 },
+				{ Type: OpSetData, Path: "/a", Data: "x", Version: 2 },
+			},
+			failed: 1,
+			code:   BadVersion,
+		},
+		{
+			ops: []*Op{
+				{ Type: OpCreate, Path: "/c" },
+				{ Type: OpCreate, Path: "/c" },
+			},
+			failed: 1,
+			code:   KeyExists,
+		},
+		{
+			ops: []*Op{
+				{ Type: OpDelete, Path: "/a", Version: -1 },
+			},
+			failed: 0,
+			code:   NotEmpty,
+		},
+		// nodes changed more than once are restored to their state before
+		// the transaction, not to an intermediate one
+		{
+			ops: []*Op{
+				{ Type: OpSetData, Path: "/a/b", Data: "x", Version: -1 },
+				{ Type: OpDelete, Path: "/a/b", Version: -1 },
+				{ Type: OpCheck, Path: "/missing", Version: -1 },
+			},
+			failed: 2,
+			code:   KeyNotFound,
+		},
+		{
+			ops: []*Op{
+				{ Type: OpDelete, Path: "/a/b", Version: -1 },
+				{ Type: OpCreate, Path: "/a/b", Data: "x" },
+				{ Type: OpCreate, Path: "/a/b/c", Data: "x" },
+				{ Type: OpSetData, Path: "/a/b", Data: "y", Version: -1 },
+				{ Type: OpCheck, Path: "/missing", Version: -1 },
+			},
+			failed: 4,
+			code:   KeyNotFound,
+		},
+		{
+			ops: []*Op{
+				{ Type: OpCreate, Path: "/c", Data: "c" },
+				{ Type: OpCreate, Path: "/c/d", Data: "d" },
+				{ Type: OpDelete, Path: "/c/d", Version: -1 },
+				{ Type: OpDelete, Path: "/a/b", Version: -1 },
+				{ Type: OpDelete, Path: "/a", Version: -1 },
+				{ Type: OpCheck, Path: "/missing", Version: -1 },
+			},
+			failed: 5,
+			code:   KeyNotFound,
+		},
+	}
+
+	for i, test := range tests {
+		nodes, failed, err := c.Multi(ctx, test.ops)
+		if err == nil {
+			t.Fatalf("%d: expected multi to fail, got %v", i, nodes)
+		}
+		if failed != test.failed || err.Code() != test.code {
+			t.Fatalf("%d: expected op %d to fail with %d, got op %d with %d", i, test.failed, test.code, failed, err.Code())
+		}
+	}
+
+	check := func(c *FileClient) {
+		expectFileData(t, c, "/a", "a")
+		expectFileData(t, c, "/a/b", "b")
+		expectFileNoNode(t, c, "/c")
+		if n, _ := c.GetData(ctx, "/a/b"); n.CreatedIndex != 2 || n.ModifiedIndex != 2 {
+			t.Fatalf("expected /a/b indexes 2/2, got %d/%d", n.CreatedIndex, n.ModifiedIndex)
+		}
+		if index, _ := c.Sync(ctx, "/"); index != 2 {
+			t.Fatalf("expected index 2, got %d", index)
+		}
+		children, _ := c.GetChildren(ctx, "/a")
+		if len(children) != 1 || children[0] != "b" {
+			t.Fatalf("unexpected children of /a: %v", children)
+		}
+		if children, _ := c.GetChildren(ctx, "/a/b"); len(children) != 0 {
+			t.Fatalf("unexpected children of /a/b: %v", children)
+		}
+		if children, _ := c.GetChildren(ctx, "/"); len(children) != 1 || children[0] != "a" {
+			t.Fatalf("unexpected children of /: %v", children)
+		}
+	}
+
+	check(c)
+	if got := fileSize(t, path); got != size {
+		t.Fatalf("expected aborted transactions not to be logged, log grew from %d to %d bytes", size, got)
+	}
+
+	c = reopenFileClient(t, c, path)
+	defer c.Close()
+	check(c)
+}
+
+func TestFileClientSessions(t *testing.T) {
+	ctx := context.Background()
+	c, path := newTestFileClient(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	session, err := c.NewSession(ctx, time.Minute)
+	if err != nil {
+		t.Fatal(err.String())
+	}
+	other, err := c.NewSession(ctx, time.Minute)
+	if err != nil {
+		t.Fatal(err.String())
+	}
+	if err := c.CreateEphemeral(ctx, "/a", "a", session); err != nil {
+		t.Fatal(err.String())
+	}
+	if err := c.CreateEphemeral(ctx, "/a/b", "b", session); err == nil || err.Code() != NoChildrenForEphemerals {
+		t.Fatalf("expected ephemeral nodes not to have children, got %v", err)
+	}
+	if err := c.CreateEphemeral(ctx, "/c", "c", other); err != nil {
+		t.Fatal(err.String())
+	}
+	if err := c.Create(ctx, "/d", "d"); err != nil {
+		t.Fatal(err.String())
+	}
+	if err := c.CreateEphemeral(ctx, "/e", "e", 42); err == nil || err.Code() != KeyNotFound {
+		t.Fatalf("expected unknown sessions to be refused, got %v", err)
+	}
+	if n, _ := c.GetData(ctx, "/a"); n.EphemeralOwner != session {
+		t.Fatalf("expected /a to be owned by %d, got %d", session, n.EphemeralOwner)
+	}
+
+	// sessions and owners survive both replaying the log and compacting it
+	c = reopenFileClient(t, c, path)
+	c.mutex.Lock()
+	compactErr := c.compact()
+	c.mutex.Unlock()
+	if compactErr != nil {
+		t.Fatal(compactErr)
+	}
+	c = reopenFileClient(t, c, path)
+	defer c.Close()
+
+	if n, _ := c.GetData(ctx, "/a"); n.EphemeralOwner != session {
+		t.Fatalf("expected /a to be owned by %d, got %d", session, n.EphemeralOwner)
+	}
+	if err := c.KeepAlive(ctx, session); err != nil {
+		t.Fatal(err.String())
+	}
+
+	// closing a session deletes its ephemeral nodes only
+	if err := c.CloseSession(ctx, session); err != nil {
+		t.Fatal(err.String())
+	}
+	expectFileNoNode(t, c, "/a")
+	expectFileData(t, c, "/c", "c")
+	expectFileData(t, c, "/d", "d")
+	if err := c.KeepAlive(ctx, session); err == nil || err.Code() != KeyNotFound {
+		t.Fatalf("expected closed sessions not to be kept alive, got %v", err)
+	}
+	if err := c.CloseSession(ctx, session); err == nil || err.Code() != KeyNotFound {
+		t.Fatalf("expected closed sessions not to be closed again, got %v", err)
+	}
+
+	c = reopenFileClient(t, c, path)
+	expectFileNoNode(t, c, "/a")
+	expectFileData(t, c, "/c", "c")
+	if err := c.KeepAlive(ctx, session); err == nil || err.Code() != KeyNotFound {
+		t.Fatalf("expected closed sessions to stay closed, got %v", err)
+	}
+}
+
+func TestFileClientSessionExpiry(t *testing.T) {
+	ctx := context.Background()
+	c, path := newTestFileClient(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	kept, err := c.NewSession(ctx, 300 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err.String())
+	}
+	expired, err := c.NewSession(ctx, 300 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err.String())
+	}
+	if err := c.CreateEphemeral(ctx, "/kept", "", kept); err != nil {
+		t.Fatal(err.String())
+	}
+	if err := c.CreateEphemeral(ctx, "/expired", "", expired); err != nil {
+		t.Fatal(err.String())
+	}
+
+	for i := 0; i < 10; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if err := c.KeepAlive(ctx, kept); err != nil {
+			t.Fatalf("expected %d to be kept alive, got %s", kept, err.String())
+		}
+	}
+	expectFileData(t, c, "/kept", "")
+	expectFileNoNode(t, c, "/expired")
+	if err := c.KeepAlive(ctx, expired); err == nil || err.Code() != KeyNotFound {
+		t.Fatalf("expected %d to be expired, got %v", expired, err)
+	}
+
+	// restarting gives sessions a whole ttl before expiring them
+	c = reopenFileClient(t, c, path)
+	defer c.Close()
+	expectFileData(t, c, "/kept", "")
+	time.Sleep(600 * time.Millisecond)
+	expectFileNoNode(t, c, "/kept")
+}
+
+func TestFileClientWatch(t *testing.T) {
+	ctx := context.Background()
+	c, path := newTestFileClient(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	defer c.Close()
+
+	if err := c.Create(ctx, "/a", "a"); err != nil {
+		t.Fatal(err.String())
+	}
+
+	stop := make(chan struct{})
+	data, err := c.Watch(ctx, "/a", false, stop)
+	if err != nil {
+		t.Fatal(err.String())
+	}
+	children, err := c.Watch(ctx, "/a", true, stop)
+	if err != nil {
+		t.Fatal(err.String())
+	}
+	missing, err := c.Watch(ctx, "/b", false, stop)
+	if err != nil {
+		t.Fatal(err.String())
+	}
+
+	if err := c.Create(ctx, "/a/c", "c"); err != nil {
+		t.Fatal(err.String())
+	}
+	if err := c.SetData(ctx, "/a", "x", -1); err != nil {
+		t.Fatal(err.String())
+	}
+	if _, _, err := c.Multi(ctx, []*Op{
+		{ Type: OpDelete, Path: "/a/c", Version: -1 },
+		{ Type: OpDelete, Path: "/a", Version: -1 },
+		{ Type: OpCreate, Path: "/b", Data: "b" },
+	}); err != nil {
+		t.Fatal(err.String())
+	}
+	// failed transactions aren't notified
+	if _, _, err := c.Multi(ctx, []*Op{
+		{ Type: OpSetData, Path: "/b", Data: "x", Version: -1 },
+		{ Type: OpCheck, Path: "/missing", Version: -1 },
+	}); err == nil {
+		t.Fatal("expected multi to fail")
+	}
+	close(stop)
+
+	tests := []struct {
+		events   <-chan *Event
+		expected []Event
+	}{
+		{ data, []Event{ { EventDataChanged, "/a", 3 }, { EventDeleted, "/a", 4 } } },
+		{ children, []Event{
+			{ EventChildrenChanged, "/a", 2 }, { EventDataChanged, "/a", 3 },
+			{ EventChildrenChanged, "/a", 4 }, { EventDeleted, "/a", 4 },
+		} },
+		{ missing, []Event{ { EventCreated, "/b", 4 } } },
+	}
+	for i, test := range tests {
+		var got []Event
+		for e := range test.events {
+			got = append(got, *e)
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Fatalf("%d: expected %v, got %v", i, test.expected, got)
+		}
+	}
+}
+
+func TestFileClientWatchLost(t *testing.T) {
+	ctx := context.Background()
+	c, path := newTestFileClient(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	if err := c.Create(ctx, "/a", ""); err != nil {
+		t.Fatal(err.String())
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	slow, err := c.Watch(ctx, "/a", false, stop)
+	if err != nil {
+		t.Fatal(err.String())
+	}
+
+	// watchers falling behind lose their watch instead of blocking writes
+	for i := 0; i <= fileWatchBuffer; i++ {
+		if err := c.SetData(ctx, "/a", "", -1); err != nil {
+			t.Fatal(err.String())
+		}
+	}
+	n := 0
+	for range slow {
+		n++
+	}
+	if n != fileWatchBuffer {
+		t.Fatalf("expected %d events before losing the watch, got %d", fileWatchBuffer, n)
+	}
+
+	// closing the client closes every watch
+	closed, err := c.Watch(ctx, "/a", false, stop)
+	if err != nil {
+		t.Fatal(err.String())
+	}
+	c.Close()
+	for range closed {
+	}
+	if _, err := c.Watch(ctx, "/a", false, stop); err == nil {
+		t.Fatal("expected watches on a closed client to fail")
+	}
+}
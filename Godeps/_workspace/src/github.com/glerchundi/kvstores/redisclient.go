@@ -0,0 +1,705 @@
+package kvstores
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// idle connections kept around
+	redisPoolSize = 16
+	// keyspace notifications required by watches: keyspace events (K) of
+	// generic (g), hash (h) and sorted set (z) commands
+	redisNotifyEvents = "Kghz"
+)
+
+// Every znode is stored as a hash holding its data, the zxid of its creation
+// (czxid) and last modification (version) and the creation and modification
+// time in milliseconds (ctime, mtime). The names of the children of a znode
+// are kept in a sorted set and a global counter is used to assign zxids.
+const (
+	redisNodePrefix     = "node:"
+	redisChildrenPrefix = "children:"
+	redisZxidKey        = "zxid"
+)
+
+// redisMultiScript atomically validates and applies a list of operations. It
+// receives the current time followed by (type, path, data, version) tuples and
+// returns {1, zxid, czxid_1, version_1, ..., czxid_n, version_n} on success or
+// {0, index, code} with the failing operation and the error code (as defined
+// in this package).
+var redisMultiScript = newRedisScript(`
+local now = ARGV[1]
+local zxid = tonumber(redis.call('GET', 'zxid') or '0') + 1
+
+local nodes = {}
+local function node(path)
+  if nodes[path] == nil then
+    local h = redis.call('HMGET', 'node:' .. path, 'czxid', 'version')
+    if h[1] then
+      nodes[path] = { exists = true, czxid = tonumber(h[1]), version = tonumber(h[2]) }
+    else
+      nodes[path] = { exists = path == '/', czxid = 0, version = 0 }
+    end
+  end
+  return nodes[path]
+end
+
+local counts = {}
+local function count(path)
+  if counts[path] == nil then
+    counts[path] = redis.call('ZCARD', 'children:' .. path)
+  end
+  return counts[path]
+end
+
+local function parent(path)
+  local p = string.match(path, '^(.*)/[^/]*$')
+  if p == '' then return '/' end
+  return p
+end
+
+local n = (#ARGV - 1) / 4
+local result = { 1, zxid }
+
+-- validate every operation taking into account the previous ones
+for i = 0, n - 1 do
+  local op, path, version = tonumber(ARGV[2 + i*4]), ARGV[3 + i*4], tonumber(ARGV[5 + i*4])
+  local s = node(path)
+  if op == 1 then
+    if s.exists then return { 0, i, 5 } end
+    local p = parent(path)
+    if not node(p).exists then return { 0, i, 4 } end
+    s.exists, s.czxid, s.version = true, zxid, zxid
+    counts[p] = count(p) + 1
+    counts[path] = 0
+  else
+    if not s.exists then return { 0, i, 4 } end
+    if version ~= -1 and version ~= s.version then return { 0, i, 6 } end
+    if op == 2 then
+      if path == '/' then return { 0, i, 1 } end
+      if count(path) > 0 then return { 0, i, 7 } end
+      local p = parent(path)
+      s.exists = false
+      counts[p] = count(p) - 1
+    elseif op == 3 then
+      s.version = zxid
+    end
+  end
+  table.insert(result, s.czxid)
+  table.insert(result, s.version)
+end
+
+-- apply them
+local writes = false
+for i = 0, n - 1 do
+  local op, path, data = tonumber(ARGV[2 + i*4]), ARGV[3 + i*4], ARGV[4 + i*4]
+  local p, name = parent(path), string.match(path, '[^/]*$')
+  if op == 1 then
+    redis.call('HMSET', 'node:' .. path, 'data', data, 'czxid', zxid, 'version', zxid, 'ctime', now, 'mtime', now)
+    redis.call('ZADD', 'children:' .. p, 0, name)
+    writes = true
+  elseif op == 2 then
+    redis.call('DEL', 'node:' .. path)
+    redis.call('ZREM', 'children:' .. p, name)
+    writes = true
+  elseif op == 3 then
+    redis.call('HMSET', 'node:' .. path, 'data', data, 'version', zxid, 'mtime', now)
+    writes = true
+  end
+end
+
+if writes then
+  redis.call('SET', 'zxid', zxid)
+end
+
+return result
+`)
+
+// redisChildrenScript returns the children of a node or nil if it does not
+// exist.
+var redisChildrenScript = newRedisScript(`
+if ARGV[1] ~= '/' and redis.call('EXISTS', 'node:' .. ARGV[1]) == 0 then
+  return false
+end
+return redis.call('ZRANGE', 'children:' .. ARGV[1], 0, -1)
+`)
+
+type RedisClient struct {
+	addr        string
+	db          int
+	dialTimeout time.Duration
+	pool        chan *redisConn
+	endpoints   *endpoints
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+type redisScript struct {
+	src string
+	sha string
+}
+
+func newRedisScript(src string) *redisScript {
+	sum := sha1.Sum([]byte(src))
+	return &redisScript { src: src, sha: hex.EncodeToString(sum[:]) }
+}
+
+func NewRedisClient(addr string, db int, retry *RetryOptions, dialTimeout time.Duration) (*RedisClient, error) {
+	c := &RedisClient {
+		addr:        addr,
+		db:          db,
+		dialTimeout: dialTimeout,
+		pool:        make(chan *redisConn, redisPoolSize),
+	}
+
+	// a single endpoint, used for retries and the circuit breaker
+	c.endpoints = newEndpoints("redis", []string{ addr }, c.probe, retry)
+	if !c.endpoints.healthy() {
+		c.endpoints.close()
+		return nil, errors.New("cannot connect to redis: " + addr)
+	}
+
+	// watches rely on keyspace notifications, try enabling them
+	if err := c.enableNotifications(); err != nil {
+		log.Printf("unable to enable keyspace notifications, watches won't work: %s", err.String())
+	}
+
+	return c, nil
+}
+
+// Close stops probing the server and closes pooled connections.
+func (c *RedisClient) Close() error {
+	c.endpoints.close()
+	for {
+		select {
+		case conn := <-c.pool:
+			conn.close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (c *RedisClient) Create(ctx context.Context, path string, data string) *Error {
+	_, _, err := c.Multi(ctx, []*Op{ { Type: OpCreate, Path: path, Data: data } })
+	return err
+}
+
+func (c *RedisClient) Delete(ctx context.Context, path string, version int32) *Error {
+	_, _, err := c.Multi(ctx, []*Op{ { Type: OpDelete, Path: path, Version: version } })
+	return err
+}
+
+func (c *RedisClient) Exists(ctx context.Context, path string) *Error {
+	if path == "/" {
+		return nil
+	}
+
+	reply, err := c.do(ctx, "EXISTS", redisNodePrefix+path)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := reply.(int64); n == 0 {
+		return &Error { code: KeyNotFound }
+	}
+
+	return nil
+}
+
+func (c *RedisClient) GetData(ctx context.Context, path string) (*Node, *Error) {
+	reply, err := c.do(ctx, "HMGET", redisNodePrefix+path, "data", "czxid", "version")
+	if err != nil {
+		return nil, err
+	}
+
+	fields, ok := reply.([]interface{})
+	if !ok || len(fields) != 3 {
+		return nil, &Error { code: Unknown, msg: "unexpected reply" }
+	}
+
+	if fields[1] == nil {
+		// root always exists
+		if path == "/" {
+			return &Node { Path: path }, nil
+		}
+		return nil, &Error { code: KeyNotFound }
+	}
+
+	data, _ := fields[0].([]byte)
+	czxid, _ := fields[1].([]byte)
+	version, _ := fields[2].([]byte)
+
+	node := &Node { Path: path, Value: string(data) }
+	node.CreatedIndex, _ = strconv.ParseUint(string(czxid), 10, 64)
+	node.ModifiedIndex, _ = strconv.ParseUint(string(version), 10, 64)
+	return node, nil
+}
+
+func (c *RedisClient) SetData(ctx context.Context, path string, data string, version int32) *Error {
+	_, _, err := c.Multi(ctx, []*Op{ { Type: OpSetData, Path: path, Data: data, Version: version } })
+	return err
+}
+
+func (c *RedisClient) GetChildren(ctx context.Context, path string) ([]string, *Error) {
+	reply, err := c.eval(ctx, false, redisChildrenScript, path)
+	if err != nil {
+		return nil, err
+	}
+
+	if reply == nil {
+		return nil, &Error { code: KeyNotFound }
+	}
+
+	names, _ := reply.([]interface{})
+	children := make([]string, len(names))
+	for i, name := range names {
+		b, _ := name.([]byte)
+		children[i] = string(b)
+	}
+
+	return children, nil
+}
+
+// Sync returns the current zxid, reads are always up to date since there is a
+// single server.
+func (c *RedisClient) Sync(ctx context.Context, path string) (uint64, *Error) {
+	reply, err := c.do(ctx, "GET", redisZxidKey)
+	if err != nil {
+		return 0, err
+	}
+
+	b, _ := reply.([]byte)
+	zxid, _ := strconv.ParseUint(string(b), 10, 64)
+	return zxid, nil
+}
+
+func (c *RedisClient) Synced(index uint64) Client {
+	return c
+}
+
+func (c *RedisClient) Multi(ctx context.Context, ops []*Op) ([]*Node, int, *Error) {
+	args := []interface{} { time.Now().UnixNano() / int64(time.Millisecond) }
+	for i, op := range ops {
+		if op.Session != 0 {
+			return nil, i, &Error { code: Unimplemented, msg: "ephemeral nodes are not supported" }
+		}
+		args = append(args, op.Type, op.Path, op.Data, op.Version)
+	}
+
+	reply, err := c.eval(ctx, true, redisMultiScript, args...)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	result, _ := reply.([]interface{})
+	if len(result) < 2 {
+		return nil, -1, &Error { code: Unknown, msg: "unexpected reply" }
+	}
+
+	if ok, _ := result[0].(int64); ok == 0 {
+		if len(result) != 3 {
+			return nil, -1, &Error { code: Unknown, msg: "unexpected reply" }
+		}
+		failed, _ := result[1].(int64)
+		code, _ := result[2].(int64)
+		return nil, int(failed), &Error { code: int(code) }
+	}
+
+	if len(result) != 2+2*len(ops) {
+		return nil, -1, &Error { code: Unknown, msg: "unexpected reply" }
+	}
+
+	nodes := make([]*Node, len(ops))
+	for i, op := range ops {
+		czxid, _ := result[2+2*i].(int64)
+		version, _ := result[3+2*i].(int64)
+		nodes[i] = &Node {
+			Path:          op.Path,
+			CreatedIndex:  uint64(czxid),
+			ModifiedIndex: uint64(version),
+		}
+		if op.Type != OpCheck {
+			nodes[i].Value = op.Data
+		}
+	}
+
+	return nodes, -1, nil
+}
+
+// Watch subscribes to the keyspace notifications of the node (and its
+// children set) on a dedicated connection.
+func (c *RedisClient) Watch(ctx context.Context, path string, children bool, stop <-chan struct{}) (<-chan *Event, *Error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+
+	conn, err := c.dial()
+	if err != nil {
+		return nil, c.connError(ctx, err)
+	}
+
+	// subscribing can't outlive the deadline of ctx, the subscription can
+	deadline, _ := ctx.Deadline()
+	conn.conn.SetDeadline(deadline)
+
+	nodeChannel := c.keyspaceChannel(redisNodePrefix + path)
+	childrenChannel := c.keyspaceChannel(redisChildrenPrefix + path)
+	args := []interface{} { "SUBSCRIBE", nodeChannel }
+	if children {
+		args = append(args, childrenChannel)
+	}
+
+	if err := conn.send(args...); err != nil {
+		conn.close()
+		return nil, c.connError(ctx, err)
+	}
+
+	// wait for every subscription to be confirmed
+	for i := 1; i < len(args); i++ {
+		if _, err := conn.receive(); err != nil {
+			conn.close()
+			return nil, c.connError(ctx, err)
+		}
+	}
+	conn.conn.SetDeadline(time.Time{})
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-stop:
+		case <-done:
+		}
+		conn.close()
+	}()
+
+	events := make(chan *Event)
+	go func() {
+		defer close(events)
+		defer close(done)
+		for {
+			reply, err := conn.receive()
+			if err != nil {
+				return
+			}
+
+			msg, _ := reply.([]interface{})
+			if len(msg) != 3 {
+				continue
+			}
+			channel, _ := msg[1].([]byte)
+			name, _ := msg[2].([]byte)
+
+			event := c.mapNotification(path, string(channel) == childrenChannel, string(name))
+			if event == nil {
+				continue
+			}
+
+			select {
+			case events <- event:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+//
+// PRIVATE
+//
+
+// mapNotification translates a keyspace notification into an event. As both
+// creations and modifications are notified as hset, the node is read to tell
+// them apart: a node never modified since its creation has been created.
+func (c *RedisClient) mapNotification(path string, children bool, name string) *Event {
+	if children {
+		switch name {
+		case "zadd", "zrem":
+			return &Event { Type: EventChildrenChanged, Path: path, Index: c.zxid() }
+		}
+		return nil
+	}
+
+	switch name {
+	case "del":
+		return &Event { Type: EventDeleted, Path: path, Index: c.zxid() }
+	case "hset":
+		node, err := c.GetData(context.Background(), path)
+		if err != nil {
+			return nil
+		}
+		event := &Event { Type: EventDataChanged, Path: path, Index: node.ModifiedIndex }
+		if node.CreatedIndex == node.ModifiedIndex {
+			event.Type = EventCreated
+		}
+		return event
+	}
+
+	return nil
+}
+
+func (c *RedisClient) zxid() uint64 {
+	reply, err := c.do(context.Background(), "GET", redisZxidKey)
+	if err != nil {
+		return 0
+	}
+
+	b, _ := reply.([]byte)
+	zxid, _ := strconv.ParseUint(string(b), 10, 64)
+	return zxid
+}
+
+func (c *RedisClient) keyspaceChannel(key string) string {
+	return fmt.Sprintf("__keyspace@%d__:%s", c.db, key)
+}
+
+func (c *RedisClient) enableNotifications() *Error {
+	reply, err := c.do(context.Background(), "CONFIG", "GET", "notify-keyspace-events")
+	if err != nil {
+		return err
+	}
+
+	var current string
+	if values, _ := reply.([]interface{}); len(values) == 2 {
+		b, _ := values[1].([]byte)
+		current = string(b)
+	}
+
+	missing := ""
+	for _, flag := range redisNotifyEvents {
+		if !strings.ContainsRune(current, flag) && (flag == 'K' || !strings.ContainsRune(current, 'A')) {
+			missing += string(flag)
+		}
+	}
+
+	if missing == "" {
+		return nil
+	}
+
+	_, err = c.do(context.Background(), "CONFIG", "SET", "notify-keyspace-events", current+missing)
+	return err
+}
+
+func (c *RedisClient) eval(ctx context.Context, write bool, script *redisScript, args ...interface{}) (interface{}, *Error) {
+	reply, err := c.call(ctx, write, append([]interface{} { "EVALSHA", script.sha, 0 }, args...)...)
+	if err != nil && strings.HasPrefix(err.String(), "NOSCRIPT") {
+		reply, err = c.call(ctx, write, append([]interface{} { "EVAL", script.src, 0 }, args...)...)
+	}
+	return reply, err
+}
+
+func (c *RedisClient) Breaker() *Breaker {
+	return c.endpoints.breaker
+}
+
+func (c *RedisClient) probe(addr string) (bool, *Error) {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+
+	_, err := c.exec(ctx, "PING")
+	return false, err
+}
+
+// do sends a read command.
+func (c *RedisClient) do(ctx context.Context, args ...interface{}) (interface{}, *Error) {
+	return c.call(ctx, false, args...)
+}
+
+func (c *RedisClient) call(ctx context.Context, write bool, args ...interface{}) (interface{}, *Error) {
+	var reply interface{}
+	err := c.endpoints.do(ctx, write, func(context.Context, string) (err *Error) {
+		reply, err = c.exec(ctx, args...)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return reply, nil
+}
+
+// exec sends a command on a pooled connection, which can't outlive the
+// deadline of ctx.
+func (c *RedisClient) exec(ctx context.Context, args ...interface{}) (interface{}, *Error) {
+	conn, err := c.get()
+	if err != nil {
+		return nil, unreachableError(err)
+	}
+
+	deadline, _ := ctx.Deadline()
+	conn.conn.SetDeadline(deadline)
+
+	if err = conn.send(args...); err != nil {
+		conn.close()
+		return nil, c.connError(ctx, err)
+	}
+
+	reply, err := conn.receive()
+	if err != nil {
+		if rerr, ok := err.(redisError); ok {
+			c.put(conn)
+			return nil, &Error { code: Unknown, msg: string(rerr) }
+		}
+		conn.close()
+		return nil, c.connError(ctx, err)
+	}
+
+	c.put(conn)
+	return reply, nil
+}
+
+// connError maps a connection failure, which is a timeout rather than an
+// unreachable server if it was caused by the deadline of ctx. The connection
+// deadline, set to the one of ctx, may expire slightly before ctx does.
+func (c *RedisClient) connError(ctx context.Context, err error) *Error {
+	if cerr := contextError(ctx); cerr != nil {
+		return cerr
+	}
+	if _, ok := ctx.Deadline(); ok {
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			return &Error { code: Timeout, msg: context.DeadlineExceeded.Error() }
+		}
+	}
+	return unreachableError(err)
+}
+
+func (c *RedisClient) get() (*redisConn, error) {
+	select {
+	case conn := <-c.pool:
+		return conn, nil
+	default:
+		return c.dial()
+	}
+}
+
+func (c *RedisClient) put(conn *redisConn) {
+	conn.conn.SetDeadline(time.Time{})
+	select {
+	case c.pool <- conn:
+	default:
+		conn.close()
+	}
+}
+
+func (c *RedisClient) dial() (*redisConn, error) {
+	netConn, err := net.DialTimeout("tcp", c.addr, c.dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &redisConn {
+		conn: netConn,
+		r:    bufio.NewReader(netConn),
+		w:    bufio.NewWriter(netConn),
+	}
+
+	if c.db != 0 {
+		if err := conn.send("SELECT", c.db); err == nil {
+			_, err = conn.receive()
+		}
+		if err != nil {
+			conn.close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+func (c *redisConn) close() {
+	c.conn.Close()
+}
+
+// send writes a command as an array of bulk strings.
+func (c *redisConn) send(args ...interface{}) error {
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		var b []byte
+		switch v := arg.(type) {
+		case []byte:
+			b = v
+		case string:
+			b = []byte(v)
+		default:
+			b = []byte(fmt.Sprint(v))
+		}
+		fmt.Fprintf(c.w, "$%d\r\n", len(b))
+		c.w.Write(b)
+		c.w.WriteString("\r\n")
+	}
+	return c.w.Flush()
+}
+
+// receive reads a reply: simple strings are returned as string, integers as
+// int64, bulk strings as []byte (nil if null) and arrays as []interface{}.
+// Error replies are returned as redisError.
+func (c *redisConn) receive() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("malformed reply")
+	}
+	kind, line := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, redisError(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:size], nil
+	case '*':
+		count, err := strconv.Atoi(line)
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		values := make([]interface{}, count)
+		for i := range values {
+			values[i], err = c.receive()
+			if err != nil {
+				if _, ok := err.(redisError); !ok {
+					return nil, err
+				}
+				values[i] = err
+			}
+		}
+		return values, nil
+	}
+
+	return nil, errors.New("unknown reply type: " + string(kind))
+}
@@ -0,0 +1,741 @@
+package kvstores
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// fakeRedis is an in-process stand-in for a redis server speaking its
+// protocol. It implements the commands used by RedisClient, runs scripts on a
+// Lua 5.1 interpreter like redis does and publishes keyspace notifications as
+// configured by notify-keyspace-events.
+type fakeRedis struct {
+	listener net.Listener
+
+	mutex       sync.Mutex
+	dbs         map[int]map[string]interface{}
+	config      map[string]string
+	scripts     map[string]string
+	conns       map[*fakeRedisConn]bool
+	subscribers map[*fakeRedisConn]bool
+	evals       int
+	evalshas    int
+	// commands left unanswered, as by a hung server
+	stalled     map[string]bool
+}
+
+type fakeRedisConn struct {
+	conn     net.Conn
+	db       int
+	out      chan []byte
+	channels map[string]bool
+}
+
+// replies as returned by commands, besides int64, []byte, nil (null bulk
+// string) and []interface{}
+type fakeRedisStatus string
+type fakeRedisError string
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeRedis {
+		listener:    listener,
+		dbs:         make(map[int]map[string]interface{}),
+		config:      map[string]string { "notify-keyspace-events": "" },
+		scripts:     make(map[string]string),
+		conns:       make(map[*fakeRedisConn]bool),
+		subscribers: make(map[*fakeRedisConn]bool),
+		stalled:     make(map[string]bool),
+	}
+	go f.serve()
+
+	return f
+}
+
+func (f *fakeRedis) addr() string {
+	return f.listener.Addr().String()
+}
+
+func (f *fakeRedis) close() {
+	f.listener.Close()
+	f.mutex.Lock()
+	for c := range f.conns {
+		c.conn.Close()
+	}
+	f.mutex.Unlock()
+}
+
+func (f *fakeRedis) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		c := &fakeRedisConn { conn: conn, out: make(chan []byte, 1024) }
+		f.mutex.Lock()
+		f.conns[c] = true
+		f.mutex.Unlock()
+		go c.writeLoop()
+		go f.handle(c)
+	}
+}
+
+func (c *fakeRedisConn) writeLoop() {
+	for buf := range c.out {
+		if _, err := c.conn.Write(buf); err != nil {
+			c.conn.Close()
+		}
+	}
+}
+
+func (f *fakeRedis) handle(c *fakeRedisConn) {
+	defer func() {
+		f.mutex.Lock()
+		delete(f.conns, c)
+		delete(f.subscribers, c)
+		close(c.out)
+		f.mutex.Unlock()
+		c.conn.Close()
+	}()
+
+	r := bufio.NewReader(c.conn)
+	for {
+		args, err := readFakeRedisCommand(r)
+		if err != nil {
+			return
+		}
+
+		f.mutex.Lock()
+		reply := f.dispatch(c, args)
+		if reply != nil || strings.ToUpper(args[0]) != "SUBSCRIBE" {
+			c.out <- encodeFakeRedisReply(reply)
+		}
+		f.mutex.Unlock()
+	}
+}
+
+func readFakeRedisCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("unexpected command: %q", line)
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, count)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty command")
+	}
+	return args, nil
+}
+
+func encodeFakeRedisReply(reply interface{}) []byte {
+	switch v := reply.(type) {
+	case fakeRedisStatus:
+		return []byte("+" + string(v) + "\r\n")
+	case fakeRedisError:
+		return []byte("-" + string(v) + "\r\n")
+	case int64:
+		return []byte(":" + strconv.FormatInt(v, 10) + "\r\n")
+	case []byte:
+		return []byte("$" + strconv.Itoa(len(v)) + "\r\n" + string(v) + "\r\n")
+	case []interface{}:
+		buf := []byte("*" + strconv.Itoa(len(v)) + "\r\n")
+		for _, e := range v {
+			buf = append(buf, encodeFakeRedisReply(e)...)
+		}
+		return buf
+	}
+	return []byte("$-1\r\n")
+}
+
+func (f *fakeRedis) keys(db int) map[string]interface{} {
+	if f.dbs[db] == nil {
+		f.dbs[db] = make(map[string]interface{})
+	}
+	return f.dbs[db]
+}
+
+// notify publishes a keyspace notification if enabled for the class of event.
+func (f *fakeRedis) notify(db int, class rune, event string, key string) {
+	flags := f.config["notify-keyspace-events"]
+	if !strings.ContainsRune(flags, 'K') || !(strings.ContainsRune(flags, class) || strings.ContainsRune(flags, 'A')) {
+		return
+	}
+
+	channel := fmt.Sprintf("__keyspace@%d__:%s", db, key)
+	for c := range f.subscribers {
+		if c.channels[channel] {
+			c.out <- encodeFakeRedisReply([]interface{} { []byte("message"), []byte(channel), []byte(event) })
+		}
+	}
+}
+
+func (f *fakeRedis) dispatch(c *fakeRedisConn, args []string) interface{} {
+	keys := f.keys(c.db)
+	cmd := strings.ToUpper(args[0])
+	if f.stalled[cmd] {
+		return nil
+	}
+	switch cmd {
+	case "PING":
+		return fakeRedisStatus("PONG")
+	case "SELECT":
+		db, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fakeRedisError("ERR invalid DB index")
+		}
+		c.db = db
+		return fakeRedisStatus("OK")
+	case "CONFIG":
+		switch strings.ToUpper(args[1]) {
+		case "GET":
+			return []interface{} { []byte(args[2]), []byte(f.config[args[2]]) }
+		case "SET":
+			f.config[args[2]] = args[3]
+			return fakeRedisStatus("OK")
+		}
+	case "SUBSCRIBE":
+		if c.channels == nil {
+			c.channels = make(map[string]bool)
+		}
+		f.subscribers[c] = true
+		for _, channel := range args[1:] {
+			c.channels[channel] = true
+			c.out <- encodeFakeRedisReply([]interface{} {
+				[]byte("subscribe"), []byte(channel), int64(len(c.channels)),
+			})
+		}
+		return nil
+	case "EVAL":
+		f.evals++
+		sum := sha1.Sum([]byte(args[1]))
+		f.scripts[hex.EncodeToString(sum[:])] = args[1]
+		return f.eval(c, args[1], args[2:])
+	case "EVALSHA":
+		f.evalshas++
+		src, found := f.scripts[args[1]]
+		if !found {
+			return fakeRedisError("NOSCRIPT No matching script. Please use EVAL.")
+		}
+		return f.eval(c, src, args[2:])
+	}
+
+	return f.command(c.db, keys, cmd, args[1:])
+}
+
+// command runs the data commands, which scripts can call too.
+func (f *fakeRedis) command(db int, keys map[string]interface{}, cmd string, args []string) interface{} {
+	switch cmd {
+	case "EXISTS":
+		if _, found := keys[args[0]]; found {
+			return int64(1)
+		}
+		return int64(0)
+	case "GET":
+		if v, ok := keys[args[0]].(string); ok {
+			return []byte(v)
+		}
+		return nil
+	case "SET":
+		keys[args[0]] = args[1]
+		f.notify(db, '$', "set", args[0])
+		return fakeRedisStatus("OK")
+	case "DEL":
+		var n int64
+		for _, key := range args {
+			if _, found := keys[key]; found {
+				delete(keys, key)
+				f.notify(db, 'g', "del", key)
+				n++
+			}
+		}
+		return n
+	case "HMGET":
+		h, _ := keys[args[0]].(map[string]string)
+		values := make([]interface{}, len(args)-1)
+		for i, field := range args[1:] {
+			if v, found := h[field]; found {
+				values[i] = []byte(v)
+			}
+		}
+		return values
+	case "HMSET":
+		h, _ := keys[args[0]].(map[string]string)
+		if h == nil {
+			h = make(map[string]string)
+			keys[args[0]] = h
+		}
+		for i := 1; i+1 < len(args); i += 2 {
+			h[args[i]] = args[i+1]
+		}
+		f.notify(db, 'h', "hset", args[0])
+		return fakeRedisStatus("OK")
+	case "ZADD":
+		z, _ := keys[args[0]].(map[string]bool)
+		if z == nil {
+			z = make(map[string]bool)
+			keys[args[0]] = z
+		}
+		var added int64
+		for i := 2; i < len(args); i += 2 {
+			if !z[args[i]] {
+				z[args[i]] = true
+				added++
+			}
+		}
+		if added > 0 {
+			f.notify(db, 'z', "zadd", args[0])
+		}
+		return added
+	case "ZREM":
+		z, _ := keys[args[0]].(map[string]bool)
+		var removed int64
+		for _, member := range args[1:] {
+			if z[member] {
+				delete(z, member)
+				removed++
+			}
+		}
+		if removed > 0 {
+			f.notify(db, 'z', "zrem", args[0])
+			if len(z) == 0 {
+				delete(keys, args[0])
+				f.notify(db, 'g', "del", args[0])
+			}
+		}
+		return removed
+	case "ZCARD":
+		z, _ := keys[args[0]].(map[string]bool)
+		return int64(len(z))
+	case "ZRANGE":
+		z, _ := keys[args[0]].(map[string]bool)
+		members := make([]string, 0, len(z))
+		for member := range z {
+			members = append(members, member)
+		}
+		// every member has the same score, so they are sorted
+		// lexicographically
+		sort.Strings(members)
+		start, _ := strconv.Atoi(args[1])
+		stop, _ := strconv.Atoi(args[2])
+		if stop < 0 {
+			stop += len(members)
+		}
+		values := make([]interface{}, 0)
+		for i := start; i <= stop && i < len(members); i++ {
+			values = append(values, []byte(members[i]))
+		}
+		return values
+	}
+
+	return fakeRedisError("ERR unknown command '" + cmd + "'")
+}
+
+// eval runs src with the KEYS and ARGV tables set, converting values between
+// redis and Lua the way redis does.
+func (f *fakeRedis) eval(c *fakeRedisConn, src string, args []string) interface{} {
+	numKeys, err := strconv.Atoi(args[0])
+	if err != nil || numKeys > len(args)-1 {
+		return fakeRedisError("ERR invalid number of keys")
+	}
+
+	L := lua.NewState()
+	defer L.Close()
+
+	table := func(values []string) *lua.LTable {
+		t := L.NewTable()
+		for _, v := range values {
+			t.Append(lua.LString(v))
+		}
+		return t
+	}
+	L.SetGlobal("KEYS", table(args[1:1+numKeys]))
+	L.SetGlobal("ARGV", table(args[1+numKeys:]))
+
+	redis := L.NewTable()
+	L.SetField(redis, "call", L.NewFunction(func(L *lua.LState) int {
+		cmdArgs := make([]string, L.GetTop())
+		for i := range cmdArgs {
+			cmdArgs[i] = lua.LVAsString(L.Get(i + 1))
+		}
+		reply := f.command(c.db, f.keys(c.db), strings.ToUpper(cmdArgs[0]), cmdArgs[1:])
+		if rerr, ok := reply.(fakeRedisError); ok {
+			L.RaiseError("%s", string(rerr))
+		}
+		L.Push(toLuaValue(L, reply))
+		return 1
+	}))
+	L.SetGlobal("redis", redis)
+
+	if err := L.DoString(src); err != nil {
+		return fakeRedisError("ERR " + err.Error())
+	}
+	return fromLuaValue(L.Get(-1))
+}
+
+func toLuaValue(L *lua.LState, reply interface{}) lua.LValue {
+	switch v := reply.(type) {
+	case int64:
+		return lua.LNumber(v)
+	case []byte:
+		return lua.LString(v)
+	case fakeRedisStatus:
+		t := L.NewTable()
+		L.SetField(t, "ok", lua.LString(v))
+		return t
+	case []interface{}:
+		t := L.NewTable()
+		for _, e := range v {
+			t.Append(toLuaValue(L, e))
+		}
+		return t
+	}
+	return lua.LFalse
+}
+
+func fromLuaValue(v lua.LValue) interface{} {
+	switch v := v.(type) {
+	case lua.LNumber:
+		return int64(v)
+	case lua.LString:
+		return []byte(v)
+	case lua.LBool:
+		if v {
+			return int64(1)
+		}
+		return nil
+	case *lua.LTable:
+		if ok := v.RawGetString("ok"); ok != lua.LNil {
+			return fakeRedisStatus(lua.LVAsString(ok))
+		}
+		if err := v.RawGetString("err"); err != lua.LNil {
+			return fakeRedisError(lua.LVAsString(err))
+		}
+		values := make([]interface{}, 0)
+		for i := 1; ; i++ {
+			e := v.RawGetInt(i)
+			if e == lua.LNil {
+				break
+			}
+			values = append(values, fromLuaValue(e))
+		}
+		return values
+	}
+	return nil
+}
+
+func newTestRedisClient(t *testing.T, db int) (*RedisClient, *fakeRedis) {
+	f := newFakeRedis(t)
+	c, err := NewRedisClient(f.addr(), db, nil, time.Second)
+	if err != nil {
+		f.close()
+		t.Fatal(err)
+	}
+	return c, f
+}
+
+func expectRedisNode(t *testing.T, c *RedisClient, path string, value string, created uint64, modified uint64) {
+	n, err := c.GetData(context.Background(), path)
+	if err != nil {
+		t.Fatalf("%s: unexpected error: %s", path, err.String())
+	}
+	if n.Value != value || n.CreatedIndex != created || n.ModifiedIndex != modified {
+		t.Fatalf("%s: expected %q %d/%d, got %q %d/%d", path, value, created, modified, n.Value, n.CreatedIndex, n.ModifiedIndex)
+	}
+}
+
+func expectRedisZxid(t *testing.T, c *RedisClient, zxid uint64) {
+	if got, err := c.Sync(context.Background(), "/"); err != nil || got != zxid {
+		t.Fatalf("expected zxid %d, got %d (%v)", zxid, got, err)
+	}
+}
+
+func TestRedisClientMulti(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestRedisClient(t, 0)
+	defer f.close()
+
+	if err := c.Create(ctx, "/a", "a"); err != nil {
+		t.Fatal(err.String())
+	}
+	// the script is loaded by the first call and run by its hash from then on
+	if f.evals != 1 || f.evalshas != 1 {
+		t.Fatalf("expected EVALSHA to fall back to EVAL once, got %d EVAL and %d EVALSHA", f.evals, f.evalshas)
+	}
+
+	nodes, failed, err := c.Multi(ctx, []*Op{
+		{ Type: OpCreate, Path: "/a/b", Data: "b" },
+		{ Type: OpSetData, Path: "/a", Data: "x", Version: 1 },
+		{ Type: OpCheck, Path: "/a", Version: 2 },
+		{ Type: OpCreate, Path: "/a/b/c", Data: "c" },
+	})
+	if err != nil {
+		t.Fatalf("unexpected error at op %d: %s", failed, err.String())
+	}
+	if f.evals != 1 || f.evalshas != 2 {
+		t.Fatalf("expected the script to be cached, got %d EVAL and %d EVALSHA", f.evals, f.evalshas)
+	}
+	if nodes[0].CreatedIndex != 2 || nodes[1].CreatedIndex != 1 || nodes[1].ModifiedIndex != 2 || nodes[2].ModifiedIndex != 2 {
+		t.Fatalf("expected nodes to carry the multi zxid, got %+v %+v %+v", nodes[0], nodes[1], nodes[2])
+	}
+	expectRedisNode(t, c, "/a", "x", 1, 2)
+	expectRedisNode(t, c, "/a/b/c", "c", 2, 2)
+	expectRedisZxid(t, c, 2)
+
+	tests := []struct {
+		ops    []*Op
+		failed int
+		code   int
+	}{
+		{
+			ops: []*Op{
+				{ Type: OpCreate, Path: "/d" },
+				{ Type: OpCreate, Path: "/d" },
+			},
+			failed: 1,
+			code:   KeyExists,
+		},
+		{
+			ops: []*Op{
+				{ Type: OpCreate, Path: "/d" },
+				{ Type: OpSetData, Path: "/e", Version: -1 },
+			},
+			failed: 1,
+			code:   KeyNotFound,
+		},
+		{
+			ops: []*Op{
+				{ Type: OpCreate, Path: "/d" },
+				{ Type: OpCreate, Path: "/d/e/f" },
+			},
+			failed: 1,
+			code:   KeyNotFound,
+		},
+		{
+			ops: []*Op{
+				{ Type: OpCreate, Path: "/d" },
+				{ Type: OpSetData, Path: "/a", Version: 1 },
+			},
+			failed: 1,
+			code:   BadVersion,
+		},
+		{
+			ops: []*Op{
+				{ Type: OpCreate, Path: "/d" },
+				{ Type: OpDelete, Path: "/a/b", Version: -1 },
+			},
+			failed: 1,
+			code:   NotEmpty,
+		},
+		{
+			ops: []*Op{
+				{ Type: OpDelete, Path: "/", Version: -1 },
+			},
+			failed: 0,
+			code:   Unknown,
+		},
+	}
+	for i, test := range tests {
+		_, failed, err := c.Multi(ctx, test.ops)
+		if err == nil || failed != test.failed || err.Code() != test.code {
+			t.Fatalf("%d: expected op %d to fail with %d, got op %d with %v", i, test.failed, test.code, failed, err)
+		}
+	}
+
+	// aborted multis leave no trace
+	if err := c.Exists(ctx, "/d"); err == nil || err.Code() != KeyNotFound {
+		t.Fatalf("expected /d not to exist, got %v", err)
+	}
+	expectRedisZxid(t, c, 2)
+
+	// read only multis don't consume a zxid
+	if _, _, err := c.Multi(ctx, []*Op{ { Type: OpCheck, Path: "/a", Version: 2 } }); err != nil {
+		t.Fatal(err.String())
+	}
+	expectRedisZxid(t, c, 2)
+
+	// deleting the children first lets the parent be deleted in the same multi
+	if _, failed, err := c.Multi(ctx, []*Op{
+		{ Type: OpDelete, Path: "/a/b/c", Version: -1 },
+		{ Type: OpDelete, Path: "/a/b", Version: -1 },
+		{ Type: OpDelete, Path: "/a", Version: 2 },
+	}); err != nil {
+		t.Fatalf("unexpected error at op %d: %s", failed, err.String())
+	}
+	expectRedisZxid(t, c, 3)
+	if children, err := c.GetChildren(ctx, "/"); err != nil || len(children) != 0 {
+		t.Fatalf("expected / to have no children, got %v (%v)", children, err)
+	}
+
+	if _, _, err := c.Multi(ctx, []*Op{ { Type: OpCreate, Path: "/e", Session: 1 } }); err == nil || err.Code() != Unimplemented {
+		t.Fatalf("expected ephemeral nodes to be unimplemented, got %v", err)
+	}
+}
+
+func TestRedisClientGetChildren(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestRedisClient(t, 0)
+	defer f.close()
+
+	if _, err := c.GetChildren(ctx, "/a"); err == nil || err.Code() != KeyNotFound {
+		t.Fatalf("expected children of a missing node to fail, got %v", err)
+	}
+
+	for _, path := range []string{ "/a", "/c", "/b", "/a/z", "/a/y" } {
+		if err := c.Create(ctx, path, ""); err != nil {
+			t.Fatal(err.String())
+		}
+	}
+
+	for path, expected := range map[string]string {
+		"/":   "a,b,c",
+		"/a":  "y,z",
+		"/b":  "",
+	} {
+		children, err := c.GetChildren(ctx, path)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", path, err.String())
+		}
+		if got := strings.Join(children, ","); got != expected {
+			t.Fatalf("%s: expected children %q, got %q", path, expected, got)
+		}
+	}
+}
+
+func expectRedisEvent(t *testing.T, events <-chan *Event, eventType int, path string, index uint64) {
+	select {
+	case e, ok := <-events:
+		if !ok {
+			t.Fatalf("expected event %d on %s, watch was lost", eventType, path)
+		}
+		if e.Type != eventType || e.Path != path || e.Index != index {
+			t.Fatalf("expected event %d on %s at %d, got %d on %s at %d", eventType, path, index, e.Type, e.Path, e.Index)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected event %d on %s, got none", eventType, path)
+	}
+}
+
+func TestRedisClientWatch(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestRedisClient(t, 1)
+	defer f.close()
+
+	// notifications are enabled on connect
+	f.mutex.Lock()
+	flags := f.config["notify-keyspace-events"]
+	f.mutex.Unlock()
+	if flags != redisNotifyEvents {
+		t.Fatalf("expected keyspace notifications %q to be enabled, got %q", redisNotifyEvents, flags)
+	}
+
+	stop := make(chan struct{})
+	events, err := c.Watch(ctx, "/w", false, stop)
+	if err != nil {
+		t.Fatal(err.String())
+	}
+
+	c.Create(ctx, "/w", "a")
+	expectRedisEvent(t, events, EventCreated, "/w", 1)
+	c.SetData(ctx, "/w", "b", -1)
+	expectRedisEvent(t, events, EventDataChanged, "/w", 2)
+
+	// a children watch is notified of the node changes too, which are told
+	// apart by the keeper
+	children := make(chan struct{})
+	defer close(children)
+	childEvents, err := c.Watch(ctx, "/w", true, children)
+	if err != nil {
+		t.Fatal(err.String())
+	}
+
+	c.Create(ctx, "/w/c", "c")
+	expectRedisEvent(t, childEvents, EventChildrenChanged, "/w", 3)
+	c.SetData(ctx, "/w/c", "d", -1)
+	c.Delete(ctx, "/w/c", -1)
+	expectRedisEvent(t, childEvents, EventChildrenChanged, "/w", 5)
+
+	c.Delete(ctx, "/w", -1)
+	expectRedisEvent(t, events, EventDeleted, "/w", 6)
+	expectRedisEvent(t, childEvents, EventDeleted, "/w", 6)
+
+	// nothing was written to db 0
+	f.mutex.Lock()
+	written := len(f.dbs[0])
+	f.mutex.Unlock()
+	if written != 0 {
+		t.Fatalf("expected db 0 to be left untouched, got %d keys", written)
+	}
+
+	close(stop)
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Fatal("expected no more events once stopped")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected events to be closed once stopped")
+	}
+}
+
+func TestRedisClientWatchDeadline(t *testing.T) {
+	c, f := newTestRedisClient(t, 0)
+	defer f.close()
+
+	f.mutex.Lock()
+	f.stalled["SUBSCRIBE"] = true
+	f.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100 * time.Millisecond)
+	defer cancel()
+	stop := make(chan struct{})
+	defer close(stop)
+
+	start := time.Now()
+	if _, err := c.Watch(ctx, "/w", false, stop); err == nil || err.Code() != Timeout {
+		t.Fatalf("expected the watch to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the watch to give up at the deadline, took %s", elapsed)
+	}
+}
@@ -0,0 +1,209 @@
+package kvstores
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSOptions are the files used to secure the connections to a backend. All
+// of them are optional: without a certificate the client does not
+// authenticate itself and without a ca the system roots are used.
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
+}
+
+// NewTLSConfig returns a tls configuration which loads the files in opts and
+// reloads them, on the next handshake, whenever they change on disk.
+func NewTLSConfig(opts *TLSOptions) (*tls.Config, error) {
+	if (opts.CertFile == "") != (opts.KeyFile == "") {
+		return nil, errors.New("both cert and key are required for client authentication")
+	}
+
+	r := &tlsReloader { opts: *opts }
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config {}
+	if opts.CertFile != "" {
+		config.GetClientCertificate = r.clientCertificate
+	}
+	if opts.CAFile != "" {
+		// the chain is verified against the (reloadable) ca by verify, which
+		// requires the connections to be established by newTransport
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = r.verify
+	}
+
+	return config, nil
+}
+
+// newTransport returns an http transport dialing with a timeout and securing
+// connections with tlsConfig, if not nil. The name of the host dialed is only
+// reported to VerifyConnection if it's sent as server name indication, which
+// is never the case for ip addresses, so the transport passes it explicitly.
+func newTransport(tlsConfig *tls.Config, dialTimeout time.Duration) *http.Transport {
+	dial := func(network, addr string) (net.Conn, error) {
+		return net.DialTimeout(network, addr, dialTimeout)
+	}
+
+	transport := &http.Transport {
+		Dial:            dial,
+		TLSClientConfig: tlsConfig,
+	}
+	if tlsConfig == nil || tlsConfig.VerifyConnection == nil {
+		return transport
+	}
+
+	transport.DialTLS = func(network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		config := tlsConfig.Clone()
+		if config.ServerName == "" {
+			config.ServerName = host
+		}
+		verify := config.VerifyConnection
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			cs.ServerName = config.ServerName
+			return verify(cs)
+		}
+
+		conn, err := dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConn := tls.Client(conn, config)
+		conn.SetDeadline(time.Now().Add(dialTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+
+		return tlsConn, nil
+	}
+
+	return transport
+}
+
+// tlsReloader keeps the certificates loaded from disk up to date.
+type tlsReloader struct {
+	opts    TLSOptions
+
+	mutex   sync.Mutex
+	cert    *tls.Certificate
+	roots   *x509.CertPool
+	modTime time.Time
+}
+
+func (r *tlsReloader) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.maybeReload()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.cert, nil
+}
+
+func (r *tlsReloader) verify(cs tls.ConnectionState) error {
+	// without a name any certificate issued by the ca would be accepted
+	if cs.ServerName == "" {
+		return errors.New("tls: unable to verify the certificate of a server without its name")
+	}
+
+	r.maybeReload()
+
+	r.mutex.Lock()
+	roots := r.roots
+	r.mutex.Unlock()
+
+	opts := x509.VerifyOptions {
+		DNSName:       cs.ServerName,
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// maybeReload reloads the files if any of them changed. Failures are logged and
+// the previously loaded certificates kept, since files are usually replaced
+// non atomically.
+func (r *tlsReloader) maybeReload() {
+	r.mutex.Lock()
+	modTime := r.modTime
+	r.mutex.Unlock()
+
+	if r.lastModified().Equal(modTime) {
+		return
+	}
+
+	if err := r.reload(); err != nil {
+		log.Printf("unable to reload tls certificates: %s", err.Error())
+	}
+}
+
+func (r *tlsReloader) reload() error {
+	modTime := r.lastModified()
+
+	var cert *tls.Certificate
+	if r.opts.CertFile != "" {
+		c, err := tls.LoadX509KeyPair(r.opts.CertFile, r.opts.KeyFile)
+		if err != nil {
+			return err
+		}
+		cert = &c
+	}
+
+	var roots *x509.CertPool
+	if r.opts.CAFile != "" {
+		pem, err := ioutil.ReadFile(r.opts.CAFile)
+		if err != nil {
+			return err
+		}
+
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return errors.New("no certificates found in " + r.opts.CAFile)
+		}
+	}
+
+	r.mutex.Lock()
+	r.cert, r.roots, r.modTime = cert, roots, modTime
+	r.mutex.Unlock()
+
+	return nil
+}
+
+// lastModified returns the latest modification time of the files.
+func (r *tlsReloader) lastModified() time.Time {
+	var modTime time.Time
+	for _, file := range []string{ r.opts.CertFile, r.opts.KeyFile, r.opts.CAFile } {
+		if file == "" {
+			continue
+		}
+
+		if fi, err := os.Stat(file); err == nil && fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+	}
+
+	return modTime
+}
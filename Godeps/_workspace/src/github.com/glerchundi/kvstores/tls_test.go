@@ -0,0 +1,299 @@
+package kvstores
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate along with its key, issued by generateCert.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+var testSerial int64
+
+// generateCert issues a certificate valid from notBefore to notAfter, signed by
+// parent or self signed (a ca) if nil. Certificates with hosts are valid for
+// those names, the rest of them are client certificates.
+func generateCert(t *testing.T, name string, parent *testCert, hosts []string, notBefore, notAfter time.Time) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testSerial++
+	template := &x509.Certificate {
+		SerialNumber: big.NewInt(testSerial),
+		Subject:      pkix.Name { CommonName: name },
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{ x509.ExtKeyUsageClientAuth },
+	}
+	for _, host := range hosts {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{ x509.ExtKeyUsageServerAuth }
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.ExtKeyUsage = nil
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCert { cert: cert, key: key, der: der }
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate { Certificate: [][]byte{ c.der }, PrivateKey: c.key }
+}
+
+// write stores the certificate, and its key if keyFile is not empty, as pem
+// files modified at modTime.
+func (c *testCert) write(t *testing.T, certFile, keyFile string, modTime time.Time) {
+	certPem := pem.EncodeToMemory(&pem.Block { Type: "CERTIFICATE", Bytes: c.der })
+	if err := ioutil.WriteFile(certFile, certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(certFile, modTime, modTime)
+
+	if keyFile == "" {
+		return
+	}
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPem := pem.EncodeToMemory(&pem.Block { Type: "EC PRIVATE KEY", Bytes: der })
+	if err := ioutil.WriteFile(keyFile, keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(keyFile, modTime, modTime)
+}
+
+// newTestTLSServer serves the common name of the client certificate, if any,
+// presenting cert and requiring clients to authenticate if clientCA is set.
+func newTestTLSServer(cert *testCert, clientCA *testCert) *httptest.Server {
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) > 0 {
+			w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+		}
+	}))
+	s.TLS = &tls.Config { Certificates: []tls.Certificate{ cert.tlsCertificate() } }
+	if clientCA != nil {
+		s.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+		s.TLS.ClientCAs = x509.NewCertPool()
+		s.TLS.ClientCAs.AddCert(clientCA.cert)
+	}
+	s.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	s.StartTLS()
+	return s
+}
+
+// tlsGet sends a request to url through a new connection secured by config and
+// returns the body of the reply.
+func tlsGet(config *tls.Config, url string) (string, error) {
+	transport := newTransport(config, time.Second)
+	transport.DisableKeepAlives = true
+	client := &http.Client {
+		Transport: transport,
+		Timeout:   5 * time.Second,
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestTLSConfigVerifiesServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstores-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	ca := generateCert(t, "ca", nil, nil, now.Add(-time.Hour), now.Add(time.Hour))
+	otherCA := generateCert(t, "other ca", nil, nil, now.Add(-time.Hour), now.Add(time.Hour))
+	caFile := filepath.Join(dir, "ca.pem")
+	ca.write(t, caFile, "", now)
+
+	config, err := NewTLSConfig(&TLSOptions { CAFile: caFile })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		cert *testCert
+		ok   bool
+	}{
+		{ "valid", generateCert(t, "server", ca, []string{ "127.0.0.1" }, now.Add(-time.Hour), now.Add(time.Hour)), true },
+		{ "wrong ca", generateCert(t, "server", otherCA, []string{ "127.0.0.1" }, now.Add(-time.Hour), now.Add(time.Hour)), false },
+		{ "wrong hostname", generateCert(t, "server", ca, []string{ "etcd.example.com" }, now.Add(-time.Hour), now.Add(time.Hour)), false },
+		{ "expired", generateCert(t, "server", ca, []string{ "127.0.0.1" }, now.Add(-2 * time.Hour), now.Add(-time.Hour)), false },
+		{ "not yet valid", generateCert(t, "server", ca, []string{ "127.0.0.1" }, now.Add(time.Hour), now.Add(2 * time.Hour)), false },
+	}
+
+	for _, test := range tests {
+		s := newTestTLSServer(test.cert, nil)
+		_, err := tlsGet(config, s.URL)
+		s.Close()
+		if test.ok && err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.name, err)
+		}
+		if !test.ok && err == nil {
+			t.Fatalf("%s: expected the server certificate to be rejected", test.name)
+		}
+	}
+
+	// dialing an ip directly sends no server name to verify the certificate
+	// against, which must not skip the hostname check
+	s := newTestTLSServer(generateCert(t, "server", ca, []string{ "etcd.example.com" }, now.Add(-time.Hour), now.Add(time.Hour)), nil)
+	defer s.Close()
+	if conn, err := tls.Dial("tcp", s.Listener.Addr().String(), config); err == nil {
+		conn.Close()
+		t.Fatal("expected a connection without server name to be rejected")
+	}
+}
+
+func TestTLSConfigReloadsCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstores-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	oldCA := generateCert(t, "old ca", nil, nil, now.Add(-time.Hour), now.Add(time.Hour))
+	newCA := generateCert(t, "new ca", nil, nil, now.Add(-time.Hour), now.Add(time.Hour))
+	caFile := filepath.Join(dir, "ca.pem")
+	oldCA.write(t, caFile, "", now.Add(-time.Minute))
+
+	config, err := NewTLSConfig(&TLSOptions { CAFile: caFile })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestTLSServer(generateCert(t, "server", newCA, []string{ "127.0.0.1" }, now.Add(-time.Hour), now.Add(time.Hour)), nil)
+	defer s.Close()
+
+	if _, err := tlsGet(config, s.URL); err == nil {
+		t.Fatal("expected the server certificate to be rejected by the old ca")
+	}
+
+	// rotated ca files are picked up by the next handshake
+	newCA.write(t, caFile, "", now)
+	if _, err := tlsGet(config, s.URL); err != nil {
+		t.Fatalf("expected the server certificate to be accepted by the new ca, got %s", err)
+	}
+
+	// a broken ca file keeps the previously loaded one
+	if err := ioutil.WriteFile(caFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(caFile, now.Add(time.Minute), now.Add(time.Minute))
+	if _, err := tlsGet(config, s.URL); err != nil {
+		t.Fatalf("expected the new ca to be kept, got %s", err)
+	}
+}
+
+func TestTLSConfigReloadsClientCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstores-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	ca := generateCert(t, "ca", nil, nil, now.Add(-time.Hour), now.Add(time.Hour))
+	caFile, certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	ca.write(t, caFile, "", now.Add(-time.Minute))
+
+	expired := generateCert(t, "expired", ca, nil, now.Add(-2 * time.Hour), now.Add(-time.Hour))
+	expired.write(t, certFile, keyFile, now.Add(-time.Minute))
+
+	config, err := NewTLSConfig(&TLSOptions { CertFile: certFile, KeyFile: keyFile, CAFile: caFile })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestTLSServer(generateCert(t, "server", ca, []string{ "127.0.0.1" }, now.Add(-time.Hour), now.Add(time.Hour)), ca)
+	defer s.Close()
+
+	if _, err := tlsGet(config, s.URL); err == nil {
+		t.Fatal("expected the expired client certificate to be rejected")
+	}
+
+	renewed := generateCert(t, "renewed", ca, nil, now.Add(-time.Hour), now.Add(time.Hour))
+	renewed.write(t, certFile, keyFile, now)
+	name, err := tlsGet(config, s.URL)
+	if err != nil {
+		t.Fatalf("expected the renewed client certificate to be accepted, got %s", err)
+	}
+	if name != "renewed" {
+		t.Fatalf("expected the renewed client certificate to be presented, got %q", name)
+	}
+}
+
+func TestNewTLSConfigInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstores-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	garbage := filepath.Join(dir, "garbage.pem")
+	if err := ioutil.WriteFile(garbage, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opts := range []*TLSOptions {
+		{ CertFile: garbage },
+		{ CertFile: garbage, KeyFile: garbage },
+		{ CAFile: garbage },
+		{ CAFile: filepath.Join(dir, "missing.pem") },
+	} {
+		if _, err := NewTLSConfig(opts); err == nil {
+			t.Fatalf("%+v: expected an error", opts)
+		}
+	}
+}
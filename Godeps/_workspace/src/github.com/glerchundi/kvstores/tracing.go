@@ -0,0 +1,44 @@
+package kvstores
+
+import (
+	"context"
+	"net/http"
+)
+
+// Tracer creates spans around the requests sent to backends.
+type Tracer interface {
+	// StartSpan starts a span, child of the one in ctx if any, returning the
+	// context holding it and a function ending it with the request error.
+	StartSpan(ctx context.Context, name string, attrs map[string]interface{}) (context.Context, func(err *Error))
+	// Inject writes the span held by ctx, if any, to the headers of an http
+	// request so that the backend joins its trace.
+	Inject(ctx context.Context, header http.Header)
+}
+
+var tracer Tracer
+
+// SetTracer sets the tracer of every client, it must be called before sending
+// any request. Traces are propagated to etcd3 requests and consul
+// transactions, requests sent through the etcd and consul client libraries
+// are traced but can't carry the trace context.
+func SetTracer(t Tracer) {
+	tracer = t
+}
+
+// startSpan starts the span of a request sent to addr.
+func (e *endpoints) startSpan(ctx context.Context, addr string, write bool) (context.Context, func(*Error)) {
+	if tracer == nil {
+		return ctx, func(*Error) {}
+	}
+	return tracer.StartSpan(ctx, e.name + " request", map[string]interface{} {
+		"db.system":     e.name,
+		"net.peer.name": addr,
+		"write":         write,
+	})
+}
+
+func injectTrace(ctx context.Context, header http.Header) {
+	if tracer != nil {
+		tracer.Inject(ctx, header)
+	}
+}
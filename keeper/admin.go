@@ -0,0 +1,138 @@
+package keeper
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"sort"
+
+	kv "github.com/glerchundi/kvstores"
+	"github.com/glerchundi/parkeeper/log"
+	"github.com/glerchundi/parkeeper/metrics"
+)
+
+//
+// Admin server: reports the state of the server in json over http, modeled on
+// the AdminServer of zookeeper. Every command is served at /commands/<name>.
+//
+
+var adminCommands = map[string]func(*Server) (int, interface{}) {
+	"monitor":       (*Server).monitorCommand,
+	"connections":   (*Server).connectionsCommand,
+	"watches":       (*Server).watchesCommand,
+	"configuration": (*Server).configurationCommand,
+	"ruok":          (*Server).ruokCommand,
+	"backend":       (*Server).backendCommand,
+	"hot_spots":     (*Server).hotSpotsCommand,
+}
+
+// AdminHandler returns the handler of the admin server, which also exports
+// expvar variables at /debug/vars, prometheus metrics at /metrics and the log
+// level at /log/level, which can be changed with a PUT.
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/commands", s.listCommands)
+	for name, command := range adminCommands {
+		mux.HandleFunc("/commands/" + name, s.adminCommand(name, command))
+	}
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle("/log/level", log.LevelHandler())
+	return mux
+}
+
+func (s *Server) listCommands(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(adminCommands))
+	for name := range adminCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	writeAdminResponse(w, "commands", http.StatusOK, map[string][]string { "commands": names })
+}
+
+func (s *Server) adminCommand(name string, command func(*Server) (int, interface{})) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if (r.Method != "GET" && r.Method != "HEAD") {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		status, v := command(s)
+		writeAdminResponse(w, name, status, v)
+	}
+}
+
+// writeAdminResponse writes the fields of v along with the command name and
+// error, which is only set if the command failed, as zookeeper does.
+func writeAdminResponse(w http.ResponseWriter, name string, status int, v interface{}) {
+	fields := make(map[string]json.RawMessage)
+	if (v != nil) {
+		b, err := json.Marshal(v)
+		if (err == nil) {
+			err = json.Unmarshal(b, &fields)
+		}
+		if (err != nil) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	fields["command"], _ = json.Marshal(name)
+	fields["error"] = json.RawMessage("null")
+	if (status != http.StatusOK) {
+		fields["error"], _ = json.Marshal(http.StatusText(status))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(fields)
+}
+
+func (s *Server) monitorCommand() (int, interface{}) {
+	return http.StatusOK, s.monitorInfo()
+}
+
+func (s *Server) connectionsCommand() (int, interface{}) {
+	return http.StatusOK, map[string]interface{} { "connections": s.connectionsInfo() }
+}
+
+func (s *Server) watchesCommand() (int, interface{}) {
+	return http.StatusOK, s.watchesInfo()
+}
+
+func (s *Server) configurationCommand() (int, interface{}) {
+	return http.StatusOK, s.configurationInfo()
+}
+
+// hotSpotsCommand fails if hot spots are disabled.
+func (s *Server) hotSpotsCommand() (int, interface{}) {
+	info := s.hotSpotsInfo()
+	if (info == nil) {
+		return http.StatusNotFound, nil
+	}
+	return http.StatusOK, info
+}
+
+// ruokCommand always succeeds while the process is able to serve requests,
+// which makes it suitable for liveness probes.
+func (s *Server) ruokCommand() (int, interface{}) {
+	return http.StatusOK, nil
+}
+
+// backendCommand fails while the backend circuit breaker is open, which makes
+// it suitable for readiness probes.
+func (s *Server) backendCommand() (int, interface{}) {
+	state := s.backendState()
+	status := http.StatusOK
+	if (state == kv.BreakerOpen.String()) {
+		status = http.StatusServiceUnavailable
+	}
+	return status, map[string]interface{} {
+		"backend_state": state,
+		"healthy":       status == http.StatusOK,
+	}
+}
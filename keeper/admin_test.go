@@ -0,0 +1,157 @@
+package keeper
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// adminRequest sends a request to the admin server and returns the status
+// along with the decoded json reply.
+func adminRequest(t testing.TB, s *httptest.Server, method string, path string) (int, map[string]interface{}) {
+	req, err := http.NewRequest(method, s.URL + path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var fields map[string]interface{}
+	if (resp.Header.Get("Content-Type") == "application/json") {
+		if err := json.NewDecoder(resp.Body).Decode(&fields); err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode, fields
+}
+
+func TestAdminCommands(t *testing.T) {
+	fileClient, cleanup := newTestFileClient(t)
+	defer cleanup()
+
+	opts := DefaultOptions
+	opts.Version = "3.4.6"
+	opts.HotSpotsWindow = 0
+	s := NewServer("127.0.0.1:2181", fileClient, &opts)
+	admin := httptest.NewServer(s.AdminHandler())
+	defer admin.Close()
+
+	status, fields := adminRequest(t, admin, "GET", "/commands")
+	if status != http.StatusOK {
+		t.Fatalf("commands: unexpected status %d", status)
+	}
+	expected := []interface{}{ "backend", "configuration", "connections", "hot_spots", "monitor", "ruok", "watches" }
+	if !reflect.DeepEqual(fields["commands"], expected) {
+		t.Fatalf("commands: expected %v, got %v", expected, fields["commands"])
+	}
+
+	tests := []struct {
+		path   string
+		status int
+		fields map[string]interface{}
+	}{
+		{ "/commands/ruok", http.StatusOK, map[string]interface{} { "command": "ruok", "error": nil } },
+		{ "/commands/monitor", http.StatusOK, map[string]interface{} {
+			"command": "monitor", "error": nil,
+			"version": "3.4.6-parkeeper", "num_alive_connections": 0.0, "server_state": "standalone", "backend_state": "closed",
+		} },
+		{ "/commands/configuration", http.StatusOK, map[string]interface{} {
+			"command": "configuration", "error": nil,
+			"client_port_address": "127.0.0.1:2181", "max_client_cnxns": 60.0, "jute_maxbuffer": 1572864.0,
+			"four_letter_words": []interface{}{ "ruok", "srvr", "stat", "mntr" },
+		} },
+		{ "/commands/connections", http.StatusOK, map[string]interface{} { "command": "connections", "error": nil, "connections": []interface{}{} } },
+		{ "/commands/watches", http.StatusOK, map[string]interface{} {
+			"command": "watches", "error": nil,
+			"session_id_to_watched_paths": map[string]interface{}{}, "num_connections": 0.0, "num_paths": 0.0, "num_total_watches": 0.0,
+		} },
+		{ "/commands/backend", http.StatusOK, map[string]interface{} { "command": "backend", "error": nil, "backend_state": "closed", "healthy": true } },
+		// hot spots are disabled
+		{ "/commands/hot_spots", http.StatusNotFound, map[string]interface{} { "command": "hot_spots", "error": "Not Found" } },
+	}
+	for _, test := range tests {
+		status, fields := adminRequest(t, admin, "GET", test.path)
+		if status != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.path, test.status, status)
+		}
+		for name, value := range test.fields {
+			if !reflect.DeepEqual(fields[name], value) {
+				t.Errorf("%s: expected %s to be %#v, got %#v", test.path, name, value, fields[name])
+			}
+		}
+	}
+
+	// commands are read only
+	req, _ := http.NewRequest("POST", admin.URL + "/commands/ruok", strings.NewReader("{}"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != "GET, HEAD" {
+		t.Fatalf("expected POST to be rejected, got %d (Allow: %s)", resp.StatusCode, resp.Header.Get("Allow"))
+	}
+	if status, _ := adminRequest(t, admin, "GET", "/commands/stat"); status != http.StatusNotFound {
+		t.Fatalf("expected unknown commands to be not found, got %d", status)
+	}
+}
+
+func TestAdminHotSpots(t *testing.T) {
+	fileClient, cleanup := newTestFileClient(t)
+	defer cleanup()
+
+	opts := DefaultOptions
+	opts.HotSpotsWindow = time.Minute
+	opts.HotSpotsTop = 1
+	s := NewServer("127.0.0.1:2181", fileClient, &opts)
+	admin := httptest.NewServer(s.AdminHandler())
+	defer admin.Close()
+
+	s.hotSpots.record(opGetData, &GetDataReq { Path: newPath("/a") })
+	s.hotSpots.record(opGetData, &GetDataReq { Path: newPath("/a") })
+	s.hotSpots.record(opGetData, &GetDataReq { Path: newPath("/b") })
+	s.hotSpots.record(opSetData, &SetDataReq { Path: newPath("/b") })
+
+	status, fields := adminRequest(t, admin, "GET", "/commands/hot_spots")
+	if status != http.StatusOK {
+		t.Fatalf("unexpected status %d", status)
+	}
+	expected := map[string]interface{} {
+		"command":           "hot_spots",
+		"error":             nil,
+		"window":            60000.0,
+		"top_read_paths":    []interface{}{ map[string]interface{} { "path": "/a", "count": 2.0 } },
+		"top_written_paths": []interface{}{ map[string]interface{} { "path": "/b", "count": 1.0 } },
+	}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Fatalf("expected %v, got %v", expected, fields)
+	}
+}
+
+func TestAdminBackendBreakerOpen(t *testing.T) {
+	fileClient, cleanup := newTestFileClient(t)
+	defer cleanup()
+	breaker, closeBreaker := newOpenBreaker(t)
+	defer closeBreaker()
+
+	s := NewServer("127.0.0.1:2181", &breakerClient { Client: fileClient, breaker: breaker }, nil)
+	admin := httptest.NewServer(s.AdminHandler())
+	defer admin.Close()
+
+	// not ready, but still alive
+	status, fields := adminRequest(t, admin, "GET", "/commands/backend")
+	expected := map[string]interface{} { "command": "backend", "error": "Service Unavailable", "backend_state": "open", "healthy": false }
+	if status != http.StatusServiceUnavailable || !reflect.DeepEqual(fields, expected) {
+		t.Fatalf("expected %d %v, got %d %v", http.StatusServiceUnavailable, expected, status, fields)
+	}
+	if status, _ := adminRequest(t, admin, "GET", "/commands/ruok"); status != http.StatusOK {
+		t.Fatalf("ruok: unexpected status %d", status)
+	}
+}
@@ -0,0 +1,236 @@
+package keeper
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/glerchundi/parkeeper/log"
+)
+
+//
+// Audit log: records every mutating request as a json line, modeled on the
+// audit log of zookeeper 3.6. Disabled unless Options.AuditLog is set.
+//
+
+type auditRecord struct {
+	Time      string `json:"time"`
+	Session   string `json:"session"`
+	User      string `json:"user"`
+	IP        string `json:"ip"`
+	Operation string `json:"operation"`
+	Znode     string `json:"znode"`
+	ZnodeType string `json:"znode_type,omitempty"`
+	Acl       string `json:"acl,omitempty"`
+	Multi     bool   `json:"multi,omitempty"`
+	Result    string `json:"result"`
+	ErrorCode int32  `json:"error_code"`
+	Zxid      int64  `json:"zxid"`
+}
+
+// auditRequest writes the audit records of req, replied with rep, if it's a
+// mutating one. Operations of a multi are recorded one by one, every one of
+// them as failed if the multi is.
+func (k *Keeper) auditRequest(req interface{}, rep *OpRep) {
+	if rep == nil {
+		return
+	}
+
+	records := make([]*auditRecord, 0, 1)
+	if multi, ok := req.(*MultiReq); ok {
+		multiRep, _ := rep.Rep.(*MultiRep)
+		for i, op := range multi.Ops {
+			record := auditRecordOf(op.Op)
+			if record == nil {
+				continue
+			}
+			record.Multi = true
+			setAuditResult(record, rep.Hdr.Err, rep.Hdr.Zxid)
+			if (multiRep != nil && i < len(multiRep.Ops)) {
+				if (record.Operation == "create" && multiRep.Ops[i].Path != "") {
+					record.Znode = multiRep.Ops[i].Path
+				}
+				setAuditResult(record, multiRep.Ops[i].Hdr.Err, multiRep.Ops[i].Stat.ModifiedZxid)
+				// operations before the failing one are rolled back
+				if (multiRep.Ops[i].Hdr.OpCode == opMultiError) {
+					record.Result = "failure"
+				}
+			}
+			records = append(records, record)
+		}
+	} else if record := auditRecordOf(req); record != nil {
+		zxid := rep.Hdr.Zxid
+		switch r := rep.Rep.(type) {
+		case *CreateRep:
+			// sequential nodes are recorded by their actual path
+			record.Znode = r.Path
+		case *Create2Rep:
+			record.Znode = r.Path
+			if (zxid == 0) {
+				zxid = r.Stat.CreatedZxid
+			}
+		case *SetDataRep:
+			if (zxid == 0) {
+				zxid = r.Stat.ModifiedZxid
+			}
+		}
+		setAuditResult(record, rep.Hdr.Err, zxid)
+		records = append(records, record)
+	}
+	if len(records) == 0 {
+		return
+	}
+
+	ip := remoteIP(k.conn)
+	now := time.Now().Format(time.RFC3339Nano)
+	for _, record := range records {
+		record.Time = now
+		record.Session = fmt.Sprintf("0x%x", k.sessionId)
+		// no auth scheme is supported yet, clients are only identified by
+		// their address
+		record.User = "ip:" + ip
+		record.IP = ip
+
+		b, err := json.Marshal(record)
+		if err != nil {
+			continue
+		}
+		if _, err := k.audit.Write(append(b, '\n')); err != nil {
+			log.Error("unable to write audit log: ", err)
+			return
+		}
+	}
+}
+
+// auditRecordOf returns the record of req, without its result, if it's a
+// mutating request.
+func auditRecordOf(req interface{}) *auditRecord {
+	switch r := req.(type) {
+	case *CreateReq:
+		return &auditRecord { Operation: "create", Znode: r.Path.Value, ZnodeType: znodeType(r.Flags), Acl: aclString(r.Acls) }
+	case *Create2Req:
+		return &auditRecord { Operation: "create", Znode: r.Path.Value, ZnodeType: znodeType(r.Flags), Acl: aclString(r.Acls) }
+	case *DeleteReq:
+		return &auditRecord { Operation: "delete", Znode: r.Path.Value }
+	case *SetDataReq:
+		return &auditRecord { Operation: "setData", Znode: r.Path.Value }
+	case *SetAclReq:
+		return &auditRecord { Operation: "setAcl", Znode: r.Path.Value, Acl: aclString(r.Acls) }
+	}
+	return nil
+}
+
+func setAuditResult(record *auditRecord, errCode int32, zxid int64) {
+	record.Result = "success"
+	if (errCode != errOk) {
+		record.Result = "failure"
+	}
+	record.ErrorCode = errCode
+	record.Zxid = zxid
+}
+
+func znodeType(flags int32) string {
+	t := "persistent"
+	if (flags&flagEphemeral != 0) {
+		t = "ephemeral"
+	}
+	if (flags&flagSequence != 0) {
+		t += "_sequential"
+	}
+	return t
+}
+
+// aclString formats acls as zookeeper does: scheme:id:perms, comma separated.
+func aclString(acls []Acl) string {
+	s := make([]string, len(acls))
+	for i, acl := range acls {
+		perms := ""
+		for _, p := range []struct { bit int32; c string } { {1, "r"}, {2, "w"}, {4, "c"}, {8, "d"}, {16, "a"} } {
+			if (acl.Perms&p.bit != 0) {
+				perms += p.c
+			}
+		}
+		s[i] = acl.Id.Scheme + ":" + acl.Id.Id + ":" + perms
+	}
+	return strings.Join(s, ",")
+}
+
+// AuditFile is an audit log file rotated once it exceeds a size, keeping the
+// previous ones as path.1, path.2... up to a number of backups.
+type AuditFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mutex      sync.Mutex
+	file       *os.File
+	size       int64
+}
+
+// OpenAuditFile opens, or creates, the audit log file at path. It's never
+// rotated if maxSize isn't positive.
+func OpenAuditFile(path string, maxSize int64, maxBackups int) (*AuditFile, error) {
+	f := &AuditFile { path: path, maxSize: maxSize, maxBackups: maxBackups }
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *AuditFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// Write appends p, rotating the file first if p doesn't fit in it.
+func (f *AuditFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if (f.maxSize > 0 && f.size > 0 && f.size + int64(len(p)) > f.maxSize) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *AuditFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	// the file is reopened even if it couldn't be moved, growing instead of
+	// losing records
+	if (f.maxBackups > 0) {
+		for i := f.maxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i + 1))
+		}
+		os.Rename(f.path, f.path + ".1")
+	} else {
+		os.Remove(f.path)
+	}
+
+	return f.open()
+}
+
+func (f *AuditFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.file.Close()
+}
@@ -0,0 +1,248 @@
+package keeper
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a buffer safe to be written by several sessions.
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+// records returns the records written, failing unless every one of them was
+// written at a valid time.
+func (b *syncBuffer) records(t testing.TB) []auditRecord {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var records []auditRecord
+	dec := json.NewDecoder(bytes.NewReader(b.buf.Bytes()))
+	for dec.More() {
+		var record auditRecord
+		if err := dec.Decode(&record); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, record.Time); err != nil {
+			t.Fatalf("invalid time: %v", err)
+		}
+		record.Time = ""
+		records = append(records, record)
+	}
+	return records
+}
+
+// addrConn is a connection from addr.
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// multiPackets returns the packets of a multi request: hdr followed by the
+// header and request of every operation, given in pairs, and the done header.
+func multiPackets(hdr *OpReqHeader, ops ...interface{}) []interface{} {
+	packets := []interface{}{ hdr }
+	for i := 0; i < len(ops); i += 2 {
+		opHdr := ops[i].(MultiHeader)
+		packets = append(packets, &opHdr, ops[i + 1])
+	}
+	return append(packets, &MultiHeader { OpCode: -1, Done: true, Err: -1 })
+}
+
+func TestAuditRequests(t *testing.T) {
+	fileClient, cleanup := newTestFileClient(t)
+	defer cleanup()
+
+	audit := &syncBuffer {}
+	opts := DefaultOptions
+	opts.AuditLog = audit
+	s, stop := newTestServer(t, fileClient, &opts)
+	defer stop()
+
+	conn, err := net.Dial("tcp", s.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	rep := connect(t, conn)
+
+	acls := []Acl{ { Perms: 31, Id: Id { Scheme: "world", Id: "anyone" } } }
+	requests := [][]interface{} {
+		{ &OpReqHeader { Xid: 1, OpCode: opCreate }, &CreateReq { Path: newPath("/a"), Data: []byte("a"), Acls: acls } },
+		{ &OpReqHeader { Xid: 2, OpCode: opSetData }, &SetDataReq { Path: newPath("/a"), Data: []byte("a1"), Version: -1 } },
+		// reads aren't recorded
+		{ &OpReqHeader { Xid: 3, OpCode: opGetData }, &GetDataReq { Path: newPath("/a") } },
+		{ &OpReqHeader { Xid: 4, OpCode: opDelete }, &DeleteReq { Path: newPath("/missing"), Version: -1 } },
+		multiPackets(&OpReqHeader { Xid: 5, OpCode: opMulti },
+			MultiHeader { OpCode: opCreate }, &CreateReq { Path: newPath("/m"), Acls: acls, Flags: flagEphemeral },
+			MultiHeader { OpCode: opSetData }, &SetDataReq { Path: newPath("/a"), Data: []byte("a2"), Version: -1 },
+		),
+		// every operation of a failed multi fails
+		multiPackets(&OpReqHeader { Xid: 6, OpCode: opMulti },
+			MultiHeader { OpCode: opCreate }, &CreateReq { Path: newPath("/n"), Acls: acls },
+			MultiHeader { OpCode: opDelete }, &DeleteReq { Path: newPath("/missing"), Version: -1 },
+			MultiHeader { OpCode: opSetData }, &SetDataReq { Path: newPath("/a"), Data: []byte("a3"), Version: -1 },
+		),
+	}
+	for _, request := range requests {
+		writeFrame(t, conn, request...)
+		readReply(t, conn, nil)
+	}
+
+	ip := strings.Split(conn.LocalAddr().String(), ":")[0]
+	session := fmt.Sprintf("0x%x", rep.SessionId)
+	// single creates and sets don't reply the stats of the node
+	expected := []auditRecord {
+		{ Operation: "create", Znode: "/a", ZnodeType: "persistent", Acl: "world:anyone:rwcda", Result: "success" },
+		{ Operation: "setData", Znode: "/a", Result: "success" },
+		{ Operation: "delete", Znode: "/missing", Result: "failure", ErrorCode: errNoNode },
+		{ Operation: "create", Znode: "/m", ZnodeType: "ephemeral", Acl: "world:anyone:rwcda", Multi: true, Result: "success", Zxid: 4 },
+		{ Operation: "setData", Znode: "/a", Multi: true, Result: "success", Zxid: 4 },
+		{ Operation: "create", Znode: "/n", ZnodeType: "persistent", Acl: "world:anyone:rwcda", Multi: true, Result: "failure" },
+		{ Operation: "delete", Znode: "/missing", Multi: true, Result: "failure", ErrorCode: errNoNode },
+		{ Operation: "setData", Znode: "/a", Multi: true, Result: "failure", ErrorCode: errRuntimeInconsistency },
+	}
+	for i := range expected {
+		expected[i].Session, expected[i].User, expected[i].IP = session, "ip:" + ip, ip
+	}
+	if records := audit.records(t); !reflect.DeepEqual(records, expected) {
+		t.Fatalf("expected records:\n%+v\ngot:\n%+v", expected, records)
+	}
+}
+
+// Sequential nodes are recorded by the path they were created at, which is
+// only known once replied.
+func TestAuditSequentialPaths(t *testing.T) {
+	audit := &syncBuffer {}
+	k := &Keeper {
+		conn:      &addrConn { addr: &net.TCPAddr { IP: net.IPv4(10, 0, 0, 1), Port: 40000 } },
+		audit:     audit,
+		sessionId: 0x100,
+	}
+
+	k.auditRequest(
+		&CreateReq { Path: newPath("/lock-"), Flags: flagEphemeral | flagSequence },
+		newRep(1, 5, errOk, &CreateRep { Path: "/lock-0000000004" }),
+	)
+	k.auditRequest(
+		&Create2Req { Path: newPath("/q-"), Flags: flagSequence },
+		newRep(2, 0, errOk, &Create2Rep { Path: "/q-0000000005", Stat: Stat { CreatedZxid: 6, ModifiedZxid: 6 } }),
+	)
+	k.auditRequest(
+		&MultiReq { Ops: []MultiReqOp{
+			{ Hdr: MultiHeader { OpCode: opCreate }, Op: &CreateReq { Path: newPath("/q-"), Flags: flagSequence } },
+		} },
+		newRep(3, 0, errOk, &MultiRep { Ops: []MultiRepOp{
+			{ Hdr: MultiHeader { OpCode: opCreate }, Path: "/q-0000000006", Stat: Stat { CreatedZxid: 7, ModifiedZxid: 7 } },
+		} }),
+	)
+
+	expected := []auditRecord {
+		{ Operation: "create", Znode: "/lock-0000000004", ZnodeType: "ephemeral_sequential", Result: "success", Zxid: 5 },
+		{ Operation: "create", Znode: "/q-0000000005", ZnodeType: "persistent_sequential", Result: "success", Zxid: 6 },
+		{ Operation: "create", Znode: "/q-0000000006", ZnodeType: "persistent_sequential", Multi: true, Result: "success", Zxid: 7 },
+	}
+	for i := range expected {
+		expected[i].Session, expected[i].User, expected[i].IP = "0x100", "ip:10.0.0.1", "10.0.0.1"
+	}
+	if records := audit.records(t); !reflect.DeepEqual(records, expected) {
+		t.Fatalf("expected records:\n%+v\ngot:\n%+v", expected, records)
+	}
+}
+
+// expectFiles fails unless the files of dir hold the expected content.
+func expectFiles(t testing.TB, dir string, expected map[string]string) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, entry := range entries {
+		b, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[entry.Name()] = string(b)
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Fatalf("expected files %q, got %q", expected, files)
+	}
+}
+
+func TestAuditFileRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	// two records fit in a file
+	f, err := OpenAuditFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(f *AuditFile, record string) {
+		if _, err := f.Write([]byte(record)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(f, "r1\n")
+	write(f, "r2\n")
+	write(f, "r3\n")
+	expectFiles(t, dir, map[string]string { "audit.log": "r1\nr2\nr3\n" })
+	write(f, "r4\n")
+	expectFiles(t, dir, map[string]string { "audit.log": "r4\n", "audit.log.1": "r1\nr2\nr3\n" })
+
+	// the oldest backups are dropped
+	write(f, "r5.....\n")
+	expectFiles(t, dir, map[string]string { "audit.log": "r5.....\n", "audit.log.1": "r4\n", "audit.log.2": "r1\nr2\nr3\n" })
+	write(f, "r6.....\n")
+	write(f, "r7.....\n")
+	expectFiles(t, dir, map[string]string { "audit.log": "r7.....\n", "audit.log.1": "r6.....\n", "audit.log.2": "r5.....\n" })
+
+	// the size of the file is kept across restarts
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if f, err = OpenAuditFile(path, 10, 2); err != nil {
+		t.Fatal(err)
+	}
+	write(f, "r8\n")
+	expectFiles(t, dir, map[string]string { "audit.log": "r8\n", "audit.log.1": "r7.....\n", "audit.log.2": "r6.....\n" })
+
+	// records bigger than a file are written to one of their own
+	write(f, "r9............\n")
+	write(f, "r10\n")
+	expectFiles(t, dir, map[string]string { "audit.log": "r10\n", "audit.log.1": "r9............\n", "audit.log.2": "r8\n" })
+	f.Close()
+
+	// without backups the file is truncated
+	if f, err = OpenAuditFile(path, 10, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	write(f, "r11......\n")
+	expectFiles(t, dir, map[string]string { "audit.log": "r11......\n", "audit.log.1": "r9............\n", "audit.log.2": "r8\n" })
+}
@@ -0,0 +1,60 @@
+package keeper
+
+import (
+	"sync"
+)
+
+// bufferClasses are the sizes of the pooled frame buffers, most frames fit in
+// the smallest ones and only a few (big znodes or children lists) require the
+// biggest ones. Bigger frames, up to the max buffer, aren't pooled.
+var bufferClasses = []int { 512, 4 * 1024, 64 * 1024, 1024 * 1024 }
+
+// bufferPool is implemented by sync.Pool, tests track the buffers going
+// through it.
+type bufferPool interface {
+	Get() interface{}
+	Put(interface{})
+}
+
+var bufferPools = func() []bufferPool {
+	pools := make([]bufferPool, len(bufferClasses))
+	for i := range bufferClasses {
+		size := bufferClasses[i]
+		pools[i] = &sync.Pool {
+			New: func() interface{} { return make([]byte, size) },
+		}
+	}
+	return pools
+}()
+
+// bufferClass returns the index of the smallest class holding size bytes, or
+// -1 if none does.
+func bufferClass(size int) int {
+	for i, classSize := range bufferClasses {
+		if size <= classSize {
+			return i
+		}
+	}
+	return -1
+}
+
+// allocBuffer returns a buffer of size bytes, to be released with freeBuffer.
+func allocBuffer(size int) []byte {
+	i := bufferClass(size)
+	if i < 0 {
+		return make([]byte, size)
+	}
+	return bufferPools[i].Get().([]byte)[:size]
+}
+
+// freeBuffer returns buf to its pool, it must not be used afterwards.
+func freeBuffer(buf []byte) {
+	if buf == nil {
+		return
+	}
+
+	buf = buf[:cap(buf)]
+	if i := bufferClass(len(buf)); i >= 0 && bufferClasses[i] == len(buf) {
+		bufferPools[i].Put(buf)
+	}
+}
@@ -0,0 +1,191 @@
+package keeper
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// trackingPool records the buffers of a class handed out, failing on buffers
+// returned twice or not taken from it.
+type trackingPool struct {
+	pool      sync.Pool
+	size      int
+
+	mutex     sync.Mutex
+	out       map[*byte]bool
+	gets      int
+	errors    []string
+}
+
+func newTrackingPool(size int) *trackingPool {
+	p := &trackingPool { size: size, out: make(map[*byte]bool) }
+	p.pool.New = func() interface{} { return make([]byte, size) }
+	return p
+}
+
+func (p *trackingPool) Get() interface{} {
+	buf := p.pool.Get().([]byte)
+
+	p.mutex.Lock()
+	p.out[&buf[0]] = true
+	p.gets++
+	p.mutex.Unlock()
+
+	return buf
+}
+
+func (p *trackingPool) Put(v interface{}) {
+	buf := v.([]byte)
+
+	p.mutex.Lock()
+	if len(buf) != p.size {
+		p.errors = append(p.errors, fmt.Sprintf("%d bytes buffer returned to the %d bytes class", len(buf), p.size))
+	} else if !p.out[&buf[0]] {
+		p.errors = append(p.errors, fmt.Sprintf("%d bytes buffer returned twice or not taken from its class", p.size))
+	}
+	delete(p.out, &buf[0])
+	p.mutex.Unlock()
+
+	p.pool.Put(buf)
+}
+
+// trackBuffers replaces the buffer pools by tracking ones, restored by the
+// returned function which fails on buffers not returned exactly once.
+func trackBuffers(t *testing.T) ([]*trackingPool, func()) {
+	pools := bufferPools
+	tracked := make([]*trackingPool, len(bufferClasses))
+	bufferPools = make([]bufferPool, len(bufferClasses))
+	for i, size := range bufferClasses {
+		tracked[i] = newTrackingPool(size)
+		bufferPools[i] = tracked[i]
+	}
+
+	return tracked, func() {
+		bufferPools = pools
+		for _, p := range tracked {
+			for _, err := range p.errors {
+				t.Error(err)
+			}
+			if len(p.out) > 0 {
+				t.Errorf("%d buffers of %d bytes were never returned", len(p.out), p.size)
+			}
+		}
+	}
+}
+
+// dataRep returns a reply whose frame takes size bytes: size prefix, header,
+// data length, data and stat.
+func dataRep(size int) Rep {
+	return &OpRep { Hdr: &OpRepHeader {}, Rep: &GetDataRep { Data: make([]byte, size - 92) } }
+}
+
+func TestEncodeFrameClasses(t *testing.T) {
+	pools, check := trackBuffers(t)
+	defer check()
+
+	maxBuffer := DefaultOptions.MaxBuffer
+	tests := []struct {
+		size  int
+		class int
+	}{
+		{ 511, 0 }, { 512, 0 }, { 513, 1 },
+		{ 4095, 1 }, { 4096, 1 }, { 4097, 2 },
+		{ 65535, 2 }, { 65536, 2 }, { 65537, 3 },
+		{ 1048575, 3 }, { 1048576, 3 },
+		// bigger frames are held by an unpooled buffer fitting any frame
+		{ 1048577, -1 }, { 4 + maxBuffer, -1 },
+	}
+	for _, test := range tests {
+		gets := make([]int, len(pools))
+		for i, p := range pools {
+			gets[i] = p.gets
+		}
+
+		buf, err := encodeFrame(dataRep(test.size), maxBuffer)
+		if err != nil {
+			t.Fatalf("%d bytes: unexpected error: %s", test.size, err)
+		}
+		if len(buf) != test.size {
+			t.Fatalf("%d bytes: got a %d bytes frame", test.size, len(buf))
+		}
+		expectedCap := 4 + maxBuffer
+		if test.class >= 0 {
+			expectedCap = bufferClasses[test.class]
+		}
+		if cap(buf) != expectedCap {
+			t.Fatalf("%d bytes: expected a %d bytes buffer, got %d", test.size, expectedCap, cap(buf))
+		}
+
+		// every smaller class was tried once, and its buffer returned, before
+		// retrying with the next one
+		for i, p := range pools {
+			expected := 0
+			if test.class < 0 || i <= test.class {
+				expected = 1
+			}
+			if p.gets - gets[i] != expected {
+				t.Fatalf("%d bytes: expected %d buffers of %d bytes, got %d", test.size, expected, p.size, p.gets - gets[i])
+			}
+		}
+		freeBuffer(buf)
+	}
+
+	// frames over the max buffer are refused, returning every buffer tried
+	if _, err := encodeFrame(dataRep(5 + maxBuffer), maxBuffer); err == nil {
+		t.Fatal("expected frames over the max buffer to be refused")
+	}
+}
+
+func TestBufferPoolsSoak(t *testing.T) {
+	_, check := trackBuffers(t)
+	defer check()
+
+	// frames around every class boundary, and over the biggest one
+	var sizes []int
+	for _, size := range append(append([]int {}, bufferClasses...), 1536 * 1024) {
+		sizes = append(sizes, size - 1, size, size + 1)
+	}
+	maxBuffer := 2 * 1024 * 1024
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				for j := range sizes {
+					size := sizes[(g + i + j) % len(sizes)]
+
+					// frames received
+					buf := allocBuffer(size)
+					if len(buf) != size {
+						errs <- fmt.Errorf("allocated %d bytes instead of %d", len(buf), size)
+						return
+					}
+					buf[0], buf[size - 1] = 1, 1
+					freeBuffer(buf)
+
+					// frames sent
+					buf, err := encodeFrame(dataRep(size), maxBuffer)
+					if err != nil {
+						errs <- err
+						return
+					}
+					if len(buf) != size {
+						errs <- fmt.Errorf("encoded %d bytes instead of %d", len(buf), size)
+						return
+					}
+					freeBuffer(buf)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,413 @@
+package keeper
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	kv "github.com/glerchundi/kvstores"
+)
+
+//
+// Four letter words: admin commands sent instead of a connect request whose
+// plain text reply is followed by the connection being closed.
+//
+
+var fourLetterWords = map[string]func(*Server, io.Writer) {
+	"ruok": (*Server).ruok,
+	"stat": (*Server).stat,
+	"srvr": (*Server).srvr,
+	"mntr": (*Server).mntr,
+	"cons": (*Server).cons,
+	"envi": (*Server).envi,
+	"wchs": (*Server).wchs,
+	"dump": (*Server).dump,
+	"conf": (*Server).conf,
+}
+
+// opNames are the short names of the last operation reported by cons.
+var opNames = map[int32]string {
+	opCreate:       "CREA",
+	opDelete:       "DELE",
+	opExists:       "EXIS",
+	opGetData:      "GETD",
+	opSetData:      "SETD",
+	opGetAcl:       "GETA",
+	opSetAcl:       "SETA",
+	opGetChildren:  "GETC",
+	opSync:         "SYNC",
+	opPing:         "PING",
+	opGetChildren2: "GET2",
+	opCheck:        "CHEC",
+	opMulti:        "MULT",
+	opCreate2:      "CRE2",
+	opClose:        "CLOS",
+	opSetAuth:      "SAUT",
+	opSetWatches:   "SETW",
+}
+
+// runFourLetterWord answers cmd, unless it isn't enabled, and closes the
+// connection once the client read the reply.
+func (k *Keeper) runFourLetterWord(cmd string) {
+	k.logger().Debug("four letter word: ", cmd)
+
+	var buf bytes.Buffer
+	if (k.server != nil && k.server.fourLetterWordEnabled(cmd)) {
+		fourLetterWords[cmd](k.server, &buf)
+	} else {
+		fmt.Fprintf(&buf, "%s is not executed because it is not in the whitelist.\n", cmd)
+	}
+
+	if _, err := k.conn.Write(buf.Bytes()); err != nil {
+		k.logger().Debug("unable to reply four letter word: ", err)
+		return
+	}
+
+	// closing with unread input (the newline sent by `echo ruok | nc`) resets
+	// the connection, which may discard the reply
+	if tcpConn, ok := k.conn.(*net.TCPConn); ok {
+		tcpConn.CloseWrite()
+	}
+	k.conn.SetReadDeadline(time.Now().Add(time.Second))
+	io.Copy(ioutil.Discard, io.LimitReader(k.conn, 1024))
+}
+
+func (s *Server) fourLetterWordEnabled(cmd string) bool {
+	for _, enabled := range s.opts.FourLetterWords {
+		if (enabled == cmd || enabled == "*") {
+			return true
+		}
+	}
+	return false
+}
+
+// ruok replies imok unless the backend is down, in which case, as zookeeper
+// does when not serving requests, there is no reply.
+func (s *Server) ruok(w io.Writer) {
+	if (s.backendState() != kv.BreakerOpen.String()) {
+		fmt.Fprint(w, "imok")
+	}
+}
+
+func (s *Server) stat(w io.Writer) {
+	fmt.Fprintf(w, "Zookeeper version: %s\n", s.version())
+	fmt.Fprintf(w, "Clients:\n")
+	for _, conn := range s.connectionsInfo() {
+		fmt.Fprintf(w, " /%s[1](queued=%d,recved=%d,sent=%d)\n", conn.RemoteAddress, conn.Outstanding, conn.PacketsReceived, conn.PacketsSent)
+	}
+	fmt.Fprintf(w, "\n")
+	s.writeServer(w)
+}
+
+func (s *Server) srvr(w io.Writer) {
+	fmt.Fprintf(w, "Zookeeper version: %s\n", s.version())
+	s.writeServer(w)
+}
+
+func (s *Server) writeServer(w io.Writer) {
+	info := s.monitorInfo()
+	fmt.Fprintf(w, "Latency min/avg/max: %d/%d/%d\n", info.MinLatency, info.AvgLatency, info.MaxLatency)
+	fmt.Fprintf(w, "Received: %d\n", info.PacketsReceived)
+	fmt.Fprintf(w, "Sent: %d\n", info.PacketsSent)
+	fmt.Fprintf(w, "Connections: %d\n", info.NumAliveConnections)
+	fmt.Fprintf(w, "Outstanding: %d\n", info.OutstandingRequests)
+	fmt.Fprintf(w, "Mode: %s\n", info.ServerState)
+	fmt.Fprintf(w, "Backend: %s\n", info.BackendState)
+}
+
+func (s *Server) mntr(w io.Writer) {
+	info := s.monitorInfo()
+	fmt.Fprintf(w, "zk_version\t%s\n", info.Version)
+	fmt.Fprintf(w, "zk_avg_latency\t%d\n", info.AvgLatency)
+	fmt.Fprintf(w, "zk_max_latency\t%d\n", info.MaxLatency)
+	fmt.Fprintf(w, "zk_min_latency\t%d\n", info.MinLatency)
+	fmt.Fprintf(w, "zk_packets_received\t%d\n", info.PacketsReceived)
+	fmt.Fprintf(w, "zk_packets_sent\t%d\n", info.PacketsSent)
+	fmt.Fprintf(w, "zk_num_alive_connections\t%d\n", info.NumAliveConnections)
+	fmt.Fprintf(w, "zk_outstanding_requests\t%d\n", info.OutstandingRequests)
+	fmt.Fprintf(w, "zk_server_state\t%s\n", info.ServerState)
+	fmt.Fprintf(w, "zk_watch_count\t%d\n", info.WatchCount)
+	fmt.Fprintf(w, "zk_ephemerals_count\t%d\n", info.EphemeralsCount)
+	fmt.Fprintf(w, "zk_backend_state\t%s\n", info.BackendState)
+	if hotSpots := s.hotSpotsInfo(); hotSpots != nil {
+		for i, spot := range hotSpots.Reads {
+			fmt.Fprintf(w, "zk_hot_read_path_%d\t%s\n", i + 1, spot.Path)
+			fmt.Fprintf(w, "zk_hot_read_path_%d_count\t%d\n", i + 1, spot.Count)
+		}
+		for i, spot := range hotSpots.Writes {
+			fmt.Fprintf(w, "zk_hot_write_path_%d\t%s\n", i + 1, spot.Path)
+			fmt.Fprintf(w, "zk_hot_write_path_%d_count\t%d\n", i + 1, spot.Count)
+		}
+	}
+}
+
+func (s *Server) cons(w io.Writer) {
+	for _, conn := range s.connectionsInfo() {
+		fmt.Fprintf(w, " /%s[1](queued=%d,recved=%d,sent=%d", conn.RemoteAddress, conn.Outstanding, conn.PacketsReceived, conn.PacketsSent)
+		if (conn.connectionSession != nil) {
+			fmt.Fprintf(w, ",sid=%s", conn.SessionId)
+			if (conn.LastOperation != "") {
+				fmt.Fprintf(w, ",lop=%s", conn.LastOperation)
+			}
+			fmt.Fprintf(w, ",est=%d,to=%d", conn.Established, conn.SessionTimeout)
+			fmt.Fprintf(w, ",llat=%d,minlat=%d,avglat=%d,maxlat=%d", conn.LastLatency, conn.MinLatency, conn.AvgLatency, conn.MaxLatency)
+		}
+		fmt.Fprintf(w, ")\n")
+	}
+	fmt.Fprintf(w, "\n")
+}
+
+func (s *Server) envi(w io.Writer) {
+	host, _ := os.Hostname()
+	dir, _ := os.Getwd()
+	fmt.Fprintf(w, "Environment:\n")
+	fmt.Fprintf(w, "zookeeper.version=%s\n", s.version())
+	fmt.Fprintf(w, "host.name=%s\n", host)
+	fmt.Fprintf(w, "go.version=%s\n", runtime.Version())
+	fmt.Fprintf(w, "os.name=%s\n", runtime.GOOS)
+	fmt.Fprintf(w, "os.arch=%s\n", runtime.GOARCH)
+	fmt.Fprintf(w, "user.dir=%s\n", dir)
+	fmt.Fprintf(w, "process.id=%d\n", os.Getpid())
+	fmt.Fprintf(w, "process.uptime=%s\n", time.Since(s.started) / time.Second * time.Second)
+}
+
+func (s *Server) wchs(w io.Writer) {
+	info := s.watchesInfo()
+	fmt.Fprintf(w, "%d connections watching %d paths\n", info.NumConnections, info.NumPaths)
+	fmt.Fprintf(w, "Total watches:%d\n", info.NumTotalWatches)
+}
+
+// dump lists the sessions along with the paths they watch, there are no
+// ephemerals to list as they are tracked by the backend.
+func (s *Server) dump(w io.Writer) {
+	fmt.Fprintf(w, "Sessions dump:\n")
+	for _, conn := range s.connectionsInfo() {
+		if (conn.connectionSession == nil) {
+			continue
+		}
+
+		fmt.Fprintf(w, "%s\t%s\ttimeout=%d\n", conn.SessionId, conn.RemoteAddress, conn.SessionTimeout)
+		for _, watch := range conn.watches {
+			fmt.Fprintf(w, "\t%s\n", watch)
+		}
+	}
+}
+
+func (s *Server) conf(w io.Writer) {
+	info := s.configurationInfo()
+	fmt.Fprintf(w, "clientPortAddress=%s\n", info.ClientPortAddress)
+	fmt.Fprintf(w, "minSessionTimeout=%d\n", info.MinSessionTimeout)
+	fmt.Fprintf(w, "maxSessionTimeout=%d\n", info.MaxSessionTimeout)
+	fmt.Fprintf(w, "maxClientCnxns=%d\n", info.MaxClientCnxns)
+	fmt.Fprintf(w, "jute.maxbuffer=%d\n", info.MaxBuffer)
+	fmt.Fprintf(w, "4lw.commands.whitelist=%s\n", strings.Join(info.FourLetterWords, ","))
+}
+
+//
+// Server state reported by four letter words and the admin server.
+//
+
+type monitorInfo struct {
+	Version             string `json:"version"`
+	AvgLatency          int64  `json:"avg_latency"`
+	MaxLatency          int64  `json:"max_latency"`
+	MinLatency          int64  `json:"min_latency"`
+	PacketsReceived     int64  `json:"packets_received"`
+	PacketsSent         int64  `json:"packets_sent"`
+	NumAliveConnections int    `json:"num_alive_connections"`
+	OutstandingRequests int64  `json:"outstanding_requests"`
+	ServerState         string `json:"server_state"`
+	WatchCount          int    `json:"watch_count"`
+	EphemeralsCount     int    `json:"ephemerals_count"`
+	BackendState        string `json:"backend_state"`
+}
+
+type connectionInfo struct {
+	RemoteAddress   string `json:"remote_socket_address"`
+	Outstanding     int64  `json:"outstanding_requests"`
+	PacketsReceived int64  `json:"packets_received"`
+	PacketsSent     int64  `json:"packets_sent"`
+	// only set once connected
+	*connectionSession
+}
+
+type connectionSession struct {
+	SessionId      string `json:"session_id"`
+	LastOperation  string `json:"last_operation"`
+	Established    int64  `json:"established"`
+	SessionTimeout int64  `json:"session_timeout"`
+	LastLatency    int64  `json:"last_latency"`
+	MinLatency     int64  `json:"min_latency"`
+	AvgLatency     int64  `json:"avg_latency"`
+	MaxLatency     int64  `json:"max_latency"`
+	// watched paths followed by their kind, sorted
+	watches        []string
+}
+
+type watchesInfo struct {
+	SessionWatches  map[string][]string `json:"session_id_to_watched_paths"`
+	NumConnections  int                 `json:"num_connections"`
+	NumPaths        int                 `json:"num_paths"`
+	NumTotalWatches int                 `json:"num_total_watches"`
+}
+
+type hotSpotsInfo struct {
+	Window int64     `json:"window"`
+	Reads  []hotSpot `json:"top_read_paths"`
+	Writes []hotSpot `json:"top_written_paths"`
+}
+
+type configurationInfo struct {
+	ClientPortAddress string   `json:"client_port_address"`
+	MinSessionTimeout int64    `json:"min_session_timeout"`
+	MaxSessionTimeout int64    `json:"max_session_timeout"`
+	MaxClientCnxns    int      `json:"max_client_cnxns"`
+	MaxBuffer         int      `json:"jute_maxbuffer"`
+	FourLetterWords   []string `json:"four_letter_words"`
+}
+
+func (s *Server) monitorInfo() *monitorInfo {
+	min, avg, max, _ := s.stats.latency()
+	received, sent := s.stats.packets()
+	info := &monitorInfo {
+		Version:         s.version(),
+		AvgLatency:      avg,
+		MaxLatency:      max,
+		MinLatency:      min,
+		PacketsReceived: received,
+		PacketsSent:     sent,
+		ServerState:     "standalone",
+		BackendState:    s.backendState(),
+	}
+
+	for _, k := range s.connections() {
+		info.NumAliveConnections++
+		info.OutstandingRequests += atomic.LoadInt64(&k.outstanding)
+		info.WatchCount += k.watches.len()
+		info.EphemeralsCount += k.ephemeralsCount()
+	}
+
+	return info
+}
+
+func (s *Server) connectionsInfo() []*connectionInfo {
+	keepers := s.connections()
+	conns := make([]*connectionInfo, len(keepers))
+	for i, k := range keepers {
+		conns[i] = k.connectionInfo()
+	}
+	return conns
+}
+
+func (s *Server) watchesInfo() *watchesInfo {
+	info := &watchesInfo { SessionWatches: make(map[string][]string) }
+	paths := make(map[string]bool)
+	for _, k := range s.connections() {
+		keys := k.watches.keys()
+		if (len(keys) == 0) {
+			continue
+		}
+
+		info.NumConnections++
+		info.NumTotalWatches += len(keys)
+		var sessionPaths []string
+		for _, key := range keys {
+			paths[key.path] = true
+			sessionPaths = append(sessionPaths, key.path)
+		}
+		if session, ok := k.session.Load().(sessionInfo); ok {
+			sort.Strings(sessionPaths)
+			info.SessionWatches[fmt.Sprintf("0x%x", session.id)] = sessionPaths
+		}
+	}
+	info.NumPaths = len(paths)
+
+	return info
+}
+
+// hotSpotsInfo returns the most read and written paths, nil if disabled.
+func (s *Server) hotSpotsInfo() *hotSpotsInfo {
+	if (s.hotSpots == nil) {
+		return nil
+	}
+
+	reads, writes := s.hotSpots.topK()
+	return &hotSpotsInfo {
+		Window: int64(s.hotSpots.window / time.Millisecond),
+		Reads:  reads,
+		Writes: writes,
+	}
+}
+
+func (s *Server) configurationInfo() *configurationInfo {
+	return &configurationInfo {
+		ClientPortAddress: s.addr,
+		MinSessionTimeout: int64(minSessionTimeout / time.Millisecond),
+		MaxSessionTimeout: int64(maxSessionTimeout / time.Millisecond),
+		MaxClientCnxns:    s.opts.MaxClientCnxns,
+		MaxBuffer:         s.opts.MaxBuffer,
+		FourLetterWords:   s.opts.FourLetterWords,
+	}
+}
+
+func (s *Server) version() string {
+	if (s.opts.Version == "") {
+		return "parkeeper"
+	}
+	return s.opts.Version + "-parkeeper"
+}
+
+// backendState returns the state of the circuit breaker around the backend,
+// which is always closed if there is none.
+func (s *Server) backendState() string {
+	if breakerClient, ok := s.storeClient.(kv.BreakerClient); ok {
+		return breakerClient.Breaker().State().String()
+	}
+	return kv.BreakerClosed.String()
+}
+
+func (k *Keeper) connectionInfo() *connectionInfo {
+	received, sent := k.stats.packets()
+	conn := &connectionInfo {
+		RemoteAddress:   k.conn.RemoteAddr().String(),
+		Outstanding:     atomic.LoadInt64(&k.outstanding),
+		PacketsReceived: received,
+		PacketsSent:     sent,
+	}
+
+	info, ok := k.session.Load().(sessionInfo)
+	if (!ok) {
+		return conn
+	}
+
+	min, avg, max, last := k.stats.latency()
+	conn.connectionSession = &connectionSession {
+		SessionId:      fmt.Sprintf("0x%x", info.id),
+		LastOperation:  opNames[atomic.LoadInt32(&k.lastOp)],
+		Established:    k.established.UnixNano() / int64(time.Millisecond),
+		SessionTimeout: int64(info.timeout / time.Millisecond),
+		LastLatency:    last,
+		MinLatency:     min,
+		AvgLatency:     avg,
+		MaxLatency:     max,
+	}
+
+	for _, key := range k.watches.keys() {
+		kind := "data"
+		if (key.kind == watchChildren) {
+			kind = "children"
+		}
+		conn.watches = append(conn.watches, key.path + " (" + kind + ")")
+	}
+	sort.Strings(conn.watches)
+
+	return conn
+}
@@ -0,0 +1,118 @@
+package keeper
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fourLetterWord sends cmd instead of a connect request and returns the reply,
+// failing unless the connection is closed after it.
+func fourLetterWord(t testing.TB, addr string, cmd string) string {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(cmd)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("%s: expected the connection to be closed after the reply: %v", cmd, err)
+	}
+	return string(reply)
+}
+
+// expectLines fails unless every line is in reply.
+func expectLines(t testing.TB, cmd string, reply string, lines ...string) {
+	for _, line := range lines {
+		if !strings.Contains(reply, line + "\n") {
+			t.Errorf("%s: expected %q in:\n%s", cmd, line, reply)
+		}
+	}
+}
+
+func TestFourLetterWords(t *testing.T) {
+	fileClient, cleanup := newTestFileClient(t)
+	defer cleanup()
+
+	opts := DefaultOptions
+	opts.Version = "3.4.6"
+	opts.FourLetterWords = []string{ "ruok", "mntr", "cons", "conf" }
+	s, stop := newTestServer(t, fileClient, &opts)
+	defer stop()
+
+	// a session watching a node
+	conn, err := net.Dial("tcp", s.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	connectRep := connect(t, conn)
+	writeFrame(t, conn, &OpReqHeader { Xid: 1, OpCode: opExists }, &ExistsReq { Path: newPath("/"), Watch: true })
+	if hdr := readReply(t, conn, nil); hdr.Err != errOk {
+		t.Fatalf("unexpected error: %d", hdr.Err)
+	}
+
+	if reply := fourLetterWord(t, s.addr, "ruok"); reply != "imok" {
+		t.Fatalf("ruok: expected imok, got %q", reply)
+	}
+
+	expectLines(t, "mntr", fourLetterWord(t, s.addr, "mntr"),
+		"zk_version\t3.4.6-parkeeper",
+		"zk_packets_received\t2",
+		"zk_packets_sent\t2",
+		"zk_outstanding_requests\t0",
+		"zk_server_state\tstandalone",
+		"zk_watch_count\t1",
+		"zk_backend_state\tclosed",
+		"zk_hot_read_path_1\t/",
+		"zk_hot_read_path_1_count\t1",
+	)
+
+	cons := fourLetterWord(t, s.addr, "cons")
+	session := fmt.Sprintf(",sid=0x%x,lop=EXIS,est=", connectRep.SessionId)
+	if !strings.Contains(cons, " /" + conn.LocalAddr().String() + "[1](queued=0,recved=2,sent=2" + session) {
+		t.Errorf("cons: expected the session of %s to be listed, got:\n%s", conn.LocalAddr(), cons)
+	}
+	if !strings.HasSuffix(cons, ")\n\n") {
+		t.Errorf("cons: expected an empty line at the end, got:\n%s", cons)
+	}
+
+	expectLines(t, "conf", fourLetterWord(t, s.addr, "conf"),
+		"clientPortAddress=" + s.addr,
+		"maxClientCnxns=60",
+		"jute.maxbuffer=1572864",
+		"4lw.commands.whitelist=ruok,mntr,cons,conf",
+	)
+
+	// known words are rejected unless whitelisted
+	if reply := fourLetterWord(t, s.addr, "stat"); reply != "stat is not executed because it is not in the whitelist.\n" {
+		t.Fatalf("stat: unexpected reply %q", reply)
+	}
+}
+
+func TestFourLetterWordsBreakerOpen(t *testing.T) {
+	fileClient, cleanup := newTestFileClient(t)
+	defer cleanup()
+	breaker, closeBreaker := newOpenBreaker(t)
+	defer closeBreaker()
+
+	opts := DefaultOptions
+	opts.FourLetterWords = []string{ "*" }
+	s, stop := newTestServer(t, &breakerClient { Client: fileClient, breaker: breaker }, &opts)
+	defer stop()
+
+	// as zookeeper does when not serving requests, ruok gets no reply
+	if reply := fourLetterWord(t, s.addr, "ruok"); reply != "" {
+		t.Fatalf("ruok: expected no reply, got %q", reply)
+	}
+	expectLines(t, "mntr", fourLetterWord(t, s.addr, "mntr"), "zk_backend_state\topen")
+	expectLines(t, "srvr", fourLetterWord(t, s.addr, "srvr"), "Backend: open")
+}
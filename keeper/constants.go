@@ -1,5 +1,9 @@
 package keeper
 
+import (
+	"time"
+)
+
 const (
 	opCreate       = 1
 	opDelete       = 2
@@ -18,6 +22,8 @@ const (
 	opClose        = -11
 	opSetAuth      = 100
 	opSetWatches   = 101
+	// used as multi result/done header opcode
+	opMultiError   = -1
 )
 
 const (
@@ -99,3 +105,26 @@ const (
 	flagEphemeral = 1
 	flagSequence  = 2
 )
+
+const (
+	eventNodeCreated         = 1
+	eventNodeDeleted         = 2
+	eventNodeDataChanged     = 3
+	eventNodeChildrenChanged = 4
+)
+
+const (
+	stateSyncConnected = 3
+)
+
+const (
+	// xid used by the server to send watch notifications
+	xidWatcherEvent = -1
+)
+
+const (
+	// session timeout bounds, ZooKeeper defaults (2 and 20 times a tick time
+	// of 2 seconds)
+	minSessionTimeout = 4 * time.Second
+	maxSessionTimeout = 40 * time.Second
+)
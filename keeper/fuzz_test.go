@@ -0,0 +1,121 @@
+package keeper
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// FuzzDecodePacket decodes request frames, which either decode or fail with a
+// ProtocolError.
+func FuzzDecodePacket(f *testing.F) {
+	// every golden request behind a header with its opcode
+	for opCode, creator := range creatorByOpCode {
+		typ := reflect.TypeOf(creator())
+		for _, test := range goldenPackets {
+			if test.decode && reflect.TypeOf(test.packet) == typ {
+				f.Add(append(golden("00000001"), append(int32Bytes(opCode), test.bytes...)...))
+			}
+		}
+	}
+	f.Add(golden("00000001"))
+	f.Add(golden("00000001 0000002a"))
+
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		reqHdr, req, err := decodeRequest(buf)
+		if err != nil {
+			var perr *ProtocolError
+			if !errors.As(err, &perr) {
+				t.Fatalf("expected a protocol error, got %T: %v", err, err)
+			}
+			return
+		}
+		if reqHdr == nil || req == nil {
+			t.Fatal("expected a request to be decoded")
+		}
+
+		// whatever the opcode, decoding never reads past the frame
+		for _, creator := range creatorByOpCode {
+			if n, err := DecodePacket(buf, creator()); err == nil && n > len(buf) {
+				t.Fatalf("%d bytes read out of %d", n, len(buf))
+			}
+		}
+	})
+}
+
+// FuzzHandshake sends a session the bytes before its connect request, closing
+// it with a ProtocolError if the first frame is too big or malformed.
+func FuzzHandshake(f *testing.F) {
+	fileClient, cleanup := newTestFileClient(f)
+	defer cleanup()
+
+	opts := DefaultOptions
+	opts.MaxBuffer = 4096
+
+	connectReq := golden("00000000 0000000000000000 00007530 0000000000000000", passwdHex)
+	f.Add(frame(connectReq))
+	f.Add(frame(append(connectReq, 1)))
+	f.Add(frame(connectReq[:len(connectReq) - 1]))
+	f.Add(frame(golden("00000000 0000000000000000 00007530 0000000000000000 7fffffff")))
+	f.Add(golden("00100000"))
+	f.Add([]byte("ruok"))
+	f.Add(frame(nil))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// the outcome of the first frame, unless it's a four letter word or
+		// the connection closes before it's received
+		expectProtocolError := false
+		if len(data) >= 4 && fourLetterWords[string(data[:4])] == nil {
+			size := binary.BigEndian.Uint32(data[:4])
+			if int64(size) > int64(opts.MaxBuffer) {
+				expectProtocolError = true
+			} else if uint64(len(data) - 4) >= uint64(size) {
+				_, err := DecodePacket(data[4:4 + size], &ConnectReq {})
+				expectProtocolError = err != nil
+			}
+		}
+
+		client, server := net.Pipe()
+		defer client.Close()
+		k := NewKeeper(server, fileClient, &opts)
+		handled := make(chan struct{})
+		go func() {
+			defer close(handled)
+			k.Handle()
+		}()
+		go io.Copy(ioutil.Discard, client)
+
+		// a session failing the handshake closes the connection by itself
+		client.Write(data)
+		if !expectProtocolError {
+			client.Close()
+		}
+
+		select {
+		case <-handled:
+		case <-time.After(10 * time.Second):
+			t.Fatal("expected the session to be closed")
+		}
+
+		var perr *ProtocolError
+		if expectProtocolError && !errors.As(k.tomb.Err(), &perr) {
+			t.Fatalf("expected a protocol error, got %v", k.tomb.Err())
+		}
+	})
+}
+
+// frame prefixes buf with its size.
+func frame(buf []byte) []byte {
+	return append(int32Bytes(int32(len(buf))), buf...)
+}
+
+func int32Bytes(v int32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(v))
+	return b
+}
@@ -0,0 +1,233 @@
+// +build ignore
+
+// gen_codec generates the jute encoders/decoders of the packets declared in
+// packets.go, run it through go generate. Types with a hand written Encode or
+// Decode method, as well as those with fields whose encoding can't be told
+// from their type (interfaces), are left alone.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+const (
+	input  = "packets.go"
+	output = "packets_codec.go"
+)
+
+var primitives = map[string]string {
+	"bool":     "Bool",
+	"int32":    "Int32",
+	"int64":    "Int64",
+	"string":   "String",
+	"[]byte":   "Buffer",
+	"[]string": "Strings",
+}
+
+type field struct {
+	name string
+	// primitive, struct, pointer (to struct) or vector (of structs)
+	kind string
+	// primitive suffix or struct type name
+	typ  string
+}
+
+type packet struct {
+	name   string
+	fields []field
+}
+
+func main() {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, ".", func(fi os.FileInfo) bool {
+		return fi.Name() != output && !strings.HasPrefix(fi.Name(), "gen_")
+	}, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// hand written encoders/decoders
+	handWritten := make(map[string]bool)
+	for _, pkg := range pkgs {
+		for _, file := range pkg.Files {
+			for _, decl := range file.Decls {
+				fn, ok := decl.(*ast.FuncDecl)
+				if !ok || fn.Recv == nil || (fn.Name.Name != "Encode" && fn.Name.Name != "Decode") {
+					continue
+				}
+				handWritten[receiverType(fn.Recv.List[0].Type)] = true
+			}
+		}
+	}
+
+	file, err := parser.ParseFile(fset, input, nil, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// structs in declaration order
+	var names []string
+	structs := make(map[string]*ast.StructType)
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			typeSpec := spec.(*ast.TypeSpec)
+			if st, ok := typeSpec.Type.(*ast.StructType); ok {
+				names = append(names, typeSpec.Name.Name)
+				structs[typeSpec.Name.Name] = st
+			}
+		}
+	}
+
+	// a struct is supported if every field is, which for nested ones
+	// requires them to be supported too
+	packets := make(map[string]*packet)
+	var resolve func(name string) bool
+	resolving := make(map[string]bool)
+	resolve = func(name string) bool {
+		if _, found := packets[name]; found {
+			return true
+		}
+		if handWritten[name] {
+			return true
+		}
+		st, found := structs[name]
+		if !found || resolving[name] {
+			return false
+		}
+		resolving[name] = true
+		defer delete(resolving, name)
+
+		p := &packet { name: name }
+		for _, f := range st.Fields.List {
+			fld, ok := mapField(f.Type, resolve)
+			if !ok {
+				return false
+			}
+			for _, ident := range f.Names {
+				fld.name = ident.Name
+				p.fields = append(p.fields, fld)
+			}
+		}
+		packets[name] = p
+		return true
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by gen_codec.go from %s; DO NOT EDIT.\n\npackage keeper\n", input)
+	for _, name := range names {
+		if handWritten[name] || !resolve(name) {
+			continue
+		}
+		writeDecode(&buf, packets[name])
+		writeEncode(&buf, packets[name])
+	}
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(output, src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func receiverType(expr ast.Expr) string {
+	if star, ok := expr.(*ast.StarExpr); ok {
+		expr = star.X
+	}
+	if ident, ok := expr.(*ast.Ident); ok {
+		return ident.Name
+	}
+	return ""
+}
+
+func mapField(expr ast.Expr, resolve func(string) bool) (field, bool) {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		if suffix, found := primitives[t.Name]; found {
+			return field { kind: "primitive", typ: suffix }, true
+		}
+		return field { kind: "struct", typ: t.Name }, resolve(t.Name)
+	case *ast.StarExpr:
+		if ident, ok := t.X.(*ast.Ident); ok {
+			return field { kind: "pointer", typ: ident.Name }, resolve(ident.Name)
+		}
+	case *ast.ArrayType:
+		if ident, ok := t.Elt.(*ast.Ident); ok && t.Len == nil {
+			if suffix, found := primitives["[]" + ident.Name]; found {
+				return field { kind: "primitive", typ: suffix }, true
+			}
+			return field { kind: "vector", typ: ident.Name }, resolve(ident.Name)
+		}
+	}
+
+	return field {}, false
+}
+
+func writeDecode(buf *bytes.Buffer, p *packet) {
+	fmt.Fprintf(buf, "\nfunc (p *%s) Decode(buf []byte) (int, error) {\n", p.name)
+	if len(p.fields) == 0 {
+		fmt.Fprintf(buf, "return 0, nil\n}\n")
+		return
+	}
+
+	fmt.Fprintf(buf, "n := 0\nvar err error\n")
+	for _, f := range p.fields {
+		fail := fmt.Sprintf("return n, codecError(%q, err)", p.name + "." + f.name)
+		switch f.kind {
+		case "primitive":
+			fmt.Fprintf(buf, "if p.%s, n, err = decode%s(buf, n); err != nil {\n%s\n}\n", f.name, f.typ, fail)
+		case "struct":
+			fmt.Fprintf(buf, "if n, err = decodeStruct(buf, n, &p.%s); err != nil {\n%s\n}\n", f.name, fail)
+		case "pointer":
+			fmt.Fprintf(buf, "p.%s = &%s{}\n", f.name, f.typ)
+			fmt.Fprintf(buf, "if n, err = decodeStruct(buf, n, p.%s); err != nil {\n%s\n}\n", f.name, fail)
+		case "vector":
+			fmt.Fprintf(buf, "var count%s int\n", f.name)
+			fmt.Fprintf(buf, "if count%s, n, err = decodeLength(buf, n, 1); err != nil {\n%s\n}\n", f.name, fail)
+			fmt.Fprintf(buf, "p.%s = nil\nif count%s >= 0 {\np.%s = make([]%s, count%s)\n}\n", f.name, f.name, f.name, f.typ, f.name)
+			fmt.Fprintf(buf, "for i := range p.%s {\nif n, err = decodeStruct(buf, n, &p.%s[i]); err != nil {\n%s\n}\n}\n", f.name, f.name, fail)
+		}
+	}
+	fmt.Fprintf(buf, "return n, nil\n}\n")
+}
+
+func writeEncode(buf *bytes.Buffer, p *packet) {
+	fmt.Fprintf(buf, "\nfunc (p *%s) Encode(buf []byte) (int, error) {\n", p.name)
+	if len(p.fields) == 0 {
+		fmt.Fprintf(buf, "return 0, nil\n}\n")
+		return
+	}
+
+	fmt.Fprintf(buf, "n := 0\nvar err error\n")
+	for _, f := range p.fields {
+		fail := fmt.Sprintf("return n, codecError(%q, err)", p.name + "." + f.name)
+		switch f.kind {
+		case "primitive":
+			fmt.Fprintf(buf, "if n, err = encode%s(buf, n, p.%s); err != nil {\n%s\n}\n", f.typ, f.name, fail)
+		case "struct":
+			fmt.Fprintf(buf, "if n, err = encodeStruct(buf, n, &p.%s); err != nil {\n%s\n}\n", f.name, fail)
+		case "pointer":
+			fmt.Fprintf(buf, "if p.%s == nil {\nreturn n, codecError(%q, ErrNilField)\n}\n", f.name, p.name + "." + f.name)
+			fmt.Fprintf(buf, "if n, err = encodeStruct(buf, n, p.%s); err != nil {\n%s\n}\n", f.name, fail)
+		case "vector":
+			fmt.Fprintf(buf, "if n, err = encodeInt32(buf, n, int32(len(p.%s))); err != nil {\n%s\n}\n", f.name, fail)
+			fmt.Fprintf(buf, "for i := range p.%s {\nif n, err = encodeStruct(buf, n, &p.%s[i]); err != nil {\n%s\n}\n}\n", f.name, f.name, fail)
+		}
+	}
+	fmt.Fprintf(buf, "return n, nil\n}\n")
+}
@@ -0,0 +1,86 @@
+package keeper
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/glerchundi/parkeeper/log"
+)
+
+//
+// Listener handoff: on SIGUSR2 a new process of the same executable and
+// arguments is started, inheriting the listener, and this one drains. Clients
+// keep connecting to the same port while the binary is upgraded.
+//
+
+// ListenerFDEnv names the environment variable holding the descriptor of the
+// listener inherited from the previous process, if any.
+const ListenerFDEnv = "PARKEEPER_LISTENER_FD"
+
+// listen returns the listener inherited from the previous process, if any,
+// or one bound to addr.
+func listen(addr string) (*net.TCPListener, error) {
+	if env := os.Getenv(ListenerFDEnv); env != "" {
+		fd, err := strconv.Atoi(env)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %q", ListenerFDEnv, env)
+		}
+		f := os.NewFile(uintptr(fd), "listener")
+		defer f.Close()
+		l, err := net.FileListener(f)
+		if err != nil {
+			return nil, err
+		}
+		tcpListener, ok := l.(*net.TCPListener)
+		if !ok {
+			l.Close()
+			return nil, fmt.Errorf("inherited listener isn't a tcp one: %s", l.Addr())
+		}
+		log.Info("serving listener inherited from the previous process: ", l.Addr())
+		return tcpListener, nil
+	}
+
+	laddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenTCP("tcp", laddr)
+}
+
+// handoff starts a new process serving listener.
+func handoff(listener *net.TCPListener) error {
+	f, err := listener.File()
+	if err != nil {
+		return err
+	}
+	// the new process has its own copy
+	defer f.Close()
+
+	path, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	env := make([]string, 0, len(os.Environ()) + 1)
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, ListenerFDEnv + "=") {
+			env = append(env, kv)
+		}
+	}
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	// extra files are numbered from 3 on, after stdin, stdout and stderr
+	cmd.ExtraFiles = []*os.File { f }
+	cmd.Env = append(env, ListenerFDEnv + "=3")
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	log.Info("listener handed over to process ", cmd.Process.Pid)
+	return nil
+}
@@ -0,0 +1,215 @@
+package keeper
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// handoffTestEnv is set in the processes started by TestHandoff.
+const handoffTestEnv = "PARKEEPER_TEST_HANDOFF"
+
+func TestListenInherited(t *testing.T) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr { IP: net.IPv4(127, 0, 0, 1) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f, err := l.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a descriptor of its own, which is closed by listen as inherited ones are
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(ListenerFDEnv, strconv.Itoa(fd))
+	inherited, err := listen("127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inherited.Close()
+	if inherited.Addr().String() != l.Addr().String() {
+		t.Fatalf("expected to listen on %s, got %s", l.Addr(), inherited.Addr())
+	}
+
+	// connections are accepted by either of them, as they share the socket
+	l.Close()
+	conn, err := net.Dial("tcp", inherited.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	inherited.SetDeadline(time.Now().Add(5 * time.Second))
+	accepted, err := inherited.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted.Close()
+
+	t.Setenv(ListenerFDEnv, "stdin")
+	if _, err := listen("127.0.0.1:0"); err == nil {
+		t.Fatal("expected an invalid descriptor to be rejected")
+	}
+}
+
+// TestHandoffProcess is the process a listener is handed over to by
+// TestHandoff: it answers the first connection with its pid and exits.
+func TestHandoffProcess(t *testing.T) {
+	if os.Getenv(handoffTestEnv) == "" {
+		t.Skip("only run by TestHandoff")
+	}
+
+	l, err := listen("127.0.0.1:1")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	l.SetDeadline(time.Now().Add(10 * time.Second))
+	conn, err := l.Accept()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(conn, "%d\n", os.Getpid())
+	conn.Close()
+	os.Exit(0)
+}
+
+func TestHandoff(t *testing.T) {
+	fileClient, cleanup := newTestFileClient(t)
+	defer cleanup()
+	s, stop := newTestServer(t, fileClient, nil)
+	defer stop()
+
+	// the new process runs TestHandoffProcess only
+	args := os.Args
+	os.Args = []string{ args[0], "-test.run=^TestHandoffProcess$" }
+	defer func() { os.Args = args }()
+	t.Setenv(handoffTestEnv, "1")
+	if err := handoff(s.listener); err != nil {
+		t.Fatal(err)
+	}
+	s.Drain(time.Second)
+
+	// once drained, connections to the same address reach the new process
+	conn, err := net.Dial("tcp", s.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid, _ := strconv.Atoi(strings.TrimSpace(line)); pid == 0 || pid == os.Getpid() {
+		t.Fatalf("expected to be answered by a new process, got %q", line)
+	}
+}
+
+func TestDrainWaitsForRequests(t *testing.T) {
+	fileClient, cleanup := newTestFileClient(t)
+	defer cleanup()
+	if err := fileClient.Create(context.Background(), "/slow", "slow"); err != nil {
+		t.Fatal(err.String())
+	}
+
+	client := &slowClient {
+		Client:    fileClient,
+		latencies: map[string]time.Duration { "/slow": 300 * time.Millisecond },
+	}
+	s, stop := newTestServer(t, client, nil)
+	defer stop()
+
+	conn, err := net.Dial("tcp", s.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	connect(t, conn)
+
+	// drain while a request is being processed
+	writeFrame(t, conn, &OpReqHeader { Xid: 1, OpCode: opGetData }, &GetDataReq { Path: newPath("/slow") })
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		client.mutex.Lock()
+		started := len(client.started)
+		client.mutex.Unlock()
+		if (started > 0) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	drained := make(chan struct{})
+	go func() {
+		s.Drain(5 * time.Second)
+		close(drained)
+	}()
+
+	// the request is replied before the connection is closed
+	rep := &GetDataRep {}
+	if hdr := readReply(t, conn, rep); hdr.Xid != 1 || hdr.Err != errOk || string(rep.Data) != "slow" {
+		t.Fatalf("expected the pending request to be replied, got xid %d, error %d and %q", hdr.Xid, hdr.Err, rep.Data)
+	}
+	expectClosed(t, conn, 5 * time.Second)
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the server to be drained")
+	}
+
+	// no more connections are accepted
+	if conn, err := net.Dial("tcp", s.addr); err == nil {
+		conn.Close()
+		t.Fatal("expected the listener to be closed")
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	fileClient, cleanup := newTestFileClient(t)
+	defer cleanup()
+	if err := fileClient.Create(context.Background(), "/hung", ""); err != nil {
+		t.Fatal(err.String())
+	}
+
+	client := &slowClient {
+		Client:    fileClient,
+		latencies: map[string]time.Duration { "/hung": 2 * time.Second },
+	}
+	s, stop := newTestServer(t, client, nil)
+	defer stop()
+
+	conn, err := net.Dial("tcp", s.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	connect(t, conn)
+	writeFrame(t, conn, &OpReqHeader { Xid: 1, OpCode: opGetData }, &GetDataReq { Path: newPath("/hung") })
+	time.Sleep(50 * time.Millisecond)
+
+	// connections still open after the timeout are closed without replying,
+	// although draining waits for the request to return
+	drained := make(chan struct{})
+	go func() {
+		s.Drain(100 * time.Millisecond)
+		close(drained)
+	}()
+	expectClosed(t, conn, time.Second)
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the server to be drained")
+	}
+}
@@ -0,0 +1,206 @@
+package keeper
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//
+// Slow requests and hot spots: requests taking longer than a threshold, from
+// decoding until their reply is written, are logged along with the time spent
+// in the backend, and the most read and written paths are counted over a
+// sliding window.
+//
+
+// requestTiming accumulates the time a request spends in backend calls.
+type requestTiming struct {
+	backend int64
+}
+
+type requestTimingKey struct{}
+
+func withRequestTiming(ctx context.Context, timing *requestTiming) context.Context {
+	return context.WithValue(ctx, requestTimingKey{}, timing)
+}
+
+// addBackendTime adds d to the backend time of the request ctx belongs to, if
+// any.
+func addBackendTime(ctx context.Context, d time.Duration) {
+	if timing, ok := ctx.Value(requestTimingKey{}).(*requestTiming); ok {
+		atomic.AddInt64(&timing.backend, int64(d))
+	}
+}
+
+func (t *requestTiming) backendTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&t.backend))
+}
+
+// sentRep is a reply whose sent function is called once written to the
+// connection.
+type sentRep struct {
+	*OpRep
+	sent func()
+}
+
+// readOps and writeOps are the requests counted as reads and writes of their
+// path by hot spots.
+var readOps = map[int32]bool {
+	opExists:       true,
+	opGetData:      true,
+	opGetAcl:       true,
+	opGetChildren:  true,
+	opGetChildren2: true,
+}
+
+var writeOps = map[int32]bool {
+	opCreate:  true,
+	opCreate2: true,
+	opDelete:  true,
+	opSetData: true,
+	opSetAcl:  true,
+}
+
+const (
+	// the window is split in buckets, expired one at a time
+	hotSpotsBuckets  = 6
+	// distinct paths counted by bucket, the rest are ignored
+	maxHotSpotsPaths = 10000
+)
+
+type hotSpotsBucket struct {
+	start  time.Time
+	reads  map[string]int64
+	writes map[string]int64
+}
+
+// hotSpots counts the reads and writes of every path over a sliding window.
+type hotSpots struct {
+	window  time.Duration
+	top     int
+
+	mutex   sync.Mutex
+	buckets [hotSpotsBuckets]hotSpotsBucket
+	current int
+}
+
+type hotSpot struct {
+	Path  string `json:"path"`
+	Count int64  `json:"count"`
+}
+
+func newHotSpotsBucket(start time.Time) hotSpotsBucket {
+	return hotSpotsBucket {
+		start:  start,
+		reads:  make(map[string]int64),
+		writes: make(map[string]int64),
+	}
+}
+
+// newHotSpots returns hot spots reporting the top paths over window, which
+// must be positive.
+func newHotSpots(window time.Duration, top int) *hotSpots {
+	h := &hotSpots { window: window, top: top }
+	h.reset(time.Now())
+	return h
+}
+
+func (h *hotSpots) reset(now time.Time) {
+	for i := range h.buckets {
+		h.buckets[i] = newHotSpotsBucket(now)
+	}
+	h.current = 0
+}
+
+// record counts the request of opCode on path, operations of a multi are
+// counted one by one.
+func (h *hotSpots) record(opCode int32, req interface{}) {
+	h.recordAt(opCode, req, time.Now())
+}
+
+// recordAt counts the request as received at now.
+func (h *hotSpots) recordAt(opCode int32, req interface{}, now time.Time) {
+	if multi, ok := req.(*MultiReq); ok {
+		for _, op := range multi.Ops {
+			h.recordAt(op.Hdr.OpCode, op.Op, now)
+		}
+		return
+	}
+
+	path, ok := pathOf(req)
+	if !ok || !(readOps[opCode] || writeOps[opCode]) {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	bucket := h.advance(now)
+	counts := bucket.reads
+	if writeOps[opCode] {
+		counts = bucket.writes
+	}
+	if _, found := counts[path]; found || len(counts) < maxHotSpotsPaths {
+		counts[path]++
+	}
+}
+
+// advance moves to the bucket now belongs to, clearing the expired ones.
+func (h *hotSpots) advance(now time.Time) *hotSpotsBucket {
+	if (now.Sub(h.buckets[h.current].start) >= h.window) {
+		// idle for a whole window
+		h.reset(now)
+		return &h.buckets[h.current]
+	}
+
+	width := h.window / hotSpotsBuckets
+	for now.Sub(h.buckets[h.current].start) >= width {
+		start := h.buckets[h.current].start.Add(width)
+		h.current = (h.current + 1) % hotSpotsBuckets
+		h.buckets[h.current] = newHotSpotsBucket(start)
+	}
+	return &h.buckets[h.current]
+}
+
+// topK returns the most read and most written paths within the window.
+func (h *hotSpots) topK() (reads []hotSpot, writes []hotSpot) {
+	return h.topKAt(time.Now())
+}
+
+// topKAt returns the top paths within the window ending at now.
+func (h *hotSpots) topKAt(now time.Time) (reads []hotSpot, writes []hotSpot) {
+	h.mutex.Lock()
+	h.advance(now)
+	allReads := make(map[string]int64)
+	allWrites := make(map[string]int64)
+	for _, bucket := range h.buckets {
+		for path, count := range bucket.reads {
+			allReads[path] += count
+		}
+		for path, count := range bucket.writes {
+			allWrites[path] += count
+		}
+	}
+	h.mutex.Unlock()
+
+	return topHotSpots(allReads, h.top), topHotSpots(allWrites, h.top)
+}
+
+func topHotSpots(counts map[string]int64, k int) []hotSpot {
+	spots := make([]hotSpot, 0, len(counts))
+	for path, count := range counts {
+		spots = append(spots, hotSpot { Path: path, Count: count })
+	}
+	sort.Slice(spots, func(i, j int) bool {
+		if (spots[i].Count != spots[j].Count) {
+			return spots[i].Count > spots[j].Count
+		}
+		return spots[i].Path < spots[j].Path
+	})
+	if (len(spots) > k) {
+		spots = spots[:k]
+	}
+	return spots
+}
@@ -0,0 +1,214 @@
+package keeper
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glerchundi/parkeeper/log"
+	"github.com/glerchundi/parkeeper/metrics"
+)
+
+func TestHotSpotsWindow(t *testing.T) {
+	// six buckets of ten seconds
+	start := time.Now()
+	h := newHotSpots(time.Minute, 2)
+	h.reset(start)
+
+	for i := 0; i < 3; i++ {
+		h.recordAt(opGetData, &GetDataReq { Path: newPath("/a") }, start)
+	}
+	h.recordAt(opSetData, &SetDataReq { Path: newPath("/w") }, start)
+	// neither pings nor syncs are reads
+	h.recordAt(opPing, &PingReq {}, start)
+	h.recordAt(opSync, &SyncReq { Path: newPath("/a") }, start)
+
+	later := start.Add(15 * time.Second)
+	for _, path := range []string{ "/c", "/b", "/c", "/b" } {
+		h.recordAt(opExists, &ExistsReq { Path: newPath(path) }, later)
+	}
+	// operations of a multi are counted one by one
+	h.recordAt(opMulti, &MultiReq { Ops: []MultiReqOp{
+		{ Hdr: MultiHeader { OpCode: opCreate }, Op: &CreateReq { Path: newPath("/m") } },
+		{ Hdr: MultiHeader { OpCode: opSetData }, Op: &SetDataReq { Path: newPath("/m") } },
+		{ Hdr: MultiHeader { OpCode: opCheck }, Op: &CheckVersionReq { Path: newPath("/w") } },
+	} }, later)
+
+	tests := []struct {
+		now    time.Time
+		reads  []hotSpot
+		writes []hotSpot
+	}{
+		// the top two paths, ties broken by path
+		{
+			later,
+			[]hotSpot{ { "/a", 3 }, { "/b", 2 } },
+			[]hotSpot{ { "/m", 2 }, { "/w", 1 } },
+		},
+		// the first bucket is still within the window
+		{
+			start.Add(59 * time.Second),
+			[]hotSpot{ { "/a", 3 }, { "/b", 2 } },
+			[]hotSpot{ { "/m", 2 }, { "/w", 1 } },
+		},
+		// until the window slides past it
+		{
+			start.Add(65 * time.Second),
+			[]hotSpot{ { "/b", 2 }, { "/c", 2 } },
+			[]hotSpot{ { "/m", 2 } },
+		},
+		// idle for a whole window
+		{
+			start.Add(200 * time.Second),
+			[]hotSpot{},
+			[]hotSpot{},
+		},
+	}
+	for i, test := range tests {
+		reads, writes := h.topKAt(test.now)
+		if !reflect.DeepEqual(reads, test.reads) || !reflect.DeepEqual(writes, test.writes) {
+			t.Fatalf("%d: expected %v and %v, got %v and %v", i, test.reads, test.writes, reads, writes)
+		}
+	}
+}
+
+func TestHotSpotsMaxPaths(t *testing.T) {
+	start := time.Now()
+	h := newHotSpots(time.Minute, 1)
+	h.reset(start)
+
+	for i := 0; i < maxHotSpotsPaths; i++ {
+		h.recordAt(opGetData, &GetDataReq { Path: newPath("/" + strconv.Itoa(i)) }, start)
+	}
+	// new paths are ignored once the bucket is full, the counted ones aren't
+	h.recordAt(opGetData, &GetDataReq { Path: newPath("/new") }, start)
+	h.recordAt(opGetData, &GetDataReq { Path: newPath("/new") }, start)
+	h.recordAt(opGetData, &GetDataReq { Path: newPath("/7") }, start)
+	if reads, _ := h.topKAt(start); !reflect.DeepEqual(reads, []hotSpot{ { "/7", 2 } }) {
+		t.Fatalf("unexpected reads: %v", reads)
+	}
+
+	// the next bucket starts empty
+	later := start.Add(10 * time.Second)
+	h.recordAt(opGetData, &GetDataReq { Path: newPath("/new") }, later)
+	h.recordAt(opGetData, &GetDataReq { Path: newPath("/new") }, later)
+	h.recordAt(opGetData, &GetDataReq { Path: newPath("/new") }, later)
+	if reads, _ := h.topKAt(later); !reflect.DeepEqual(reads, []hotSpot{ { "/new", 3 } }) {
+		t.Fatalf("unexpected reads: %v", reads)
+	}
+}
+
+// slowRequests returns the requests of op logged as slow so far.
+func slowRequests(t testing.TB, op string) float64 {
+	var buf bytes.Buffer
+	metrics.Write(&buf)
+	prefix := fmt.Sprintf("parkeeper_slow_requests_total{op=%q} ", op)
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), prefix) {
+			v, err := strconv.ParseFloat(strings.TrimPrefix(scanner.Text(), prefix), 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return v
+		}
+	}
+	return 0
+}
+
+func TestSlowRequestThreshold(t *testing.T) {
+	fileClient, cleanup := newTestFileClient(t)
+	defer cleanup()
+	for _, path := range []string{ "/fast", "/slow" } {
+		if err := fileClient.Create(context.Background(), path, ""); err != nil {
+			t.Fatal(err.String())
+		}
+	}
+
+	client := &slowClient {
+		Client:    fileClient,
+		latencies: map[string]time.Duration { "/slow": 100 * time.Millisecond },
+	}
+	opts := DefaultOptions
+	opts.SlowRequestThreshold = 50 * time.Millisecond
+	s, stop := newTestServer(t, client, &opts)
+	defer stop()
+
+	conn, err := net.Dial("tcp", s.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	connect(t, conn)
+
+	exists, getData := slowRequests(t, "exists"), slowRequests(t, "getData")
+	writeFrame(t, conn, &OpReqHeader { Xid: 1, OpCode: opExists }, &ExistsReq { Path: newPath("/fast") })
+	writeFrame(t, conn, &OpReqHeader { Xid: 2, OpCode: opGetData }, &GetDataReq { Path: newPath("/slow") })
+	for i := 0; i < 2; i++ {
+		if hdr := readReply(t, conn, nil); hdr.Err != errOk {
+			t.Fatalf("xid %d: unexpected error %d", hdr.Xid, hdr.Err)
+		}
+	}
+
+	// slow requests are accounted once their reply is written
+	deadline := time.Now().Add(5 * time.Second)
+	for slowRequests(t, "getData") == getData && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := slowRequests(t, "getData") - getData; n != 1 {
+		t.Fatalf("expected the read of /slow to be slow, got %v slow reads", n)
+	}
+	if n := slowRequests(t, "exists") - exists; n != 0 {
+		t.Fatalf("expected the check of /fast not to be slow, got %v slow checks", n)
+	}
+}
+
+// Request loggers are only built if something is logged with them.
+func TestSlowRequestLogger(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	k := &Keeper { conn: server, slowThreshold: 50 * time.Millisecond }
+
+	built := 0
+	reqLog := func() *log.Log {
+		built++
+		return k.requestLogger(&OpReqHeader { Xid: 1, OpCode: opGetData }, &GetDataReq { Path: newPath("/a") })
+	}
+
+	// fast requests
+	k.checkSlowRequest(reqLog, opGetData, time.Now(), &requestTiming {})
+	if built != 0 {
+		t.Fatalf("expected no logger to be built, %d were", built)
+	}
+
+	// slow requests, while warnings aren't logged
+	k.checkSlowRequest(reqLog, opGetData, time.Now().Add(-time.Second), &requestTiming {})
+	if built != 0 {
+		t.Fatalf("expected no logger to be built, %d were", built)
+	}
+
+	// and while they are
+	log.SetLevel(log.WarningLevel)
+	defer log.SetLevel(log.ErrorLevel)
+	k.checkSlowRequest(reqLog, opGetData, time.Now().Add(-time.Second), &requestTiming {})
+	if built != 1 {
+		t.Fatalf("expected a logger to be built, %d were", built)
+	}
+
+	// processors build it only when logging
+	ctx := log.NewLazyContext(context.Background(), reqLog)
+	if built != 1 {
+		t.Fatalf("expected no logger to be built, %d were", built)
+	}
+	if log.FromContext(ctx) == nil || built != 2 {
+		t.Fatalf("expected a logger to be built, %d were", built)
+	}
+}
@@ -0,0 +1,186 @@
+package keeper
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+//
+// Jute primitives used by the generated encoders/decoders (packets_codec.go).
+// Every one of them takes the buffer and the offset to read/write at and
+// returns the offset right after the value, bounds are always checked.
+//
+
+var (
+	ErrUnhandledType = errors.New("type has no encoder/decoder")
+	ErrShortBuffer   = errors.New("buffer too small")
+	ErrInvalidLength = errors.New("invalid length")
+	ErrNilField      = errors.New("nil field")
+)
+
+// CodecError tells which field of a packet couldn't be encoded or decoded.
+type CodecError struct {
+	Field string
+	Err   error
+}
+
+func (e *CodecError) Error() string {
+	return e.Field + ": " + e.Err.Error()
+}
+
+func (e *CodecError) Unwrap() error {
+	return e.Err
+}
+
+func codecError(field string, err error) error {
+	return &CodecError { Field: field, Err: err }
+}
+
+func decodeBool(buf []byte, n int) (bool, int, error) {
+	if len(buf) - n < 1 {
+		return false, n, ErrShortBuffer
+	}
+	return buf[n] != 0, n + 1, nil
+}
+
+func decodeInt32(buf []byte, n int) (int32, int, error) {
+	if len(buf) - n < 4 {
+		return 0, n, ErrShortBuffer
+	}
+	return int32(binary.BigEndian.Uint32(buf[n:])), n + 4, nil
+}
+
+func decodeInt64(buf []byte, n int) (int64, int, error) {
+	if len(buf) - n < 8 {
+		return 0, n, ErrShortBuffer
+	}
+	return int64(binary.BigEndian.Uint64(buf[n:])), n + 8, nil
+}
+
+// decodeLength reads the length of a buffer, string or vector whose elements
+// take at least minSize bytes each, -1 stands for null.
+func decodeLength(buf []byte, n int, minSize int) (int, int, error) {
+	length, n, err := decodeInt32(buf, n)
+	if err != nil {
+		return 0, n, err
+	}
+
+	if length < -1 {
+		return 0, n, ErrInvalidLength
+	}
+	if int64(length) * int64(minSize) > int64(len(buf) - n) {
+		return 0, n, ErrShortBuffer
+	}
+
+	return int(length), n, nil
+}
+
+func decodeBuffer(buf []byte, n int) ([]byte, int, error) {
+	length, n, err := decodeLength(buf, n, 1)
+	if err != nil || length < 0 {
+		return nil, n, err
+	}
+
+	b := make([]byte, length)
+	copy(b, buf[n:])
+	return b, n + length, nil
+}
+
+func decodeString(buf []byte, n int) (string, int, error) {
+	length, n, err := decodeLength(buf, n, 1)
+	if err != nil || length < 0 {
+		return "", n, err
+	}
+
+	return string(buf[n:n+length]), n + length, nil
+}
+
+func decodeStrings(buf []byte, n int) ([]string, int, error) {
+	count, n, err := decodeLength(buf, n, 4)
+	if err != nil || count < 0 {
+		return nil, n, err
+	}
+
+	s := make([]string, count)
+	for i := range s {
+		if s[i], n, err = decodeString(buf, n); err != nil {
+			return nil, n, err
+		}
+	}
+
+	return s, n, nil
+}
+
+func decodeStruct(buf []byte, n int, d Decoder) (int, error) {
+	n2, err := d.Decode(buf[n:])
+	return n + n2, err
+}
+
+func encodeBool(buf []byte, n int, v bool) (int, error) {
+	if len(buf) - n < 1 {
+		return n, ErrShortBuffer
+	}
+	buf[n] = 0
+	if v {
+		buf[n] = 1
+	}
+	return n + 1, nil
+}
+
+func encodeInt32(buf []byte, n int, v int32) (int, error) {
+	if len(buf) - n < 4 {
+		return n, ErrShortBuffer
+	}
+	binary.BigEndian.PutUint32(buf[n:], uint32(v))
+	return n + 4, nil
+}
+
+func encodeInt64(buf []byte, n int, v int64) (int, error) {
+	if len(buf) - n < 8 {
+		return n, ErrShortBuffer
+	}
+	binary.BigEndian.PutUint64(buf[n:], uint64(v))
+	return n + 8, nil
+}
+
+// encodeBuffer writes b, a nil one is written as null.
+func encodeBuffer(buf []byte, n int, b []byte) (int, error) {
+	if b == nil {
+		return encodeInt32(buf, n, -1)
+	}
+
+	if len(buf) - n < 4 + len(b) {
+		return n, ErrShortBuffer
+	}
+	n, _ = encodeInt32(buf, n, int32(len(b)))
+	return n + copy(buf[n:], b), nil
+}
+
+func encodeString(buf []byte, n int, s string) (int, error) {
+	if len(buf) - n < 4 + len(s) {
+		return n, ErrShortBuffer
+	}
+	n, _ = encodeInt32(buf, n, int32(len(s)))
+	return n + copy(buf[n:], s), nil
+}
+
+// encodeStrings writes s, a nil one is written as an empty vector.
+func encodeStrings(buf []byte, n int, s []string) (int, error) {
+	n, err := encodeInt32(buf, n, int32(len(s)))
+	if err != nil {
+		return n, err
+	}
+
+	for _, v := range s {
+		if n, err = encodeString(buf, n, v); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+func encodeStruct(buf []byte, n int, e Encoder) (int, error) {
+	n2, err := e.Encode(buf[n:])
+	return n + n2, err
+}
@@ -1,12 +1,14 @@
 package keeper
 
 import (
+	"context"
 	"errors"
 	"io"
 	"net"
 	"time"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"encoding/binary"
 
 	kv "github.com/glerchundi/kvstores"
@@ -16,41 +18,104 @@ import (
 )
 
 const (
-	bufferSize = 1536 * 1024
+	connectTimeout = 30 * time.Second
+	// replies pending once closing have this long to be written
+	flushTimeout   = 100 * time.Millisecond
 )
 
-var bufferPool = sync.Pool {
-	New: func() interface{} { return make([]byte, bufferSize) },
+var errBackendDown = errors.New("backend circuit breaker open")
+
+// errDraining closes the connections of a draining server, the client
+// reconnects elsewhere resuming its session.
+var errDraining = errors.New("server draining, session moved")
+
+// ProtocolError is returned when a client sends a malformed frame, which
+// closes its connection.
+type ProtocolError struct {
+	Err error
+}
+
+func (e *ProtocolError) Error() string {
+	return "protocol error: " + e.Err.Error()
 }
 
 type Keeper struct {
 	conn             net.Conn
 	storeClient      kv.Client
 	temp             []byte
+	maxBuffer        int
+	// mutating requests are recorded here, if set
+	audit            io.Writer
+	// requests slower than this are logged, if positive
+	slowThreshold    time.Duration
+
+	sessionId        int64
+	sessionTimeout   time.Duration
+	watches          *watchManager
+	// client whose reads observe the last sync, if any
+	syncedClient     kv.Client
+	syncIndex        uint64
 
 	tomb             *tomb.Tomb
 
 	recvChan         chan []byte
 	sendChan         chan Rep
-	processorChan    chan func()error
+	pipeline         *pipeline
+	// closed to stop taking requests and close once the pending ones are
+	// replied
+	draining         chan struct{}
+	drainOnce        sync.Once
+	// requests are delayed to comply with the rate limits of the session
+	// and, if served by a server, of its client ip
+	rateLimits       rateLimits
+	ipLimits         *clientLimits
+
+	// reported by four letter words
+	server           *Server
+	established      time.Time
+	session          atomic.Value
+	stats            stats
+	outstanding      int64
+	lastOp           int32
+	ephemeralsMutex  sync.Mutex
+	ephemerals       map[string]bool
+}
+
+// sessionInfo is the session of a connection as reported by four letter words.
+type sessionInfo struct {
+	id      int64
+	timeout time.Duration
 }
 
 //
 // PUBLIC
 //
 
-func NewKeeper(conn net.Conn, c kv.Client) *Keeper {
-	return &Keeper {
+func NewKeeper(conn net.Conn, c kv.Client, opts *Options) *Keeper {
+	if (opts == nil) {
+		opts = &DefaultOptions
+	}
+
+	k := &Keeper {
 		conn:             conn,
 		storeClient:      c,
 		temp:             make([]byte, 4),
+		maxBuffer:        opts.MaxBuffer,
+		audit:            opts.AuditLog,
+		slowThreshold:    opts.SlowRequestThreshold,
+		established:      time.Now(),
+		ephemerals:       make(map[string]bool),
 
 		tomb:             new(tomb.Tomb),
 
 		recvChan:         make(chan []byte, 16),
 		sendChan:         make(chan Rep, 16),
-		processorChan:    make(chan func()error, 16),
+		pipeline:         newPipeline(),
+		draining:         make(chan struct{}),
+		rateLimits:       newRateLimits(opts.SessionReadRate, opts.SessionWriteRate),
 	}
+	k.watches = newWatchManager(c, k.sendChan, k.tomb.Dying())
+	return k
 }
 
 func (k *Keeper) Handle()error {
@@ -61,47 +126,80 @@ func (k *Keeper) Handle()error {
 	k.trackedLoop(k.recvLoop)
 	k.trackedLoop(k.sendLoop)
 
+	// the loops above may end as soon as the connection is closed, the tomb
+	// is kept alive until the ones serving the session are started
+	handshake := make(chan struct{})
+	k.trackedLoop(func(*tomb.Tomb) error {
+		<-handshake
+		return nil
+	})
+
 	// loop until connect request was received or a timeout reached
-	connectTimeout := time.After(30 * time.Second)
+	timeout := time.After(connectTimeout)
 	select {
 	case buf := <-k.recvChan:
 		// try parsing connect request
 		req := &ConnectReq {}
 		_, err := DecodePacket(buf, req)
+		freeBuffer(buf)
 		if (err != nil) {
+			k.tomb.Kill(&ProtocolError { Err: err })
+			break
+		}
+
+		// create or resume session
+		expired, err := k.openSession(req)
+		if err != nil {
 			k.tomb.Kill(err)
+			break
+		}
+		if !expired {
+			k.session.Store(sessionInfo { id: k.sessionId, timeout: k.sessionTimeout })
+			sessionsGauge.Inc()
+			defer sessionsGauge.Dec()
+			defer k.untrackEphemerals()
 		}
 
-		// create connection reply
+		// create connection reply, an expired session is notified with a
+		// zero timeout and session id
 		rep := &ConnectRep {
 			ProtocolVersion: req.ProtocolVersion,
-			TimeOut: req.TimeOut,
-			SessionId: 1,
+			TimeOut: int32(k.sessionTimeout / time.Millisecond),
+			SessionId: k.sessionId,
 			Passwd: req.Passwd,
 		}
+		if expired {
+			rep.TimeOut, rep.SessionId = 0, 0
+		}
 
 		// write connection reply
 		k.sendChan <- rep
 
+		if expired {
+			k.tomb.Kill(fmt.Errorf("session expired: %d", req.SessionId))
+			break
+		}
+
 		// start loops
 		k.trackedLoop(k.requestLoop)
-		k.trackedLoop(k.processorLoop)
-	case <-k.tomb.Dead():
-	case <-connectTimeout:
-		k.tomb.Kill(errors.New(fmt.Sprintf("connect wasn't received in %d", connectTimeout)))
-	}
-
-	// main loop
-	for {
-		select {
-		case <-k.tomb.Dying():
-			// causes recv loop to EOF/exit
-			k.conn.Close()
-		case <-k.tomb.Dead():
-			return nil
+		k.trackedLoop(k.replyLoop)
+		if _, ok := k.storeClient.(kv.SessionClient); ok {
+			k.trackedLoop(k.sessionLoop)
 		}
+	case <-k.tomb.Dying():
+	case <-k.draining:
+		k.tomb.Kill(errDraining)
+	case <-timeout:
+		k.tomb.Kill(fmt.Errorf("connect wasn't received in %s", connectTimeout))
 	}
-
+	close(handshake)
+
+	// main loop, once dying the recv loop is interrupted while the send loop
+	// flushes the pending replies
+	<-k.tomb.Dying()
+	k.conn.SetReadDeadline(time.Now())
+	k.conn.SetWriteDeadline(time.Now().Add(flushTimeout))
+	<-k.tomb.Dead()
 	return nil
 }
 
@@ -110,7 +208,7 @@ func (k *Keeper) IsClosed() bool {
 	c := k.conn
 	c.SetReadDeadline(time.Now())
 	if _, err := c.Read(k.temp[:1]); err == io.xEOF {
-		log.Debug(fmt.Sprintf("%s detected closed LAN connection"))
+		k.logger().Debug("detected closed LAN connection")
 	  	c.Close()
 		c = nil
 	} else {
@@ -125,7 +223,7 @@ func (k *Keeper) Close() {
 	k.tomb.Kill(nil)
 	err := k.tomb.Wait()
 	if (err != nil) {
-		log.Debug("closed due to: ", err)
+		k.logger().Debug("closed due to: ", err)
 	}
 }
 
@@ -133,6 +231,53 @@ func (k *Keeper) Close() {
 // PRIVATE
 //
 
+// openSession negotiates the session timeout and creates a new session (or
+// resumes the requested one) if the backend supports them. Backends without
+// session support share a dummy session.
+func (k *Keeper) openSession(req *ConnectReq) (expired bool, err error) {
+	if k.backendDown() {
+		return false, errBackendDown
+	}
+
+	k.sessionTimeout = time.Duration(req.TimeOut) * time.Millisecond
+	if k.sessionTimeout < minSessionTimeout {
+		k.sessionTimeout = minSessionTimeout
+	} else if k.sessionTimeout > maxSessionTimeout {
+		k.sessionTimeout = maxSessionTimeout
+	}
+
+	sessionClient, ok := k.storeClient.(kv.SessionClient)
+	if !ok {
+		k.sessionId = 1
+		return false, nil
+	}
+
+	if req.SessionId != 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), k.opTimeout())
+		defer cancel()
+		defer observeBackend(ctx, sessionClient, "KeepAlive", time.Now())
+		if kerr := sessionClient.KeepAlive(ctx, req.SessionId); kerr != nil {
+			if kerr.Code() == kv.KeyNotFound {
+				return true, nil
+			}
+			return false, fmt.Errorf("unable to resume session %d: %s", req.SessionId, kerr.String())
+		}
+		k.sessionId = req.SessionId
+		return false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), k.opTimeout())
+	defer cancel()
+	start := time.Now()
+	sessionId, kerr := sessionClient.NewSession(ctx, k.sessionTimeout)
+	observeBackend(ctx, sessionClient, "NewSession", start)
+	if kerr != nil {
+		return false, fmt.Errorf("unable to create session: %s", kerr.String())
+	}
+	k.sessionId = sessionId
+	return false, nil
+}
+
 func (k *Keeper) read(buf []byte) (n int, err error) {
 	n, err = io.ReadFull(k.conn, buf)
 	if (err != nil) {
@@ -145,150 +290,430 @@ func (k *Keeper) read(buf []byte) (n int, err error) {
 	return
 }
 
-func (k *Keeper) alloc() []byte {
-	return bufferPool.Get().([]byte)
-}
-
-func (k *Keeper) free(buf []byte) {
-	if (buf != nil) {
-		bufferPool.Put(buf)
-	}
-}
-
 func (k *Keeper) trackedLoop(f func(*tomb.Tomb)error) {
 	k.tomb.Go(func() error { return f(k.tomb) })
 }
 
 func (k *Keeper) recvLoop(t *tomb.Tomb) error {
-	for {
+	for first := true; ; first = false {
 		_, err := k.read(k.temp[:4])
 		if (err != nil) {
 			return err
 		}
 
+		// four letter words are sent instead of the connect request
+		if first {
+			if cmd := string(k.temp[:4]); fourLetterWords[cmd] != nil {
+				k.runFourLetterWord(cmd)
+				t.Kill(nil)
+				return nil
+			}
+		}
+
 		// parse frame size
 		len := binary.BigEndian.Uint32(k.temp[:4])
-		if (len > bufferSize) {
-			return errors.New(fmt.Sprintf("length should be at most %d bytes (received %d)", bufferSize, len))
+		if (int64(len) > int64(k.maxBuffer)) {
+			return &ProtocolError { Err: fmt.Errorf("length should be at most %d bytes (received %d)", k.maxBuffer, len) }
 		}
 
-		// alloc buffer (freeing if full read from conn wasn't possible)
-		var buf = k.alloc()
-		defer k.free(buf)
+		// alloc a buffer fitting the frame, it's freed once decoded
+		buf := allocBuffer(int(len))
 
 		// read frame
-		_, err = k.read(buf[:len])
+		_, err = k.read(buf)
 		if (err != nil) {
+			freeBuffer(buf)
 			return err
 		}
 
-		// log input
-		log.Debug("<- ", fmt.Sprintf("%x%x", k.temp[:4], buf[:len]))
+		// log input, hex dumps are only built if they are going to be logged
+		if log.Enabled(log.DebugLevel) {
+			k.logger().Debug("<- ", fmt.Sprintf("%x%x", k.temp[:4], buf))
+		}
+		k.eachStats((*stats).addReceived)
+		receivedBytes.Add(float64(4 + len))
 
-		// send frame to channel
+		// send frame to channel, blocking while there are too many frames
+		// pending to be processed
 		select {
-		case k.recvChan <- buf[:len]:
+		case k.recvChan <- buf:
 		case <-t.Dying():
+			freeBuffer(buf)
 			return nil
 		}
 	}
-
-	return nil
 }
 
 func (k *Keeper) sendLoop(t *tomb.Tomb) error {
-	var timeout <-chan time.Time = nil
 	for {
 		select {
 		case rep := <-k.sendChan:
-			var buf []byte = k.alloc()
-			defer k.free(buf)
-
-			bytesWritten, err := EncodePacket(buf[4:], rep)
-			if (err != nil) {
+			if err := k.send(rep); err != nil {
 				return err
 			}
+		case <-t.Dying():
+			// send the replies already queued, such as the close one, and
+			// leave without waiting for more
+			for {
+				select {
+				case rep := <-k.sendChan:
+					if err := k.send(rep); err != nil {
+						return err
+					}
+				default:
+					return nil
+				}
+			}
+		}
+	}
+}
 
-			// write frame size
-			binary.BigEndian.PutUint32(buf[:4], uint32(bytesWritten))
+// send writes the frame of rep to the connection.
+func (k *Keeper) send(rep Rep) error {
+	buf, err := encodeFrame(rep, k.maxBuffer)
+	if (err != nil) {
+		return err
+	}
 
-			// write buffer to connection
-			_, err = k.conn.Write(buf[:4+bytesWritten])
-			if err != nil {
-				return err
-			}
+	// write buffer to connection
+	_, err = k.conn.Write(buf)
+	if err != nil {
+		freeBuffer(buf)
+		return err
+	}
 
-			// log output
-			log.Debug("-> ", fmt.Sprintf("%x", buf[:4+bytesWritten]))
-		case <-t.Dying():
-			// create a timeout in order to send pending requests (close reply)
-			if (timeout == nil) {
-				timeout = time.After(100 * time.Millisecond)
+	// log output
+	if log.Enabled(log.DebugLevel) {
+		k.logger().Debug("-> ", fmt.Sprintf("%x", buf))
+	}
+	sentBytes.Add(float64(len(buf)))
+	freeBuffer(buf)
+	k.eachStats((*stats).addSent)
+	if sent, ok := rep.(*sentRep); ok {
+		sent.sent()
+	}
+	return nil
+}
+
+// encodeFrame returns a buffer holding the size prefixed frame of rep, trying
+// bigger buffers until it fits in one or it exceeds maxBuffer.
+func encodeFrame(rep Rep, maxBuffer int) ([]byte, error) {
+	for i := 0; i <= len(bufferClasses); i++ {
+		size := 4 + maxBuffer
+		if (i < len(bufferClasses)) {
+			if (bufferClasses[i] >= size) {
+				continue
 			}
-		case <-timeout:
-			close(k.sendChan)
-			return nil
+			size = bufferClasses[i]
+		}
+
+		buf := allocBuffer(size)
+		bytesWritten, err := EncodePacket(buf[4:], rep)
+		if (err == nil) {
+			// write frame size
+			binary.BigEndian.PutUint32(buf[:4], uint32(bytesWritten))
+			return buf[:4+bytesWritten], nil
+		}
+
+		freeBuffer(buf)
+		if (!errors.Is(err, ErrShortBuffer)) {
+			return nil, err
 		}
 	}
+
+	return nil, fmt.Errorf("reply exceeds %d bytes", maxBuffer)
 }
 
 func (k *Keeper) requestLoop(t *tomb.Tomb) error {
 	for {
 		select {
 		case buf := <-k.recvChan:
-			// current & total bytes read
-			bytesRead := 0
-			totalBytesRead := 0
-
-			// parse request header
-			reqHdr := &OpReqHeader{}
-			bytesRead, err := DecodePacket(buf, reqHdr)
-			totalBytesRead = totalBytesRead+bytesRead
+			decoded := time.Now()
+
+			// decoded requests don't reference the frame, which can be reused
+			reqHdr, req, err := decodeRequest(buf)
+			freeBuffer(buf)
 			if (err != nil) {
-				log.Error(fmt.Sprintf("unable to decode request header: %s", err.Error()))
+				k.logger().Error(fmt.Sprintf("unable to decode request: %s", err.Error()))
 				return err
 			}
 
-			// create request
-			creator, found := creatorByOpCode[reqHdr.OpCode]
-			if !found {
-				log.Error(fmt.Sprintf("cannot create opcode: %d", reqHdr.OpCode))
-				return err
+			// every entry logged on behalf of the request carries its xid,
+			// opcode and path, the logger is only built if something is
+			reqLog := func() *log.Log { return k.requestLogger(reqHdr, req) }
+			if (k.server != nil && k.server.hotSpots != nil) {
+				k.server.hotSpots.record(reqHdr.OpCode, req)
 			}
 
-			// parse request
-			req := creator()
-			bytesRead, err = DecodePacket(buf[bytesRead:], req)
-			totalBytesRead = totalBytesRead+bytesRead
-			if (err != nil) {
-				log.Error(fmt.Sprintf("unable to decode request: %s", err.Error()))
-				return err
+			// throttled requests hold back the ones after them
+			if delay := k.throttle(reqHdr.OpCode); delay > 0 {
+				throttledRequestsTotal.With(label(opLabels, reqHdr.OpCode)).Inc()
+				select {
+				case <-time.After(delay):
+				case <-t.Dying():
+					return nil
+				}
 			}
 
-			// queue processor
-			k.processorChan <- func()error {
-				processOpReq(OpReq{ Hdr: reqHdr, Req: req }, k.storeClient, k.sendChan)
+			// dispatch processor, a sync waits for the requests before it
+			// and affects every request dispatched after it
+			received := time.Now()
+			atomic.StoreInt32(&k.lastOp, reqHdr.OpCode)
+			atomic.AddInt64(&k.outstanding, 1)
+			dispatched := k.pipeline.dispatch(concurrentOps[reqHdr.OpCode], func() pipelineResult {
+				// disconnect instead of serving requests into a dead backend, the
+				// client sees a connection loss and retries elsewhere
+				if k.backendDown() {
+					return pipelineResult { err: errBackendDown }
+				}
+
+				// a request taking too long gets an operation timeout reply,
+				// the connection is kept
+				timing := &requestTiming {}
+				ctx, cancel := context.WithTimeout(log.NewLazyContext(context.Background(), reqLog), k.opTimeout())
+				ctx = withRequestTiming(ctx, timing)
+				rep := processOpReq(ctx, OpReq{ Hdr: reqHdr, Req: req, SessionId: k.sessionId }, k.client(), k.watches)
+				cancel()
+				latency := time.Since(received)
+				k.trackEphemerals(req, rep)
+				if (k.audit != nil) {
+					k.auditRequest(req, rep)
+				}
+				k.eachStats(func(s *stats) { s.addLatency(latency) })
+				if (reqHdr.OpCode == opSync && rep != nil && rep.Hdr.Err == errOk) {
+					k.synced(uint64(rep.Hdr.Zxid))
+				}
+				res := pipelineResult { rep: rep }
+				if (k.slowThreshold > 0) {
+					res.sent = func() { k.checkSlowRequest(reqLog, reqHdr.OpCode, decoded, timing) }
+				}
 				if (reqHdr.OpCode == opClose) {
-					return errors.New("graceful connection close requested")
+					res.err = errors.New("graceful connection close requested")
 				}
+				return res
+			}, t.Dying())
+			if !dispatched {
+				atomic.AddInt64(&k.outstanding, -1)
 				return nil
 			}
+		case <-k.draining:
+			// no more requests are taken, the reply loop closes the
+			// connection once every request before is replied
+			atomic.AddInt64(&k.outstanding, 1)
+			if !k.pipeline.dispatch(false, func() pipelineResult {
+				return pipelineResult { err: errDraining }
+			}, t.Dying()) {
+				atomic.AddInt64(&k.outstanding, -1)
+			}
+			return nil
 		case <-t.Dying():
-			close(k.recvChan)
+			// recvChan is left open, the recv loop may still be sending
 			return nil
 		}
 	}
 }
 
-func (k *Keeper) processorLoop(t *tomb.Tomb) error {
+// decodeRequest decodes the header and the request of a frame, reporting a
+// malformed one as a ProtocolError.
+func decodeRequest(buf []byte) (*OpReqHeader, Req, error) {
+	reqHdr := &OpReqHeader{}
+	n, err := DecodePacket(buf, reqHdr)
+	if (err != nil) {
+		return nil, nil, &ProtocolError { Err: err }
+	}
+
+	creator, found := creatorByOpCode[reqHdr.OpCode]
+	if !found {
+		return nil, nil, &ProtocolError { Err: fmt.Errorf("unknown opcode: %d", reqHdr.OpCode) }
+	}
+
+	req := creator()
+	if _, err = DecodePacket(buf[n:], req); err != nil {
+		return nil, nil, &ProtocolError { Err: err }
+	}
+
+	return reqHdr, req, nil
+}
+
+// drain asks the client to move to another server: no more requests are taken
+// and the connection is closed once the pending ones are replied, keeping the
+// session.
+func (k *Keeper) drain() {
+	k.drainOnce.Do(func() { close(k.draining) })
+}
+
+// disconnect closes the connection right away, without replying the pending
+// requests, so that the client sees a connection loss.
+func (k *Keeper) disconnect(err error) {
+	k.tomb.Kill(err)
+	k.conn.Close()
+}
+
+// checkSlowRequest logs the request decoded at decoded, with the logger
+// returned by reqLog, if its reply took longer than the slow request threshold
+// to be sent.
+func (k *Keeper) checkSlowRequest(reqLog func() *log.Log, opCode int32, decoded time.Time, timing *requestTiming) {
+	latency := time.Since(decoded)
+	if (latency <= k.slowThreshold) {
+		return
+	}
+
+	slowRequestsTotal.With(label(opLabels, opCode)).Inc()
+	if log.Enabled(log.WarningLevel) {
+		reqLog().WithFields(log.Fields { "latency": latency, "backend_time": timing.backendTime() }).Warning("slow request")
+	}
+}
+
+// requestLogger returns a logger adding the xid, opcode and path of the
+// request to every entry.
+func (k *Keeper) requestLogger(hdr *OpReqHeader, req interface{}) *log.Log {
+	fields := log.Fields { "xid": hdr.Xid, "op": label(opLabels, hdr.OpCode) }
+	if path, ok := pathOf(req); ok {
+		fields["path"] = path
+	}
+	return k.logger().WithFields(fields)
+}
+
+// logger returns a logger adding the remote address and, once connected, the
+// session id to every entry.
+func (k *Keeper) logger() *log.Log {
+	fields := log.Fields { "remote": k.conn.RemoteAddr().String() }
+	if info, ok := k.session.Load().(sessionInfo); ok {
+		fields["session"] = fmt.Sprintf("0x%x", info.id)
+	}
+	return log.WithFields(fields)
+}
+
+// pathOf returns the path targeted by req, if any.
+func pathOf(req interface{}) (string, bool) {
+	var path *Path
+	switch r := req.(type) {
+	case *CreateReq:
+		path = r.Path
+	case *Create2Req:
+		path = r.Path
+	case *DeleteReq:
+		path = r.Path
+	case *ExistsReq:
+		path = r.Path
+	case *GetDataReq:
+		path = r.Path
+	case *SetDataReq:
+		path = r.Path
+	case *GetAclReq:
+		path = r.Path
+	case *SetAclReq:
+		path = r.Path
+	case *GetChildrenReq:
+		path = r.Path
+	case *GetChildren2Req:
+		path = r.Path
+	case *SyncReq:
+		path = r.Path
+	case *CheckVersionReq:
+		path = r.Path
+	}
+	if path == nil {
+		return "", false
+	}
+	return path.Value, true
+}
+
+// eachStats calls f with the stats of the connection and, if served by a
+// server, with the server wide ones.
+func (k *Keeper) eachStats(f func(*stats)) {
+	f(&k.stats)
+	if (k.server != nil) {
+		f(&k.server.stats)
+	}
+}
+
+// opTimeout returns the time a request has to complete. Clients consider the
+// connection lost if no reply, including those to pings queued behind other
+// requests, arrives within two thirds of the session timeout.
+func (k *Keeper) opTimeout() time.Duration {
+	return k.sessionTimeout / 3
+}
+
+// backendDown returns whether the circuit breaker around the backend is open.
+func (k *Keeper) backendDown() bool {
+	breakerClient, ok := k.storeClient.(kv.BreakerClient)
+	return ok && breakerClient.Breaker().State() == kv.BreakerOpen
+}
+
+// client returns the client requests must be processed with.
+func (k *Keeper) client() kv.Client {
+	if (k.syncedClient != nil) {
+		return k.syncedClient
+	}
+	return k.storeClient
+}
+
+// synced makes later reads observe at least index, as returned by a sync.
+func (k *Keeper) synced(index uint64) {
+	syncClient, ok := k.storeClient.(kv.SyncClient)
+	if !ok || (k.syncedClient != nil && index <= k.syncIndex) {
+		return
+	}
+
+	k.syncIndex = index
+	k.syncedClient = syncClient.Synced(index)
+}
+
+// replyLoop sends the replies in request order as they are processed.
+func (k *Keeper) replyLoop(t *tomb.Tomb) error {
 	for {
 		select {
-		case f := <- k.processorChan:
-			if err := f(); err != nil {
-				return err
+		case result := <-k.pipeline.results:
+			var res pipelineResult
+			select {
+			case res = <-result:
+			case <-t.Dying():
+				return nil
+			}
+			atomic.AddInt64(&k.outstanding, -1)
+
+			if (res.rep != nil) {
+				var rep Rep = res.rep
+				if (res.sent != nil) {
+					rep = &sentRep { OpRep: res.rep, sent: res.sent }
+				}
+				select {
+				case k.sendChan <- rep:
+				case <-t.Dying():
+					return nil
+				}
+			}
+			if (res.err != nil) {
+				return res.err
+			}
+		case <-t.Dying():
+			return nil
+		}
+	}
+}
+
+// sessionLoop keeps the session alive while the client is connected. Once
+// disconnected the session expires unless the client reconnects in time.
+func (k *Keeper) sessionLoop(t *tomb.Tomb) error {
+	sessionClient := k.storeClient.(kv.SessionClient)
+	ticker := time.NewTicker(k.sessionTimeout / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), k.opTimeout())
+			start := time.Now()
+			err := sessionClient.KeepAlive(ctx, k.sessionId)
+			observeBackend(ctx, sessionClient, "KeepAlive", start)
+			cancel()
+			if err != nil {
+				if err.Code() == kv.KeyNotFound {
+					return fmt.Errorf("session expired: %d", k.sessionId)
+				}
+				k.logger().Error(fmt.Sprintf("unable to keep session %d alive: %s", k.sessionId, err.String()))
 			}
 		case <-t.Dying():
-			close(k.processorChan)
 			return nil
 		}
 	}
@@ -0,0 +1,135 @@
+package keeper
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	kv "github.com/glerchundi/kvstores"
+	"github.com/glerchundi/parkeeper/log"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLogger(log.NewLevelLogger(log.ErrorLevel, log.TextFormat))
+	os.Exit(m.Run())
+}
+
+// newTestFileClient returns a file backend stored in a temporary directory,
+// removed by the returned function.
+func newTestFileClient(t testing.TB) (*kv.FileClient, func()) {
+	dir, err := ioutil.TempDir("", "keeper")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := kv.NewFileClient(filepath.Join(dir, "data.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return c, func() {
+		c.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// writeFrame sends packets as a single size prefixed frame.
+func writeFrame(t testing.TB, conn net.Conn, packets ...interface{}) {
+	buf := make([]byte, 64 * 1024)
+	n := 4
+	for _, packet := range packets {
+		written, err := EncodePacket(buf[n:], packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n += written
+	}
+	binary.BigEndian.PutUint32(buf[:4], uint32(n - 4))
+
+	if _, err := conn.Write(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readFrame returns the next frame received, without its size, failing if none
+// is received within timeout.
+func readFrame(t testing.TB, conn net.Conn, timeout time.Duration) []byte {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	size := make([]byte, 4)
+	if _, err := io.ReadFull(conn, size); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, binary.BigEndian.Uint32(size))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf
+}
+
+// connect opens a session through conn.
+func connect(t testing.TB, conn net.Conn) *ConnectRep {
+	writeFrame(t, conn, &ConnectReq { TimeOut: 30000, Passwd: make([]byte, 16) })
+
+	rep := &ConnectRep {}
+	if _, err := DecodePacket(readFrame(t, conn, 5 * time.Second), rep); err != nil {
+		t.Fatal(err)
+	}
+	if rep.TimeOut == 0 {
+		t.Fatal("expected a session to be opened")
+	}
+
+	return rep
+}
+
+// readReply decodes the header of the next reply and, if it succeeded, the
+// reply itself into rep.
+func readReply(t testing.TB, conn net.Conn, rep interface{}) *OpRepHeader {
+	buf := readFrame(t, conn, 5 * time.Second)
+
+	hdr := &OpRepHeader {}
+	n, err := DecodePacket(buf, hdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Err == errOk && rep != nil {
+		if _, err := DecodePacket(buf[n:], rep); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return hdr
+}
+
+// newPath returns an initialized path, as if decoded.
+func newPath(value string) *Path {
+	p := &Path { Value: value }
+	p.Init()
+	return p
+}
+
+// expectClosed fails unless the peer closes conn within timeout.
+func expectClosed(t testing.TB, conn net.Conn, timeout time.Duration) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, 1024)
+	for {
+		_, err := conn.Read(buf)
+		if err == nil {
+			continue
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			t.Fatalf("expected the connection to be closed within %s", timeout)
+		}
+		return
+	}
+}
@@ -0,0 +1,166 @@
+package keeper
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+//
+// Limits: connections are capped per client ip and overall, and requests are
+// rate limited per session and per client ip with token buckets, reads and
+// writes separately. As zookeeper's request throttler does, throttled
+// requests are delayed rather than dropped: the session stops reading until
+// they are dispatched, which pushes back on the client.
+//
+
+// tokenBucket allows rate requests per second on average and bursts of up to
+// one second worth of them.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket, nil if rate isn't positive, which
+// never delays anything.
+func newTokenBucket(rate float64) *tokenBucket {
+	if (rate <= 0) {
+		return nil
+	}
+	burst := rate
+	if (burst < 1) {
+		burst = 1
+	}
+	return &tokenBucket { rate: rate, burst: burst, tokens: burst, last: time.Now() }
+}
+
+// reserve takes a token, returning how long to wait until it's actually
+// available. Tokens are taken even if not available yet so that delayed
+// requests are served in order.
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	if (b == nil) {
+		return 0
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if (now.After(b.last)) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if (b.tokens > b.burst) {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+	b.tokens--
+	if (b.tokens >= 0) {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// rateLimits are the buckets of reads and writes of a session or client.
+type rateLimits struct {
+	reads  *tokenBucket
+	writes *tokenBucket
+}
+
+func newRateLimits(readRate float64, writeRate float64) rateLimits {
+	return rateLimits { reads: newTokenBucket(readRate), writes: newTokenBucket(writeRate) }
+}
+
+// reserve takes a token of opCode, returning how long to wait for it. Pings
+// and closes are never throttled lest sessions expire.
+func (l rateLimits) reserve(opCode int32, now time.Time) time.Duration {
+	switch {
+	case opCode == opPing || opCode == opClose:
+		return 0
+	case concurrentOps[opCode]:
+		return l.reads.reserve(now)
+	default:
+		return l.writes.reserve(now)
+	}
+}
+
+// clientLimits are shared by the connections of a client ip.
+type clientLimits struct {
+	ip          string
+	connections int
+	rateLimits
+}
+
+// errTooManyConnections is returned when accepting a connection exceeds the
+// connection limits.
+type errTooManyConnections struct {
+	ip    string
+	limit int
+	// whether the limit is the one of the client ip or the global one
+	perIP bool
+}
+
+func (e *errTooManyConnections) Error() string {
+	if e.perIP {
+		return fmt.Sprintf("too many connections from %s, max is %d", e.ip, e.limit)
+	}
+	return fmt.Sprintf("too many connections, max is %d", e.limit)
+}
+
+// remoteIP returns the ip conn comes from, its whole address if it isn't a
+// host:port one.
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// admit accounts a connection of k against the connection limits, returning
+// the limits of its client ip. The server mutex must be held.
+func (s *Server) admit(k *Keeper) (*clientLimits, error) {
+	ip := remoteIP(k.conn)
+	client := s.clients[ip]
+	if (s.opts.MaxConnections > 0 && len(s.keepers) >= s.opts.MaxConnections) {
+		return nil, &errTooManyConnections { ip: ip, limit: s.opts.MaxConnections }
+	}
+	if (client != nil && s.opts.MaxClientCnxns > 0 && client.connections >= s.opts.MaxClientCnxns) {
+		return nil, &errTooManyConnections { ip: ip, limit: s.opts.MaxClientCnxns, perIP: true }
+	}
+
+	if (client == nil) {
+		client = &clientLimits {
+			ip:         ip,
+			rateLimits: newRateLimits(s.opts.ClientReadRate, s.opts.ClientWriteRate),
+		}
+		s.clients[ip] = client
+	}
+	client.connections++
+	return client, nil
+}
+
+// release undoes admit once the connection of client is closed. The server
+// mutex must be held.
+func (s *Server) release(client *clientLimits) {
+	client.connections--
+	if (client.connections == 0) {
+		delete(s.clients, client.ip)
+	}
+}
+
+// throttle returns how long a request of opCode must be delayed to comply
+// with the rate limits of the session and of its client ip.
+func (k *Keeper) throttle(opCode int32) time.Duration {
+	now := time.Now()
+	delay := k.rateLimits.reserve(opCode, now)
+	if (k.ipLimits != nil) {
+		if d := k.ipLimits.reserve(opCode, now); d > delay {
+			delay = d
+		}
+	}
+	return delay
+}
@@ -0,0 +1,224 @@
+package keeper
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Now()
+	type reservation struct {
+		at    time.Duration
+		delay time.Duration
+	}
+	tests := []struct {
+		rate         float64
+		reservations []reservation
+	}{
+		// a second worth of requests in a burst, the rest queue in order
+		{ 10, []reservation {
+			{ 0, 0 }, { 0, 0 }, { 0, 0 }, { 0, 0 }, { 0, 0 }, { 0, 0 }, { 0, 0 }, { 0, 0 }, { 0, 0 }, { 0, 0 },
+			{ 0, 100 * time.Millisecond }, { 0, 200 * time.Millisecond },
+			{ 50 * time.Millisecond, 250 * time.Millisecond },
+			// the queue is drained by now
+			{ time.Second + 300 * time.Millisecond, 0 },
+		} },
+		// idle buckets don't fill up beyond the burst
+		{ 2, []reservation {
+			{ 10 * time.Second, 0 }, { 10 * time.Second, 0 }, { 10 * time.Second, 500 * time.Millisecond },
+		} },
+		// rates below one per second still allow a request at once
+		{ 0.5, []reservation {
+			{ 0, 0 }, { 0, 2 * time.Second }, { 0, 4 * time.Second },
+			{ 6 * time.Second, 0 }, { 6 * time.Second, 2 * time.Second },
+		} },
+		// time going backwards doesn't add tokens
+		{ 1, []reservation {
+			{ time.Second, 0 }, { 0, time.Second },
+		} },
+		// unlimited
+		{ 0, []reservation { { 0, 0 }, { 0, 0 }, { 0, 0 } } },
+	}
+	for _, test := range tests {
+		b := newTokenBucket(test.rate)
+		if (b != nil) {
+			b.last = start
+		}
+		for i, r := range test.reservations {
+			delay := b.reserve(start.Add(r.at))
+			// allow for the rounding of float durations
+			if diff := delay - r.delay; diff < -time.Microsecond || diff > time.Microsecond {
+				t.Fatalf("rate %v: reservation %d: expected a delay of %s, got %s", test.rate, i, r.delay, delay)
+			}
+		}
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	now := time.Now()
+	l := newRateLimits(1, 1)
+	l.reads.last, l.writes.last = now, now
+
+	// reads and writes are limited separately
+	if delay := l.reserve(opGetData, now); delay != 0 {
+		t.Fatalf("unexpected read delay: %s", delay)
+	}
+	if delay := l.reserve(opSetData, now); delay != 0 {
+		t.Fatalf("unexpected write delay: %s", delay)
+	}
+	if delay := l.reserve(opExists, now); delay != time.Second {
+		t.Fatalf("expected reads to be throttled, got a delay of %s", delay)
+	}
+	if delay := l.reserve(opCreate, now); delay != time.Second {
+		t.Fatalf("expected writes to be throttled, got a delay of %s", delay)
+	}
+	// syncs wait for every request before them, as writes do
+	if delay := l.reserve(opSync, now); delay != 2 * time.Second {
+		t.Fatalf("expected syncs to be throttled as writes, got a delay of %s", delay)
+	}
+
+	// lest sessions expire
+	for _, opCode := range []int32{ opPing, opClose } {
+		if delay := l.reserve(opCode, now); delay != 0 {
+			t.Fatalf("expected op %d not to be throttled, got a delay of %s", opCode, delay)
+		}
+	}
+}
+
+// Requests wait for the longest of the delays of their session and of their
+// client ip.
+func TestThrottle(t *testing.T) {
+	now := time.Now()
+	k := &Keeper {
+		rateLimits: newRateLimits(2, 0),
+		ipLimits:   &clientLimits { rateLimits: newRateLimits(1, 1) },
+	}
+	k.rateLimits.reads.last, k.ipLimits.reads.last, k.ipLimits.writes.last = now, now, now
+
+	if delay := k.throttle(opGetData); delay != 0 {
+		t.Fatalf("unexpected delay: %s", delay)
+	}
+	// the client ip is out of tokens
+	if delay := k.throttle(opGetData); delay < 900 * time.Millisecond || delay > time.Second {
+		t.Fatalf("expected a delay of about a second, got %s", delay)
+	}
+	// and so is the session, which is faster
+	if delay := k.throttle(opGetData); delay < 1900 * time.Millisecond || delay > 2 * time.Second {
+		t.Fatalf("expected a delay of about two seconds, got %s", delay)
+	}
+
+	// writes are only limited by the client ip
+	if delay := k.throttle(opSetData); delay != 0 {
+		t.Fatalf("unexpected delay: %s", delay)
+	}
+}
+
+func TestThrottledSession(t *testing.T) {
+	fileClient, cleanup := newTestFileClient(t)
+	defer cleanup()
+
+	opts := DefaultOptions
+	opts.SessionWriteRate = 10
+	s, stop := newTestServer(t, fileClient, &opts)
+	defer stop()
+
+	conn, err := net.Dial("tcp", s.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	connect(t, conn)
+
+	// a burst of ten writes, the two after it are delayed but not dropped
+	start := time.Now()
+	for i := int32(1); i <= 12; i++ {
+		writeFrame(t, conn, &OpReqHeader { Xid: i, OpCode: opSetData }, &SetDataReq { Path: newPath("/"), Version: -1 })
+	}
+	for i := int32(1); i <= 12; i++ {
+		if hdr := readReply(t, conn, nil); hdr.Xid != i || hdr.Err != errOk {
+			t.Fatalf("expected reply to xid %d, got xid %d with error %d", i, hdr.Xid, hdr.Err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 150 * time.Millisecond {
+		t.Fatalf("expected the writes to be throttled, they took %s", elapsed)
+	}
+
+	// reads are unlimited
+	start = time.Now()
+	for i := int32(13); i <= 40; i++ {
+		writeFrame(t, conn, &OpReqHeader { Xid: i, OpCode: opExists }, &ExistsReq { Path: newPath("/") })
+	}
+	for i := int32(13); i <= 40; i++ {
+		readReply(t, conn, nil)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the reads not to be throttled, they took %s", elapsed)
+	}
+}
+
+// dialFrom connects to addr from ip, a loopback one, and starts a session.
+func dialFrom(t testing.TB, ip string, addr string) net.Conn {
+	dialer := net.Dialer { LocalAddr: &net.TCPAddr { IP: net.ParseIP(ip) } }
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connect(t, conn)
+	return conn
+}
+
+// expectRejected fails unless the connection from ip is closed before it
+// starts a session.
+func expectRejected(t testing.TB, ip string, addr string) {
+	dialer := net.Dialer { LocalAddr: &net.TCPAddr { IP: net.ParseIP(ip) } }
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	writeFrame(t, conn, &ConnectReq { TimeOut: 30000, Passwd: make([]byte, 16) })
+	expectClosed(t, conn, 5 * time.Second)
+}
+
+func TestConnectionLimits(t *testing.T) {
+	fileClient, cleanup := newTestFileClient(t)
+	defer cleanup()
+
+	opts := DefaultOptions
+	opts.MaxClientCnxns = 2
+	opts.MaxConnections = 3
+	s, stop := newTestServer(t, fileClient, &opts)
+	defer stop()
+
+	// per client ip
+	a1 := dialFrom(t, "127.0.0.1", s.addr)
+	defer a1.Close()
+	a2 := dialFrom(t, "127.0.0.1", s.addr)
+	defer a2.Close()
+	expectRejected(t, "127.0.0.1", s.addr)
+
+	// overall
+	b1 := dialFrom(t, "127.0.0.2", s.addr)
+	defer b1.Close()
+	expectRejected(t, "127.0.0.2", s.addr)
+	expectRejected(t, "127.0.0.3", s.addr)
+
+	// closed connections are released
+	a1.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.connections()) > 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c1 := dialFrom(t, "127.0.0.3", s.addr)
+	defer c1.Close()
+	expectRejected(t, "127.0.0.1", s.addr)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for ip, n := range map[string]int { "127.0.0.1": 1, "127.0.0.2": 1, "127.0.0.3": 1 } {
+		if client := s.clients[ip]; client == nil || client.connections != n {
+			t.Fatalf("expected %d connections from %s, got %+v", n, ip, client)
+		}
+	}
+}
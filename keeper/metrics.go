@@ -0,0 +1,198 @@
+package keeper
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	kv "github.com/glerchundi/kvstores"
+	"github.com/glerchundi/parkeeper/metrics"
+)
+
+var (
+	requestsTotal = metrics.NewCounterVec(
+		"parkeeper_requests_total",
+		"Requests processed by opcode.",
+		"op",
+	)
+	requestErrorsTotal = metrics.NewCounterVec(
+		"parkeeper_request_errors_total",
+		"Requests replied with an error by opcode and error.",
+		"op", "error",
+	)
+	requestDuration = metrics.NewHistogramVec(
+		"parkeeper_request_duration_seconds",
+		"Time taken to process requests by opcode.",
+		metrics.DefBuckets,
+		"op",
+	)
+	slowRequestsTotal = metrics.NewCounterVec(
+		"parkeeper_slow_requests_total",
+		"Requests slower than the slow request threshold by opcode.",
+		"op",
+	)
+	throttledRequestsTotal = metrics.NewCounterVec(
+		"parkeeper_throttled_requests_total",
+		"Requests delayed by the session or client ip rate limits by opcode.",
+		"op",
+	)
+	rejectedConnectionsTotal = metrics.NewCounterVec(
+		"parkeeper_rejected_connections_total",
+		"Connections rejected by the client ip or global connection limit.",
+		"limit",
+	)
+	backendRequestDuration = metrics.NewHistogramVec(
+		"parkeeper_backend_request_duration_seconds",
+		"Time taken by backend calls by backend and method.",
+		metrics.DefBuckets,
+		"backend", "method",
+	)
+
+	connectionsGauge = metrics.NewGauge(
+		"parkeeper_connections",
+		"Open client connections.",
+	)
+	sessionsGauge = metrics.NewGauge(
+		"parkeeper_sessions",
+		"Sessions of the connected clients.",
+	)
+	watchesGauge = metrics.NewGauge(
+		"parkeeper_watches",
+		"Watches set by the connected clients.",
+	)
+	ephemeralsGauge = metrics.NewGauge(
+		"parkeeper_ephemerals",
+		"Ephemeral nodes created by the connected clients.",
+	)
+
+	receivedBytes = metrics.NewCounter(
+		"parkeeper_received_bytes_total",
+		"Bytes received from clients.",
+	)
+	sentBytes = metrics.NewCounter(
+		"parkeeper_sent_bytes_total",
+		"Bytes sent to clients.",
+	)
+)
+
+// opLabels are the names of the opcodes as reported by metrics.
+var opLabels = map[int32]string {
+	opCreate:       "create",
+	opDelete:       "delete",
+	opExists:       "exists",
+	opGetData:      "getData",
+	opSetData:      "setData",
+	opGetAcl:       "getACL",
+	opSetAcl:       "setACL",
+	opGetChildren:  "getChildren",
+	opSync:         "sync",
+	opPing:         "ping",
+	opGetChildren2: "getChildren2",
+	opCheck:        "check",
+	opMulti:        "multi",
+	opCreate2:      "create2",
+	opClose:        "closeSession",
+	opSetAuth:      "setAuth",
+	opSetWatches:   "setWatches",
+}
+
+// errLabels are the names of the errors replied as reported by metrics.
+var errLabels = map[int32]string {
+	errSystemError:          "systemError",
+	errRuntimeInconsistency: "runtimeInconsistency",
+	errUnimplemented:        "unimplemented",
+	errOperationTimeout:     "operationTimeout",
+	errBadArguments:         "badArguments",
+	errNoNode:               "noNode",
+	errNoAuth:               "noAuth",
+	errBadVersion:           "badVersion",
+	errNodeExists:           "nodeExists",
+	errNotEmpty:             "notEmpty",
+}
+
+func label(labels map[int32]string, code int32) string {
+	if l, found := labels[code]; found {
+		return l
+	}
+	return strconv.Itoa(int(code))
+}
+
+// observeRequest records a request processed in duration and replied with
+// rep, if any.
+func observeRequest(opCode int32, rep *OpRep, duration time.Duration) {
+	op := label(opLabels, opCode)
+	requestsTotal.With(op).Inc()
+	requestDuration.With(op).Observe(duration.Seconds())
+	if (rep != nil && rep.Hdr.Err != errOk) {
+		requestErrorsTotal.With(op, label(errLabels, rep.Hdr.Err)).Inc()
+	}
+}
+
+// observeBackend records the latency of a backend call started at start, also
+// as backend time of the request ctx belongs to. It's meant to be deferred
+// right before the call.
+func observeBackend(ctx context.Context, client kv.Client, method string, start time.Time) {
+	latency := time.Since(start)
+	backendRequestDuration.With(kv.BackendName(client), method).Observe(latency.Seconds())
+	addBackendTime(ctx, latency)
+}
+
+// trackEphemerals keeps the ephemeral nodes created by the session, which are
+// reported until deleted through it or the connection is closed.
+func (k *Keeper) trackEphemerals(req interface{}, rep *OpRep) {
+	if _, ok := k.storeClient.(kv.SessionClient); !ok || rep == nil || rep.Hdr.Err != errOk {
+		return
+	}
+
+	k.ephemeralsMutex.Lock()
+	defer k.ephemeralsMutex.Unlock()
+
+	// creations within a multi aren't bound to the session
+	if multi, ok := req.(*MultiReq); ok {
+		if multiRep, ok := rep.Rep.(*MultiRep); ok && len(multiRep.Ops) > 0 && multiRep.Ops[0].Hdr.OpCode == opMultiError {
+			return
+		}
+		for _, op := range multi.Ops {
+			if r, ok := op.Op.(*DeleteReq); ok && k.ephemerals[r.Path.Value] {
+				delete(k.ephemerals, r.Path.Value)
+				ephemeralsGauge.Dec()
+			}
+		}
+		return
+	}
+
+	switch r := req.(type) {
+	case *CreateReq:
+		if (r.Flags&flagEphemeral != 0 && !k.ephemerals[r.Path.Value]) {
+			k.ephemerals[r.Path.Value] = true
+			ephemeralsGauge.Inc()
+		}
+	case *Create2Req:
+		if (r.Flags&flagEphemeral != 0 && !k.ephemerals[r.Path.Value]) {
+			k.ephemerals[r.Path.Value] = true
+			ephemeralsGauge.Inc()
+		}
+	case *DeleteReq:
+		if (k.ephemerals[r.Path.Value]) {
+			delete(k.ephemerals, r.Path.Value)
+			ephemeralsGauge.Dec()
+		}
+	}
+}
+
+// untrackEphemerals stops reporting the ephemeral nodes of the session once
+// the connection is closed.
+func (k *Keeper) untrackEphemerals() {
+	k.ephemeralsMutex.Lock()
+	defer k.ephemeralsMutex.Unlock()
+
+	ephemeralsGauge.Add(float64(-len(k.ephemerals)))
+	k.ephemerals = make(map[string]bool)
+}
+
+// ephemeralsCount returns the ephemeral nodes created by the session.
+func (k *Keeper) ephemeralsCount() int {
+	k.ephemeralsMutex.Lock()
+	defer k.ephemeralsMutex.Unlock()
+	return len(k.ephemerals)
+}
@@ -1,15 +1,13 @@
 package keeper
 
 import (
-	"encoding/binary"
-	"errors"
 	"fmt"
-	"reflect"
-	"runtime"
 
 	"github.com/glerchundi/parkeeper/log"
 )
 
+//go:generate go run gen_codec.go
+
 //
 // Common structs
 //
@@ -18,8 +16,9 @@ type Rep interface{}
 type Req interface{}
 
 type OpReq struct {
-	Hdr *OpReqHeader
-	Req interface{}
+	Hdr       *OpReqHeader
+	Req       interface{}
+	SessionId int64
 }
 
 type OpRep struct {
@@ -27,6 +26,17 @@ type OpRep struct {
 	Rep interface{}
 }
 
+// Encode writes the header followed by the reply, if any.
+func (r *OpRep) Encode(buf []byte) (int, error) {
+	n, err := r.Hdr.Encode(buf)
+	if err != nil || r.Rep == nil {
+		return n, err
+	}
+
+	n2, err := EncodePacket(buf[n:], r.Rep)
+	return n + n2, err
+}
+
 type OpReqHeader struct {
 	Xid    int32
 	OpCode int32
@@ -75,24 +85,26 @@ type Path struct {
 	isValid bool
 }
 
-func (p *Path) Decode(buf []byte) (int, error) {
-	return decodePacketValue(buf, reflect.ValueOf(&p.Value))
+// Decode reads the path and validates it.
+func (p *Path) Decode(buf []byte) (n int, err error) {
+	if p.Value, n, err = decodeString(buf, 0); err != nil {
+		return n, err
+	}
+
+	p.Init()
+	return n, nil
 }
 
 func (p *Path) Encode(buf []byte) (int, error) {
-	return encodePacketValue(buf, reflect.ValueOf(&p.Value))
+	return encodeString(buf, 0, p.Value)
 }
 
 // Ported from: ZooKeeper's PathUtils.java
 func (p *Path) Init() {
 	p.isValid = false
 
-	runeCount := 0
-	runes := make([]rune, len(p.Value))
-	for i, rune := range p.Value {
-		runes[i] = rune
-		runeCount = runeCount + 1
-	}
+	runes := []rune(p.Value)
+	runeCount := len(runes)
 
 	if (runeCount == 0) {
 		log.Error("Path length must be > 0")
@@ -177,6 +189,16 @@ type ConnectRep struct {
 type NotifyReq struct {}
 type NotifyRep struct {}
 
+//
+// Watcher event
+//
+
+type WatcherEvent struct {
+	Type  int32
+	State int32
+	Path  string
+}
+
 //
 // Create Req/Rep
 //
@@ -333,7 +355,7 @@ type CheckVersionRep struct {}
 //
 
 type MultiHeader struct {
-	OpoCde int32
+	OpCode int32
 	Done   bool
 	Err    int32
 }
@@ -344,19 +366,86 @@ type MultiReqOp struct {
 }
 
 type MultiRepOp struct {
-	Hdr    MultiHeader
-	String string
-	Stat   Stat
+	Hdr  MultiHeader
+	Path string
+	Stat Stat
 }
 
 type MultiReq struct {
-	Ops        []MultiReqOp
-	DoneHeader MultiHeader
+	Ops []MultiReqOp
+}
+
+// Decode reads operations until the done header is found. Each one of them is
+// preceded by a header telling which kind of request follows.
+func (r *MultiReq) Decode(buf []byte) (int, error) {
+	n := 0
+	for {
+		hdr := MultiHeader {}
+		n2, err := DecodePacket(buf[n:], &hdr)
+		n += n2
+		if err != nil {
+			return n, err
+		}
+
+		if hdr.Done {
+			return n, nil
+		}
+
+		var op Req
+		switch hdr.OpCode {
+		case opCreate:
+			op = &CreateReq {}
+		case opDelete:
+			op = &DeleteReq {}
+		case opSetData:
+			op = &SetDataReq {}
+		case opCheck:
+			op = &CheckVersionReq {}
+		default:
+			return n, fmt.Errorf("unsupported multi opcode: %d", hdr.OpCode)
+		}
+
+		n2, err = DecodePacket(buf[n:], op)
+		n += n2
+		if err != nil {
+			return n, err
+		}
+
+		r.Ops = append(r.Ops, MultiReqOp { Hdr: hdr, Op: op })
+	}
 }
 
 type MultiRep struct {
-	Ops        []MultiRepOp
-	DoneHeader MultiHeader
+	Ops []MultiRepOp
+}
+
+// Encode writes every operation result followed by the done header. The
+// payload depends on the result type: created path, stat, error code or none.
+func (r *MultiRep) Encode(buf []byte) (int, error) {
+	n := 0
+	for i := range r.Ops {
+		op := &r.Ops[i]
+		n2, err := EncodePacket(buf[n:], &op.Hdr)
+		n += n2
+		if err != nil {
+			return n, err
+		}
+
+		switch op.Hdr.OpCode {
+		case opCreate:
+			n, err = encodeString(buf, n, op.Path)
+		case opSetData:
+			n, err = encodeStruct(buf, n, &op.Stat)
+		case opMultiError:
+			n, err = encodeInt32(buf, n, op.Hdr.Err)
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+
+	n2, err := EncodePacket(buf[n:], &MultiHeader { OpCode: opMultiError, Done: true, Err: -1 })
+	return n + n2, err
 }
 
 //
@@ -425,24 +514,16 @@ var creatorByOpCode = map[int32]func()Req {
 	opGetChildren2: func() Req { return &GetChildren2Req{} },
 	opCheck:        func() Req { return &CheckVersionReq{} },
 	opMulti:        func() Req { return &MultiReq{} },
-	opCreate2:      nil,
+	opCreate2:      func() Req { return &Create2Req{} },
 	opClose:        func() Req { return &CloseReq{} },
 	opSetAuth:      func() Req { return &SetAuthReq{} },
 	opSetWatches:   func() Req { return &SetWatchesReq{} },
 }
 
 //
-// Generic Encoding/Decoding methods thanks to samuel@descolada.com (http://samuelks.com). Used
-// in go-zookeeper project (https://github.com/samuel/go-zookeeper)
-// Such a good piece of code!!
+// Encoding/Decoding
 //
 
-var (
-	ErrUnhandledFieldType = errors.New("unhandled field type")
-	ErrPtrExpected        = errors.New("encode/decode expect a non-nil pointer to struct")
-	ErrShortBuffer        = errors.New("buffer too small")
-)
-
 type Decoder interface {
 	Decode(buf []byte) (int, error)
 }
@@ -451,198 +532,22 @@ type Encoder interface {
 	Encode(buf []byte) (int, error)
 }
 
-type Initializer interface {
-	Init()
-}
-
-func DecodePacket(buf []byte, st interface{}) (n int, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			if e, ok := r.(runtime.Error); ok && e.Error() == "runtime error: slice bounds out of range" {
-				err = ErrShortBuffer
-			} else {
-				panic(r)
-			}
-		}
-	}()
-
-	v := reflect.ValueOf(st)
-	if v.Kind() != reflect.Ptr || v.IsNil() {
-		return 0, ErrPtrExpected
-	}
-	return decodePacketValue(buf, v)
-}
-
-func decodePacketValue(buf []byte, v reflect.Value) (int, error) {
-	rv := v
-	kind := v.Kind()
-	if kind == reflect.Ptr {
-		if v.IsNil() {
-			v.Set(reflect.New(v.Type().Elem()))
-		}
-		v = v.Elem()
-		kind = v.Kind()
-	}
-
-	var n int = 0
-	var err error = nil
-	switch kind {
-	default:
-		return n, ErrUnhandledFieldType
-	case reflect.Struct:
-		if de, ok := rv.Interface().(Decoder); ok {
-			n, err = de.Decode(buf)
-		} else if de, ok := v.Interface().(Decoder); ok {
-			n, err = de.Decode(buf)
-		} else {
-			for i := 0; i < v.NumField(); i++ {
-				field := v.Field(i)
-				n2, err := decodePacketValue(buf[n:], field)
-				n += n2
-				if err != nil {
-					break
-				}
-			}
-		}
-
-		if (err != nil) {
-			return n, err
-		}
-
-		if i, ok := rv.Interface().(Initializer); ok {
-			i.Init()
-		} else if i, ok := v.Interface().(Initializer); ok {
-			i.Init()
-		}
-	case reflect.Bool:
-		v.SetBool(buf[n] != 0)
-		n++
-	case reflect.Int32:
-		v.SetInt(int64(binary.BigEndian.Uint32(buf[n : n+4])))
-		n += 4
-	case reflect.Int64:
-		v.SetInt(int64(binary.BigEndian.Uint64(buf[n : n+8])))
-		n += 8
-	case reflect.String:
-		ln := int(binary.BigEndian.Uint32(buf[n : n+4]))
-		v.SetString(string(buf[n+4 : n+4+ln]))
-		n += 4 + ln
-	case reflect.Slice:
-		switch v.Type().Elem().Kind() {
-		default:
-			count := int(binary.BigEndian.Uint32(buf[n : n+4]))
-			n += 4
-			values := reflect.MakeSlice(v.Type(), count, count)
-			v.Set(values)
-			for i := 0; i < count; i++ {
-				n2, err := decodePacketValue(buf[n:], values.Index(i))
-				n += n2
-				if err != nil {
-					return n, err
-				}
-			}
-		case reflect.Uint8:
-			ln := int(int32(binary.BigEndian.Uint32(buf[n : n+4])))
-			if ln < 0 {
-				n += 4
-				v.SetBytes(nil)
-			} else {
-				bytes := make([]byte, ln)
-				copy(bytes, buf[n+4:n+4+ln])
-				v.SetBytes(bytes)
-				n += 4 + ln
-			}
-		}
-	}
-	return n, nil
-}
-
-func EncodePacket(buf []byte, st interface{}) (n int, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			if e, ok := r.(runtime.Error); ok && e.Error() == "runtime error: slice bounds out of range" {
-				err = ErrShortBuffer
-			} else {
-				panic(r)
-			}
-		}
-	}()
-
-	v := reflect.ValueOf(st)
-	if v.Kind() != reflect.Ptr || v.IsNil() {
-		return 0, ErrPtrExpected
+// DecodePacket decodes st, which must implement Decoder, from buf and returns
+// the number of bytes read.
+func DecodePacket(buf []byte, st interface{}) (int, error) {
+	de, ok := st.(Decoder)
+	if !ok {
+		return 0, ErrUnhandledType
 	}
-	return encodePacketValue(buf, v)
+	return de.Decode(buf)
 }
 
-func encodePacketValue(buf []byte, v reflect.Value) (int, error) {
-	rv := v
-	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
-		v = v.Elem()
+// EncodePacket encodes st, which must implement Encoder, into buf and returns
+// the number of bytes written.
+func EncodePacket(buf []byte, st interface{}) (int, error) {
+	en, ok := st.(Encoder)
+	if !ok {
+		return 0, ErrUnhandledType
 	}
-
-	n := 0
-	switch v.Kind() {
-	default:
-		return n, ErrUnhandledFieldType
-	case reflect.Struct:
-		if en, ok := rv.Interface().(Encoder); ok {
-			return en.Encode(buf)
-		} else if en, ok := v.Interface().(Encoder); ok {
-			return en.Encode(buf)
-		} else {
-			for i := 0; i < v.NumField(); i++ {
-				field := v.Field(i)
-				n2, err := encodePacketValue(buf[n:], field)
-				n += n2
-				if err != nil {
-					return n, err
-				}
-			}
-		}
-	case reflect.Bool:
-		if v.Bool() {
-			buf[n] = 1
-		} else {
-			buf[n] = 0
-		}
-		n++
-	case reflect.Int32:
-		binary.BigEndian.PutUint32(buf[n:n+4], uint32(v.Int()))
-		n += 4
-	case reflect.Int64:
-		binary.BigEndian.PutUint64(buf[n:n+8], uint64(v.Int()))
-		n += 8
-	case reflect.String:
-		str := v.String()
-		binary.BigEndian.PutUint32(buf[n:n+4], uint32(len(str)))
-		copy(buf[n+4:n+4+len(str)], []byte(str))
-		n += 4 + len(str)
-	case reflect.Slice:
-		switch v.Type().Elem().Kind() {
-		default:
-			count := v.Len()
-			startN := n
-			n += 4
-			for i := 0; i < count; i++ {
-				n2, err := encodePacketValue(buf[n:], v.Index(i))
-				n += n2
-				if err != nil {
-					return n, err
-				}
-			}
-			binary.BigEndian.PutUint32(buf[startN:startN+4], uint32(count))
-		case reflect.Uint8:
-			if v.IsNil() {
-				binary.BigEndian.PutUint32(buf[n:n+4], uint32(0xffffffff))
-				n += 4
-			} else {
-				bytes := v.Bytes()
-				binary.BigEndian.PutUint32(buf[n:n+4], uint32(len(bytes)))
-				copy(buf[n+4:n+4+len(bytes)], bytes)
-				n += 4 + len(bytes)
-			}
-		}
-	}
-	return n, nil
+	return en.Encode(buf)
 }
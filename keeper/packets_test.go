@@ -0,0 +1,254 @@
+package keeper
+
+import (
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// golden returns the bytes spelled in hex by parts, spaces are ignored.
+func golden(parts ...string) []byte {
+	b, err := hex.DecodeString(strings.Replace(strings.Join(parts, ""), " ", "", -1))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// jute encodings of the values used across the golden packets, laid out as in
+// zookeeper.jute: big endian integers, booleans as a byte and buffers,
+// strings and vectors prefixed by their length (-1 if null)
+const (
+	// "/a/b"
+	pathHex    = "00000004 2f612f62"
+	// [world:anyone with every permission]
+	aclsHex    = "00000001 0000001f 00000005 776f726c64 00000006 616e796f6e65"
+	// Stat { 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11 }
+	statHex    = "0000000000000001 0000000000000002 0000000000000003 0000000000000004 00000005 00000006 00000007 0000000000000008 00000009 0000000a 000000000000000b"
+	// 16 bytes of password
+	passwdHex  = "00000010 000102030405060708090a0b0c0d0e0f"
+)
+
+var (
+	testStat = Stat {
+		CreatedZxid: 1, ModifiedZxid: 2, CreatedTime: 3, ModifiedTime: 4,
+		Version: 5, ChildrenVersion: 6, AclVersion: 7, EphemeralOwner: 8,
+		DataLength: 9, NumChildren: 10, Pzxid: 11,
+	}
+	testAcls   = []Acl { { Perms: 31, Id: Id { Scheme: "world", Id: "anyone" } } }
+	testPasswd = []byte { 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15 }
+)
+
+// goldenPackets are every request and reply along with their encoding. Packets
+// only received are not encoded and those only sent are not decoded.
+var goldenPackets = []struct {
+	name   string
+	packet interface{}
+	bytes  []byte
+	encode bool
+	decode bool
+}{
+	{ "request header", &OpReqHeader { Xid: 1, OpCode: opGetData }, golden("00000001 00000004"), true, true },
+	{ "reply header", &OpRepHeader { Xid: 1, Zxid: 16, Err: errNoNode }, golden("00000001 0000000000000010 ffffff9b"), true, true },
+	{ "connect request", &ConnectReq { TimeOut: 30000, Passwd: make([]byte, 16) }, golden("00000000 0000000000000000 00007530 0000000000000000 00000010 00000000000000000000000000000000"), true, true },
+	{ "connect reply", &ConnectRep { TimeOut: 30000, SessionId: 0x0123456789abcdef, Passwd: testPasswd }, golden("00000000 00007530 0123456789abcdef", passwdHex), true, true },
+	{ "watcher event", &WatcherEvent { Type: eventNodeDataChanged, State: stateSyncConnected, Path: "/a/b" }, golden("00000003 00000003", pathHex), true, true },
+	{ "create request", &CreateReq { Path: newPath("/a/b"), Data: []byte("hi"), Acls: testAcls, Flags: 1 }, golden(pathHex, "00000002 6869", aclsHex, "00000001"), true, true },
+	{ "create request without data", &CreateReq { Path: newPath("/a/b"), Acls: testAcls }, golden(pathHex, "ffffffff", aclsHex, "00000000"), true, true },
+	{ "create reply", &CreateRep { Path: "/a/b" }, golden(pathHex), true, true },
+	{ "delete request", &DeleteReq { Path: newPath("/a/b"), Version: -1 }, golden(pathHex, "ffffffff"), true, true },
+	{ "delete reply", &DeleteRep {}, golden(), true, true },
+	{ "exists request", &ExistsReq { Path: newPath("/a/b"), Watch: true }, golden(pathHex, "01"), true, true },
+	{ "exists reply", &ExistsRep { Stat: testStat }, golden(statHex), true, true },
+	{ "get data request", &GetDataReq { Path: newPath("/a/b") }, golden(pathHex, "00"), true, true },
+	{ "get data reply", &GetDataRep { Data: []byte("hi"), Stat: testStat }, golden("00000002 6869", statHex), true, true },
+	{ "get data reply without data", &GetDataRep { Stat: testStat }, golden("ffffffff", statHex), true, true },
+	{ "set data request", &SetDataReq { Path: newPath("/a/b"), Data: []byte("hi"), Version: 5 }, golden(pathHex, "00000002 6869 00000005"), true, true },
+	{ "set data reply", &SetDataRep { Stat: testStat }, golden(statHex), true, true },
+	{ "get acl request", &GetAclReq { Path: newPath("/a/b") }, golden(pathHex), true, true },
+	{ "get acl reply", &GetAclRep { Acls: testAcls, Stat: testStat }, golden(aclsHex, statHex), true, true },
+	{ "set acl request", &SetAclReq { Path: newPath("/a/b"), Acls: testAcls, Version: 2 }, golden(pathHex, aclsHex, "00000002"), true, true },
+	{ "set acl reply", &SetAclRep { Stat: testStat }, golden(statHex), true, true },
+	{ "get children request", &GetChildrenReq { Path: newPath("/a/b"), Watch: true }, golden(pathHex, "01"), true, true },
+	{ "get children reply", &GetChildrenRep { Children: []string { "c", "d" } }, golden("00000002 00000001 63 00000001 64"), true, true },
+	{ "get children reply without children", &GetChildrenRep { Children: []string {} }, golden("00000000"), true, true },
+	{ "sync request", &SyncReq { Path: newPath("/a/b") }, golden(pathHex), true, true },
+	{ "sync reply", &SyncRep { Path: "/a/b" }, golden(pathHex), true, true },
+	{ "ping request", &PingReq {}, golden(), true, true },
+	{ "ping reply", &PingRep {}, golden(), true, true },
+	{ "get children2 request", &GetChildren2Req { Path: newPath("/a/b") }, golden(pathHex, "00"), true, true },
+	{ "get children2 reply", &GetChildren2Rep { Children: []string { "c" }, Stat: testStat }, golden("00000001 00000001 63", statHex), true, true },
+	{ "check version request", &CheckVersionReq { Path: newPath("/a/b"), Version: 5 }, golden(pathHex, "00000005"), true, true },
+	{ "check version reply", &CheckVersionRep {}, golden(), true, true },
+	{ "create2 request", &Create2Req { Path: newPath("/a/b"), Data: []byte("hi"), Acls: testAcls, Flags: 3 }, golden(pathHex, "00000002 6869", aclsHex, "00000003"), true, true },
+	{ "create2 reply", &Create2Rep { Path: "/a/b0000000001", Stat: testStat }, golden("0000000e 2f612f6230303030303030303031", statHex), true, true },
+	{ "close request", &CloseReq {}, golden(), true, true },
+	{ "close reply", &CloseRep {}, golden(), true, true },
+	{ "set auth request", &SetAuthReq { Scheme: "digest", Auth: []byte("user:pass") }, golden("00000000 00000006 646967657374 00000009 757365723a70617373"), true, true },
+	{ "set auth reply", &SetAuthRep {}, golden(), true, true },
+	{
+		"set watches request",
+		&SetWatchesReq { RelativeZxid: 16, DataWatches: []string { "/a" }, ExistWatches: []string {}, ChildWatches: []string { "/a", "/a/b" } },
+		golden("0000000000000010 00000001 00000002 2f61 00000000 00000002 00000002 2f61", pathHex),
+		true, true,
+	},
+	{ "set watches reply", &SetWatchesRep {}, golden(), true, true },
+	{ "multi header", &MultiHeader { OpCode: opCreate, Done: false, Err: -1 }, golden("00000001 00 ffffffff"), true, true },
+	{
+		// every operation is preceded by a header with its opcode, the
+		// done one ends the transaction
+		"multi request",
+		&MultiReq { Ops: []MultiReqOp {
+			{ Hdr: MultiHeader { OpCode: opCreate, Err: -1 }, Op: &CreateReq { Path: newPath("/a/b"), Data: []byte("hi"), Acls: testAcls } },
+			{ Hdr: MultiHeader { OpCode: opSetData, Err: -1 }, Op: &SetDataReq { Path: newPath("/a/b"), Data: []byte("ho"), Version: -1 } },
+			{ Hdr: MultiHeader { OpCode: opCheck, Err: -1 }, Op: &CheckVersionReq { Path: newPath("/a/b"), Version: 1 } },
+			{ Hdr: MultiHeader { OpCode: opDelete, Err: -1 }, Op: &DeleteReq { Path: newPath("/a/b"), Version: 1 } },
+		} },
+		golden(
+			"00000001 00 ffffffff", pathHex, "00000002 6869", aclsHex, "00000000",
+			"00000005 00 ffffffff", pathHex, "00000002 686f ffffffff",
+			"0000000d 00 ffffffff", pathHex, "00000001",
+			"00000002 00 ffffffff", pathHex, "00000001",
+			"ffffffff 01 ffffffff",
+		),
+		false, true,
+	},
+	{
+		// results carry the created path, the stat of set data or the
+		// error of the failed operation
+		"multi reply",
+		&MultiRep { Ops: []MultiRepOp {
+			{ Hdr: MultiHeader { OpCode: opCreate }, Path: "/a/b" },
+			{ Hdr: MultiHeader { OpCode: opSetData }, Stat: testStat },
+			{ Hdr: MultiHeader { OpCode: opCheck } },
+			{ Hdr: MultiHeader { OpCode: opDelete } },
+			{ Hdr: MultiHeader { OpCode: opMultiError, Err: errNoNode } },
+		} },
+		golden(
+			"00000001 00 00000000", pathHex,
+			"00000005 00 00000000", statHex,
+			"0000000d 00 00000000",
+			"00000002 00 00000000",
+			"ffffffff 00 ffffff9b ffffff9b",
+			"ffffffff 01 ffffffff",
+		),
+		true, false,
+	},
+	{
+		"reply",
+		&OpRep { Hdr: &OpRepHeader { Xid: 7, Zxid: 16 }, Rep: &GetDataRep { Data: []byte("hi"), Stat: testStat } },
+		golden("00000007 0000000000000010 00000000 00000002 6869", statHex),
+		true, false,
+	},
+	{ "error reply", &OpRep { Hdr: &OpRepHeader { Xid: 7, Zxid: 16, Err: errNoNode } }, golden("00000007 0000000000000010 ffffff9b"), true, false },
+}
+
+func TestEncodePackets(t *testing.T) {
+	for _, test := range goldenPackets {
+		if !test.encode {
+			continue
+		}
+
+		buf := make([]byte, len(test.bytes))
+		n, err := EncodePacket(buf, test.packet)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.name, err)
+		}
+		if n != len(test.bytes) || !reflect.DeepEqual(buf[:n], test.bytes) {
+			t.Fatalf("%s: expected %x, got %x", test.name, test.bytes, buf[:n])
+		}
+
+		// a buffer a byte short never fits it
+		if len(test.bytes) > 0 {
+			if _, err := EncodePacket(buf[:len(buf) - 1], test.packet); !errors.Is(err, ErrShortBuffer) {
+				t.Fatalf("%s: expected a short buffer error, got %v", test.name, err)
+			}
+		}
+	}
+}
+
+func TestDecodePackets(t *testing.T) {
+	for _, test := range goldenPackets {
+		if !test.decode {
+			continue
+		}
+
+		packet := reflect.New(reflect.TypeOf(test.packet).Elem()).Interface()
+		n, err := DecodePacket(test.bytes, packet)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.name, err)
+		}
+		if n != len(test.bytes) {
+			t.Fatalf("%s: expected %d bytes to be read, got %d", test.name, len(test.bytes), n)
+		}
+		if !reflect.DeepEqual(packet, test.packet) {
+			t.Fatalf("%s: expected %+v, got %+v", test.name, test.packet, packet)
+		}
+
+		// a truncated packet is never decoded
+		if len(test.bytes) > 0 {
+			packet = reflect.New(reflect.TypeOf(test.packet).Elem()).Interface()
+			if _, err := DecodePacket(test.bytes[:len(test.bytes) - 1], packet); !errors.Is(err, ErrShortBuffer) {
+				t.Fatalf("%s: expected a short buffer error, got %v", test.name, err)
+			}
+		}
+	}
+}
+
+func TestDecodeConnectReqReadOnly(t *testing.T) {
+	// clients since zookeeper 3.4 append the read only flag, which is ignored
+	buf := golden("00000000 0000000000000000 00007530 0000000000000000", passwdHex, "01")
+	req := &ConnectReq {}
+	n, err := DecodePacket(buf, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(buf) - 1 {
+		t.Fatalf("expected %d bytes to be read, got %d", len(buf) - 1, n)
+	}
+	if req.TimeOut != 30000 || !reflect.DeepEqual(req.Passwd, testPasswd) {
+		t.Fatalf("unexpected connect request: %+v", req)
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	for _, test := range goldenPackets {
+		if !test.encode {
+			continue
+		}
+
+		packet := test.packet
+		buf := make([]byte, len(test.bytes))
+		b.Run(test.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(buf)))
+			for i := 0; i < b.N; i++ {
+				if _, err := EncodePacket(buf, packet); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	for _, test := range goldenPackets {
+		if !test.decode {
+			continue
+		}
+
+		typ := reflect.TypeOf(test.packet).Elem()
+		buf := test.bytes
+		b.Run(test.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(buf)))
+			for i := 0; i < b.N; i++ {
+				if _, err := DecodePacket(buf, reflect.New(typ).Interface()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package keeper
+
+import (
+	"sync"
+)
+
+const (
+	// requests of a session being processed at the same time
+	maxSessionRequests = 32
+	// requests being processed at the same time across every session
+	maxRequests        = 1024
+)
+
+// requestSlots bounds the requests being processed across every session.
+var requestSlots = make(chan struct{}, maxRequests)
+
+// concurrentOps are the requests which don't modify anything and can thus be
+// processed concurrently with each other.
+var concurrentOps = map[int32]bool {
+	opExists:       true,
+	opGetData:      true,
+	opGetAcl:       true,
+	opGetChildren:  true,
+	opPing:         true,
+	opGetChildren2: true,
+	opCheck:        true,
+}
+
+type pipelineResult struct {
+	rep  *OpRep
+	// if set, the connection is closed once rep is sent
+	err  error
+	// if set, called once rep is written to the connection
+	sent func()
+}
+
+// pipeline processes the requests of a session concurrently while keeping the
+// guarantees of zookeeper: reads run concurrently with each other but any
+// other request waits for every request before it to complete and runs
+// alone, so that requests after it observe its effects. Results are delivered
+// in request order regardless of when they complete.
+type pipeline struct {
+	barrier sync.RWMutex
+	slots   chan struct{}
+	results chan chan pipelineResult
+}
+
+func newPipeline() *pipeline {
+	return &pipeline {
+		slots:   make(chan struct{}, maxSessionRequests),
+		results: make(chan chan pipelineResult, maxSessionRequests),
+	}
+}
+
+// dispatch runs f once the requests it depends on completed and there are
+// slots available. It must be called in request order and returns false if
+// dying before f could be started.
+func (p *pipeline) dispatch(concurrent bool, f func() pipelineResult, dying <-chan struct{}) bool {
+	result := make(chan pipelineResult, 1)
+	select {
+	case p.results <- result:
+	case <-dying:
+		return false
+	}
+
+	lock, unlock := p.barrier.Lock, p.barrier.Unlock
+	if concurrent {
+		lock, unlock = p.barrier.RLock, p.barrier.RUnlock
+	}
+	lock()
+
+	select {
+	case p.slots <- struct{}{}:
+	case <-dying:
+		unlock()
+		return false
+	}
+
+	select {
+	case requestSlots <- struct{}{}:
+	case <-dying:
+		<-p.slots
+		unlock()
+		return false
+	}
+
+	go func() {
+		res := f()
+		<-requestSlots
+		<-p.slots
+		unlock()
+		result <- res
+	}()
+
+	return true
+}
@@ -0,0 +1,370 @@
+package keeper
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	kv "github.com/glerchundi/kvstores"
+)
+
+// slowClient delays every request to the backend it wraps, checking that
+// writes run alone: no request may run while a write does.
+type slowClient struct {
+	kv.Client
+	latency time.Duration
+	// latency of the requests on a given path, instead of the default one
+	latencies map[string]time.Duration
+
+	mutex     sync.Mutex
+	reads     int
+	writes    int
+	maxReads  int
+	// requests in the order they started, and violations of the barriers
+	started   []string
+	errors    []string
+}
+
+func (c *slowClient) run(op string, path string, write bool, f func()) {
+	c.mutex.Lock()
+	if c.writes > 0 || (write && c.reads > 0) {
+		c.errors = append(c.errors, fmt.Sprintf("%s %s started along with %d reads and %d writes", op, path, c.reads, c.writes))
+	}
+	if write {
+		c.writes++
+	} else {
+		c.reads++
+		if c.reads > c.maxReads {
+			c.maxReads = c.reads
+		}
+	}
+	c.started = append(c.started, path)
+	latency, found := c.latencies[path]
+	if !found {
+		latency = c.latency
+	}
+	c.mutex.Unlock()
+
+	time.Sleep(latency)
+	f()
+
+	c.mutex.Lock()
+	if write {
+		c.writes--
+	} else {
+		c.reads--
+	}
+	c.mutex.Unlock()
+}
+
+func (c *slowClient) Create(ctx context.Context, path string, data string) (err *kv.Error) {
+	c.run("create", path, true, func() { err = c.Client.Create(ctx, path, data) })
+	return
+}
+
+func (c *slowClient) Delete(ctx context.Context, path string, version int32) (err *kv.Error) {
+	c.run("delete", path, true, func() { err = c.Client.Delete(ctx, path, version) })
+	return
+}
+
+func (c *slowClient) Exists(ctx context.Context, path string) (err *kv.Error) {
+	c.run("exists", path, false, func() { err = c.Client.Exists(ctx, path) })
+	return
+}
+
+func (c *slowClient) GetData(ctx context.Context, path string) (node *kv.Node, err *kv.Error) {
+	c.run("get", path, false, func() { node, err = c.Client.GetData(ctx, path) })
+	return
+}
+
+func (c *slowClient) SetData(ctx context.Context, path string, data string, version int32) (err *kv.Error) {
+	c.run("set", path, true, func() { err = c.Client.SetData(ctx, path, data, version) })
+	return
+}
+
+func (c *slowClient) GetChildren(ctx context.Context, path string) (children []string, err *kv.Error) {
+	c.run("children", path, false, func() { children, err = c.Client.GetChildren(ctx, path) })
+	return
+}
+
+func TestPipelineOrder(t *testing.T) {
+	fileClient, cleanup := newTestFileClient(t)
+	defer cleanup()
+	for _, path := range []string{ "/a", "/b", "/c" } {
+		if err := fileClient.Create(context.Background(), path, path); err != nil {
+			t.Fatal(err.String())
+		}
+	}
+
+	// the first read of every batch is the slowest, so reads complete out
+	// of order
+	client := &slowClient {
+		Client:    fileClient,
+		latency:   10 * time.Millisecond,
+		latencies: map[string]time.Duration { "/a": 50 * time.Millisecond },
+	}
+	s, stop := newTestServer(t, client, nil)
+	defer stop()
+
+	conn, err := net.Dial("tcp", s.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	connect(t, conn)
+
+	type request struct {
+		op   int32
+		path string
+		data string
+	}
+	requests := []request {
+		{ opGetData, "/a", "" },
+		{ opGetData, "/b", "" },
+		{ opExists, "/c", "" },
+		{ opSetData, "/b", "b1" },
+		{ opGetData, "/a", "" },
+		{ opGetData, "/b", "" },
+		{ opCreate, "/d", "d" },
+		{ opGetChildren, "/", "" },
+		{ opSetData, "/a", "a1" },
+		{ opSetData, "/c", "c1" },
+		{ opGetData, "/a", "" },
+		{ opGetData, "/c", "" },
+	}
+
+	// every request is sent before reading any reply
+	for i, r := range requests {
+		hdr := &OpReqHeader { Xid: int32(i + 1), OpCode: r.op }
+		switch r.op {
+		case opGetData:
+			writeFrame(t, conn, hdr, &GetDataReq { Path: newPath(r.path) })
+		case opExists:
+			writeFrame(t, conn, hdr, &ExistsReq { Path: newPath(r.path) })
+		case opGetChildren:
+			writeFrame(t, conn, hdr, &GetChildrenReq { Path: newPath(r.path) })
+		case opSetData:
+			writeFrame(t, conn, hdr, &SetDataReq { Path: newPath(r.path), Data: []byte(r.data), Version: -1 })
+		case opCreate:
+			writeFrame(t, conn, hdr, &CreateReq { Path: newPath(r.path), Data: []byte(r.data), Acls: []Acl{ { Perms: 31, Id: Id { Scheme: "world", Id: "anyone" } } } })
+		}
+	}
+
+	// replies arrive in request order, and reads observe the writes before
+	// them but none after them
+	expected := map[int]string { 1: "/a", 2: "/b", 5: "/a", 6: "b1", 11: "a1", 12: "c1" }
+	for i, r := range requests {
+		var rep interface{}
+		switch r.op {
+		case opGetData:
+			rep = &GetDataRep {}
+		case opGetChildren:
+			rep = &GetChildrenRep {}
+		}
+
+		hdr := readReply(t, conn, rep)
+		if hdr.Xid != int32(i + 1) {
+			t.Fatalf("expected reply to xid %d, got %d", i + 1, hdr.Xid)
+		}
+		if hdr.Err != errOk {
+			t.Fatalf("xid %d: unexpected error %d", hdr.Xid, hdr.Err)
+		}
+		if data, found := expected[i + 1]; found && string(rep.(*GetDataRep).Data) != data {
+			t.Fatalf("xid %d: expected %q, got %q", hdr.Xid, data, rep.(*GetDataRep).Data)
+		}
+		if children, ok := rep.(*GetChildrenRep); ok && len(children.Children) != 4 {
+			t.Fatalf("xid %d: expected the created node to be listed, got %v", hdr.Xid, children.Children)
+		}
+	}
+
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	for _, err := range client.errors {
+		t.Error(err)
+	}
+	if client.maxReads < 3 {
+		t.Errorf("expected the first reads to run concurrently, at most %d did", client.maxReads)
+	}
+
+	// writes split the requests into batches which run in request order,
+	// reads within a batch in any order
+	batches := [][]string {
+		{ "/a", "/b", "/c" }, { "/b" }, { "/a", "/b" }, { "/d" }, { "/" }, { "/a" }, { "/c" }, { "/a", "/c" },
+	}
+	started := client.started
+	for i, batch := range batches {
+		if len(started) < len(batch) {
+			t.Fatalf("batch %d: expected %v to be started, got %v", i, batch, started)
+		}
+		seen := make(map[string]bool)
+		for _, path := range started[:len(batch)] {
+			seen[path] = true
+		}
+		for _, path := range batch {
+			if !seen[path] {
+				t.Fatalf("batch %d: expected %v to be started, got %v", i, batch, started[:len(batch)])
+			}
+		}
+		started = started[len(batch):]
+	}
+}
+
+// laggingClient writes to leader but reads from a replica which never catches
+// up, only clients returned by Synced read from the leader.
+type laggingClient struct {
+	kv.Client
+	leader kv.Client
+
+	mutex  sync.Mutex
+	writes uint64
+	synced []uint64
+}
+
+func (c *laggingClient) write(err *kv.Error) *kv.Error {
+	if (err == nil) {
+		c.mutex.Lock()
+		c.writes++
+		c.mutex.Unlock()
+	}
+	return err
+}
+
+func (c *laggingClient) Create(ctx context.Context, path string, data string) *kv.Error {
+	return c.write(c.leader.Create(ctx, path, data))
+}
+
+func (c *laggingClient) Delete(ctx context.Context, path string, version int32) *kv.Error {
+	return c.write(c.leader.Delete(ctx, path, version))
+}
+
+func (c *laggingClient) SetData(ctx context.Context, path string, data string, version int32) *kv.Error {
+	return c.write(c.leader.SetData(ctx, path, data, version))
+}
+
+func (c *laggingClient) Sync(ctx context.Context, path string) (uint64, *kv.Error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.writes, nil
+}
+
+func (c *laggingClient) Synced(index uint64) kv.Client {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.synced = append(c.synced, index)
+	return c.leader
+}
+
+func TestPipelineSyncBarrier(t *testing.T) {
+	leader, cleanupLeader := newTestFileClient(t)
+	defer cleanupLeader()
+	replica, cleanupReplica := newTestFileClient(t)
+	defer cleanupReplica()
+	for _, c := range []kv.Client{ leader, replica } {
+		if err := c.Create(context.Background(), "/a", "a"); err != nil {
+			t.Fatal(err.String())
+		}
+	}
+
+	// the write is slow, so the sync would overtake it if it didn't wait
+	client := &laggingClient {
+		Client: replica,
+		leader: &slowClient { Client: leader, latency: 50 * time.Millisecond },
+	}
+	s, stop := newTestServer(t, client, nil)
+	defer stop()
+
+	conn, err := net.Dial("tcp", s.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	connect(t, conn)
+
+	// every request is sent before reading any reply
+	writeFrame(t, conn, &OpReqHeader { Xid: 1, OpCode: opSetData }, &SetDataReq { Path: newPath("/a"), Data: []byte("a1"), Version: -1 })
+	writeFrame(t, conn, &OpReqHeader { Xid: 2, OpCode: opGetData }, &GetDataReq { Path: newPath("/a") })
+	writeFrame(t, conn, &OpReqHeader { Xid: 3, OpCode: opSync }, &SyncReq { Path: newPath("/a") })
+	for xid := int32(4); xid <= 6; xid++ {
+		writeFrame(t, conn, &OpReqHeader { Xid: xid, OpCode: opGetData }, &GetDataReq { Path: newPath("/a") })
+	}
+
+	// reads before the sync may be stale, reads after it observe every write
+	// made before it
+	expected := map[int32]string { 2: "a", 4: "a1", 5: "a1", 6: "a1" }
+	for xid := int32(1); xid <= 6; xid++ {
+		var rep interface{}
+		if _, found := expected[xid]; found {
+			rep = &GetDataRep {}
+		} else if xid == 3 {
+			rep = &SyncRep {}
+		}
+
+		hdr := readReply(t, conn, rep)
+		if hdr.Xid != xid {
+			t.Fatalf("expected reply to xid %d, got %d", xid, hdr.Xid)
+		}
+		if hdr.Err != errOk {
+			t.Fatalf("xid %d: unexpected error %d", xid, hdr.Err)
+		}
+		if data, found := expected[xid]; found && string(rep.(*GetDataRep).Data) != data {
+			t.Fatalf("xid %d: expected %q, got %q", xid, data, rep.(*GetDataRep).Data)
+		}
+		if xid == 3 && hdr.Zxid != 1 {
+			t.Fatalf("expected the sync to observe the write before it, got zxid %d", hdr.Zxid)
+		}
+	}
+
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if len(client.synced) != 1 || client.synced[0] != 1 {
+		t.Fatalf("expected reads to be synced to index 1, got %v", client.synced)
+	}
+}
+
+// BenchmarkPipeline sends requests, one write every ten reads, to a backend
+// with a millisecond of latency without waiting for their replies.
+func BenchmarkPipeline(b *testing.B) {
+	fileClient, cleanup := newTestFileClient(b)
+	defer cleanup()
+	if err := fileClient.Create(context.Background(), "/a", "a"); err != nil {
+		b.Fatal(err.String())
+	}
+
+	s, stop := newTestServer(b, &slowClient { Client: fileClient, latency: time.Millisecond }, nil)
+	defer stop()
+
+	conn, err := net.Dial("tcp", s.addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	connect(b, conn)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < b.N; i++ {
+			if hdr := readReply(b, conn, nil); hdr.Err != errOk {
+				b.Errorf("xid %d: unexpected error %d", hdr.Xid, hdr.Err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < b.N; i++ {
+		hdr := &OpReqHeader { Xid: int32(i + 1), OpCode: opGetData }
+		if i % 10 == 9 {
+			hdr.OpCode = opSetData
+			writeFrame(b, conn, hdr, &SetDataReq { Path: newPath("/a"), Data: []byte("a"), Version: -1 })
+			continue
+		}
+		writeFrame(b, conn, hdr, &GetDataReq { Path: newPath("/a") })
+	}
+	<-done
+}
@@ -1,80 +1,87 @@
 package keeper
 
 import (
+	"context"
 	"fmt"
+	"time"
 
 	kv "github.com/glerchundi/kvstores"
 	"github.com/glerchundi/parkeeper/log"
+	"github.com/glerchundi/parkeeper/tracing"
 )
 
-var processorByOpCode = map[int32]func(OpReq, kv.Client)*OpRep {
-	opCreate: func (opReq OpReq, client kv.Client) *OpRep {
-		return processCreateReq(opReq, client)
+var processorByOpCode = map[int32]func(context.Context, OpReq, kv.Client)*OpRep {
+	opCreate: func (ctx context.Context, opReq OpReq, client kv.Client) *OpRep {
+		return processCreateReq(ctx, opReq, client)
 	},
-	opDelete: func (opReq OpReq, client kv.Client) *OpRep {
-		return processDeleteReq(opReq, client)
+	opDelete: func (ctx context.Context, opReq OpReq, client kv.Client) *OpRep {
+		return processDeleteReq(ctx, opReq, client)
 	},
-	opExists: func (opReq OpReq, client kv.Client) *OpRep {
-		return processExistsReq(opReq, client)
+	opExists: func (ctx context.Context, opReq OpReq, client kv.Client) *OpRep {
+		return processExistsReq(ctx, opReq, client)
 	},
-	opGetData: func (opReq OpReq, client kv.Client) *OpRep {
-		return processGetDataReq(opReq, client)
+	opGetData: func (ctx context.Context, opReq OpReq, client kv.Client) *OpRep {
+		return processGetDataReq(ctx, opReq, client)
 	},
-	opSetData: func (opReq OpReq, client kv.Client) *OpRep {
-		return processSetDataReq(opReq, client)
+	opSetData: func (ctx context.Context, opReq OpReq, client kv.Client) *OpRep {
+		return processSetDataReq(ctx, opReq, client)
 	},
-	opGetAcl: func (opReq OpReq, _ kv.Client) *OpRep {
+	opGetAcl: func (_ context.Context, opReq OpReq, _ kv.Client) *OpRep {
 		return processGetAclReq(opReq)
 	},
-	opSetAcl: func (opReq OpReq, _ kv.Client) *OpRep {
+	opSetAcl: func (_ context.Context, opReq OpReq, _ kv.Client) *OpRep {
 		return processSetAclReq(opReq)
 	},
-	opGetChildren: func (opReq OpReq, client kv.Client) *OpRep {
-		return processGetChildrenReq(opReq, client)
+	opGetChildren: func (ctx context.Context, opReq OpReq, client kv.Client) *OpRep {
+		return processGetChildrenReq(ctx, opReq, client)
 	},
-	opSync: func (opReq OpReq, _ kv.Client) *OpRep {
-		return processSyncReq(opReq)
+	opSync: func (ctx context.Context, opReq OpReq, client kv.Client) *OpRep {
+		return processSyncReq(ctx, opReq, client)
 	},
-	opPing: func (opReq OpReq, _ kv.Client) *OpRep {
+	opPing: func (_ context.Context, opReq OpReq, _ kv.Client) *OpRep {
 		return processPingReq(opReq)
 	},
-	opGetChildren2: func (opReq OpReq, client kv.Client) *OpRep {
-		return processGetChildren2Req(opReq, client)
+	opGetChildren2: func (ctx context.Context, opReq OpReq, client kv.Client) *OpRep {
+		return processGetChildren2Req(ctx, opReq, client)
 	},
-	opCheck: func (opReq OpReq, client kv.Client) *OpRep {
-		return processCheckVersionReq(opReq, client)
+	opCheck: func (ctx context.Context, opReq OpReq, client kv.Client) *OpRep {
+		return processCheckVersionReq(ctx, opReq, client)
 	},
-	opMulti: func (opReq OpReq, _ kv.Client) *OpRep {
-		return processMultiReq(opReq)
+	opMulti: func (ctx context.Context, opReq OpReq, client kv.Client) *OpRep {
+		return processMultiReq(ctx, opReq, client)
 	},
-	opCreate2: func (opReq OpReq, client kv.Client) *OpRep {
-		return processCreate2Req(opReq, client)
+	opCreate2: func (ctx context.Context, opReq OpReq, client kv.Client) *OpRep {
+		return processCreate2Req(ctx, opReq, client)
 	},
-	opClose: func (opReq OpReq, _ kv.Client) *OpRep {
-		return processCloseReq(opReq)
+	opClose: func (ctx context.Context, opReq OpReq, client kv.Client) *OpRep {
+		return processCloseReq(ctx, opReq, client)
 	},
-	opSetAuth: func (opReq OpReq, _ kv.Client) *OpRep {
+	opSetAuth: func (_ context.Context, opReq OpReq, _ kv.Client) *OpRep {
 		return processSetAuthReq(opReq)
 	},
-	opSetWatches: func (opReq OpReq, _ kv.Client) *OpRep {
+	opSetWatches: func (_ context.Context, opReq OpReq, _ kv.Client) *OpRep {
 		return processSetWatchesReq(opReq)
 	},
 }
 
 var keeperErrFromBackendErr = map[int]int32 {
-	kv.Unknown:            errSystemError,
-	kv.Unimplemented:      errUnimplemented,
-	kv.BackendUnreachable: errSystemError,
-	kv.KeyNotFound:        errNoNode,
-	kv.KeyExists:          errNodeExists,
-	kv.BadVersion:         errBadVersion,
+	kv.Unknown:                 errSystemError,
+	kv.Unimplemented:           errUnimplemented,
+	kv.BackendUnreachable:      errSystemError,
+	kv.KeyNotFound:             errNoNode,
+	kv.KeyExists:               errNodeExists,
+	kv.BadVersion:              errBadVersion,
+	kv.NotEmpty:                errNotEmpty,
+	kv.AccessDenied:            errNoAuth,
+	kv.Timeout:                 errOperationTimeout,
+	kv.NoChildrenForEphemerals: errNoChildrenForEphemerals,
 }
 
 func mapBackendError(err *kv.Error) int32 {
 	errCode := err.Code()
 	keeperErr, found := keeperErrFromBackendErr[errCode]
 	if !found {
-		log.Error(fmt.Sprintf("unexpected client error: ", errCode))
+		log.Error(fmt.Sprintf("unexpected client error: %d", errCode))
 		return errSystemError
 	}
 
@@ -89,8 +96,7 @@ func newRep(xid int32, zxid int64, err int32, rep interface{}) *OpRep {
 }
 
 func newErrorRep(xid int32, zxid int64, err int32) *OpRep {
-	var empty struct{}
-	return newRep(xid, zxid, err, empty)
+	return newRep(xid, zxid, err, nil)
 }
 
 func newBackendErrorRep(xid int32, zxid int64, err *kv.Error) *OpRep {
@@ -120,29 +126,62 @@ func newStat(createdIndex uint64, modifiedIndex uint64, dataLength int) Stat {
 	}
 }
 
-func processOpReq(opReq OpReq, storeClient kv.Client, sendChan chan Rep) {
+func processOpReq(ctx context.Context, opReq OpReq, storeClient kv.Client, watches *watchManager) *OpRep {
+	start := time.Now()
+
+	// every backend request is traced as a child of the request span
+	ctx, span := tracing.Start(ctx, "zookeeper " + label(opLabels, opReq.Hdr.OpCode), tracing.SpanKindServer)
+	defer span.End()
+	span.SetAttribute("zookeeper.opcode", label(opLabels, opReq.Hdr.OpCode))
+	span.SetAttribute("zookeeper.xid", opReq.Hdr.Xid)
+	span.SetAttribute("zookeeper.session_id", fmt.Sprintf("0x%x", opReq.SessionId))
+	if path, ok := pathOf(opReq.Req); ok {
+		span.SetAttribute("zookeeper.path", path)
+	}
+
 	// find processor
 	processor, found := processorByOpCode[opReq.Hdr.OpCode]
 	if !found {
-		log.Error(fmt.Sprintf("cannot process opcode: %d", opReq.Hdr.OpCode))
-		return
+		log.FromContext(ctx).Error(fmt.Sprintf("cannot process opcode: %d", opReq.Hdr.OpCode))
+		span.SetError("unknown opcode")
+		return nil
+	}
+
+	// set watch (if requested) before processing the request, this way no
+	// change happening after the read is missed
+	var cancelWatch func()
+	if path, kind, ok := watchOf(opReq.Req); ok && path.IsValid() {
+		var err *kv.Error
+		if cancelWatch, err = watches.add(ctx, path.Value, kind); err != nil {
+			log.FromContext(ctx).Error(fmt.Sprintf("unable to set watch on %s: %s", path.Value, err.String()))
+		}
 	}
 
-	// process request & write rep (if needed)
-	rep := processor(opReq, storeClient)
-	if (rep != nil) {
-		sendChan <- rep
+	// process request
+	rep := processor(ctx, opReq, storeClient)
+
+	// a watch is kept on failure only if it's waiting for the node creation
+	if cancelWatch != nil && rep != nil && rep.Hdr.Err != errOk {
+		if _, isExists := opReq.Req.(*ExistsReq); !isExists || rep.Hdr.Err != errNoNode {
+			cancelWatch()
+		}
+	}
+
+	observeRequest(opReq.Hdr.OpCode, rep, time.Since(start))
+	if (rep != nil && rep.Hdr.Err != errOk) {
+		span.SetError(label(errLabels, rep.Hdr.Err))
 	}
+	return rep
 }
 
-func processCreateReq(opReq OpReq, client kv.Client) *OpRep {
+func processCreateReq(ctx context.Context, opReq OpReq, client kv.Client) *OpRep {
 	xid := opReq.Hdr.Xid
 	req := opReq.Req.(*CreateReq)
 	if err := newErrorRepIfInvalidPath(xid, 0, req.Path); err != nil {
 		return err
 	}
 
-	err := client.Create(req.Path.Value, string(req.Data))
+	err := create(ctx, client, req.Path.Value, string(req.Data), req.Flags, opReq.SessionId)
 	if (err != nil) {
 		return newBackendErrorRep(xid, 0, err)
 	}
@@ -153,14 +192,28 @@ func processCreateReq(opReq OpReq, client kv.Client) *OpRep {
 	)
 }
 
-func processDeleteReq(opReq OpReq, client kv.Client) *OpRep {
+// create creates a node which, if requested and supported by the backend, is
+// bound to the session.
+func create(ctx context.Context, client kv.Client, path string, data string, flags int32, sessionId int64) *kv.Error {
+	if sessionClient, ok := client.(kv.SessionClient); ok && flags&flagEphemeral != 0 {
+		defer observeBackend(ctx, client, "CreateEphemeral", time.Now())
+		return sessionClient.CreateEphemeral(ctx, path, data, sessionId)
+	}
+
+	defer observeBackend(ctx, client, "Create", time.Now())
+	return client.Create(ctx, path, data)
+}
+
+func processDeleteReq(ctx context.Context, opReq OpReq, client kv.Client) *OpRep {
 	xid := opReq.Hdr.Xid
 	req := opReq.Req.(*DeleteReq)
 	if err := newErrorRepIfInvalidPath(xid, 0, req.Path); err != nil {
 		return err
 	}
 
-	err := client.Delete(req.Path.Value, req.Version)
+	start := time.Now()
+	err := client.Delete(ctx, req.Path.Value, req.Version)
+	observeBackend(ctx, client, "Delete", start)
 	if (err != nil) {
 		return newBackendErrorRep(xid, 0, err)
 	}
@@ -171,14 +224,16 @@ func processDeleteReq(opReq OpReq, client kv.Client) *OpRep {
 	)
 }
 
-func processExistsReq(opReq OpReq, client kv.Client) *OpRep {
+func processExistsReq(ctx context.Context, opReq OpReq, client kv.Client) *OpRep {
 	xid := opReq.Hdr.Xid
 	req := opReq.Req.(*ExistsReq)
 	if err := newErrorRepIfInvalidPath(xid, 0, req.Path); err != nil {
 		return err
 	}
 
-	err := client.Exists(req.Path.Value)
+	start := time.Now()
+	err := client.Exists(ctx, req.Path.Value)
+	observeBackend(ctx, client, "Exists", start)
 	if (err != nil) {
 		return newBackendErrorRep(xid, 0, err)
 	}
@@ -189,35 +244,42 @@ func processExistsReq(opReq OpReq, client kv.Client) *OpRep {
 	)
 }
 
-func processGetDataReq(opReq OpReq, client kv.Client) *OpRep {
+func processGetDataReq(ctx context.Context, opReq OpReq, client kv.Client) *OpRep {
 	xid := opReq.Hdr.Xid
 	req := opReq.Req.(*GetDataReq)
 	if err := newErrorRepIfInvalidPath(xid, 0, req.Path); err != nil {
 		return err
 	}
 
-	node, err := client.GetData(req.Path.Value)
+	start := time.Now()
+	node, err := client.GetData(ctx, req.Path.Value)
+	observeBackend(ctx, client, "GetData", start)
 	if (err != nil) {
 		return newBackendErrorRep(xid, 0, err)
 	}
 
+	stat := newStat(node.CreatedIndex, node.ModifiedIndex, len(node.Value))
+	stat.EphemeralOwner = node.EphemeralOwner
+
 	return newRep(
 		xid, 0, errOk,
 		&GetDataRep {
 		    Data: []byte(node.Value),
-		    Stat: newStat(node.CreatedIndex, node.ModifiedIndex, len(node.Value)),
+		    Stat: stat,
 	    },
 	)
 }
 
-func processSetDataReq(opReq OpReq, client kv.Client) *OpRep {
+func processSetDataReq(ctx context.Context, opReq OpReq, client kv.Client) *OpRep {
 	xid := opReq.Hdr.Xid
 	req := opReq.Req.(*SetDataReq)
 	if err := newErrorRepIfInvalidPath(xid, 0, req.Path); err != nil {
 		return err
 	}
 
-	err := client.SetData(req.Path.Value, string(req.Data), req.Version)
+	start := time.Now()
+	err := client.SetData(ctx, req.Path.Value, string(req.Data), req.Version)
+	observeBackend(ctx, client, "SetData", start)
 	if (err != nil) {
 		return newBackendErrorRep(xid, 0, err)
 	}
@@ -236,14 +298,16 @@ func processSetAclReq(opReq OpReq) *OpRep {
 	return newErrorRep(opReq.Hdr.Xid, 0, errUnimplemented)
 }
 
-func processGetChildrenReq(opReq OpReq, client kv.Client) *OpRep {
+func processGetChildrenReq(ctx context.Context, opReq OpReq, client kv.Client) *OpRep {
 	xid := opReq.Hdr.Xid
 	req := opReq.Req.(*GetChildrenReq)
 	if err := newErrorRepIfInvalidPath(xid, 0, req.Path); err != nil {
 		return err
 	}
 
-	children, err := client.GetChildren(req.Path.Value)
+	start := time.Now()
+	children, err := client.GetChildren(ctx, req.Path.Value)
+	observeBackend(ctx, client, "GetChildren", start)
 	if (err != nil) {
 		return newBackendErrorRep(xid, 0, err)
 	}
@@ -254,15 +318,27 @@ func processGetChildrenReq(opReq OpReq, client kv.Client) *OpRep {
 	)
 }
 
-func processSyncReq(opReq OpReq) *OpRep {
+func processSyncReq(ctx context.Context, opReq OpReq, client kv.Client) *OpRep {
 	xid := opReq.Hdr.Xid
 	req := opReq.Req.(*SyncReq)
 	if err := newErrorRepIfInvalidPath(xid, 0, req.Path); err != nil {
 		return err
 	}
 
+	// backends without a read barrier are considered always in sync
+	var index uint64
+	if syncClient, ok := client.(kv.SyncClient); ok {
+		var err *kv.Error
+		start := time.Now()
+		index, err = syncClient.Sync(ctx, req.Path.Value)
+		observeBackend(ctx, client, "Sync", start)
+		if (err != nil) {
+			return newBackendErrorRep(xid, 0, err)
+		}
+	}
+
 	return newRep(
-		xid, 0, errOk,
+		xid, int64(index), errOk,
 		&SyncRep { Path: req.Path.Value },
 	)
 }
@@ -274,14 +350,16 @@ func processPingReq(OpReq) *OpRep {
 	)
 }
 
-func processGetChildren2Req(opReq OpReq, client kv.Client) *OpRep {
+func processGetChildren2Req(ctx context.Context, opReq OpReq, client kv.Client) *OpRep {
 	xid := opReq.Hdr.Xid
 	req := opReq.Req.(*GetChildren2Req)
 	if err := newErrorRepIfInvalidPath(xid, 0, req.Path); err != nil {
 		return err
 	}
 
-	children, err := client.GetChildren(req.Path.Value)
+	start := time.Now()
+	children, err := client.GetChildren(ctx, req.Path.Value)
+	observeBackend(ctx, client, "GetChildren", start)
 	if (err != nil) {
 		return newBackendErrorRep(xid, 0, err)
 	}
@@ -295,14 +373,16 @@ func processGetChildren2Req(opReq OpReq, client kv.Client) *OpRep {
 	)
 }
 
-func processCheckVersionReq(opReq OpReq, client kv.Client) *OpRep {
+func processCheckVersionReq(ctx context.Context, opReq OpReq, client kv.Client) *OpRep {
 	xid := opReq.Hdr.Xid
 	req := opReq.Req.(*CheckVersionReq)
 	if err := newErrorRepIfInvalidPath(xid, 0, req.Path); err != nil {
 		return err
 	}
 
-	node, err := client.GetData(req.Path.Value)
+	start := time.Now()
+	node, err := client.GetData(ctx, req.Path.Value)
+	observeBackend(ctx, client, "GetData", start)
 	if (err != nil) {
 		return newBackendErrorRep(xid, 0, err)
 	}
@@ -317,18 +397,82 @@ func processCheckVersionReq(opReq OpReq, client kv.Client) *OpRep {
 	)
 }
 
-func processMultiReq(opReq OpReq) *OpRep {
-	return newErrorRep(opReq.Hdr.Xid, 0, errUnimplemented)
+func processMultiReq(ctx context.Context, opReq OpReq, client kv.Client) *OpRep {
+	xid := opReq.Hdr.Xid
+	req := opReq.Req.(*MultiReq)
+
+	txnClient, ok := client.(kv.TxnClient)
+	if !ok {
+		return newErrorRep(xid, 0, errUnimplemented)
+	}
+
+	// translate requests into backend operations
+	ops := make([]*kv.Op, len(req.Ops))
+	for i, reqOp := range req.Ops {
+		var path *Path
+		op := &kv.Op { Version: -1 }
+		switch r := reqOp.Op.(type) {
+		case *CreateReq:
+			path, op.Type, op.Data = r.Path, kv.OpCreate, string(r.Data)
+			if _, ok := client.(kv.SessionClient); ok && r.Flags&flagEphemeral != 0 {
+				op.Session = opReq.SessionId
+			}
+		case *DeleteReq:
+			path, op.Type, op.Version = r.Path, kv.OpDelete, r.Version
+		case *SetDataReq:
+			path, op.Type, op.Data, op.Version = r.Path, kv.OpSetData, string(r.Data), r.Version
+		case *CheckVersionReq:
+			path, op.Type, op.Version = r.Path, kv.OpCheck, r.Version
+		}
+
+		if err := newErrorRepIfInvalidPath(xid, 0, path); err != nil {
+			return err
+		}
+
+		op.Path = path.Value
+		ops[i] = op
+	}
+
+	start := time.Now()
+	nodes, failed, err := txnClient.Multi(ctx, ops)
+	observeBackend(ctx, client, "Multi", start)
+	if err != nil && failed < 0 {
+		return newBackendErrorRep(xid, 0, err)
+	}
+
+	// on failure every result is an error: ok for the ones before the failing
+	// operation and runtime inconsistency for the ones after it
+	rep := &MultiRep { Ops: make([]MultiRepOp, len(ops)) }
+	for i, op := range ops {
+		hdr := MultiHeader { OpCode: req.Ops[i].Hdr.OpCode, Done: false, Err: errOk }
+		if err != nil {
+			hdr.OpCode = opMultiError
+			switch {
+			case i == failed:
+				hdr.Err = mapBackendError(err)
+			case i > failed:
+				hdr.Err = errRuntimeInconsistency
+			}
+		}
+
+		rep.Ops[i] = MultiRepOp { Hdr: hdr, Path: op.Path }
+		if err == nil {
+			node := nodes[i]
+			rep.Ops[i].Stat = newStat(node.CreatedIndex, node.ModifiedIndex, len(node.Value))
+		}
+	}
+
+	return newRep(xid, 0, errOk, rep)
 }
 
-func processCreate2Req(opReq OpReq, client kv.Client) *OpRep {
+func processCreate2Req(ctx context.Context, opReq OpReq, client kv.Client) *OpRep {
 	xid := opReq.Hdr.Xid
 	req := opReq.Req.(*Create2Req)
 	if err := newErrorRepIfInvalidPath(xid, 0, req.Path); err != nil {
 		return err
 	}
 
-	err := client.Create(req.Path.Value, string(req.Data))
+	err := create(ctx, client, req.Path.Value, string(req.Data), req.Flags, opReq.SessionId)
 	if (err != nil) {
 		return newBackendErrorRep(xid, 0, err)
 	}
@@ -342,8 +486,17 @@ func processCreate2Req(opReq OpReq, client kv.Client) *OpRep {
 	)
 }
 
-func processCloseReq(opReq OpReq) *OpRep {
+func processCloseReq(ctx context.Context, opReq OpReq, client kv.Client) *OpRep {
 	xid := opReq.Hdr.Xid
+	if sessionClient, ok := client.(kv.SessionClient); ok {
+		start := time.Now()
+		err := sessionClient.CloseSession(ctx, opReq.SessionId)
+		observeBackend(ctx, client, "CloseSession", start)
+		if err != nil {
+			log.FromContext(ctx).Error(fmt.Sprintf("unable to close session %d: %s", opReq.SessionId, err.String()))
+		}
+	}
+
 	return newRep(
 		xid, 0, errOk,
 		&CloseRep {},
@@ -0,0 +1,51 @@
+package keeper
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	kv "github.com/glerchundi/kvstores"
+)
+
+func TestMultiCreatesEphemerals(t *testing.T) {
+	ctx := context.Background()
+	fileClient, cleanup := newTestFileClient(t)
+	defer cleanup()
+
+	session, err := fileClient.NewSession(ctx, time.Minute)
+	if err != nil {
+		t.Fatal(err.String())
+	}
+
+	opReq := OpReq {
+		Hdr: &OpReqHeader { Xid: 1, OpCode: opMulti },
+		Req: &MultiReq { Ops: []MultiReqOp{
+			{ Hdr: MultiHeader { OpCode: opCreate }, Op: &CreateReq { Path: newPath("/ephemeral"), Flags: flagEphemeral } },
+			{ Hdr: MultiHeader { OpCode: opCreate }, Op: &CreateReq { Path: newPath("/persistent") } },
+		} },
+		SessionId: session,
+	}
+	if rep := processMultiReq(ctx, opReq, fileClient); rep.Hdr.Err != errOk {
+		t.Fatalf("unexpected error: %d", rep.Hdr.Err)
+	}
+
+	node, err := fileClient.GetData(ctx, "/ephemeral")
+	if err != nil {
+		t.Fatal(err.String())
+	}
+	if node.EphemeralOwner != session {
+		t.Fatalf("expected /ephemeral to be owned by %d, got %d", session, node.EphemeralOwner)
+	}
+
+	// ephemeral nodes go away with their session
+	if err := fileClient.CloseSession(ctx, session); err != nil {
+		t.Fatal(err.String())
+	}
+	if err := fileClient.Exists(ctx, "/ephemeral"); err == nil || err.Code() != kv.KeyNotFound {
+		t.Fatalf("expected /ephemeral to be deleted, got %v", err)
+	}
+	if err := fileClient.Exists(ctx, "/persistent"); err != nil {
+		t.Fatal(err.String())
+	}
+}
@@ -1,10 +1,13 @@
 package keeper
 
 import (
+	"fmt"
+	"io"
 	"net"
 	"time"
 	"os"
 	"os/signal"
+	"sort"
 	"sync"
 	"syscall"
 
@@ -12,66 +15,224 @@ import (
 	"github.com/glerchundi/parkeeper/log"
 )
 
+// Options tune the server and the sessions it serves.
+type Options struct {
+	// frames bigger than MaxBuffer bytes are rejected, as zookeeper does
+	// with jute.maxbuffer, and so are replies
+	MaxBuffer int
+	// four letter words answered, "*" enables all of them
+	FourLetterWords []string
+	// reported by four letter words
+	Version string
+	// creations, deletions, data and acl changes are recorded as json lines
+	// here, disabled if nil
+	AuditLog io.Writer
+	// requests whose reply takes longer than this to be sent are logged,
+	// disabled if zero
+	SlowRequestThreshold time.Duration
+	// the HotSpotsTop most read and written paths over HotSpotsWindow are
+	// reported, disabled if either is zero
+	HotSpotsWindow time.Duration
+	HotSpotsTop int
+	// connections accepted from a single client ip, as maxClientCnxns in
+	// zookeeper, and overall, unlimited if zero
+	MaxClientCnxns int
+	MaxConnections int
+	// reads and writes per second allowed to every session and to every
+	// client ip, in bursts of up to a second worth of them; throttled
+	// requests are delayed, unlimited if zero
+	SessionReadRate float64
+	SessionWriteRate float64
+	ClientReadRate float64
+	ClientWriteRate float64
+	// once signaled to stop, clients have this long to move to another
+	// server before their connections are closed
+	DrainTimeout time.Duration
+}
+
+var DefaultOptions = Options {
+	MaxBuffer: 1536 * 1024,
+	FourLetterWords: []string { "ruok", "srvr", "stat", "mntr" },
+	SlowRequestThreshold: time.Second,
+	HotSpotsWindow: time.Minute,
+	HotSpotsTop: 10,
+	MaxClientCnxns: 60,
+	DrainTimeout: 10 * time.Second,
+}
+
 type Server struct {
 	addr        string
 	storeClient kv.Client
+	opts        Options
 	// stop gracefully without interrupting anyone
 	ch          chan bool
 	waitGroup   *sync.WaitGroup
+	stopOnce    sync.Once
+
+	// live connections and stats reported by four letter words
+	started     time.Time
+	stats       stats
+	mutex       sync.Mutex
+	keepers     map[*Keeper]bool
+	listener    *net.TCPListener
+	draining    bool
+	// connections and rate limits by client ip
+	clients     map[string]*clientLimits
+	// most read and written paths, if enabled
+	hotSpots    *hotSpots
 }
 
 //
 // PUBLIC
 //
 
-func NewServer(addr string, storeClient kv.Client) *Server {
+func NewServer(addr string, storeClient kv.Client, opts *Options) *Server {
+	if opts == nil {
+		opts = &DefaultOptions
+	}
+
 	server := &Server{
 		addr:        addr,
 		storeClient: storeClient,
+		opts:        *opts,
 		ch:          make(chan bool),
 		waitGroup:   &sync.WaitGroup{},
+		started:     time.Now(),
+		keepers:     make(map[*Keeper]bool),
+		clients:     make(map[string]*clientLimits),
+	}
+	if (opts.HotSpotsWindow > 0 && opts.HotSpotsTop > 0) {
+		server.hotSpots = newHotSpots(opts.HotSpotsWindow, opts.HotSpotsTop)
 	}
 	return server
 }
 
 
 func (s *Server) Start() {
-	laddr, err := net.ResolveTCPAddr("tcp", s.addr)
+	listener, err := listen(s.addr)
 	if nil != err {
 		log.Fatal(err)
 	}
-	listener, err := net.ListenTCP("tcp", laddr)
-	if nil != err {
-		log.Fatal(err)
-	}
-	log.Debug("listening on: ", listener.Addr())
-
-	// Make a new service and send it into the background.
-	go s.serve(listener)
+	s.serveListener(listener)
 
-	// Handle SIGINT and SIGTERM.
-	ch := make(chan os.Signal)
-	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
-	log.Debug(<-ch)
+	// SIGINT and SIGTERM drain the server, SIGUSR2 hands the listener over to
+	// a new process first.
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2)
+	for {
+		sig := <-ch
+		log.Info("received signal: ", sig)
+		if (sig == syscall.SIGUSR2) {
+			if err := handoff(listener); err != nil {
+				log.Error("unable to hand the listener over: ", err)
+				continue
+			}
+		}
+		break
+	}
 
 	// Stop the service gracefully.
-	s.Stop()
+	s.Drain(s.opts.DrainTimeout)
 }
 
-// Stop the service by closing the service's channel.  Block until the service
-// is really stopped.
+// Stop the service by closing the service's channel and every connection.
+// Block until the service is really stopped.
 func (s *Server) Stop() {
-	close(s.ch)
-	s.waitGroup.Wait()
+	s.Drain(0)
+}
+
+// Drain stops accepting connections and asks the connected clients to move to
+// another server: connections are closed once the requests received so far
+// are replied, keeping their sessions so that clients resume them elsewhere.
+// Connections still open after timeout are closed right away. Block until
+// the service is really stopped.
+func (s *Server) Drain(timeout time.Duration) {
+	s.stopOnce.Do(func() { close(s.ch) })
+
+	s.mutex.Lock()
+	s.draining = true
+	if (s.listener != nil) {
+		s.listener.Close()
+	}
+	s.mutex.Unlock()
+
+	keepers := s.connections()
+	if (len(keepers) > 0) {
+		log.Info(fmt.Sprintf("draining %d connections for up to %s", len(keepers), timeout))
+	}
+	for _, k := range keepers {
+		k.drain()
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.waitGroup.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return
+	case <-time.After(timeout):
+	}
+
+	for _, k := range s.connections() {
+		k.logger().Warning("closing connection still open after draining for ", timeout)
+		k.disconnect(errDraining)
+	}
+	<-stopped
 }
 
 //
 // PRIVATE
 //
 
+// serveListener serves the connections accepted by l in the background.
+func (s *Server) serveListener(l *net.TCPListener) {
+	log.Debug("listening on: ", l.Addr())
+	s.mutex.Lock()
+	s.listener = l
+	s.mutex.Unlock()
+
+	// Make a new service and send it into the background.
+	s.waitGroup.Add(1)
+	go s.serve(l)
+
+	if breakerClient, ok := s.storeClient.(kv.BreakerClient); ok {
+		go s.disconnectOnBreakerOpen(breakerClient.Breaker())
+	}
+}
+
+// disconnectOnBreakerOpen closes every connection as soon as the circuit
+// breaker around the backend opens. Sessions only find out that the backend is
+// down when they send a request otherwise, which idle and watching ones may
+// not do for a long while.
+func (s *Server) disconnectOnBreakerOpen(breaker *kv.Breaker) {
+	ch := make(chan kv.BreakerState, 1)
+	breaker.Notify(ch)
+	defer breaker.Stop(ch)
+
+	for {
+		select {
+		case state := <-ch:
+			if (state != kv.BreakerOpen) {
+				continue
+			}
+			keepers := s.connections()
+			if (len(keepers) > 0) {
+				log.Warning(fmt.Sprintf("backend circuit breaker open, closing %d connections", len(keepers)))
+			}
+			for _, k := range keepers {
+				k.disconnect(errBackendDown)
+			}
+		case <-s.ch:
+			return
+		}
+	}
+}
+
 func (s *Server) serve(l *net.TCPListener) {
 	defer s.waitGroup.Done()
-	s.waitGroup.Add(1)
 	for {
 		select {
 		case <- s.ch:
@@ -88,21 +249,76 @@ func (s *Server) serve(l *net.TCPListener) {
 				continue
 			}
 			log.Debug(err)
+			continue
 		}
 
 		// handle the connection in a new goroutine. This returns to listener
 		// accepting code so that multiple connections may be served concurrently.
-		keeper := NewKeeper(conn, s.storeClient)
+		keeper := NewKeeper(conn, s.storeClient, &s.opts)
+		if err := s.register(keeper); err != nil {
+			keeper.logger().Warning("connection rejected: ", err)
+			conn.Close()
+			continue
+		}
 
+		s.waitGroup.Add(1)
 		go func() {
 			defer s.waitGroup.Done()
-			s.waitGroup.Add(1)
-			log.Debug("client connected: ", conn.RemoteAddr())
+			defer s.unregister(keeper)
+			keeper.logger().Debug("client connected")
 			if err := keeper.Handle(); err != nil {
-				log.Debug("client disconnected: ", conn.RemoteAddr(), " with error: ", err)
+				keeper.logger().Debug("client disconnected with error: ", err)
 			} else {
-				log.Debug("client disconnected: ", conn.RemoteAddr())
+				keeper.logger().Debug("client disconnected")
 			}
 		}()
 	}
 }
+
+// register adds the connection of k unless it exceeds the connection limits.
+func (s *Server) register(k *Keeper) error {
+	s.mutex.Lock()
+	if (s.draining) {
+		s.mutex.Unlock()
+		return errDraining
+	}
+	client, err := s.admit(k)
+	if err != nil {
+		s.mutex.Unlock()
+		if tooMany, ok := err.(*errTooManyConnections); ok && tooMany.perIP {
+			rejectedConnectionsTotal.With("client").Inc()
+		} else {
+			rejectedConnectionsTotal.With("global").Inc()
+		}
+		return err
+	}
+	k.server = s
+	k.ipLimits = client
+	s.keepers[k] = true
+	s.mutex.Unlock()
+	connectionsGauge.Inc()
+	return nil
+}
+
+func (s *Server) unregister(k *Keeper) {
+	s.mutex.Lock()
+	delete(s.keepers, k)
+	s.release(k.ipLimits)
+	s.mutex.Unlock()
+	connectionsGauge.Dec()
+}
+
+// connections returns the live connections, oldest first.
+func (s *Server) connections() []*Keeper {
+	s.mutex.Lock()
+	keepers := make([]*Keeper, 0, len(s.keepers))
+	for k := range s.keepers {
+		keepers = append(keepers, k)
+	}
+	s.mutex.Unlock()
+
+	sort.Slice(keepers, func(i, j int) bool {
+		return keepers[i].established.Before(keepers[j].established)
+	})
+	return keepers
+}
@@ -0,0 +1,123 @@
+package keeper
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	kv "github.com/glerchundi/kvstores"
+)
+
+// breakerClient guards a backend with the circuit breaker of another one and
+// accepts watches that never fire.
+type breakerClient struct {
+	kv.Client
+	breaker *kv.Breaker
+}
+
+func (c *breakerClient) Breaker() *kv.Breaker {
+	return c.breaker
+}
+
+func (c *breakerClient) Watch(ctx context.Context, path string, children bool, stop <-chan struct{}) (<-chan *kv.Event, *kv.Error) {
+	return make(chan *kv.Event), nil
+}
+
+// newTestServer serves client on a local port until the returned function is
+// called.
+func newTestServer(t testing.TB, client kv.Client, opts *Options) (*Server, func()) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr { IP: net.IPv4(127, 0, 0, 1) })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(l.Addr().String(), client, opts)
+	s.serveListener(l)
+	return s, s.Stop
+}
+
+// newOpenBreaker returns the circuit breaker of a consul agent which is not
+// there, opened by a request failing to reach it. The returned function closes
+// the agent client.
+func newOpenBreaker(t testing.TB) (*kv.Breaker, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	unreachable, err := kv.NewConsulClient([]string{ addr }, "", nil, nil, nil, &kv.RetryOptions { BreakerFailures: 1, BreakerCooldown: time.Hour }, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := unreachable.Exists(context.Background(), "/"); err == nil {
+		unreachable.Close()
+		t.Fatal("expected the request to fail")
+	}
+	if state := unreachable.Breaker().State(); state != kv.BreakerOpen {
+		unreachable.Close()
+		t.Fatalf("expected the breaker to open, got %s", state)
+	}
+
+	return unreachable.Breaker(), func() { unreachable.Close() }
+}
+
+func TestServerDisconnectsOnBreakerOpen(t *testing.T) {
+	fileClient, cleanup := newTestFileClient(t)
+	defer cleanup()
+
+	// a consul agent which is not there, whose breaker opens on the first
+	// unreachable request
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	unreachable, err := kv.NewConsulClient([]string{ addr }, "", nil, nil, nil, &kv.RetryOptions { BreakerFailures: 1, BreakerCooldown: time.Hour }, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unreachable.Close()
+
+	s, stop := newTestServer(t, &breakerClient { Client: fileClient, breaker: unreachable.Breaker() }, nil)
+	defer stop()
+
+	// an idle session and a session waiting for a watch to fire
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", s.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		connect(t, conn)
+		conns = append(conns, conn)
+	}
+	writeFrame(t, conns[1], &OpReqHeader { Xid: 1, OpCode: opGetData }, &GetDataReq { Path: newPath("/"), Watch: true })
+	if hdr := readReply(t, conns[1], nil); hdr.Err != errOk {
+		t.Fatalf("unexpected error: %d", hdr.Err)
+	}
+
+	if err := unreachable.Exists(context.Background(), "/"); err == nil {
+		t.Fatal("expected the request to fail")
+	}
+	if state := unreachable.Breaker().State(); state != kv.BreakerOpen {
+		t.Fatalf("expected the breaker to open, got %s", state)
+	}
+
+	for _, conn := range conns {
+		expectClosed(t, conn, 5 * time.Second)
+	}
+
+	// new sessions are refused until the breaker closes
+	conn, err := net.Dial("tcp", s.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	writeFrame(t, conn, &ConnectReq { TimeOut: 30000, Passwd: make([]byte, 16) })
+	expectClosed(t, conn, 5 * time.Second)
+}
@@ -0,0 +1,61 @@
+package keeper
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// stats are the counters reported by four letter words, they are kept both by
+// connection and server wide.
+type stats struct {
+	received int64
+	sent     int64
+
+	mutex    sync.Mutex
+	// request latencies
+	count    int64
+	total    time.Duration
+	min      time.Duration
+	max      time.Duration
+	last     time.Duration
+}
+
+func (s *stats) addReceived() {
+	atomic.AddInt64(&s.received, 1)
+}
+
+func (s *stats) addSent() {
+	atomic.AddInt64(&s.sent, 1)
+}
+
+func (s *stats) packets() (received int64, sent int64) {
+	return atomic.LoadInt64(&s.received), atomic.LoadInt64(&s.sent)
+}
+
+func (s *stats) addLatency(latency time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.count == 0 || latency < s.min {
+		s.min = latency
+	}
+	if latency > s.max {
+		s.max = latency
+	}
+	s.count++
+	s.total += latency
+	s.last = latency
+}
+
+// latency returns the min, avg, max and last latencies in milliseconds, as
+// reported by zookeeper.
+func (s *stats) latency() (min int64, avg int64, max int64, last int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.count > 0 {
+		avg = int64(s.total / time.Duration(s.count) / time.Millisecond)
+	}
+	return int64(s.min / time.Millisecond), avg, int64(s.max / time.Millisecond), int64(s.last / time.Millisecond)
+}
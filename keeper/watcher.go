@@ -0,0 +1,186 @@
+package keeper
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	kv "github.com/glerchundi/kvstores"
+	"github.com/glerchundi/parkeeper/log"
+)
+
+const (
+	watchData     = 1
+	watchChildren = 2
+)
+
+type watchKey struct {
+	path string
+	kind int
+}
+
+// watchManager keeps track of the watches set by a session. Like in ZooKeeper
+// watches are one-time triggers: once a relevant change is notified the watch
+// is removed and has to be set again by the client.
+type watchManager struct {
+	client   kv.WatchClient
+	sendChan chan Rep
+	dying    <-chan struct{}
+
+	mutex    sync.Mutex
+	watches  map[watchKey]func()
+}
+
+func newWatchManager(client kv.Client, sendChan chan Rep, dying <-chan struct{}) *watchManager {
+	// backends not able to watch simply ignore watch requests
+	watchClient, _ := client.(kv.WatchClient)
+	return &watchManager {
+		client:   watchClient,
+		sendChan: sendChan,
+		dying:    dying,
+		watches:  make(map[watchKey]func()),
+	}
+}
+
+// add sets a watch on path unless an equivalent one is already set, failing if
+// that takes longer than the deadline of the request setting it, ctx. The
+// returned function removes it, which is required if the request that set it
+// failed.
+func (w *watchManager) add(ctx context.Context, path string, kind int) (func(), *kv.Error) {
+	if w.client == nil {
+		return func() {}, nil
+	}
+
+	key := watchKey { path: path, kind: kind }
+	w.mutex.Lock()
+	_, found := w.watches[key]
+	w.mutex.Unlock()
+	if found {
+		return func() {}, nil
+	}
+
+	stop := make(chan struct{})
+	events, err := w.client.Watch(ctx, path, kind == watchChildren, stop)
+	if err != nil {
+		close(stop)
+		return nil, err
+	}
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			close(stop)
+			w.mutex.Lock()
+			delete(w.watches, key)
+			w.mutex.Unlock()
+			watchesGauge.Dec()
+		})
+	}
+
+	w.mutex.Lock()
+	if _, found := w.watches[key]; found {
+		// someone set the same watch meanwhile
+		w.mutex.Unlock()
+		close(stop)
+		return func() {}, nil
+	}
+	w.watches[key] = cancel
+	w.mutex.Unlock()
+	watchesGauge.Inc()
+
+	go w.wait(key, events, stop, cancel)
+
+	return cancel, nil
+}
+
+func (w *watchManager) len() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return len(w.watches)
+}
+
+// keys returns the watches currently set.
+func (w *watchManager) keys() []watchKey {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	keys := make([]watchKey, 0, len(w.watches))
+	for key := range w.watches {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (w *watchManager) wait(key watchKey, events <-chan *kv.Event, stop chan struct{}, cancel func()) {
+	defer cancel()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				log.Debug(fmt.Sprintf("watch lost: %s", key.path))
+				return
+			}
+
+			eventType := mapEvent(key.kind, event)
+			if eventType == 0 {
+				continue
+			}
+
+			rep := &OpRep {
+				Hdr: &OpRepHeader { Xid: xidWatcherEvent, Zxid: int64(event.Index), Err: errOk },
+				Rep: &WatcherEvent { Type: eventType, State: stateSyncConnected, Path: key.path },
+			}
+
+			select {
+			case w.sendChan <- rep:
+			case <-w.dying:
+			}
+			return
+		case <-stop:
+			return
+		case <-w.dying:
+			return
+		}
+	}
+}
+
+// mapEvent returns the notification triggered by event on a watch of kind, or
+// zero if it does not trigger it.
+func mapEvent(kind int, event *kv.Event) int32 {
+	switch kind {
+	case watchData:
+		switch event.Type {
+		case kv.EventCreated:
+			return eventNodeCreated
+		case kv.EventDeleted:
+			return eventNodeDeleted
+		case kv.EventDataChanged:
+			return eventNodeDataChanged
+		}
+	case watchChildren:
+		switch event.Type {
+		case kv.EventDeleted:
+			return eventNodeDeleted
+		case kv.EventChildrenChanged:
+			return eventNodeChildrenChanged
+		}
+	}
+
+	return 0
+}
+
+// watchOf returns the path and kind of the watch requested by req, if any.
+func watchOf(req interface{}) (*Path, int, bool) {
+	switch r := req.(type) {
+	case *ExistsReq:
+		return r.Path, watchData, r.Watch
+	case *GetDataReq:
+		return r.Path, watchData, r.Watch
+	case *GetChildrenReq:
+		return r.Path, watchChildren, r.Watch
+	case *GetChildren2Req:
+		return r.Path, watchChildren, r.Watch
+	}
+
+	return nil, 0, false
+}
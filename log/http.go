@@ -0,0 +1,43 @@
+package log
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// LevelHandler returns a handler reporting the level of the global logger on
+// GET and changing it on PUT or POST, either through the level form value or
+// a json body like {"level":"debug"}.
+func LevelHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD":
+		case "PUT", "POST":
+			name := r.FormValue("level")
+			if (name == "" && r.Header.Get("Content-Type") == "application/json") {
+				var body struct { Level string `json:"level"` }
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				name = body.Level
+			}
+			level, err := ParseLevel(name)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if (level != GetLevel()) {
+				SetLevel(level)
+				Info("log level changed to ", level)
+			}
+		default:
+			w.Header().Set("Allow", "GET, HEAD, PUT, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string { "level": GetLevel().String() })
+	})
+}
@@ -3,17 +3,28 @@
 // that can be found in the LICENSE file.
 
 /*
-Package log provides support for logging to stdout and stderr.
+Package log provides support for leveled logging to stdout and stderr.
 
 Log entries will be logged in the following format:
 
-    timestamp hostname tag[pid]: SEVERITY Message
+    timestamp hostname tag[pid]: SEVERITY Message key=value ...
+
+or, using the json format, as one json object per line. Loggers derived with
+WithFields add their fields to every entry and share the level of their
+parent, which can be changed at any time.
 */
 package log
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,30 +34,181 @@ func SetLogger(l *Log) {
 	globalLogger = l
 }
 
+// Level is the minimum severity of the logged entries.
+type Level int32
+
+const (
+	DebugLevel   Level = iota
+	NoticeLevel
+	InfoLevel
+	WarningLevel
+	ErrorLevel
+)
+
+var levelNames = map[Level]string {
+	DebugLevel:   "debug",
+	NoticeLevel:  "notice",
+	InfoLevel:    "info",
+	WarningLevel: "warning",
+	ErrorLevel:   "error",
+}
+
+func (l Level) String() string {
+	if name, found := levelNames[l]; found {
+		return name
+	}
+	return strconv.Itoa(int(l))
+}
+
+// ParseLevel returns the level named s, case insensitively.
+func ParseLevel(s string) (Level, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "warn" {
+		return WarningLevel, nil
+	}
+	for level, name := range levelNames {
+		if name == s {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level: %q", s)
+}
+
+// Format is the encoding of the logged entries.
+type Format int
+
+const (
+	TextFormat Format = iota
+	JSONFormat
+)
+
+// ParseFormat returns the format named s, either text or json.
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "text":
+		return TextFormat, nil
+	case "json":
+		return JSONFormat, nil
+	}
+	return 0, fmt.Errorf("unknown log format: %q", s)
+}
+
+// Fields are the key/value pairs added as context to every entry.
+type Fields map[string]interface{}
+
 type Log struct {
-	tag     string
-	pid     int
+	tag      string
+	pid      int
+	hostname string
+	format   Format
+	fields   Fields
 
-	quiet   bool
-	verbose bool
-	debug   bool
+	// shared with the derived loggers
+	level    *int32
 }
 
+// NewLogger returns a text logger which only logs errors if quiet, and
+// notices or debug messages too if verbose or debug respectively.
 func NewLogger(quiet bool, verbose bool, debug bool) *Log {
-	return &Log {
-		tag:     os.Args[0],
-		pid:     os.Getpid(),
-		quiet:   quiet,
-		debug:   verbose,
-		verbose: debug,
+	level := InfoLevel
+	switch {
+	case quiet:
+		level = ErrorLevel
+	case debug:
+		level = DebugLevel
+	case verbose:
+		level = NoticeLevel
 	}
+	return NewLevelLogger(level, TextFormat)
+}
+
+// NewLevelLogger returns a logger of the given level and format.
+func NewLevelLogger(level Level, format Format) *Log {
+	hostname, _ := os.Hostname()
+	l := &Log {
+		tag:      os.Args[0],
+		pid:      os.Getpid(),
+		hostname: hostname,
+		format:   format,
+		level:    new(int32),
+	}
+	l.SetLevel(level)
+	return l
+}
+
+// SetLevel changes the level of the logger and of those derived from it.
+func (l *Log) SetLevel(level Level) {
+	atomic.StoreInt32(l.level, int32(level))
+}
+
+func SetLevel(level Level) {
+	globalLogger.SetLevel(level)
+}
+
+func (l *Log) GetLevel() Level {
+	return Level(atomic.LoadInt32(l.level))
+}
+
+func GetLevel() Level {
+	return globalLogger.GetLevel()
+}
+
+// Enabled returns whether entries of level are logged, which avoids building
+// expensive messages that would be discarded.
+func (l *Log) Enabled(level Level) bool {
+	return level >= l.GetLevel()
+}
+
+func Enabled(level Level) bool {
+	return globalLogger.Enabled(level)
+}
+
+// WithFields returns a logger adding fields, along with those of l, to every
+// entry.
+func (l *Log) WithFields(fields Fields) *Log {
+	derived := *l
+	derived.fields = make(Fields, len(l.fields) + len(fields))
+	for k, v := range l.fields {
+		derived.fields[k] = v
+	}
+	for k, v := range fields {
+		derived.fields[k] = v
+	}
+	return &derived
+}
+
+func WithFields(fields Fields) *Log {
+	return globalLogger.WithFields(fields)
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying l.
+func NewContext(ctx context.Context, l *Log) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// NewLazyContext returns a copy of ctx carrying the logger returned by f,
+// which is only called by FromContext so that loggers nothing is logged with
+// aren't built.
+func NewLazyContext(ctx context.Context, f func() *Log) context.Context {
+	return context.WithValue(ctx, contextKey{}, f)
+}
+
+// FromContext returns the logger carried by ctx, the global one if none.
+func FromContext(ctx context.Context) *Log {
+	switch l := ctx.Value(contextKey{}).(type) {
+	case *Log:
+		return l
+	case func() *Log:
+		return l()
+	}
+	return globalLogger
 }
 
 // Debug logs a message with severity DEBUG.
 func (l *Log) Debug(v ...interface{}) {
-	if l.debug {
-		l.write("DEBUG", v...)
-	}
+	l.write(DebugLevel, v...)
 }
 
 func Debug(v ...interface{}) {
@@ -55,7 +217,7 @@ func Debug(v ...interface{}) {
 
 // Error logs a message with severity ERROR.
 func (l *Log) Error(v ...interface{}) {
-	l.write("ERROR", v...)
+	l.write(ErrorLevel, v...)
 }
 
 func Error(v ...interface{}) {
@@ -64,7 +226,7 @@ func Error(v ...interface{}) {
 
 // Fatal logs a message with severity ERROR followed by a call to os.Exit().
 func (l *Log) Fatal(v ...interface{}) {
-	l.write("ERROR", v...)
+	l.write(ErrorLevel, v...)
 	os.Exit(1)
 }
 
@@ -74,7 +236,7 @@ func Fatal(v ...interface{}) {
 
 // Info logs a message with severity INFO.
 func (l *Log) Info(v ...interface{}) {
-	l.write("INFO", v...)
+	l.write(InfoLevel, v...)
 }
 
 func Info(v ...interface{}) {
@@ -83,9 +245,7 @@ func Info(v ...interface{}) {
 
 // Notice logs a message with severity NOTICE.
 func (l *Log) Notice(v ...interface{}) {
-	if l.verbose || l.debug {
-		l.write("NOTICE", v...)
-	}
+	l.write(NoticeLevel, v...)
 }
 
 func Notice(v ...interface{}) {
@@ -94,32 +254,84 @@ func Notice(v ...interface{}) {
 
 // Warning logs a message with severity WARNING.
 func (l *Log) Warning(v ...interface{}) {
-	l.write("WARNING", v...)
+	l.write(WarningLevel, v...)
 }
 
 func Warning(v ...interface{}) {
 	globalLogger.Warning(v...)
 }
 
-// write writes error messages to stderr and all others to stdout.
+// write writes error messages to stderr and all others to stdout, each entry
+// in a single write.
 // Messages are written in the following format:
-//     timestamp hostname name: SEVERITY Message
-func (l *Log) write(level string, v ...interface{}) {
-	var w *os.File
+//     timestamp hostname name: SEVERITY Message key=value ...
+func (l *Log) write(level Level, v ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	w := os.Stdout
+	if level == ErrorLevel {
+		w = os.Stderr
+	}
+
 	timestamp := time.Now().Format(time.RFC3339)
-	hostname, _ := os.Hostname()
-	switch level {
-	case "DEBUG", "INFO", "NOTICE", "WARNING":
-		if l.quiet {
+	severity := strings.ToUpper(level.String())
+	msg := fmt.Sprint(v...)
+
+	keys := make([]string, 0, len(l.fields))
+	for k := range l.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	switch l.format {
+	case JSONFormat:
+		entry := map[string]interface{} {
+			"time":  timestamp,
+			"host":  l.hostname,
+			"tag":   l.tag,
+			"pid":   l.pid,
+			"level": level.String(),
+			"msg":   msg,
+		}
+		for _, k := range keys {
+			if _, found := entry[k]; !found {
+				entry[k] = fieldValue(l.fields[k])
+			}
+		}
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(entry); err != nil {
 			return
 		}
-		w = os.Stdout
-	case "ERROR":
-		w = os.Stderr
+	default:
+		fmt.Fprintf(
+			&buf,
+			"%s %s %s[%d]: %s %s",
+			timestamp, l.hostname, l.tag, l.pid, severity, msg,
+		)
+		for _, k := range keys {
+			s := fmt.Sprint(fieldValue(l.fields[k]))
+			if s == "" || strings.ContainsAny(s, " \"=") {
+				s = strconv.Quote(s)
+			}
+			fmt.Fprintf(&buf, " %s=%s", k, s)
+		}
+		buf.WriteByte('\n')
+	}
+	w.Write(buf.Bytes())
+}
+
+// fieldValue returns the value logged for v, errors and stringers by their
+// text so they are readable in json too.
+func fieldValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
 	}
-	fmt.Fprintf(
-		w,
-		"%s %s %s[%d]: %s %s\n",
-		timestamp, hostname, l.tag, l.pid, level, fmt.Sprint(v...),
-	)
+	return v
 }
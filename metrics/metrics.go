@@ -0,0 +1,378 @@
+/*
+Package metrics provides counters, gauges and histograms exposed in the
+prometheus text format.
+
+Metrics are registered in a global registry when created and can be
+partitioned by labels:
+
+    requests := metrics.NewCounterVec("requests_total", "Requests.", "op")
+    requests.With("get").Inc()
+*/
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefBuckets are the default histogram buckets, in seconds.
+var DefBuckets = []float64 { .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10 }
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	mutex   sync.Mutex
+	metrics = make(map[string]metric)
+)
+
+func register(name string, m metric) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if _, found := metrics[name]; found {
+		panic("metrics: " + name + " already registered")
+	}
+	metrics[name] = m
+}
+
+// Handler returns a handler writing every metric in the prometheus text
+// format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		Write(w)
+	})
+}
+
+// Write writes every metric, sorted by name, in the prometheus text format.
+func Write(w io.Writer) {
+	mutex.Lock()
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ms := make([]metric, len(names))
+	for i, name := range names {
+		ms[i] = metrics[name]
+	}
+	mutex.Unlock()
+
+	for _, m := range ms {
+		m.write(w)
+	}
+}
+
+//
+// Values
+//
+
+// value is a float64 updated atomically.
+type value struct {
+	bits uint64
+}
+
+func (v *value) add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&v.bits)
+		new := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&v.bits, old, new) {
+			return
+		}
+	}
+}
+
+func (v *value) set(f float64) {
+	atomic.StoreUint64(&v.bits, math.Float64bits(f))
+}
+
+func (v *value) get() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&v.bits))
+}
+
+// Counter is a value which only goes up.
+type Counter struct {
+	v value
+}
+
+func (c *Counter) Inc() {
+	c.v.add(1)
+}
+
+// Add increments the counter by delta, which must not be negative.
+func (c *Counter) Add(delta float64) {
+	c.v.add(delta)
+}
+
+// Gauge is a value which can go up and down.
+type Gauge struct {
+	v value
+}
+
+func (g *Gauge) Inc() {
+	g.v.add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.v.add(-1)
+}
+
+func (g *Gauge) Add(delta float64) {
+	g.v.add(delta)
+}
+
+func (g *Gauge) Set(f float64) {
+	g.v.set(f)
+}
+
+// Histogram counts observations in buckets of upper bounds.
+type Histogram struct {
+	buckets []float64
+
+	mutex   sync.Mutex
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram {
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+//
+// Metrics
+//
+
+// vec holds the children of a metric by label values.
+type vec struct {
+	name     string
+	help     string
+	typ      string
+	labels   []string
+	newChild func() interface{}
+
+	mutex    sync.RWMutex
+	children map[string]*child
+}
+
+type child struct {
+	values []string
+	metric interface{}
+}
+
+func newVec(name, help, typ string, labels []string, newChild func() interface{}) *vec {
+	v := &vec {
+		name:     name,
+		help:     help,
+		typ:      typ,
+		labels:   labels,
+		newChild: newChild,
+		children: make(map[string]*child),
+	}
+	register(name, v)
+	return v
+}
+
+func (v *vec) with(values []string) interface{} {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+	v.mutex.RLock()
+	c, found := v.children[key]
+	v.mutex.RUnlock()
+	if found {
+		return c.metric
+	}
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if c, found := v.children[key]; found {
+		return c.metric
+	}
+	c = &child { values: append([]string(nil), values...), metric: v.newChild() }
+	v.children[key] = c
+	return c.metric
+}
+
+func (v *vec) write(w io.Writer) {
+	v.mutex.RLock()
+	keys := make([]string, 0, len(v.children))
+	for key := range v.children {
+		keys = append(keys, key)
+	}
+	children := make([]*child, len(keys))
+	sort.Strings(keys)
+	for i, key := range keys {
+		children[i] = v.children[key]
+	}
+	v.mutex.RUnlock()
+
+	writeHeader(w, v.name, v.help, v.typ)
+	for _, c := range children {
+		labels := formatLabels(v.labels, c.values)
+		switch m := c.metric.(type) {
+		case *Counter:
+			writeSample(w, v.name, labels, m.v.get())
+		case *Gauge:
+			writeSample(w, v.name, labels, m.v.get())
+		case *Histogram:
+			m.mutex.Lock()
+			var cumulative uint64
+			for i, upper := range m.buckets {
+				cumulative += m.counts[i]
+				writeSample(w, v.name + "_bucket", withLabel(labels, "le", formatFloat(upper)), float64(cumulative))
+			}
+			writeSample(w, v.name + "_bucket", withLabel(labels, "le", "+Inf"), float64(m.count))
+			writeSample(w, v.name + "_sum", labels, m.sum)
+			writeSample(w, v.name + "_count", labels, float64(m.count))
+			m.mutex.Unlock()
+		}
+	}
+}
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct {
+	v *vec
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec { v: newVec(name, help, "counter", labels, func() interface{} { return &Counter {} }) }
+}
+
+// With returns the counter of the given label values, in label order.
+func (c *CounterVec) With(values ...string) *Counter {
+	return c.v.with(values).(*Counter)
+}
+
+func NewCounter(name, help string) *Counter {
+	return NewCounterVec(name, help).With()
+}
+
+// GaugeVec is a gauge partitioned by labels.
+type GaugeVec struct {
+	v *vec
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec { v: newVec(name, help, "gauge", labels, func() interface{} { return &Gauge {} }) }
+}
+
+// With returns the gauge of the given label values, in label order.
+func (g *GaugeVec) With(values ...string) *Gauge {
+	return g.v.with(values).(*Gauge)
+}
+
+func NewGauge(name, help string) *Gauge {
+	return NewGaugeVec(name, help).With()
+}
+
+// HistogramVec is a histogram partitioned by labels.
+type HistogramVec struct {
+	v *vec
+}
+
+// NewHistogramVec creates a histogram with the given bucket upper bounds,
+// which must be sorted.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec { v: newVec(name, help, "histogram", labels, func() interface{} { return newHistogram(buckets) }) }
+}
+
+// With returns the histogram of the given label values, in label order.
+func (h *HistogramVec) With(values ...string) *Histogram {
+	return h.v.with(values).(*Histogram)
+}
+
+// funcMetric is a metric whose value is read when written.
+type funcMetric struct {
+	name string
+	help string
+	typ  string
+	f    func() float64
+}
+
+func (m *funcMetric) write(w io.Writer) {
+	writeHeader(w, m.name, m.help, m.typ)
+	writeSample(w, m.name, "", m.f())
+}
+
+// NewGaugeFunc creates a gauge whose value is returned by f.
+func NewGaugeFunc(name, help string, f func() float64) {
+	register(name, &funcMetric { name: name, help: help, typ: "gauge", f: f })
+}
+
+// NewCounterFunc creates a counter whose value, which must only go up, is
+// returned by f.
+func NewCounterFunc(name, help string, f func() float64) {
+	register(name, &funcMetric { name: name, help: help, typ: "counter", f: f })
+}
+
+//
+// Text format
+//
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	help = strings.NewReplacer("\\", `\\`, "\n", `\n`).Replace(help)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeSample(w io.Writer, name, labels string, v float64) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s%s %s\n", name, labels, formatFloat(v))
+}
+
+var labelValueEscaper = strings.NewReplacer("\\", `\\`, "\"", `\"`, "\n", `\n`)
+
+func formatLabels(labels, values []string) string {
+	pairs := make([]string, len(labels))
+	for i, label := range labels {
+		pairs[i] = label + "=\"" + labelValueEscaper.Replace(values[i]) + "\""
+	}
+	return strings.Join(pairs, ",")
+}
+
+func withLabel(labels, label, value string) string {
+	pair := label + "=\"" + value + "\""
+	if labels == "" {
+		return pair
+	}
+	return labels + "," + pair
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -1,11 +1,26 @@
 package main
 
 import (
+	"context"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/syslog"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	kv "github.com/glerchundi/kvstores"
 	"github.com/glerchundi/parkeeper/keeper"
 	"github.com/glerchundi/parkeeper/log"
+	"github.com/glerchundi/parkeeper/metrics"
+	"github.com/glerchundi/parkeeper/tracing"
 
 	"github.com/codegangsta/cli"
 )
@@ -14,9 +29,63 @@ func appMain(c *cli.Context) {
 	// flags
 	bindAddr := c.String("bind-addr")
 	backendUrl := c.String("backend-url")
+	maxBuffer := c.Int("max-buffer")
+	fourLetterWords := c.String("four-letter-words")
+	adminAddr := c.String("admin-addr")
+	logLevel := c.String("log-level")
+	logFormat := c.String("log-format")
+	logLevelFile := c.String("log-level-file")
+	auditLog := c.String("audit-log")
+	auditLogMaxSize := c.Int("audit-log-max-size")
+	auditLogMaxBackups := c.Int("audit-log-max-backups")
+	slowRequestThreshold := c.Duration("slow-request-threshold")
+	hotSpotsWindow := c.Duration("hot-spots-window")
+	hotSpotsTop := c.Int("hot-spots-top")
+	maxClientCnxns := c.Int("max-client-cnxns")
+	maxConnections := c.Int("max-connections")
+	sessionReadRate := c.Float64("session-read-rate")
+	sessionWriteRate := c.Float64("session-write-rate")
+	clientReadRate := c.Float64("client-read-rate")
+	clientWriteRate := c.Float64("client-write-rate")
+	drainTimeout := c.Duration("drain-timeout")
+	traceExporter := c.String("trace-exporter")
+	traceOTLPEndpoint := c.String("trace-otlp-endpoint")
+	traceSampleRatio := c.Float64("trace-sample-ratio")
 
 	// configure main logger
-	log.SetLogger(log.NewLogger(false, true, true))
+	level, err := log.ParseLevel(logLevel)
+	if err != nil {
+		usageError(c, err)
+	}
+	format, err := log.ParseFormat(logFormat)
+	if err != nil {
+		usageError(c, err)
+	}
+	log.SetLogger(log.NewLevelLogger(level, format))
+	if logLevelFile != "" {
+		if level, err = readLogLevel(logLevelFile); err != nil {
+			log.Fatal(err)
+		}
+		log.SetLevel(level)
+	}
+
+	// tracing, spans of backend requests are children of the zookeeper ones
+	switch traceExporter {
+	case "":
+	case "stdout":
+		tracing.SetExporter(tracing.NewWriterExporter(os.Stdout), traceSampleRatio, nil)
+	case "otlp":
+		tracing.SetExporter(
+			tracing.NewOTLPExporter(traceOTLPEndpoint, "parkeeper"),
+			traceSampleRatio,
+			func(err error) { log.Error("unable to export traces: ", err) },
+		)
+	default:
+		log.Fatal("unknown trace exporter: ", traceExporter)
+	}
+	if traceExporter != "" {
+		kv.SetTracer(kvTracer{})
+	}
 
 	// backend client
 	storeClient, err := kv.NewClient(backendUrl)
@@ -24,9 +93,185 @@ func appMain(c *cli.Context) {
 		panic(err)
 	}
 
+	// re-read backend secrets and the log level on SIGHUP
+	go reloadOnSignal(storeClient, logLevelFile)
+
+	// export the backend circuit breaker state
+	if breakerClient, ok := storeClient.(kv.BreakerClient); ok {
+		expvar.Publish("backend_breaker", expvar.Func(func() interface{} {
+			breaker := breakerClient.Breaker()
+			return map[string]interface{} {
+				"state":       breaker.State().String(),
+				"transitions": breaker.Transitions(),
+			}
+		}))
+		metrics.NewGaugeFunc(
+			"parkeeper_backend_breaker_state",
+			"Backend circuit breaker state: 0 closed, 1 open, 2 half-open.",
+			func() float64 { return float64(breakerClient.Breaker().State()) },
+		)
+		metrics.NewCounterFunc(
+			"parkeeper_backend_breaker_transitions_total",
+			"Backend circuit breaker state changes.",
+			func() float64 { return float64(breakerClient.Breaker().Transitions()) },
+		)
+	}
+
+	// frames bigger than the max buffer close the connection
+	if maxBuffer <= 0 {
+		log.Fatal("max-buffer must be positive")
+	}
+	opts := keeper.DefaultOptions
+	opts.MaxBuffer = maxBuffer
+	opts.FourLetterWords = nil
+	for _, cmd := range strings.Split(fourLetterWords, ",") {
+		if cmd = strings.TrimSpace(cmd); cmd != "" {
+			opts.FourLetterWords = append(opts.FourLetterWords, cmd)
+		}
+	}
+	opts.Version = releaseVersion
+	opts.SlowRequestThreshold = slowRequestThreshold
+	if hotSpotsWindow != 0 && hotSpotsWindow < time.Second {
+		log.Fatal("hot-spots-window must be at least 1s")
+	}
+	opts.HotSpotsWindow = hotSpotsWindow
+	opts.HotSpotsTop = hotSpotsTop
+	opts.MaxClientCnxns = maxClientCnxns
+	opts.MaxConnections = maxConnections
+	opts.SessionReadRate = sessionReadRate
+	opts.SessionWriteRate = sessionWriteRate
+	opts.ClientReadRate = clientReadRate
+	opts.ClientWriteRate = clientWriteRate
+	opts.DrainTimeout = drainTimeout
+	if auditLog != "" {
+		if opts.AuditLog, err = openAuditLog(auditLog, auditLogMaxSize, auditLogMaxBackups); err != nil {
+			log.Fatal("unable to open audit log: ", err)
+		}
+	}
+
+	server := keeper.NewServer(bindAddr, storeClient, &opts)
+
+	// admin server, once the listener is handed over the previous process
+	// keeps the admin address until it's drained
+	if adminAddr != "" {
+		retryFor := time.Duration(0)
+		if os.Getenv(keeper.ListenerFDEnv) != "" {
+			retryFor = drainTimeout + 5 * time.Second
+		}
+		go serveAdmin(adminAddr, server.AdminHandler(), retryFor)
+	}
+
 	// start listening
-	server := keeper.NewServer(bindAddr, storeClient)
 	server.Start()
+	if closer, ok := storeClient.(io.Closer); ok {
+		closer.Close()
+	}
+	tracing.Shutdown()
+}
+
+// usageError reports an invalid flag along with the usage and exits, it's used
+// instead of log.Fatal until the logger is configured.
+func usageError(c *cli.Context, err error) {
+	fmt.Fprintf(os.Stderr, "Incorrect Usage: %s\n\n", err)
+	cli.ShowAppHelp(c)
+	os.Exit(2)
+}
+
+// serveAdmin serves handler at addr, retrying to bind it for up to retryFor.
+func serveAdmin(addr string, handler http.Handler, retryFor time.Duration) {
+	deadline := time.Now().Add(retryFor)
+	for {
+		l, err := net.Listen("tcp", addr)
+		if err == nil {
+			log.Info("admin server listening on: ", addr)
+			log.Fatal(http.Serve(l, handler))
+		}
+		if time.Now().After(deadline) {
+			log.Fatal(err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// kvTracer traces backend requests as client spans.
+type kvTracer struct{}
+
+func (kvTracer) StartSpan(ctx context.Context, name string, attrs map[string]interface{}) (context.Context, func(*kv.Error)) {
+	ctx, span := tracing.Start(ctx, name, tracing.SpanKindClient)
+	for key, v := range attrs {
+		span.SetAttribute(key, v)
+	}
+	return ctx, func(err *kv.Error) {
+		if err != nil {
+			span.SetError(err.String())
+		}
+		span.End()
+	}
+}
+
+func (kvTracer) Inject(ctx context.Context, header http.Header) {
+	tracing.Inject(ctx, header)
+}
+
+func reloadOnSignal(storeClient kv.Client, logLevelFile string) {
+	reloader, _ := storeClient.(kv.Reloader)
+	if reloader == nil && logLevelFile == "" {
+		return
+	}
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for _ = range ch {
+		if logLevelFile != "" {
+			if level, err := readLogLevel(logLevelFile); err != nil {
+				log.Error("unable to reload log level: ", err)
+			} else if level != log.GetLevel() {
+				log.SetLevel(level)
+				log.Info("log level changed to ", level)
+			}
+		}
+		if reloader != nil {
+			if err := reloader.Reload(); err != nil {
+				log.Error("unable to reload backend credentials: ", err)
+			} else {
+				log.Info("backend credentials reloaded")
+			}
+		}
+	}
+}
+
+// openAuditLog opens the audit log at dest, either a file rotated every
+// maxSize megabytes or syslog: syslog: for the local daemon and
+// syslog://host:port or syslog+tcp://host:port for a remote one.
+func openAuditLog(dest string, maxSize int, maxBackups int) (io.Writer, error) {
+	if !strings.HasPrefix(dest, "syslog") {
+		return keeper.OpenAuditFile(dest, int64(maxSize) * 1024 * 1024, maxBackups)
+	}
+
+	u, err := url.Parse(dest)
+	if err != nil {
+		return nil, err
+	}
+	network := ""
+	switch u.Scheme {
+	case "syslog":
+		if u.Host != "" {
+			network = "udp"
+		}
+	case "syslog+tcp":
+		network = "tcp"
+	default:
+		return nil, fmt.Errorf("unknown audit log destination: %s", dest)
+	}
+	return syslog.Dial(network, u.Host, syslog.LOG_INFO|syslog.LOG_AUTH, "parkeeper-audit")
+}
+
+func readLogLevel(file string) (log.Level, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	return log.ParseLevel(string(b))
 }
 
 func main() {
@@ -43,7 +288,117 @@ func main() {
 		cli.StringFlag{
 			Name:  "backend-url",
 			Value: "etcd://127.0.0.1:4001",
-			Usage: "backend to use (etcd://127.0.0.1:4001, consul://127.0.0.1:8500)",
+			Usage: "backend to use (etcd, etcd3, consul, redis or file), see the README for the query params each of them accepts",
+		},
+		cli.IntFlag{
+			Name:  "max-buffer",
+			Value: keeper.DefaultOptions.MaxBuffer,
+			Usage: "maximum size in bytes of requests and replies, as jute.maxbuffer in zookeeper",
+		},
+		cli.StringFlag{
+			Name:  "four-letter-words",
+			Value: strings.Join(keeper.DefaultOptions.FourLetterWords, ","),
+			Usage: "comma separated four letter words to answer (ruok, stat, srvr, mntr, cons, envi, wchs, dump and conf), * enables all of them",
+		},
+		cli.StringFlag{
+			Name:  "admin-addr",
+			Value: "",
+			Usage: "serve the admin http server (/commands/monitor, /commands/connections, /commands/watches, /commands/configuration, /commands/ruok, /commands/backend, /commands/hot_spots, /debug/vars, /metrics and /log/level) at this address, disabled if empty",
+		},
+		cli.StringFlag{
+			Name:  "log-level",
+			Value: "info",
+			Usage: "minimum severity of the logged messages (debug, notice, info, warning or error), debug dumps every packet",
+		},
+		cli.StringFlag{
+			Name:  "log-format",
+			Value: "text",
+			Usage: "format of the logged messages, text or json",
+		},
+		cli.StringFlag{
+			Name:  "log-level-file",
+			Value: "",
+			Usage: "file holding the log level, which overrides log-level and is re-read on SIGHUP",
+		},
+		cli.DurationFlag{
+			Name:  "slow-request-threshold",
+			Value: keeper.DefaultOptions.SlowRequestThreshold,
+			Usage: "log requests whose reply takes longer than this to be sent, along with their time spent in the backend, disabled if zero",
+		},
+		cli.DurationFlag{
+			Name:  "hot-spots-window",
+			Value: keeper.DefaultOptions.HotSpotsWindow,
+			Usage: "sliding window over which the most read and written paths are counted, reported by mntr and the admin server, disabled if zero",
+		},
+		cli.IntFlag{
+			Name:  "hot-spots-top",
+			Value: keeper.DefaultOptions.HotSpotsTop,
+			Usage: "number of most read and most written paths reported",
+		},
+		cli.IntFlag{
+			Name:  "max-client-cnxns",
+			Value: keeper.DefaultOptions.MaxClientCnxns,
+			Usage: "connections accepted from a single client ip, as maxClientCnxns in zookeeper, unlimited if zero",
+		},
+		cli.IntFlag{
+			Name:  "max-connections",
+			Value: keeper.DefaultOptions.MaxConnections,
+			Usage: "connections accepted overall, unlimited if zero",
+		},
+		cli.Float64Flag{
+			Name:  "session-read-rate",
+			Value: keeper.DefaultOptions.SessionReadRate,
+			Usage: "reads per second allowed to every session, in bursts of up to a second worth of them, further ones are delayed; unlimited if zero",
+		},
+		cli.Float64Flag{
+			Name:  "session-write-rate",
+			Value: keeper.DefaultOptions.SessionWriteRate,
+			Usage: "writes per second allowed to every session, unlimited if zero",
+		},
+		cli.Float64Flag{
+			Name:  "client-read-rate",
+			Value: keeper.DefaultOptions.ClientReadRate,
+			Usage: "reads per second allowed to every client ip across its sessions, unlimited if zero",
+		},
+		cli.Float64Flag{
+			Name:  "client-write-rate",
+			Value: keeper.DefaultOptions.ClientWriteRate,
+			Usage: "writes per second allowed to every client ip across its sessions, unlimited if zero",
+		},
+		cli.DurationFlag{
+			Name:  "drain-timeout",
+			Value: keeper.DefaultOptions.DrainTimeout,
+			Usage: "on SIGINT or SIGTERM, or after handing the listener over to a new process on SIGUSR2, clients are asked to reconnect elsewhere and have this long before their connections are closed",
+		},
+		cli.StringFlag{
+			Name:  "audit-log",
+			Value: "",
+			Usage: "record creations, deletions, data and acl changes as json lines in this file or in syslog (syslog: for the local daemon, syslog://host:514 or syslog+tcp://host:514 for a remote one), disabled if empty",
+		},
+		cli.IntFlag{
+			Name:  "audit-log-max-size",
+			Value: 100,
+			Usage: "size in megabytes above which the audit log file is rotated, never if zero",
+		},
+		cli.IntFlag{
+			Name:  "audit-log-max-backups",
+			Value: 10,
+			Usage: "rotated audit log files to keep",
+		},
+		cli.StringFlag{
+			Name:  "trace-exporter",
+			Value: "",
+			Usage: "export a span per request, and per backend request it sends, to otlp or stdout, disabled if empty",
+		},
+		cli.StringFlag{
+			Name:  "trace-otlp-endpoint",
+			Value: "http://127.0.0.1:4318/v1/traces",
+			Usage: "url of the otlp/http collector traces are posted to",
+		},
+		cli.Float64Flag{
+			Name:  "trace-sample-ratio",
+			Value: 1,
+			Usage: "ratio of the requests traced, between 0 and 1",
 		},
 	}
 	app.Action = appMain
@@ -0,0 +1,219 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//
+// Writer
+//
+
+// WriterExporter writes every span as a json line, meant for local testing.
+type WriterExporter struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter { w: w }
+}
+
+type writerSpan struct {
+	TraceID    string                 `json:"trace_id"`
+	SpanID     string                 `json:"span_id"`
+	ParentID   string                 `json:"parent_span_id,omitempty"`
+	Name       string                 `json:"name"`
+	Start      string                 `json:"start"`
+	Duration   string                 `json:"duration"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+func (e *WriterExporter) Export(spans []*Span) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, span := range spans {
+		ws := &writerSpan {
+			TraceID:  span.TraceID.String(),
+			SpanID:   span.SpanID.String(),
+			Name:     span.Name,
+			Start:    span.StartTime.Format(time.RFC3339Nano),
+			Duration: span.EndTime.Sub(span.StartTime).String(),
+			Error:    span.Error(),
+		}
+		if span.ParentID != (SpanID{}) {
+			ws.ParentID = span.ParentID.String()
+		}
+		span.Attributes(func(key string, v interface{}) {
+			if ws.Attributes == nil {
+				ws.Attributes = make(map[string]interface{})
+			}
+			ws.Attributes[key] = v
+		})
+		if err := enc.Encode(ws); err != nil {
+			return err
+		}
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	_, err := e.w.Write(buf.Bytes())
+	return err
+}
+
+//
+// OTLP
+//
+
+// OTLPExporter posts spans to an OTLP/HTTP collector using the json encoding.
+type OTLPExporter struct {
+	endpoint string
+	service  string
+	client   *http.Client
+}
+
+// NewOTLPExporter returns an exporter posting to endpoint, the full url of the
+// traces resource (http://127.0.0.1:4318/v1/traces), on behalf of service.
+func NewOTLPExporter(endpoint string, service string) *OTLPExporter {
+	return &OTLPExporter {
+		endpoint: endpoint,
+		service:  service,
+		client:   &http.Client { Timeout: 10 * time.Second },
+	}
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope   `json:"scope"`
+	Spans []*otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+// otlp status codes
+const (
+	otlpStatusOk    = 1
+	otlpStatusError = 2
+)
+
+func newOTLPAttribute(key string, v interface{}) otlpAttribute {
+	attr := otlpAttribute { Key: key }
+	switch v := v.(type) {
+	case string:
+		attr.Value.StringValue = &v
+	case bool:
+		attr.Value.BoolValue = &v
+	case int:
+		s := strconv.FormatInt(int64(v), 10)
+		attr.Value.IntValue = &s
+	case int32:
+		s := strconv.FormatInt(int64(v), 10)
+		attr.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		attr.Value.IntValue = &s
+	case float64:
+		attr.Value.DoubleValue = &v
+	default:
+		s := fmt.Sprint(v)
+		attr.Value.StringValue = &s
+	}
+	return attr
+}
+
+func (e *OTLPExporter) Export(spans []*Span) error {
+	ss := otlpScopeSpans { Scope: otlpScope { Name: e.service } }
+	for _, span := range spans {
+		o := &otlpSpan {
+			TraceID:           span.TraceID.String(),
+			SpanID:            span.SpanID.String(),
+			Name:              span.Name,
+			Kind:              int(span.Kind),
+			StartTimeUnixNano: strconv.FormatInt(span.StartTime.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.EndTime.UnixNano(), 10),
+			Status:            otlpStatus { Code: otlpStatusOk },
+		}
+		if span.ParentID != (SpanID{}) {
+			o.ParentSpanID = span.ParentID.String()
+		}
+		span.Attributes(func(key string, v interface{}) {
+			o.Attributes = append(o.Attributes, newOTLPAttribute(key, v))
+		})
+		if msg := span.Error(); msg != "" {
+			o.Status = otlpStatus { Code: otlpStatusError, Message: msg }
+		}
+		ss.Spans = append(ss.Spans, o)
+	}
+
+	req := &otlpRequest {
+		ResourceSpans: []otlpResourceSpans { {
+			Resource:   otlpResource { Attributes: []otlpAttribute { newOTLPAttribute("service.name", e.service) } },
+			ScopeSpans: []otlpScopeSpans { ss },
+		} },
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("otlp collector replied %s", resp.Status)
+	}
+	return nil
+}
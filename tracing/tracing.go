@@ -0,0 +1,301 @@
+/*
+Package tracing records spans of requests and exports them in batches, either
+over OTLP/HTTP or to stdout.
+
+Spans are only recorded once an exporter is set and the root span of a trace
+is sampled, until then starting a span returns a nil one whose methods do
+nothing:
+
+    ctx, span := tracing.Start(ctx, "request", tracing.SpanKindServer)
+    defer span.End()
+    span.SetAttribute("path", path)
+*/
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// Span is a timed operation within a trace.
+type Span struct {
+	TraceID   TraceID
+	SpanID    SpanID
+	ParentID  SpanID
+	Name      string
+	Kind      SpanKind
+	StartTime time.Time
+	EndTime   time.Time
+
+	mutex     sync.Mutex
+	// attributes in the order they were set
+	keys      []string
+	attrs     map[string]interface{}
+	err       string
+	ended     bool
+}
+
+// Start starts a span child of the one in ctx, if any, returning a context
+// holding it. The span is nil if tracing is disabled or the trace wasn't
+// sampled.
+func Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	t := current()
+	if t == nil {
+		return ctx, nil
+	}
+
+	parent := FromContext(ctx)
+	if parent == nil && !t.sample() {
+		return ctx, nil
+	}
+
+	span := &Span {
+		Name:      name,
+		Kind:      kind,
+		StartTime: time.Now(),
+		attrs:     make(map[string]interface{}),
+	}
+	rand.Read(span.SpanID[:])
+	if parent != nil {
+		span.TraceID = parent.TraceID
+		span.ParentID = parent.SpanID
+	} else {
+		rand.Read(span.TraceID[:])
+	}
+
+	return NewContext(ctx, span), span
+}
+
+// SetAttribute sets the attribute key of the span to v, either a string, a
+// bool or a number.
+func (s *Span) SetAttribute(key string, v interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, found := s.attrs[key]; !found {
+		s.keys = append(s.keys, key)
+	}
+	s.attrs[key] = v
+}
+
+// SetError marks the span as failed with msg.
+func (s *Span) SetError(msg string) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	s.err = msg
+	s.mutex.Unlock()
+}
+
+// End ends the span, queueing it to be exported. Spans are exported once even
+// if ended several times.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	if s.ended {
+		s.mutex.Unlock()
+		return
+	}
+	s.ended = true
+	s.EndTime = time.Now()
+	s.mutex.Unlock()
+
+	// held so that the tracer isn't shut down meanwhile
+	mutex.RLock()
+	defer mutex.RUnlock()
+	if global != nil {
+		global.enqueue(s)
+	}
+}
+
+// Attributes calls f with every attribute of the span, in the order they
+// were first set.
+func (s *Span) Attributes(f func(key string, v interface{})) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, key := range s.keys {
+		f(key, s.attrs[key])
+	}
+}
+
+// Error returns the error the span failed with, empty if it didn't.
+func (s *Span) Error() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.err
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx holding span.
+func NewContext(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, contextKey{}, span)
+}
+
+// FromContext returns the span held by ctx, nil if none.
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(contextKey{}).(*Span)
+	return span
+}
+
+// Inject writes the span held by ctx, if any, to header as a w3c traceparent
+// so that the servers receiving the request join its trace.
+func Inject(ctx context.Context, header http.Header) {
+	if span := FromContext(ctx); span != nil {
+		header.Set("traceparent", "00-" + span.TraceID.String() + "-" + span.SpanID.String() + "-01")
+	}
+}
+
+//
+// Exporting
+//
+
+// Exporter sends ended spans somewhere.
+type Exporter interface {
+	Export(spans []*Span) error
+}
+
+const (
+	// spans queued to be exported, more are dropped
+	maxQueuedSpans = 2048
+	// spans exported at once
+	maxBatchSpans  = 512
+	batchTimeout   = 5 * time.Second
+)
+
+type tracer struct {
+	exporter    Exporter
+	sampleRatio float64
+	onError     func(error)
+
+	queue       chan *Span
+	done        chan struct{}
+}
+
+var (
+	mutex  sync.RWMutex
+	global *tracer
+)
+
+func current() *tracer {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return global
+}
+
+// SetExporter enables tracing, sampling sampleRatio of the traces, which are
+// sent through exporter in batches. Export errors are passed to onError, if
+// set. The previous exporter, if any, is flushed first.
+func SetExporter(exporter Exporter, sampleRatio float64, onError func(error)) {
+	t := &tracer {
+		exporter:    exporter,
+		sampleRatio: sampleRatio,
+		onError:     onError,
+		queue:       make(chan *Span, maxQueuedSpans),
+		done:        make(chan struct{}),
+	}
+	go t.loop()
+
+	mutex.Lock()
+	previous := global
+	global = t
+	mutex.Unlock()
+
+	if previous != nil {
+		previous.shutdown()
+	}
+}
+
+// Shutdown disables tracing once every ended span is exported.
+func Shutdown() {
+	mutex.Lock()
+	t := global
+	global = nil
+	mutex.Unlock()
+
+	if t != nil {
+		t.shutdown()
+	}
+}
+
+func (t *tracer) sample() bool {
+	return t.sampleRatio >= 1 || rand.Float64() < t.sampleRatio
+}
+
+func (t *tracer) enqueue(span *Span) {
+	select {
+	case t.queue <- span:
+	default:
+		// exporting can't keep up, drop it rather than blocking requests
+	}
+}
+
+func (t *tracer) shutdown() {
+	close(t.queue)
+	<-t.done
+}
+
+func (t *tracer) loop() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(batchTimeout)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, maxBatchSpans)
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.Export(batch); err != nil && t.onError != nil {
+			t.onError(err)
+		}
+		batch = make([]*Span, 0, maxBatchSpans)
+	}
+
+	for {
+		select {
+		case span, ok := <-t.queue:
+			if !ok {
+				export()
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) >= maxBatchSpans {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		}
+	}
+}